@@ -4,15 +4,16 @@ import (
     "os"
     "fmt"
     "time"
-    "sort"
     "strings"
-    "strconv"
     "io/ioutil"
     "path/filepath"
     "encoding/json"
 
     "github.com/jessevdk/go-flags"
     "github.com/tux21b/gocql"
+
+    "github.com/zmarcantel/cmm/db"
+    "github.com/zmarcantel/cmm/migrate"
 )
 
 var Opts Options
@@ -26,7 +27,23 @@ type Options struct {
     Hosts         string `short:"p"   long:"peers"          description:"Comma-serparated list of Cassandra hosts (hostname:port)" value-name:"HOSTS"`
     Migrations    string `short:"m"   long:"migrations"     description:"Directory containing timestamp-prefixed migration files" value-name:"DIRECTORY"`
 
+    Keyspace      string `short:"k"   long:"keyspace"       description:"Keyspace migrations are recorded in [default migrations]" value-name:"KEYSPACE"`
+    Table         string `short:"T"   long:"table"          description:"Table migrations are recorded in, one per application sharing a cluster [default completed]" value-name:"TABLE"`
+    Replication   string `short:"x"   long:"replication"    description:"Replication of the migrations keyspace when it is created [default class:SimpleStrategy,replication_factor:3]" value-name:"KEY:VALUE,..."`
+
     Delay         int64  `short:"d"   long:"delay"          description:"Wait n milliseconds between migrations" value-name:"MS"`
+    SchemaWait    int64  `short:"s"   long:"schema.wait"    description:"Wait up to n seconds for all nodes to agree on the schema after DDL [default 30]" value-name:"SECONDS"`
+    Order         string `short:"O"   long:"order"          description:"What to do with pending migrations that sort before the latest applied one [fail, warn, allow]" value-name:"POLICY"`
+    Target        string `short:"g"   long:"target"         description:"Stop after the named migration (filename or timestamp prefix), reverting applied migrations after it" value-name:"NAME"`
+    Rollback      string `short:"r"   long:"rollback"       description:"Revert the last N applied migrations, or every applied migration after the named one" default:"none" value-name:"N|NAME"`
+    Baseline      string `short:"B"   long:"baseline"       description:"Mark every migration up to the named one as complete without running it" value-name:"NAME"`
+    Force         bool   `short:"F"   long:"force"          description:"Baseline even though migrations are already recorded"`
+    Resume        bool   `short:"R"   long:"resume"         description:"Continue a failed or partially applied migration from its first unapplied statement"`
+    Repair        string `short:"X"   long:"repair"         description:"Clear the failed marker of a migration after fixing it by hand" default:"none" value-name:"NAME"`
+
+    LockWait      int64  `short:"w"   long:"lock.wait"      description:"Wait n seconds for another run to release the migration lock [default 60]" value-name:"SECONDS"`
+    LockTTL       int64  `short:"t"   long:"lock.ttl"       description:"Seconds the migration lock survives without being refreshed [default 60]" value-name:"SECONDS"`
+    Unlock        bool   `short:"U"   long:"unlock"         description:"Forcibly remove a stale migration lock left by a run that died"`
 
     File          string `short:"f"   long:"file"           description:"File to do operations with [used in config, backfill]" value-name:"FILE"`
     Output        string `short:"o"   long:"output"         description:"File or path to output operation to"`
@@ -35,9 +52,19 @@ type Options struct {
 
     // help
     Describe      string `short:"D"   long:"describe"       description:"Print out the current layout as reported by the DB. ['all', keyspace, or keyspace.table]" default:"none" value-name:"ITEM"`
-    Backfill      string `short:"b"   long:"backfill"       description:"Generate migrations equating the the diff of the existing table and the JSON descriptor given by --file" default:"none" value-name:"ITEM"`
+    DescribeCQL   string `short:"Q"   long:"describe.cql"   description:"Same as above, but prints the CQL statements that recreate the layout" default:"none" value-name:"ITEM"`
+    Backfill      string `short:"b"   long:"backfill"       description:"Generate migrations equating the the diff of the existing table or keyspace and the JSON descriptor given by --file" default:"none" value-name:"ITEM"`
+    Generate      string `short:"G"   long:"generate"       description:"Generate the migrations that bring the cluster to the schema declared by the descriptor files of a directory" default:"none" value-name:"DIRECTORY"`
+    Diff          []string `short:"i" long:"diff"         description:"Compare two schemas, each a --describe JSON file or a comma-separated host list. Give it twice: the schema to compare from, then to" value-name:"FILE|HOSTS"`
+    JsonDiff      bool   `short:"I"   long:"diff.json"      description:"Same as above, but prints the differences as JSON"`
+    DiffMigrations bool  `short:"M"   long:"diff.migrations" description:"Same as --diff, but prints the migrations turning the first schema into the second, or saves them to --output"`
     List          bool   `short:"l"   long:"list"           description:"Return a list of complete and remaining migrations."`
     JsonList      bool   `short:"j"   long:"list.json"      description:"Same as above, but returns the sets as distinct JSON arrays (complete, remaining) within a parent object"`
+    Plan          bool   `short:"n"   long:"plan"           description:"Print the pending migrations, their statements and delays without running anything"`
+    JsonPlan      bool   `short:"N"   long:"plan.json"      description:"Same as above, but prints the plan as JSON"`
+    History       bool   `short:"H"   long:"history"        description:"Print who applied each migration, when, from where, and how long it took"`
+    JsonHistory   bool   `short:"J"   long:"history.json"   description:"Same as above, but prints the history as JSON"`
+    Verify        bool   `short:"V"   long:"verify"         description:"Compare migration files against the checksums recorded when they were applied. Exits non-zero on drift"`
 }
 
 
@@ -48,7 +75,15 @@ type Config struct {
     Peers          []string
     Migrations     string
 
+    Keyspace       string
+    Table          string
+    Replication    map[string]interface{}
+
     Delay          int64
+    Order          string
+    SchemaWait     int64
+    LockWait       int64
+    LockTTL        int64
     File           string
     Output         string
 }
@@ -57,14 +92,16 @@ type Config struct {
 
 //
 // Parse the supplied cli arguments
+// Parse errors are returned as *flags.Error, bad values as migrate.ErrConfig
 //
-func HandleArguments() {
-    if _, help := flags.Parse(&Opts) ; help != nil {
-        os.Exit(1)
+func HandleArguments() error {
+    if _, err := flags.Parse(&Opts) ; err != nil {
+        return err
     }
 
     // handle verbosity
     Verbosity = len(Opts.Verbose)
+    Settings.Verbosity = Verbosity
 
     // handle config first so any other specified arguments overwrite it
     // if a config file is specified, use it
@@ -73,7 +110,9 @@ func HandleArguments() {
         if (Verbosity >= SOFT) {
             fmt.Printf("Loading config from %s\n", Opts.Config)
         }
-        handleConfig()
+        if err := handleConfig() ; err != nil {
+            return err
+        }
     } else {
         if _, err := os.Stat(filepath.Join(os.Getenv("HOME"), ".cmm/config.json")); os.IsNotExist(err) {
             // the "default" config does not exist
@@ -83,11 +122,15 @@ func HandleArguments() {
                 if (Verbosity >= SOFT) { fmt.Println("No config files found.") }
             } else {
                 Opts.Config = "/etc/cmm/config.json"
-                handleConfig()
+                if err := handleConfig() ; err != nil {
+                    return err
+                }
             }
         } else {
             Opts.Config = filepath.Join(os.Getenv("HOME"), ".cmm/config.json")
-            handleConfig()
+            if err := handleConfig() ; err != nil {
+                return err
+            }
         }
     }
 
@@ -108,17 +151,51 @@ func HandleArguments() {
         Opts.Migrations = "./"
     }
 
+    // handle where migrations are recorded
+    if (len(Opts.Keyspace) > 0) {
+        Settings.Keyspace = Opts.Keyspace
+    }
+    if (len(Opts.Table) > 0) {
+        Settings.Table = Opts.Table
+    }
+    if (len(Opts.Replication) > 0) {
+        var replication, err = ParseReplication(Opts.Replication)
+        if (err != nil) {
+            return err
+        }
+        Settings.Replication = replication
+    }
+    if (Verbosity >= SOFT) {
+        fmt.Printf("Recording migrations in %s.%s\n", Settings.Keyspace, Settings.Table)
+    }
+
     // handle delay timer
-    var delayErr error
     if (Opts.Delay > 0) {
-        SettleTime, delayErr = time.ParseDuration(strconv.FormatInt(Opts.Delay, 10) + "ms")
+        Settings.Delay = time.Duration(Opts.Delay) * time.Millisecond
         if (Verbosity >= SOFT) {
             fmt.Printf("Adding %dms delay after all queries\n", Opts.Delay)
         }
-    } else {
-        SettleTime, delayErr = time.ParseDuration("0ms")
     }
-    if (delayErr != nil) { panic(delayErr) }
+
+    // handle schema agreement timeout
+    if (Opts.SchemaWait > 0) {
+        Settings.SchemaWait = time.Duration(Opts.SchemaWait) * time.Second
+    }
+
+    Settings.Resume = Opts.Resume
+
+    // handle out-of-order policy
+    if (len(Opts.Order) > 0) {
+        Settings.Order = strings.ToLower(Opts.Order)
+    }
+
+    // handle migration lock timers
+    if (Opts.LockWait > 0) {
+        Settings.LockWait = time.Duration(Opts.LockWait) * time.Second
+    }
+    if (Opts.LockTTL > 0) {
+        Settings.LockTTL = time.Duration(Opts.LockTTL) * time.Second
+    }
 
     // handle consistency
     if (len(Opts.Consistency) == 0) {
@@ -147,6 +224,28 @@ func HandleArguments() {
             fmt.Printf("Using consistency: %s\n", Consistency)
         }
     }
+
+    // catch bad keyspace, table, replication and order values before connecting
+    return Settings.Validate()
+}
+
+
+//
+// Parse a replication map from comma separated key:value pairs
+// e.g. class:NetworkTopologyStrategy,dc1:3,dc2:2
+//
+func ParseReplication(list string) (map[string]string, error) {
+    var result = make(map[string]string)
+
+    for _, pair := range strings.Split(list, ",") {
+        var parts = strings.SplitN(pair, ":", 2)
+        if (len(parts) != 2) {
+            return nil, migrate.ErrConfig{ Option: "replication", Reason: "[" + pair + "] is not a key:value pair" }
+        }
+        result[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+    }
+
+    return result, nil
 }
 
 
@@ -164,143 +263,297 @@ func BuildHosts(peerList string) {
 
 
 //
-// Recursively walk tree looking for .cql files
-// Build migration object when one is found
+// Load the migration files below the directory given by the cli
 //
-func GetMigrationFiles(dir string) {
-    if (Verbosity >= SOFT) {
-        fmt.Printf("Loading migration files from: %s\n", dir)
-    }
-
-    var topErr = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-        // if there was an error, bubble to top
-        if (err != nil) { return err }
-
-        // if the file does not have the extension .cql
-        // or it is a hidden file (or swap file for many editors)
-        // just skip this file
-        if (filepath.Ext(path) != ".cql" || info.Name()[:1] == ".") { return nil }
-
-        // attempt to read the contents of the migration file
-        if contents, fileErr := ioutil.ReadFile(path) ; fileErr != nil {
-            fmt.Printf("Error reading migration file: %s\n", path)
-            return fileErr
-        } else {
-            if (Verbosity >= LOUD) {
-                fmt.Printf("\tFile: %s\n", info.Name())
-            }
-
-            // we got everything we need, so let's create a migration
-            // and append it the list initiated in main.go
-            Migrations = append(Migrations, Migration{
-                Name:           info.Name(),
-                Path:           path,
-                Query:          string(contents),
-            })
-        }
-
-        return nil
-    })
-
-    // if there was an error walking the path print it and exit
-    // a notice that an error occured is printed within the walk func
-    if topErr != nil {
-        fmt.Print(topErr)
-        os.Exit(1)
-    }
-
-    if (Verbosity >= SOFT) {
-        fmt.Println("Sorting migrations")
-    }
-    sort.Sort(Migrations)
+func loadMigrations() error {
+    return Migrator.Load(Opts.Migrations)
 }
 
 
 //
 //  handleConfig
 //      Load a configuration map from a given JSON file
+//      A key holding the wrong type of value is an ErrConfig naming that key
 //
-func handleConfig() {
-    var contents, err = ioutil.ReadFile(Opts.Config)
-    if (err != nil) {
-        fmt.Printf("ERROR: cannot read config file [%s]\n%s\n\n", Opts.Config, err)
-        os.Exit(1)
+func handleConfig() error {
+    var contents, readErr = ioutil.ReadFile(Opts.Config)
+    if (readErr != nil) {
+        return migrate.ErrConfig{ Option: "config", Reason: "cannot read [" + Opts.Config + "]: " + readErr.Error() }
     }
 
     var formatted map[string]interface{}
     var jsonErr = json.Unmarshal(contents, &formatted)
     if (jsonErr != nil) {
-        fmt.Printf("ERROR: cannot read config file json:\n%s\n\n", jsonErr)
-        os.Exit(1)
+        return migrate.ErrConfig{ Option: "config", Reason: "cannot parse json of [" + Opts.Config + "]: " + jsonErr.Error() }
     }
 
+    var err error
     for key, val := range formatted {
         switch(key) {
             case "Protocol":
-                Opts.Protocol = int(val.(float64))
+                var number, numberErr = configNumber(key, val)
+                Opts.Protocol, err = int(number), numberErr
                 break
 
             case "Consistency":
-                Opts.Consistency = val.(string)
+                Opts.Consistency, err = configString(key, val)
                 break
 
 
             case "Peers":
-                for _, p := range val.([]interface{}) {
+                var peers, ok = val.([]interface{})
+                if (!ok) {
+                    return configError(key, "a list of hosts", val)
+                }
+                for _, p := range peers {
+                    var host, hostErr = configString(key, p)
+                    if (hostErr != nil) { return hostErr }
+
                     if ( len(Opts.Hosts) > 0 ) { Opts.Hosts += "," }
-                    Opts.Hosts += p.(string)
+                    Opts.Hosts += host
                 }
                 break
 
             case "Migrations":
-                Opts.Migrations = val.(string)
+                Opts.Migrations, err = configString(key, val)
+                break
+
+            case "Keyspace":
+                Opts.Keyspace, err = configString(key, val)
+                break
+
+            case "Table":
+                Opts.Table, err = configString(key, val)
+                break
+
+            case "Replication":
+                var replication, ok = val.(map[string]interface{})
+                if (!ok) {
+                    return configError(key, "an object", val)
+                }
+
+                var pairs []string
+                for k, v := range replication {
+                    pairs = append(pairs, fmt.Sprintf("%s:%v", k, v))
+                }
+                Opts.Replication = strings.Join(pairs, ",")
                 break
 
             case "Delay":
-                Opts.Delay = int64(val.(float64))
+                var number, numberErr = configNumber(key, val)
+                Opts.Delay, err = int64(number), numberErr
+                break
+
+            case "Order":
+                Opts.Order, err = configString(key, val)
+                break
+
+            case "SchemaWait":
+                var number, numberErr = configNumber(key, val)
+                Opts.SchemaWait, err = int64(number), numberErr
+                break
+
+            case "LockWait":
+                var number, numberErr = configNumber(key, val)
+                Opts.LockWait, err = int64(number), numberErr
+                break
+
+            case "LockTTL":
+                var number, numberErr = configNumber(key, val)
+                Opts.LockTTL, err = int64(number), numberErr
                 break
 
             case "File":
-                Opts.File = val.(string)
+                Opts.File, err = configString(key, val)
                 break
 
             case "Output":
-                Opts.Output = val.(string)
+                Opts.Output, err = configString(key, val)
                 break
         }
+
+        if (err != nil) {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func configString(key string, val interface{}) (string, error) {
+    var result, ok = val.(string)
+    if (!ok) {
+        return "", configError(key, "a string", val)
+    }
+    return result, nil
+}
+
+func configNumber(key string, val interface{}) (float64, error) {
+    var result, ok = val.(float64)
+    if (!ok) {
+        return 0, configError(key, "a number", val)
     }
+    return result, nil
+}
+
+func configError(key, expected string, val interface{}) error {
+    return migrate.ErrConfig{ Option: key, Reason: fmt.Sprintf("expected %s in [%s], got %v", expected, Opts.Config, val) }
 }
 
 
 //
 //  handlePseudocommands
 //      This will be the "catch point" for flags that do not run migrations
+//      Handled is true when one ran, the exit code is then returned
 //
-func handlePseudocommands() {
+func handlePseudocommands() (code int, handled bool) {
     if (Opts.Describe != "none") {
-        var jsonString = Describe(Opts.Describe)
+        var jsonString, err = Describe(Opts.Describe)
+        if (err != nil) { return fail(err), true }
+
         fmt.Println(jsonString)
-        os.Exit(1)
+        return EXIT_APPLIED, true
+    }
+
+    if (Opts.DescribeCQL != "none") {
+        var statements, err = DescribeCQL(Opts.DescribeCQL)
+        if (err != nil) { return fail(err), true }
+
+        fmt.Println(statements)
+        return EXIT_APPLIED, true
     }
 
     if (Opts.Backfill != "none") {
-        var migs = Backfill(Opts.Describe, Opts.File)
-        // if no output path specified, just print
-        if (len(Opts.Output) == 0) {
-            migs.Print()
+        var migs, err = Backfill(Opts.Backfill, Opts.File)
+        if (err != nil) { return fail(err), true }
+
+        if err = outputMigrations(migs) ; err != nil { return fail(err), true }
+        return EXIT_APPLIED, true
+    }
+
+    if (Opts.Generate != "none") {
+        var migs, err = Generate(Opts.Generate)
+        if (err != nil) { return fail(err), true }
+
+        if err = outputMigrations(migs) ; err != nil { return fail(err), true }
+        return EXIT_APPLIED, true
+    }
+
+    if (Opts.List || Opts.JsonList) {
+        var complete, remaining, err = List(Opts.JsonList)
+        if (err != nil) { return fail(err), true }
+
+        if (Opts.JsonList) {
+            var jsonString, err = ListToJSON(complete, remaining)
+            if (err != nil) { return fail(err), true }
+            fmt.Println(jsonString)
+        }
+        return EXIT_APPLIED, true
+    }
+
+    // a plan is meant for review and CI, so it is not an error
+    if (Opts.Plan || Opts.JsonPlan) {
+        if err := loadMigrations() ; err != nil { return fail(err), true }
+
+        var plan, err = Migrator.Plan(Opts.Target)
+        if (err != nil) { return fail(err), true }
+
+        if (Opts.JsonPlan) {
+            var jsonString, err = PlanToJSON(plan)
+            if (err != nil) { return fail(err), true }
+            fmt.Println(jsonString)
         } else {
-            migs.Save(Opts.Output)
+            PrintPlan(plan)
         }
-        os.Exit(1)
+        return EXIT_APPLIED, true
     }
 
-    if (Opts.List) {
-        fmt.Println(List(Opts.JsonList))
-        os.Exit(1)
+    if (Opts.History || Opts.JsonHistory) {
+        // older clusters need the audit columns added before they can be read
+        if err := Migrator.Init() ; err != nil { return fail(err), true }
+
+        var history, err = Migrator.History()
+        if (err != nil) { return fail(err), true }
+
+        if (Opts.JsonHistory) {
+            var jsonString, err = HistoryToJSON(history)
+            if (err != nil) { return fail(err), true }
+            fmt.Println(jsonString)
+        } else {
+            PrintHistory(history)
+        }
+        return EXIT_APPLIED, true
+    }
+
+    if (Opts.Verify) {
+        // as for --history, older clusters need the checksum column added before it can be read
+        if err := Migrator.Init() ; err != nil { return fail(err), true }
+        if err := loadMigrations() ; err != nil { return fail(err), true }
+
+        var drift, err = Migrator.Verify()
+        if (err != nil) { return fail(err), true }
+
+        PrintDrift(drift)
+        if (drift.Found()) { return EXIT_DRIFT, true }
+        return EXIT_APPLIED, true
+    }
+
+    if (Opts.Unlock) {
+        if err := Unlock() ; err != nil { return fail(err), true }
+        return EXIT_APPLIED, true
+    }
+
+    return EXIT_APPLIED, false
+}
+
+
+//
+//  handleDiff
+//      Run --diff, which needs no cluster of its own, returning the exit code
+//      Differences exit as drift does, so a script can tell when two schemas have drifted apart
+//
+func handleDiff() int {
+    if (len(Opts.Diff) != 2) {
+        return fail(migrate.ErrConfig{ Option: "diff", Reason: "give --diff twice, once for the schema to compare from and once for the one to compare to" })
     }
 
-    if (Opts.JsonList) {
-        fmt.Println(ListToJSON(List(Opts.JsonList)))
-        os.Exit(1)
+    var from, err = DescribeSource(Opts.Diff[0])
+    if (err != nil) { return fail(err) }
+
+    var to []db.KeyspaceDescriptor
+    if to, err = DescribeSource(Opts.Diff[1]) ; err != nil { return fail(err) }
+
+    if (Opts.DiffMigrations) {
+        var migs, err = DiffMigrations(from, to)
+        if (err != nil) { return fail(err) }
+
+        if err = outputMigrations(migs) ; err != nil { return fail(err) }
+        return EXIT_APPLIED
+    }
+
+    var changes = DiffSchemas(from, to)
+    if (Opts.JsonDiff) {
+        var jsonString, err = DiffToJSON(changes)
+        if (err != nil) { return fail(err) }
+        fmt.Println(jsonString)
+    } else {
+        PrintDiff(changes)
+    }
+
+    if (len(changes) > 0) { return EXIT_DRIFT }
+    return EXIT_APPLIED
+}
+
+
+//
+//  outputMigrations
+//      Print generated migrations, or save them to the directory given by --output
+//
+func outputMigrations(migs migrate.MigrationCollection) error {
+    // if no output path specified, just print
+    if (len(Opts.Output) == 0) {
+        PrintMigrations(migs)
+        return nil
     }
+    return SaveMigrations(migs, Opts.Output)
 }
\ No newline at end of file
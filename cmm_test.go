@@ -2,14 +2,19 @@ package main
 
 import (
     "os"
+    "context"
     "fmt"
+    "time"
     "strings"
+    "strconv"
     "testing"
     "io/ioutil"
 
     "github.com/tux21b/gocql"
 
+    "github.com/zmarcantel/cmm/cql/cqltest"
     "github.com/zmarcantel/cmm/db"
+    "github.com/zmarcantel/cmm/migrate"
 )
 
 var GOOD_HOSTS []string
@@ -18,18 +23,23 @@ func TestSetup(t *testing.T) {
     var testHosts = os.Getenv("TEST_HOSTS")
     fmt.Printf("Test Hosts: %s\n", testHosts)
 
+    // without hosts the suite runs against an in-memory fake cluster
     if len(testHosts) > 0 {
         GOOD_HOSTS = strings.Split(testHosts, ",")
         _ = os.Setenv("TEST_HOSTS", "")
-    } else {
-        GOOD_HOSTS = []string{ "192.168.50.100" } //"192.168.33.100", "192.168.33.101", "192.168.33.150"}
     }
 }
 
 func TestConfig(t *testing.T) {
     var testConf = "./test/config.json"
     Opts.Config = testConf
-    handleConfig()
+    if err := handleConfig() ; err != nil {
+        t.Error(
+            "For", "handleConfig()",
+            "expected", nil,
+            "got", err,
+        )
+    }
 
     // check protocol
     if (Opts.Protocol != 2) {
@@ -124,6 +134,35 @@ func TestConfig(t *testing.T) {
 }
 
 
+func TestConfigTypes(t *testing.T) {
+    var saved = Opts
+    defer func() { Opts = saved }()
+
+    var file, _ = ioutil.TempFile("", "cmm_config")
+    defer os.Remove(file.Name())
+    file.Close()
+    Opts.Config = file.Name()
+
+    var cases = map[string]string{
+        "LockTTL":      `{ "LockTTL": "60" }`,
+        "Peers":        `{ "Peers": [ "127.0.0.1", 9042 ] }`,
+        "Replication":  `{ "Replication": "SimpleStrategy" }`,
+        "Keyspace":     `{ "Keyspace": false }`,
+    }
+    for key, contents := range cases {
+        ioutil.WriteFile(file.Name(), []byte(contents), 0644)
+
+        if configErr, ok := handleConfig().(migrate.ErrConfig) ; !ok || configErr.Option != key {
+            t.Error(
+                "For", "handleConfig with " + contents,
+                "expected", "ErrConfig for " + key,
+                "got", handleConfig(),
+            )
+        }
+    }
+}
+
+
 func TestHosts(t *testing.T) {
     BuildHosts(Opts.Hosts)
 
@@ -157,12 +196,26 @@ func TestHosts(t *testing.T) {
 }
 
 func TestConnection(t *testing.T) {
-    Opts.Hosts = strings.Join(GOOD_HOSTS, ",")
-    BuildHosts(Opts.Hosts)
+    if (len(GOOD_HOSTS) == 0) {
+        Session = cqltest.NewFake()
+    } else {
+        Opts.Hosts = strings.Join(GOOD_HOSTS, ",")
+        BuildHosts(Opts.Hosts)
 
-     _, Session = connectCluster()
+        var err error
+        if _, Session, err = connectCluster() ; err != nil {
+            t.Fatal(
+                "For", "DB Connect",
+                "expected", nil,
+                "got", err,
+            )
+        }
+    }
     db.Init(Session)
 
+    Migrator = migrate.New(Session, Settings)
+    Migrator.Consistency = Consistency
+
     if _, err := db.Keyspace("system") ; err != nil {
         t.Error(
             "For", "DB Connect, get system keyspace description",
@@ -171,18 +224,93 @@ func TestConnection(t *testing.T) {
         )
     }
 
-    CreateMigrationTable(Session)
+    if err := Migrator.Init() ; err != nil {
+        t.Error(
+            "For", "Migrator.Init()",
+            "expected", nil,
+            "got", err,
+        )
+    }
+}
+
+func TestLock(t *testing.T) {
+    Migrator.Options.LockWait = 0
+    Migrator.Options.LockTTL = 10 * time.Second
+
+    var lock, err = Migrator.AcquireLock()
+    if (err != nil) {
+        t.Error(
+            "For", "AcquireLock",
+            "expected", nil,
+            "got", err,
+        )
+        return
+    }
+
+    if _, err = Migrator.AcquireLock() ; err == nil {
+        t.Error(
+            "For", "AcquireLock while held",
+            "expected", "migration lock is held",
+            "got", nil,
+        )
+    }
+
+    lock.Release()
+
+    if lock, err = Migrator.AcquireLock() ; err != nil {
+        t.Error(
+            "For", "AcquireLock after release",
+            "expected", nil,
+            "got", err,
+        )
+    } else {
+        lock.Release()
+    }
+}
+
+func TestProgress(t *testing.T) {
+    var mig = migrate.Migration{ Name: "cmm_test_progress.cql" }
+
+    Migrator.MarkProgress(mig, migrate.STATUS_FAILED, 2, 3, "column already exists")
+    if progress, found, err := Migrator.GetProgress(mig) ; err != nil || !found {
+        t.Error(
+            "For", "GetProgress after failure",
+            "expected", true,
+            "got", found, err,
+        )
+    } else if (progress.Status != migrate.STATUS_FAILED || progress.Applied != 2 || progress.Statement != 3) {
+        t.Error(
+            "For", "GetProgress",
+            "expected", "failed, 2 applied, statement 3",
+            "got", progress,
+        )
+    }
+
+    Migrator.ClearProgress(mig)
+    if _, found, _ := Migrator.GetProgress(mig) ; found {
+        t.Error(
+            "For", "GetProgress after clear",
+            "expected", false,
+            "got", found,
+        )
+    }
 }
 
 func TestLoadMigrations(t *testing.T) {
-    GetMigrationFiles(Opts.Migrations)
-    Consistency = gocql.Quorum;
+    if err := Migrator.Load(Opts.Migrations) ; err != nil {
+        t.Error(
+            "For", "Migrator.Load()",
+            "expected", nil,
+            "got", err,
+        )
+    }
+    Migrator.Consistency = gocql.Quorum;
 
-    if (Migrations.Len() != 4) {
+    if (Migrator.Migrations.Len() != 4) {
         t.Error(
-            "For", "Migrations.Len()",
+            "For", "Migrator.Migrations.Len()",
             "expected", 4,
-            "got", Migrations.Len(),
+            "got", Migrator.Migrations.Len(),
         )
     }
 
@@ -190,17 +318,17 @@ func TestLoadMigrations(t *testing.T) {
     // Create cmm_main keyspace
     //
 
-    if (Migrations[0].Name != "2014-03-01T05-44-32.070Z_add_main_keyspace.cql") {
+    if (Migrator.Migrations[0].Name != "2014-03-01T05-44-32.070Z_add_main_keyspace.cql") {
         t.Error(
-            "For", "Migrations[0].Name",
+            "For", "Migrator.Migrations[0].Name",
             "expected", "2014-03-01T05-44-32.070Z_add_main_keyspace.cql",
-            "got", Migrations[0].Name,
+            "got", Migrator.Migrations[0].Name,
         )
-    } else if (Migrations[0].Path != "test/main/keyspaces/2014-03-01T05-44-32.070Z_add_main_keyspace.cql") {
+    } else if (Migrator.Migrations[0].Path != "test/main/keyspaces/2014-03-01T05-44-32.070Z_add_main_keyspace.cql") {
         t.Error(
-            "For", "Migrations[0].Path",
+            "For", "Migrator.Migrations[0].Path",
             "expected", "test/main/keyspaces/2014-03-01T05-44-32.070Z_add_main_keyspace.cql",
-            "got", Migrations[0].Path,
+            "got", Migrator.Migrations[0].Path,
         )
     }
 
@@ -210,17 +338,17 @@ func TestLoadMigrations(t *testing.T) {
     // Create cmm_main.users table
     //
 
-    if (Migrations[1].Name != "2014-03-02T05-44-32.070Z_create_user_table.cql") {
+    if (Migrator.Migrations[1].Name != "2014-03-02T05-44-32.070Z_create_user_table.cql") {
         t.Error(
-            "For", "Migrations[1].Name",
+            "For", "Migrator.Migrations[1].Name",
             "expected", "2014-03-02T05-44-32.070Z_create_user_table.cql",
-            "got", Migrations[1].Name,
+            "got", Migrator.Migrations[1].Name,
         )
-    } else if (Migrations[1].Path != "test/main/users/2014-03-02T05-44-32.070Z_create_user_table.cql") {
+    } else if (Migrator.Migrations[1].Path != "test/main/users/2014-03-02T05-44-32.070Z_create_user_table.cql") {
         t.Error(
-            "For", "Migrations[1].Path",
+            "For", "Migrator.Migrations[1].Path",
             "expected", "test/main/users/2014-03-02T05-44-32.070Z_create_user_table.cql",
-            "got", Migrations[1].Path,
+            "got", Migrator.Migrations[1].Path,
         )
     }
 
@@ -230,17 +358,17 @@ func TestLoadMigrations(t *testing.T) {
     // Create cmm_main.items table
     //
 
-    if (Migrations[2].Name != "2014-03-02T06-13-03.495Z_create_item_table.cql") {
+    if (Migrator.Migrations[2].Name != "2014-03-02T06-13-03.495Z_create_item_table.cql") {
         t.Error(
-            "For", "Migrations[2].Name",
+            "For", "Migrator.Migrations[2].Name",
             "expected", "2014-03-02T06-13-03.495Z_create_item_table.cql",
-            "got", Migrations[2].Name,
+            "got", Migrator.Migrations[2].Name,
         )
-    } else if (Migrations[2].Path != "test/main/items/2014-03-02T06-13-03.495Z_create_item_table.cql") {
+    } else if (Migrator.Migrations[2].Path != "test/main/items/2014-03-02T06-13-03.495Z_create_item_table.cql") {
         t.Error(
-            "For", "Migrations[2].Path",
+            "For", "Migrator.Migrations[2].Path",
             "expected", "test/main/items/2014-03-02T06-13-03.495Z_create_item_table.cql",
-            "got", Migrations[2].Path,
+            "got", Migrator.Migrations[2].Path,
         )
     }
 
@@ -250,41 +378,98 @@ func TestLoadMigrations(t *testing.T) {
     // Alter cmm_main.users table
     //
 
-    if (Migrations[3].Name != "2014-03-02T06-14-04.626Z_add_items_to_user_table.cql") {
+    if (Migrator.Migrations[3].Name != "2014-03-02T06-14-04.626Z_add_items_to_user_table.cql") {
         t.Error(
-            "For", "Migrations[3].Name",
+            "For", "Migrator.Migrations[3].Name",
             "expected", "2014-03-02T06-14-04.626Z_add_items_to_user_table.cql",
-            "got", Migrations[3].Name,
+            "got", Migrator.Migrations[3].Name,
         )
-    } else if (Migrations[3].Path != "test/main/users/2014-03-02T06-14-04.626Z_add_items_to_user_table.cql") {
+    } else if (Migrator.Migrations[3].Path != "test/main/users/2014-03-02T06-14-04.626Z_add_items_to_user_table.cql") {
         t.Error(
-            "For", "Migrations[3].Path",
+            "For", "Migrator.Migrations[3].Path",
             "expected", "test/main/users/2014-03-02T06-14-04.626Z_add_items_to_user_table.cql",
-            "got", Migrations[3].Path,
+            "got", Migrator.Migrations[3].Path,
         )
-    } else if complete, err := Migrations[3].IsComplete() ; complete {
+    } else if complete, err := Migrator.IsComplete(Migrator.Migrations[3]) ; complete {
         if (err != nil) {
             t.Error(
-                "For", "Migrations[3].IsComplete() Error",
+                "For", "Migrator.IsComplete(Migrator.Migrations[3]) Error",
                 "expected", nil,
                 "got", err,
             )
         }
 
         t.Error(
-            "For", "Migrations[3].IsComplete()",
+            "For", "Migrator.IsComplete(Migrator.Migrations[3])",
+            "expected", false,
+            "got", complete,
+        )
+    }
+}
+
+
+func TestPlan(t *testing.T) {
+    var plan, _ = Migrator.Plan("")
+
+    if (len(plan.Pending) != 4) {
+        t.Error(
+            "For", "len(plan.Pending)",
+            "expected", 4,
+            "got", len(plan.Pending),
+        )
+    } else if (plan.Pending[0].Delay != 500) {
+        t.Error(
+            "For", "plan.Pending[0].Delay",
+            "expected", 500,
+            "got", plan.Pending[0].Delay,
+        )
+    } else if (len(plan.Pending[1].Statements) != 1) {
+        t.Error(
+            "For", "len(plan.Pending[1].Statements)",
+            "expected", 1,
+            "got", len(plan.Pending[1].Statements),
+        )
+    }
+
+    // planning must not run anything
+    if complete, _ := Migrator.IsComplete(Migrator.Migrations[0]) ; complete {
+        t.Error(
+            "For", "Planned: " + Migrator.Migrations[0].Name,
             "expected", false,
             "got", complete,
         )
     }
+
+    // a target leaves the migrations after it alone
+    plan, _ = Migrator.Plan("2014-03-02T05")
+
+    if (plan.Target != "2014-03-02T05-44-32.070Z_create_user_table.cql") {
+        t.Error(
+            "For", "plan.Target",
+            "expected", "2014-03-02T05-44-32.070Z_create_user_table.cql",
+            "got", plan.Target,
+        )
+    } else if (len(plan.Pending) != 2 || len(plan.AfterTarget) != 2) {
+        t.Error(
+            "For", "len(plan.Pending), len(plan.AfterTarget)",
+            "expected", "2, 2",
+            "got", len(plan.Pending), len(plan.AfterTarget),
+        )
+    }
 }
 
 
 func TestMigrations(t *testing.T) {
-    DoMigrations(Migrations, SettleTime)
+    if _, err := Migrator.Up(context.Background(), "") ; err != nil {
+        t.Error(
+            "For", "Migrator.Up()",
+            "expected", nil,
+            "got", err,
+        )
+    }
 
-    for _, mig := range Migrations {
-        if complete, err := mig.IsComplete() ; complete == false {
+    for _, mig := range Migrator.Migrations {
+        if complete, err := Migrator.IsComplete(mig) ; complete == false {
             t.Error(
                 "For", "Complete: " + mig.Name,
                 "expected", true,
@@ -300,11 +485,108 @@ func TestMigrations(t *testing.T) {
     }
 }
 
+func TestHistory(t *testing.T) {
+    var history, _ = Migrator.History()
+    var applied = make(map[string]migrate.HistoryEntry)
+    for _, entry := range history {
+        applied[entry.Name] = entry
+    }
+
+    for _, mig := range Migrator.Migrations {
+        if entry, exists := applied[mig.Name] ; !exists {
+            t.Error(
+                "For", "History of " + mig.Name,
+                "expected", "entry",
+                "got", nil,
+            )
+        } else if (entry.Version != migrate.VERSION || entry.Statements != 1 || entry.Checksum != mig.Checksum()) {
+            t.Error(
+                "For", "History of " + mig.Name,
+                "expected", migrate.VERSION + ", 1 statement, " + mig.Checksum(),
+                "got", entry,
+            )
+        }
+    }
+}
+
+func TestVerify(t *testing.T) {
+    var drift, _ = Migrator.Verify()
+
+    if (drift.Found()) {
+        t.Error(
+            "For", "drift.Found()",
+            "expected", false,
+            "got", true,
+        )
+    }
+
+    // a migration applied but no longer on disk is drift, one on disk but not applied is pending
+    var gone = migrate.Migration{ Name: "2014-03-01T00-00-00.000Z_deleted.cql", Query: "SELECT now() FROM system.local;" }
+    var last = Migrator.Migrations[len(Migrator.Migrations) - 1]
+    Migrator.MarkComplete(gone, 0, 1)
+    Migrator.MarkIncomplete(last)
+
+    drift, _ = Migrator.Verify()
+    if (!drift.Found() || len(drift.Missing) != 1 || drift.Missing[0] != gone.Name || len(drift.Unknown) != 1 || drift.Unknown[0] != last.Name) {
+        t.Error(
+            "For", "Verify with a deleted and a pending migration",
+            "expected", "drift, " + gone.Name + " missing and " + last.Name + " unknown",
+            "got", drift,
+        )
+    }
+
+    Migrator.MarkIncomplete(gone)
+    Migrator.MarkComplete(last, 0, 1)
+    if drift, _ = Migrator.Verify() ; len(drift.Unknown) != 0 || drift.Found() {
+        t.Error(
+            "For", "Verify once both are undone",
+            "expected", "no drift",
+            "got", drift,
+        )
+    }
+}
+
+func TestUnlock(t *testing.T) {
+    // the lock of a run that died
+    Session.Query(`INSERT INTO ` + Migrator.LockTable() + ` (name, owner, acquired) VALUES (?, ?, ?) USING TTL 60`,
+        migrate.LOCK_NAME, "gone:1", time.Now()).Exec()
+
+    // is removed without the migrations having to load
+    var migrations = Opts.Migrations
+    Opts.Migrations = "test/nowhere"
+    var err = Unlock()
+    Opts.Migrations = migrations
+
+    if (err != nil) {
+        t.Error(
+            "For", "Unlock with no migrations directory",
+            "expected", nil,
+            "got", err,
+        )
+    }
+
+    var owner string
+    if err := Session.Query(`SELECT owner FROM ` + Migrator.LockTable() + ` WHERE name = ?`, migrate.LOCK_NAME).Scan(&owner) ; err == nil {
+        t.Error(
+            "For", "the lock after --unlock",
+            "expected", "no lock",
+            "got", owner,
+        )
+    }
+}
+
 func TestBackfillAdd(t *testing.T) {
     Opts.Backfill = "cmm_main.users"
     Opts.File = "test/schemas/users_fields_added.json"
 
-    var migs = Backfill(Opts.Backfill, Opts.File)
+    var migs, err = Backfill(Opts.Backfill, Opts.File)
+    if (err != nil) {
+        t.Error(
+            "For", "Backfill(" + Opts.Backfill + ")",
+            "expected", nil,
+            "got", err,
+        )
+    }
     var acceptable = []string{
         "ALTER TABLE cmm_main.users ADD purchases SET<UUID>;",
         "ALTER TABLE cmm_main.users ADD ratings MAP<UUID,FLOAT>;",
@@ -334,7 +616,14 @@ func TestBackfillRemove(t *testing.T) {
     Opts.Backfill = "cmm_main.users"
     Opts.File = "test/schemas/users_fields_removed.json"
 
-    var migs = Backfill(Opts.Backfill, Opts.File)
+    var migs, err = Backfill(Opts.Backfill, Opts.File)
+    if (err != nil) {
+        t.Error(
+            "For", "Backfill(" + Opts.Backfill + ")",
+            "expected", nil,
+            "got", err,
+        )
+    }
     var acceptable = []string{
         "ALTER TABLE cmm_main.users DROP items;",
         "ALTER TABLE cmm_main.users DROP join_date;",
@@ -364,7 +653,14 @@ func TestBackfillMixed(t *testing.T) {
     Opts.Backfill = "cmm_main.users"
     Opts.File = "test/schemas/users_fields_mixed.json"
 
-    var migs = Backfill(Opts.Backfill, Opts.File)
+    var migs, err = Backfill(Opts.Backfill, Opts.File)
+    if (err != nil) {
+        t.Error(
+            "For", "Backfill(" + Opts.Backfill + ")",
+            "expected", nil,
+            "got", err,
+        )
+    }
     var acceptable = []string{
         "ALTER TABLE cmm_main.users DROP items;",
         "ALTER TABLE cmm_main.users DROP join_date;",
@@ -392,10 +688,475 @@ func TestBackfillMixed(t *testing.T) {
     }
 }
 
+func TestBackfillCreateTable(t *testing.T) {
+    var migs, err = Backfill("cmm_main.events", "test/schemas/events.json")
+    if (err != nil || len(migs) != 1) {
+        t.Fatal(
+            "For", "Backfill(cmm_main.events)",
+            "expected", "one migration",
+            "got", migs, err,
+        )
+    }
+
+    var expected = "CREATE TABLE cmm_main.events (\n" +
+        "    tenant TEXT,\n" +
+        "    day TEXT,\n" +
+        "    at TIMEUUID,\n" +
+        "    seq INT,\n" +
+        "    owner TEXT STATIC,\n" +
+        "    payload BLOB,\n" +
+        "    PRIMARY KEY ((tenant, day), at, seq)\n" +
+        ") WITH CLUSTERING ORDER BY (at DESC, seq ASC);"
+    if (migs[0].Query != expected) {
+        t.Error(
+            "For", "CREATE TABLE of events.json",
+            "\nexpected", expected,
+            "\n     got", migs[0].Query,
+        )
+    }
+
+    // once created, the same file needs nothing more
+    if err = Session.Query(migs[0].Query).Exec() ; err != nil {
+        t.Fatal(
+            "For", migs[0].Query,
+            "expected", nil,
+            "got", err,
+        )
+    }
+    if migs, err = Backfill("cmm_main.events", "test/schemas/events.json") ; err != nil || len(migs) != 0 {
+        t.Error(
+            "For", "Backfill(cmm_main.events) once created",
+            "expected", "no migrations",
+            "got", migs, err,
+        )
+    }
+
+    Session.Query("DROP TABLE cmm_main.events").Exec()
+}
+
+func TestBackfillSameTypes(t *testing.T) {
+    var migs, err = Backfill("cmm_main.users", "test/schemas/users_types_respelled.json")
+    if (err != nil || len(migs) != 0) {
+        t.Error(
+            "For", "Backfill(cmm_main.users) with types in another case and spacing",
+            "expected", "no migrations",
+            "got", migs, err,
+        )
+    }
+}
+
+func TestBackfillPrimaryKey(t *testing.T) {
+    var migs, err = Backfill("cmm_main.users", "test/schemas/users_key_changed.json")
+    if _, isConfig := err.(migrate.ErrConfig) ; !isConfig || len(migs) != 0 {
+        t.Error(
+            "For", "Backfill(cmm_main.users) changing the PRIMARY KEY",
+            "expected", "ErrConfig",
+            "got", migs, err,
+        )
+    }
+}
+
+func TestBackfillOptions(t *testing.T) {
+    var migs, err = Backfill("cmm_main.users", "test/schemas/users_options.json")
+    var expected = []string{
+        "ALTER TABLE cmm_main.users WITH comment = 'people who signed up';",
+        "ALTER TABLE cmm_main.users WITH compaction = {'class': 'LeveledCompactionStrategy', 'sstable_size_in_mb': '160'};",
+        "ALTER TABLE cmm_main.users WITH gc_grace_seconds = 3600;",
+    }
+    if (err != nil || len(migs) != len(expected)) {
+        t.Fatal(
+            "For", "Backfill(cmm_main.users) with table options",
+            "expected", expected,
+            "got", migs, err,
+        )
+    }
+
+    for i, mig := range migs {
+        if (mig.Query != expected[i]) {
+            t.Error(
+                "For", "migration query",
+                "expected", expected[i],
+                "got", mig.Query,
+            )
+        }
+        if err = Session.Query(mig.Query).Exec() ; err != nil {
+            t.Error(
+                "For", mig.Query,
+                "expected", nil,
+                "got", err,
+            )
+        }
+    }
+
+    // once set, cassandra's own spelling of the class and its defaults for the rest do not count
+    if migs, err = Backfill("cmm_main.users", "test/schemas/users_options.json") ; err != nil || len(migs) != 0 {
+        t.Error(
+            "For", "Backfill(cmm_main.users) once the options are set",
+            "expected", "no migrations",
+            "got", migs, err,
+        )
+    }
+
+    Session.Query("ALTER TABLE cmm_main.users WITH comment = '' AND compaction = {'class': 'SizeTieredCompactionStrategy'} AND gc_grace_seconds = 864000").Exec()
+}
+
+func TestBackfillKeyspace(t *testing.T) {
+    var migs, err = Backfill("cmm_shop", "test/schemas/keyspace.json")
+    var expected = []string{
+        "CREATE KEYSPACE cmm_shop WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': '3', 'dc2': '2'} AND durable_writes = false;",
+        "CREATE TABLE cmm_shop.items (\n    id UUID,\n    name TEXT,\n    PRIMARY KEY (id)\n);",
+        "CREATE TABLE cmm_shop.orders (\n    customer UUID,\n    at TIMEUUID,\n    items LIST<UUID>,\n    PRIMARY KEY (customer, at)\n) WITH CLUSTERING ORDER BY (at DESC);",
+    }
+    if (err != nil || len(migs) != len(expected)) {
+        t.Fatal(
+            "For", "Backfill(cmm_shop) of a new keyspace",
+            "expected", expected,
+            "got", migs, err,
+        )
+    }
+
+    for i, mig := range migs {
+        if (mig.Query != expected[i]) {
+            t.Error(
+                "For", "migration query",
+                "\nexpected", expected[i],
+                "\n     got", mig.Query,
+            )
+        }
+        if (i > 0 && mig.Name <= migs[i - 1].Name) {
+            t.Error(
+                "For", "the name of " + mig.Name,
+                "expected", "to sort after " + migs[i - 1].Name,
+                "got", "before",
+            )
+        }
+        if err = Session.Query(mig.Query).Exec() ; err != nil {
+            t.Error(
+                "For", mig.Query,
+                "expected", nil,
+                "got", err,
+            )
+        }
+    }
+
+    if migs, err = Backfill("cmm_shop", "test/schemas/keyspace.json") ; err != nil || len(migs) != 0 {
+        t.Error(
+            "For", "Backfill(cmm_shop) once created",
+            "expected", "no migrations",
+            "got", migs, err,
+        )
+    }
+
+    // tables left out of the list are only dropped when asked to
+    var altered = []string{
+        "ALTER KEYSPACE cmm_shop WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': '3'} AND durable_writes = true;",
+        "ALTER TABLE cmm_shop.items ADD description TEXT;",
+    }
+    var schemas = map[string][]string{
+        "test/schemas/keyspace_altered.json":   altered,
+        "test/schemas/keyspace_dropped.json":   append(altered, "DROP TABLE cmm_shop.orders;"),
+    }
+    for schema, expected := range schemas {
+        migs, err = Backfill("cmm_shop", schema)
+        if (err != nil || len(migs) != len(expected)) {
+            t.Fatal(
+                "For", "Backfill(cmm_shop) of an existing keyspace to " + schema,
+                "expected", expected,
+                "got", migs, err,
+            )
+        }
+        for i, mig := range migs {
+            if (mig.Query != expected[i]) {
+                t.Error(
+                    "For", "migration query",
+                    "expected", expected[i],
+                    "got", mig.Query,
+                )
+            }
+        }
+    }
+
+    if _, err = Backfill("cmm_shop", "test/schemas/users.json") ; err == nil {
+        t.Error(
+            "For", "Backfill(cmm_shop) of a table schema",
+            "expected", "an error",
+            "got", err,
+        )
+    }
+
+    Session.Query("DROP KEYSPACE cmm_shop").Exec()
+}
+
+func TestGenerate(t *testing.T) {
+    var migs, err = Generate("test/schemas/declared")
+    var expected = []string{
+        "CREATE KEYSPACE cmm_gen WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '1'} AND durable_writes = true;",
+        "CREATE TYPE cmm_gen.address (\n    street TEXT,\n    zip INT\n);",
+        "CREATE TABLE cmm_gen.customers (\n    id UUID,\n    email TEXT,\n    home FROZEN<address>,\n    PRIMARY KEY (id)\n) WITH gc_grace_seconds = 3600;",
+        "CREATE TABLE cmm_gen.orders (\n    customer UUID,\n    at TIMEUUID,\n    items LIST<UUID>,\n    PRIMARY KEY (customer, at)\n) WITH CLUSTERING ORDER BY (at DESC);",
+        "CREATE INDEX customers_email_idx ON cmm_gen.customers (email);",
+    }
+    if (err != nil || len(migs) != len(expected)) {
+        t.Fatal(
+            "For", "Generate(test/schemas/declared)",
+            "expected", expected,
+            "got", migs, err,
+        )
+    }
+
+    for i, mig := range migs {
+        if (mig.Query != expected[i]) {
+            t.Error(
+                "For", "migration query",
+                "\nexpected", expected[i],
+                "\n     got", mig.Query,
+            )
+        }
+        if (i > 0 && mig.Name <= migs[i - 1].Name) {
+            t.Error(
+                "For", "the name of " + mig.Name,
+                "expected", "to sort after " + migs[i - 1].Name,
+                "got", "before",
+            )
+        }
+        if err = Session.Query(mig.Query).Exec() ; err != nil {
+            t.Error(
+                "For", mig.Query,
+                "expected", nil,
+                "got", err,
+            )
+        }
+    }
+
+    if migs, err = Generate("test/schemas/declared") ; err != nil || len(migs) != 0 {
+        t.Error(
+            "For", "Generate(test/schemas/declared) once applied",
+            "expected", "no migrations",
+            "got", migs, err,
+        )
+    }
+
+    // whatever the keyspace has that the files do not declare is left in place
+    var drift = []string{
+        "ALTER TABLE cmm_gen.customers ADD nickname TEXT",
+        "DROP INDEX cmm_gen.customers_email_idx",
+        "CREATE TABLE cmm_gen.scratch (id UUID PRIMARY KEY)",
+        "CREATE TYPE cmm_gen.unused (a INT)",
+    }
+    for _, statement := range drift {
+        Session.Query(statement).Exec()
+    }
+
+    migs, err = Generate("test/schemas/declared")
+    expected = []string{
+        "ALTER TABLE cmm_gen.customers DROP nickname;",
+        "CREATE INDEX customers_email_idx ON cmm_gen.customers (email);",
+    }
+    if (err != nil || len(migs) != len(expected)) {
+        t.Fatal(
+            "For", "Generate(test/schemas/declared) of a keyspace that drifted",
+            "expected", expected,
+            "got", migs, err,
+        )
+    }
+    for i, mig := range migs {
+        if (mig.Query != expected[i]) {
+            t.Error(
+                "For", "migration query",
+                "expected", expected[i],
+                "got", mig.Query,
+            )
+        }
+    }
+
+    // unless the keyspace sets drop_missing
+    var desired, _ = LoadSchema("test/schemas/declared")
+    for i := range desired {
+        desired[i].DropMissing = true
+    }
+    var current, _ = db.AllKeyspaces()
+    migs, err = SchemaMigrations(current, desired)
+    expected = []string{
+        "ALTER TABLE cmm_gen.customers DROP nickname;",
+        "DROP TABLE cmm_gen.scratch;",
+        "CREATE INDEX customers_email_idx ON cmm_gen.customers (email);",
+        "DROP TYPE cmm_gen.unused;",
+    }
+    if (err != nil || len(migs) != len(expected)) {
+        t.Fatal(
+            "For", "SchemaMigrations with drop_missing of a keyspace that drifted",
+            "expected", expected,
+            "got", migs, err,
+        )
+    }
+    for i, mig := range migs {
+        if (mig.Query != expected[i]) {
+            t.Error(
+                "For", "migration query",
+                "expected", expected[i],
+                "got", mig.Query,
+            )
+        }
+    }
+
+    // the backfill files are not descriptors
+    if _, err = Generate("test/schemas") ; err == nil {
+        t.Error(
+            "For", "Generate(test/schemas)",
+            "expected", "an error",
+            "got", err,
+        )
+    }
+    if _, err = Generate("test/nowhere") ; err != (migrate.ErrNotFound{ Kind: "schema directory", Name: "test/nowhere" }) {
+        t.Error(
+            "For", "Generate(test/nowhere)",
+            "expected", migrate.ErrNotFound{ Kind: "schema directory", Name: "test/nowhere" },
+            "got", err,
+        )
+    }
+
+    Session.Query("DROP KEYSPACE cmm_gen").Exec()
+}
+
+func TestDiff(t *testing.T) {
+    var from, err = DescribeSource("test/schemas/diff/from.json")
+    if (err != nil || len(from) != 2) {
+        t.Fatal(
+            "For", "DescribeSource(from.json)",
+            "expected", "archive and shop, without system",
+            "got", from, err,
+        )
+    }
+
+    var to []db.KeyspaceDescriptor
+    if to, err = DescribeSource("test/schemas/diff/to.json") ; err != nil {
+        t.Fatal(
+            "For", "DescribeSource(to.json)",
+            "expected", nil,
+            "got", err,
+        )
+    }
+
+    var expected = []SchemaChange{
+        { "removed", "keyspace", "archive", "{'class': 'SimpleStrategy', 'replication_factor': '1'}", "" },
+        { "added", "keyspace", "reports", "", "{'class': 'NetworkTopologyStrategy', 'dc1': '2'}" },
+        { "changed", "replication", "shop", "{'class': 'SimpleStrategy', 'replication_factor': '1'}", "{'class': 'SimpleStrategy', 'replication_factor': '3'}" },
+        { "changed", "type", "shop.address", "(street TEXT)", "(street TEXT, zip INT)" },
+        { "removed", "table", "shop.legacy", "(id)", "" },
+        { "added", "table", "shop.orders", "", "(customer, at) (at DESC)" },
+        { "changed", "column", "shop.users.age", "INT", "BIGINT" },
+        { "added", "column", "shop.users.name", "", "TEXT" },
+        { "changed", "option", "shop.users.gc_grace_seconds", "864000", "3600" },
+        { "added", "index", "shop.users_email_idx", "", "CREATE INDEX users_email_idx ON shop.users (email);" },
+    }
+    var changes = DiffSchemas(from, to)
+    if (len(changes) != len(expected)) {
+        t.Fatal(
+            "For", "DiffSchemas(from.json, to.json)",
+            "expected", expected,
+            "got", changes,
+        )
+    }
+    for i, change := range changes {
+        if (change != expected[i]) {
+            t.Error(
+                "For", "change " + strconv.Itoa(i),
+                "expected", expected[i],
+                "got", change,
+            )
+        }
+    }
+
+    if same := DiffSchemas(to, to) ; len(same) != 0 {
+        t.Error(
+            "For", "DiffSchemas(to.json, to.json)",
+            "expected", "no changes",
+            "got", same,
+        )
+    }
+
+    var migs migrate.MigrationCollection
+    migs, err = DiffMigrations(from, to)
+    var queries = []string{
+        "ALTER KEYSPACE shop WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '3'};",
+        "CREATE KEYSPACE reports WITH replication = {'class': 'NetworkTopologyStrategy', 'dc1': '2'} AND durable_writes = false;",
+        "ALTER TYPE shop.address ADD zip INT;",
+        "ALTER TABLE shop.users ALTER age TYPE BIGINT;",
+        "ALTER TABLE shop.users ADD name TEXT;",
+        "ALTER TABLE shop.users WITH gc_grace_seconds = 3600;",
+        "CREATE TABLE shop.orders (\n    customer UUID,\n    at TIMEUUID,\n    PRIMARY KEY (customer, at)\n) WITH CLUSTERING ORDER BY (at DESC);",
+        "DROP TABLE shop.legacy;",
+        "CREATE INDEX users_email_idx ON shop.users (email);",
+        "DROP KEYSPACE archive;",
+    }
+    if (err != nil || len(migs) != len(queries)) {
+        t.Fatal(
+            "For", "DiffMigrations(from.json, to.json)",
+            "expected", queries,
+            "got", migs, err,
+        )
+    }
+    for i, mig := range migs {
+        if (mig.Query != queries[i]) {
+            t.Error(
+                "For", "migration query",
+                "\nexpected", queries[i],
+                "\n     got", mig.Query,
+            )
+        }
+    }
+
+    // differences exit as drift does
+    Opts.Diff = []string{ "test/schemas/diff/from.json", "test/schemas/diff/to.json" }
+    Opts.JsonDiff = true
+    if code := handleDiff() ; code != EXIT_DRIFT {
+        t.Error(
+            "For", "--diff from.json --diff to.json",
+            "expected", EXIT_DRIFT,
+            "got", code,
+        )
+    }
+    Opts.Diff = []string{ "test/schemas/diff/to.json", "test/schemas/diff/to.json" }
+    if code := handleDiff() ; code != EXIT_APPLIED {
+        t.Error(
+            "For", "--diff to.json --diff to.json",
+            "expected", EXIT_APPLIED,
+            "got", code,
+        )
+    }
+    Opts.Diff = []string{ "test/schemas/diff/to.json" }
+    if code := handleDiff() ; code != EXIT_FAILED {
+        t.Error(
+            "For", "--diff given once",
+            "expected", EXIT_FAILED,
+            "got", code,
+        )
+    }
+    Opts.Diff = nil
+    Opts.JsonDiff = false
+
+    // identical schemas need no migrations
+    if migs, err = DiffMigrations(from, from) ; err != nil || len(migs) != 0 {
+        t.Error(
+            "For", "DiffMigrations(from.json, from.json)",
+            "expected", "no migrations",
+            "got", migs, err,
+        )
+    }
+}
+
 func TestDescribeUsers(t *testing.T) {
     Opts.Describe = "cmm_main.users"
 
-    var output = Describe(Opts.Describe)
+    var output, describeErr = Describe(Opts.Describe)
+    if (describeErr != nil) {
+        t.Error(
+            "For", "Describe(" + Opts.Describe + ")",
+            "expected", nil,
+            "got", describeErr,
+        )
+    }
+
     var known, err = ioutil.ReadFile("test/outputs/cmm_main.users.json")
     if err != nil {
         fmt.Printf("Error while loading expected output of DESCRIBE cmm_main.users:\n%s\n\n", err)
@@ -416,6 +1177,176 @@ func TestDescribeUsers(t *testing.T) {
 }
 
 
+func TestDescribeCQL(t *testing.T) {
+    var schema = []string{
+        "CREATE KEYSPACE cmm_describe WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 }",
+        "CREATE TYPE cmm_describe.address (street TEXT, zip INT)",
+        "CREATE TABLE cmm_describe.events (tenant TEXT, day TEXT, at TIMEUUID, seq INT, owner TEXT STATIC, tags MAP<TEXT, TEXT>, PRIMARY KEY ((tenant, day), at, seq)) WITH CLUSTERING ORDER BY (at DESC, seq ASC)",
+        "CREATE INDEX ON cmm_describe.events (keys(tags))",
+    }
+    for _, statement := range schema {
+        if err := Session.Query(statement).Exec() ; err != nil {
+            t.Fatal(
+                "For", statement,
+                "expected", nil,
+                "got", err,
+            )
+        }
+    }
+
+    var expected = strings.Join([]string{
+        "CREATE KEYSPACE cmm_describe WITH replication = {'class': 'SimpleStrategy', 'replication_factor': '1'} AND durable_writes = true;",
+        "CREATE TYPE cmm_describe.address (\n    street TEXT,\n    zip INT\n);",
+        "CREATE TABLE cmm_describe.events (\n    tenant TEXT,\n    day TEXT,\n    at TIMEUUID,\n    seq INT,\n    owner TEXT STATIC,\n    tags MAP<TEXT, TEXT>,\n    PRIMARY KEY ((tenant, day), at, seq)\n) WITH CLUSTERING ORDER BY (at DESC, seq ASC);",
+        "CREATE INDEX events_tags_idx ON cmm_describe.events (keys(tags));",
+    }, "\n\n")
+
+    var output, err = DescribeCQL("cmm_describe")
+    if (err != nil || output != expected) {
+        t.Error(
+            "For", "DescribeCQL(cmm_describe)",
+            "\nexpected", expected,
+            "\n     got", output, err,
+        )
+    }
+
+    // the statements recreate the same keyspace
+    Session.Query("DROP KEYSPACE cmm_describe").Exec()
+    for _, statement := range strings.Split(output, ";\n\n") {
+        if err = Session.Query(statement).Exec() ; err != nil {
+            t.Error(
+                "For", statement,
+                "expected", nil,
+                "got", err,
+            )
+        }
+    }
+
+    if recreated, _ := DescribeCQL("cmm_describe") ; recreated != output {
+        t.Error(
+            "For", "DescribeCQL after running its statements",
+            "\nexpected", output,
+            "\n     got", recreated,
+        )
+    }
+
+    Session.Query("DROP KEYSPACE cmm_describe").Exec()
+}
+
+
+func TestReplication(t *testing.T) {
+    var replication, err = ParseReplication("class:NetworkTopologyStrategy, dc1:3,dc2:2")
+    if (err != nil) {
+        t.Error(
+            "For", "ParseReplication",
+            "expected", nil,
+            "got", err,
+        )
+    }
+    var expected = "{ 'class' : 'NetworkTopologyStrategy', 'dc1' : '3', 'dc2' : '2' }"
+
+    if literal := migrate.ReplicationLiteral(replication) ; literal != expected {
+        t.Error(
+            "For", "ReplicationLiteral",
+            "expected", expected,
+            "got", literal,
+        )
+    }
+}
+
+
+func TestRollback(t *testing.T) {
+    var last = Migrator.Migrations[len(Migrator.Migrations) - 1]
+    if (len(last.Down) == 0) {
+        t.Error(
+            "For", "len(" + last.Name + ".Down)",
+            "expected", ">0",
+            "got", len(last.Down),
+        )
+    }
+
+    // a migration is named as Up names its target: whole, without .cql, or by a unique prefix
+    var previous = Migrator.Migrations[len(Migrator.Migrations) - 2]
+    var complete, _, _ = Migrator.Status()
+    for _, target := range []string{ previous.Name, strings.TrimSuffix(previous.Name, ".cql"), previous.Name[:16] } {
+        if reverting, err := migrate.RollbackTargets(Migrator.Migrations, complete, target) ; len(reverting) != 1 || reverting[0].Name != last.Name || err != nil {
+            t.Error(
+                "For", "RollbackTargets(" + target + ")",
+                "expected", last.Name,
+                "got", reverting, err,
+            )
+        }
+    }
+    if _, err := migrate.RollbackTargets(Migrator.Migrations, complete, "2014-03-02T") ; err == nil {
+        t.Error(
+            "For", "RollbackTargets(2014-03-02T)",
+            "expected", "an error, it matches three migrations",
+            "got", err,
+        )
+    }
+
+    if reverted, err := Migrator.Down(context.Background(), "1") ; reverted != 1 || err != nil {
+        t.Error(
+            "For", "Migrator.Down(1)",
+            "expected", 1,
+            "got", reverted, err,
+        )
+    }
+
+    if complete, err := Migrator.IsComplete(last) ; complete {
+        t.Error(
+            "For", "Rolled back: " + last.Name,
+            "expected", false,
+            "got", complete,
+        )
+    } else if (err != nil) {
+        t.Error(
+            "For", "Rollback completion error",
+            "expected", nil,
+            "got", err,
+        )
+    }
+}
+
+
+func TestOutOfOrder(t *testing.T) {
+    // the rollback above left only the last migration pending, which is in order
+    if pending, _, err := Migrator.OutOfOrder(Migrator.Migrations) ; len(pending) != 0 || err != nil {
+        t.Error(
+            "For", "OutOfOrder after rollback",
+            "expected", 0,
+            "got", len(pending), err,
+        )
+    }
+
+    // pretend an older migration was merged late
+    var late = append(migrate.MigrationCollection{ migrate.Migration{ Name: "2014-03-01T00-00-00.000Z_merged_late.cql" } }, Migrator.Migrations...)
+    if pending, latest, _ := Migrator.OutOfOrder(late) ; len(pending) != 1 || latest != Migrator.Migrations[2].Name {
+        t.Error(
+            "For", "OutOfOrder with a late migration",
+            "expected", "1, " + Migrator.Migrations[2].Name,
+            "got", len(pending), latest,
+        )
+    }
+}
+
+
+func TestBaseline(t *testing.T) {
+    // the rollback above left the last migration pending
+    var last = Migrator.Migrations[len(Migrator.Migrations) - 1]
+
+    Migrator.Baseline(last.Name, true)
+
+    if complete, err := Migrator.IsComplete(last) ; !complete || err != nil {
+        t.Error(
+            "For", "Baselined: " + last.Name,
+            "expected", true,
+            "got", complete, err,
+        )
+    }
+}
+
+
 func TestClose(t *testing.T) {
     var keyErr = Session.Query(`DROP KEYSPACE cmm_main`).Exec()
     if keyErr != nil {
@@ -426,8 +1357,8 @@ func TestClose(t *testing.T) {
         )
     }
 
-    for _, mig := range Migrations {
-        if err := Session.Query(`DELETE FROM migrations.completed WHERE name = ?`, mig.Name).Exec() ; err != nil {
+    for _, mig := range Migrator.Migrations {
+        if err := Session.Query(`DELETE FROM ` + Migrator.CompletedTable() + ` WHERE name = ?`, mig.Name).Exec() ; err != nil {
             t.Error(
                 "For", "Remove completion of: " + mig.Name,
                 "expected", nil,
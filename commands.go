@@ -3,11 +3,14 @@ package main
 import (
     "os"
     "fmt"
+    "sort"
     "strings"
+    "strconv"
     "io/ioutil"
     "encoding/json"
 
     "github.com/zmarcantel/cmm/db"
+    "github.com/zmarcantel/cmm/migrate"
 
     "github.com/aybabtme/color/brush"
 )
@@ -18,143 +21,412 @@ import (
 //      Returns a JSON string representation of the item
 //      Can be "", "all", "none", "keyspace", "keyspace.table"
 //
-func Describe(target string) string {
+func Describe(target string) (string, error) {
+    var described, err = describe(target)
+    if (err != nil) {
+        return "", err
+    }
+
     var result []byte
-    var err error
+    if result, err = json.MarshalIndent(described, "", "    ") ; err != nil {
+        return "", fmt.Errorf("invalid internal json representation: %s", err)
+    }
+
+    var formatted = strings.Replace(string(result), "\\u003c", "<", -1)
+    formatted = strings.Replace(formatted, "\\u003e", ">", -1)
+
+    return formatted, nil
+}
+
+
+//
+//  DescribeCQL
+//      Describe the given keyspace(s) or tables as the CQL statements that recreate them
+//      Takes the same targets as Describe, "all" leaves out the system keyspaces
+//
+func DescribeCQL(target string) (string, error) {
+    var described, err = describe(target)
+    if (err != nil) {
+        return "", err
+    }
+
+    switch item := described.(type) {
+        case []db.KeyspaceDescriptor:
+            var statements []string
+            for _, keyspace := range item {
+                if (keyspace.Name == "system" || strings.HasPrefix(keyspace.Name, "system_")) { continue }
+                statements = append(statements, keyspace.CQL())
+            }
+            return strings.Join(statements, "\n\n"), nil
+
+        case db.KeyspaceDescriptor:
+            return item.CQL(), nil
+
+        default:
+            return described.(db.TableDescriptor).CQL(), nil
+    }
+}
 
+
+//
+//  describe
+//      Look up the descriptor(s) of a Describe target
+//
+func describe(target string) (interface{}, error) {
     if (target == "" || target == "all") {    // "all", or just --describe
         var keyspaces, err = db.AllKeyspaces()
         if (err != nil) {
-            if (err.Error() == "not found") {
-                fmt.Println("That kayspace does not exist.")
-            } else {
-                fmt.Printf("ERROR: could not get keyspace:\n%s\n", err)
-            }
-            os.Exit(1)
+            return nil, fmt.Errorf("could not get keyspaces: %s", err)
         }
-        result, err = json.MarshalIndent(keyspaces, "", "    ")
+        return keyspaces, nil
 
     } else if (strings.Index(target, ".") > 0) {     // keyspace.table pair
         var parts = strings.Split(target, ".")
         var table, err = db.Table(parts[0], parts[1])
         if (err != nil) {
             if (err.Error() == "not found") {
-                fmt.Println("That columnfamily does not exist.")
-            } else {
-                fmt.Printf("ERROR: could not get columnfamily:\n%s\n", err)
+                return nil, migrate.ErrNotFound{ Kind: "columnfamily", Name: target }
             }
-            os.Exit(1)
+            return nil, fmt.Errorf("could not get columnfamily: %s", err)
         }
-        result, err = json.MarshalIndent(table, "", "    ")
-
-    } else {                                                // default to keyspace
-        var keyspace, err = db.Keyspace(target)
-        if (err != nil) {
-            if (err.Error() == "not found") {
-                fmt.Println("That columnfamily does not exist.")
-            } else {
-                fmt.Printf("ERROR: could not get columnfamily:\n%s\n", err)
-            }
-            os.Exit(1)
-        }
-        result, err = json.MarshalIndent(keyspace, "", "    ")
+        return table, nil
     }
 
-    if err != nil {
-        fmt.Printf("ERROR: invalid internal json representation\n%s\n", err)
-        os.Exit(1)
+    // default to keyspace
+    var keyspace, err = db.Keyspace(target)
+    if (err != nil) {
+        if (err.Error() == "not found") {
+            return nil, migrate.ErrNotFound{ Kind: "keyspace", Name: target }
+        }
+        return nil, fmt.Errorf("could not get keyspace: %s", err)
     }
-
-    var formatted = strings.Replace(string(result), "\\u003c", "<", -1)
-    formatted = strings.Replace(formatted, "\\u003e", ">", -1)
-
-    return formatted
+    return keyspace, nil
 }
 
 
 //
 //  Backfill
 //      Generation of migrations that bring the current table/keyspace format to equal a JSON descriptor
+//      A keyspace is given without a table, its JSON is read by TargetKeyspace
 //
-func Backfill(collection, target string) MigrationCollection {
+func Backfill(collection, target string) (migrate.MigrationCollection, error) {
     if (len(target) <= 0) {
-        fmt.Println("ERROR: must supply (-f, --file) flag to backfill")
-        os.Exit(1)
+        return nil, migrate.ErrConfig{ Option: "backfill", Reason: "must supply (-f, --file) flag to backfill" }
     }
 
-    if (strings.Index(collection, ".") < 1) {
-        fmt.Println("ERROR: backfill can only be used on {keyspace}.{table} items")
-        os.Exit(1)
+    if (strings.Index(collection, ".") == 0 || strings.HasSuffix(collection, ".")) {
+        return nil, migrate.ErrConfig{ Option: "backfill", Reason: "backfill can only be used on {keyspace} or {keyspace}.{table} items" }
     }
 
     // read target JSON
     var contents, err = ioutil.ReadFile(target)
     if (err != nil) {
-        fmt.Printf("ERROR: could not read descriptor JSON:\n%s\n\n", err)
-        os.Exit(1)
+        return nil, fmt.Errorf("could not read descriptor JSON: %s", err)
     }
 
     // unmarshal target JSON
     var targetJSON map[string]interface{}
     var jsonErr = json.Unmarshal(contents, &targetJSON)
     if (jsonErr != nil) {
-        fmt.Printf("ERROR: could not parse descriptor JSON:\n%s\n\n", jsonErr)
-        os.Exit(1)
+        return nil, fmt.Errorf("could not parse descriptor JSON: %s", jsonErr)
     }
 
     // remove any comments of the suggested form
     delete(targetJSON, "_")
 
-    // create the placeholder for the result migrations
-    var migrations MigrationCollection
+    // a keyspace, along with its tables
+    if (strings.Index(collection, ".") < 0) {
+        var keyspace, ksErr = db.Keyspace(collection)
+        if (ksErr != nil) {
+            if (ksErr.Error() != "not found") {
+                return nil, fmt.Errorf("could not get keyspace [%s]: %s", collection, ksErr)
+            }
+            return CreateKeyspaceMigration(collection, targetJSON)
+        }
+
+        return BackfillKeyspace(keyspace, targetJSON)
+    }
 
     // get existing table
     var parts = strings.Split(collection, ".")
     var table, tblErr = db.Table(parts[0], parts[1])
     if (tblErr != nil) {
-        if (tblErr.Error() == "not found") {
-            migrations = CreateTableMigration(parts[0], parts[1], targetJSON)
-        } else {
-            os.Exit(1)
+        if (tblErr.Error() != "not found") {
+            return nil, fmt.Errorf("could not get columnfamily [%s]: %s", collection, tblErr)
         }
-    } else {
-        migrations = BackfillTable(table, targetJSON)
+        return CreateTableMigration(parts[0], parts[1], targetJSON)
     }
 
-    return migrations
+    return BackfillTable(table, targetJSON)
+}
+
+
+//
+//  Generate
+//      Generation of the migrations that bring the cluster to the schema declared by a directory of descriptor files
+//      Only the keyspaces the files declare are compared, see LoadSchema and SchemaMigrations
+//
+func Generate(directory string) (migrate.MigrationCollection, error) {
+    var desired, err = LoadSchema(directory)
+    if (err != nil) {
+        return nil, err
+    }
+
+    var current []db.KeyspaceDescriptor
+    if current, err = db.AllKeyspaces() ; err != nil {
+        return nil, fmt.Errorf("could not get keyspaces: %s", err)
+    }
+
+    var migs, schemaErr = SchemaMigrations(current, desired)
+    // tables are compared as backfill compares them, but the error is one of this command
+    if config, isConfig := schemaErr.(migrate.ErrConfig) ; isConfig {
+        config.Option = "generate"
+        return nil, config
+    }
+    return migs, schemaErr
+}
+
+
+//
+//  Unlock
+//      Remove a stale migration lock instead of running anything
+//      The migrations are never loaded, so a missing or broken directory does not stand in the way
+//
+func Unlock() error {
+    if err := Migrator.Init() ; err != nil {
+        return err
+    }
+    return Migrator.ForceUnlock()
 }
 
 
 //
 //  List
 //      Return lists of completed and remaining migrations
-//      JSON flag determines if output is JSON
+//      They are only printed when the JSON flag is not set
 //
-func List(isJson bool) (complete MigrationCollection, remaining MigrationCollection) { // should explicitly be passed Opts.JsonList
-    GetMigrationFiles(Opts.Migrations)
+func List(isJson bool) (complete migrate.MigrationCollection, remaining migrate.MigrationCollection, err error) { // should explicitly be passed Opts.JsonList
+    if err = loadMigrations() ; err != nil {
+        return
+    }
 
-    for _, mig := range Migrations {
-        var isComplete, err = mig.IsComplete()
-        if (err != nil) {
-            fmt.Printf("ERROR: error checking completion status of [%s]\n%s\n\n", mig.Name, err)
+    complete, remaining, err = Migrator.Status()
+    if (err != nil || isJson) {
+        return
+    }
+
+    for _, mig := range complete {
+        fmt.Printf("%5s  %s%s\n", brush.Green("+"), brush.Green(mig.Name), goMarker(mig))
+    }
+    for _, mig := range remaining {
+        fmt.Printf("%5s  %2s%s\n", brush.Red("-"), brush.Red(mig.Name), goMarker(mig))
+    }
+
+    // show where the target splits the migrations
+    if (len(Opts.Target) > 0) {
+        var last int
+        if last, err = Migrator.TargetIndex(Opts.Target) ; err != nil {
             return
         }
+        fmt.Printf("\nTarget: %s\n", Migrator.Migrations[last].Name)
+        for _, mig := range Migrator.Migrations[last + 1:] {
+            fmt.Printf("%5s  %s\n", brush.DarkGray(">"), brush.DarkGray(mig.Name))
+        }
+    }
+
+    return complete, remaining, nil
+}
+
+//
+//  goMarker
+//      Tags Go migrations in the list, they have no file to look at
+//
+func goMarker(mig migrate.Migration) string {
+    if (mig.Func == nil) { return "" }
+    return fmt.Sprintf("  %s", brush.DarkGray("(go)"))
+}
+
+
+//
+//  PrintPlan
+//      Print a human readable report of the plan
+//
+func PrintPlan(self migrate.MigrationPlan) {
+    if (len(self.Target) > 0) {
+        fmt.Printf("Target: %s\n", self.Target)
+    }
+
+    if (len(self.Reverting) > 0) {
+        fmt.Printf("%d migrations to revert\n", len(self.Reverting))
+        printPlanned(self.Reverting, true)
+        fmt.Println()
+    }
+
+    fmt.Printf("%d pending migrations\n", len(self.Pending))
+    printPlanned(self.Pending, false)
+
+    if (len(self.OutOfOrder) > 0) {
+        fmt.Printf("\n%d pending migrations sort before the latest applied one (--order %s)\n", len(self.OutOfOrder), Migrator.Options.Order)
+        for _, name := range self.OutOfOrder {
+            fmt.Printf("    %s\n", brush.Red(name))
+        }
+    }
+
+    if (len(self.AfterTarget) > 0) {
+        fmt.Printf("\n%d pending migrations after the target are not applied\n", len(self.AfterTarget))
+        for _, name := range self.AfterTarget {
+            fmt.Printf("    %s\n", brush.DarkGray(name))
+        }
+    }
+}
 
-        if (isComplete == false) {
-            remaining = append(remaining, mig)
+func printPlanned(migrations []migrate.PlannedMigration, reverting bool) {
+    for _, mig := range migrations {
+        if (reverting) {
+            fmt.Printf("\n%s\n", brush.Red(mig.Name))
         } else {
-            complete = append(complete, mig)
+            fmt.Printf("\n%s\n", brush.Yellow(mig.Name))
+        }
+        fmt.Printf("    Path:  %s\n", mig.Path)
+        fmt.Printf("    Delay: %dms\n", mig.Delay)
+        if (mig.Go) {
+            fmt.Printf("    Runs the Go function registered at its path\n")
+        }
+
+        for _, statement := range mig.Statements {
+            fmt.Printf("    [%d:%d] %s\n", statement.Line, statement.Column, strings.Replace(statement.Query, "\n", "\n        ", -1))
         }
     }
+}
 
-    for _, mig := range complete {
-        fmt.Printf("%5s  %s\n", brush.Green("+"), brush.Green(mig.Name))
+
+//
+//  PlanToJSON
+//      Return the JSON string representation of the plan
+//
+func PlanToJSON(plan migrate.MigrationPlan) (string, error) {
+    var formatted, err = json.MarshalIndent(plan, "", "    ")
+    if (err != nil) {
+        return "", fmt.Errorf("could not marshal JSON of --plan.json: %s", err)
     }
-    for _, mig := range remaining {
-        fmt.Printf("%5s  %2s\n", brush.Red("-"), brush.Red(mig.Name))
+
+    var result = strings.Replace(string(formatted), "\\u003c", "<", -1)
+    return strings.Replace(result, "\\u003e", ">", -1), nil
+}
+
+
+//
+//  PrintDrift
+//      Print a report of the drift, one migration per line
+//
+func PrintDrift(self migrate.Drift) {
+    for _, name := range self.Modified {
+        fmt.Printf("%5s  %s\n", brush.Red("M"), brush.Red(name))
+    }
+    for _, name := range self.Missing {
+        fmt.Printf("%5s  %s\n", brush.Red("D"), brush.Red(name))
+    }
+    for _, name := range self.Unknown {
+        fmt.Printf("%5s  %s\n", brush.Yellow("?"), brush.Yellow(name))
+    }
+    for _, name := range self.Unverified {
+        fmt.Printf("%5s  %s\n", brush.DarkGray("~"), brush.DarkGray(name))
+    }
+
+    if (self.Found()) {
+        fmt.Printf("Drift detected: %d modified, %d missing on disk, %d pending\n", len(self.Modified), len(self.Missing), len(self.Unknown))
+    } else {
+        fmt.Printf("No drift detected, %d pending\n", len(self.Unknown))
+    }
+}
+
+
+//
+//  PrintDiff
+//      Print the differences between two schemas, one per line, with what each was and became
+//      Values spanning lines, such as the body of a function, are left to --diff.json
+//
+func PrintDiff(changes []SchemaChange) {
+    var counts = make(map[string]int)
+    for _, change := range changes {
+        counts[change.Change]++
+
+        var values = change.From + change.To
+        if (len(change.From) > 0 && len(change.To) > 0) {
+            values = change.From + " -> " + change.To
+        }
+        if (strings.Contains(values, "\n")) { values = "" }
+
+        switch (change.Change) {
+            case "added":
+                fmt.Printf("%5s  %-14s  %s  %s\n", brush.Green("+"), change.Kind, brush.Green(change.Name), values)
+            case "removed":
+                fmt.Printf("%5s  %-14s  %s  %s\n", brush.Red("-"), change.Kind, brush.Red(change.Name), values)
+            default:
+                fmt.Printf("%5s  %-14s  %s  %s\n", brush.Yellow("~"), change.Kind, brush.Yellow(change.Name), values)
+        }
+    }
+
+    if (len(changes) > 0) {
+        fmt.Printf("Schemas differ: %d added, %d removed, %d changed\n", counts["added"], counts["removed"], counts["changed"])
+    } else {
+        fmt.Println("No differences")
+    }
+}
+
+
+//
+//  DiffToJSON
+//      Return the JSON string representation of the differences between two schemas
+//
+func DiffToJSON(changes []SchemaChange) (string, error) {
+    var formatted, err = json.MarshalIndent(changes, "", "    ")
+    if (err != nil) {
+        return "", fmt.Errorf("could not marshal JSON of --diff.json: %s", err)
     }
 
-    return complete, remaining
+    var result = strings.Replace(string(formatted), "\\u003c", "<", -1)
+    return strings.Replace(result, "\\u003e", ">", -1), nil
+}
+
+
+//
+//  PrintHistory
+//      Print the history as a table, one migration per line
+//
+func PrintHistory(self migrate.History) {
+    var format = "%-24s  %9s  %-12s  %-20s  %-8s  %5s  %s\n"
+    fmt.Printf(format, "DATE", "DURATION", "BY", "HOST", "VERSION", "STMTS", "NAME")
+
+    for _, entry := range self {
+        var duration, statements = "-", "-"
+        if (entry.Version != "") {
+            duration = fmt.Sprintf("%dms", entry.Duration)
+            statements = strconv.Itoa(entry.Statements)
+        }
+
+        fmt.Printf(format,
+            entry.Date.UTC().Format("2006-01-02 15:04:05.000"), duration, orDash(entry.AppliedBy),
+            orDash(entry.Host), orDash(entry.Version), statements, entry.Name)
+    }
+}
+
+
+//
+//  HistoryToJSON
+//      Return the JSON string representation of the history
+//
+func HistoryToJSON(history migrate.History) (string, error) {
+    var formatted, err = json.MarshalIndent(history, "", "    ")
+    if (err != nil) {
+        return "", fmt.Errorf("could not marshal JSON of --history.json: %s", err)
+    }
+    return string(formatted), nil
+}
+
+func orDash(value string) string {
+    if (len(value) == 0) { return "-" }
+    return value
 }
 
 
@@ -162,73 +434,192 @@ func List(isJson bool) (complete MigrationCollection, remaining MigrationCollect
 //      Return the JSON string representation of the List functions
 //      Simply marshals the structure into a JSON map of 'Complete' and 'Remaining' arrays
 //
-func ListToJSON(complete, remaining MigrationCollection) string {
-    var formatted, err = json.MarshalIndent(map[string][]Migration{
+func ListToJSON(complete, remaining migrate.MigrationCollection) (string, error) {
+    var list = map[string]interface{}{
         "Complete":       complete,
         "Remaining":      remaining,
-    }, "", "    ")
+    }
+
+    // names of the migrations falling after the target
+    if (len(Opts.Target) > 0) {
+        var last, err = Migrator.TargetIndex(Opts.Target)
+        if (err != nil) {
+            return "", err
+        }
+
+        var after = make([]string, 0)
+        for _, mig := range Migrator.Migrations[last + 1:] {
+            after = append(after, mig.Name)
+        }
+        list["AfterTarget"] = after
+    }
+
+    var formatted, err = json.MarshalIndent(list, "", "    ")
     if (err != nil) {
-        fmt.Printf("ERROR: could not marshal JSON of --list\n%s\n\n", err)
-        os.Exit(1)
+        return "", fmt.Errorf("could not marshal JSON of --list: %s", err)
     }
-    return string(formatted)
+    return string(formatted), nil
 }
 
 
 //
 //  BackfillTable
 //    Generates a series of queries that equate to the diff of the current table, and a given JSON
+//    Changes to the primary key cannot be made by a migration and are an error
+//    Only the table options the JSON gives are compared, the others are left as they are
 //
-func BackfillTable(table db.TableDescriptor, target map[string]interface{}) []Migration {
-    var result []Migration
+func BackfillTable(table db.TableDescriptor, target map[string]interface{}) (migrate.MigrationCollection, error) {
+    var desired, err = TargetTable(table.Keyspace, table.Name, target)
+    if (err != nil) {
+        return nil, err
+    }
 
-    // check for additions
-    for key, value := range target {
-        var found = false
-        var col db.ColumnDescriptor
-        for _, col = range table.Columns {
-            if (col.Name == key) {
-                found = true
-
-                // multitask and look for changed type
-                // convert types to upper case for ease
-                var upperKnown = strings.ToUpper(col.Type)
-                var upperTesting = strings.ToUpper(value.(string))
-                if (upperKnown != upperTesting) {
-                    // handle the PRIMARY KEY part a little differently
-                    if (col.Primary) {
-                        var trimmedTesting = upperTesting[:len(upperTesting) - len(" PRIMARY KEY")]
-                        if (upperKnown == trimmedTesting) { continue }
-                    }
-                    result = append(result, ChangeTypeMigration(table, col.Name, value.(string)))
-                }
-
-                // escape for loop
-                break
-            }
+    return AlterTable(table, desired)
+}
+
+
+//
+//  AlterTable
+//    The migrations adding, removing or changing the type of columns and setting options
+//    that turn the current table into the desired one
+//
+func AlterTable(table, desired db.TableDescriptor) (migrate.MigrationCollection, error) {
+    var result migrate.MigrationCollection
+
+    // cassandra cannot alter the key of a table, it has to be recreated
+    if (keyDefinition(table) != keyDefinition(desired)) {
+        return nil, migrate.ErrConfig{
+            Option: "backfill",
+            Reason: fmt.Sprintf("cannot change the PRIMARY KEY of %s.%s from %s to %s", table.Keyspace, table.Name, keyDefinition(table), keyDefinition(desired)),
         }
+    }
 
+    // check for additions
+    for _, column := range desired.Columns {
+        var existing, found = table.Column(column.Name)
         if (!found) {
-            result = append(result, CreationMigration(table, key, value.(string)))
+            var definition = column.Type
+            if (column.Kind == "static") { definition += " STATIC" }
+            result = append(result, CreationMigration(table, column.Name, definition))
+            continue
+        }
+
+        // neither can a column become static, or stop being static
+        if ((existing.Kind == "static") != (column.Kind == "static")) {
+            return nil, migrate.ErrConfig{ Option: "backfill", Reason: fmt.Sprintf("cannot change whether %s.%s.%s is STATIC", table.Keyspace, table.Name, column.Name) }
+        }
+
+        // multitask and look for changed type
+        // compare parsed types so case and spacing do not count, MAP<UUID,FLOAT> is map<uuid, float>
+        if (!db.SameType(existing.Type, column.Type)) {
+            result = append(result, ChangeTypeMigration(table, column.Name, column.Type))
         }
     }
 
 
     // check for removals
     for _, col := range table.Columns {
-        var found = false
-        for key, _ := range target {
-            if (col.Name == key) {
-                found = true
-                break
-            }
+        if _, found := desired.Column(col.Name) ; !found {
+            result = append(result, RemovalMigration(table, col.Name))
         }
+    }
 
-        if (!found) {
-            result = append(result, RemovalMigration(table, col.Name))
+
+    // check for changed options
+    var options []string
+    for name := range desired.Options {
+        options = append(options, name)
+    }
+    sort.Strings(options)
+
+    for _, name := range options {
+        if (!db.SameOption(name, table.Options[name], desired.Options[name])) {
+            result = append(result, OptionMigration(table, name, desired.Options[name]))
+        }
+    }
+
+
+    return result, nil
+}
+
+
+//
+//  keyDefinition
+//      The primary key of a table with the order of its clustering columns, e.g. (a, b) (b DESC)
+//
+func keyDefinition(table db.TableDescriptor) string {
+    return strings.TrimSpace(table.PrimaryKey() + " " + table.ClusteringOrder())
+}
+
+
+//
+//  BackfillKeyspace
+//      Generates the migrations altering the replication or durable writes of a keyspace to those of a given JSON
+//      followed by those backfilling or creating each of its tables
+//      Tables the JSON leaves out of its list are only dropped when it sets "drop_missing", otherwise they are warned about
+//
+func BackfillKeyspace(keyspace db.KeyspaceDescriptor, target map[string]interface{}) (migrate.MigrationCollection, error) {
+    var result migrate.MigrationCollection
+
+    var desired, tables, dropMissing, err = TargetKeyspace(keyspace.Name, target)
+    if (err != nil) {
+        return nil, err
+    }
+
+    if replication, durable := keyspaceChanges(keyspace, desired) ; replication || durable {
+        result = append(result, AlterKeyspaceMigration(desired, replication, durable))
+    }
+
+    // without a list of tables they are left as they are
+    if (tables == nil) {
+        return result, nil
+    }
+
+    var existing = make(map[string]db.TableDescriptor)
+    for _, table := range keyspace.Tables {
+        existing[table.Name] = table
+    }
+
+    for _, name := range sortedKeys(tables) {
+        var migs migrate.MigrationCollection
+        if table, found := existing[name] ; found {
+            migs, err = BackfillTable(table, tables[name])
+        } else {
+            migs, err = CreateTableMigration(keyspace.Name, name, tables[name])
         }
+        if (err != nil) {
+            return nil, err
+        }
+        result = append(result, migs...)
     }
 
+    // a partial list should not quietly drop the rest
+    for _, table := range keyspace.Tables {
+        if _, found := tables[table.Name] ; found {
+            continue
+        }
+
+        if (dropMissing) {
+            result = append(result, DropTableMigration(table))
+        } else {
+            fmt.Fprintf(os.Stderr, "WARNING: table [%s.%s] is not in the schema, set \"drop_missing\" to drop it\n", table.Keyspace, table.Name)
+        }
+    }
+
+    return result, nil
+}
+
+//
+//  keyspaceChanges
+//      Whether the replication and durable writes of the keyspace differ from the desired ones
+//      The class may be given with or without its package, the options are compared as strings
+//
+func keyspaceChanges(keyspace, desired db.KeyspaceDescriptor) (replication bool, durable bool) {
+    replication = strings.TrimPrefix(keyspace.Class, db.LOCATOR_PACKAGE) != strings.TrimPrefix(desired.Class, db.LOCATOR_PACKAGE) ||
+        len(keyspace.Options) != len(desired.Options)
+    for key, value := range desired.Options {
+        if (fmt.Sprint(keyspace.Options[key]) != fmt.Sprint(value)) { replication = true }
+    }
 
-    return result
+    return replication, keyspace.DurableWrites != desired.DurableWrites
 }
\ No newline at end of file
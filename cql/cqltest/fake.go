@@ -0,0 +1,3180 @@
+//
+//  Package cqltest
+//      An in-memory cql.Session that understands the CQL cmm runs, so the suite needs no cluster
+//      Only tests import it, nothing built from cmm carries it
+//
+//      var fake = cqltest.NewFake()
+//      var migrator = migrate.New(fake, migrate.DefaultOptions())
+//
+package cqltest
+
+import (
+    "fmt"
+    "sort"
+    "bytes"
+    "sync"
+    "time"
+    "reflect"
+    "strconv"
+    "strings"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/binary"
+
+    "github.com/tux21b/gocql"
+
+    "github.com/zmarcantel/cmm/cql"
+)
+
+// marshal classes cassandra reports as the validator of each CQL type
+var MARSHAL_TYPES = map[string]string{
+    "ascii":        "AsciiType",
+    "bigint":       "LongType",
+    "blob":         "BytesType",
+    "boolean":      "BooleanType",
+    "counter":      "CounterColumnType",
+    "decimal":      "DecimalType",
+    "double":       "DoubleType",
+    "float":        "FloatType",
+    "inet":         "InetAddressType",
+    "int":          "Int32Type",
+    "text":         "UTF8Type",
+    "timestamp":    "TimestampType",
+    "timeuuid":     "TimeUUIDType",
+    "uuid":         "UUIDType",
+    "varchar":      "UTF8Type",
+    "varint":       "IntegerType",
+    "list":         "ListType",
+    "set":          "SetType",
+    "map":          "MapType",
+    "frozen":       "FrozenType",
+    "tuple":        "TupleType",
+}
+
+// how many types each parameterized type takes, -1 for at least one
+var TYPE_PARAMS = map[string]int{
+    "list":     1,
+    "set":      1,
+    "map":      2,
+    "frozen":   1,
+    "tuple":    -1,
+}
+
+const COMPACTION_PACKAGE = "org.apache.cassandra.db.compaction."
+const COMPRESSION_PACKAGE = "org.apache.cassandra.io.compress."
+const MARSHAL_PACKAGE = "org.apache.cassandra.db.marshal."
+
+// the system tables of every fake node, their rows are built from the fake's state
+var SYSTEM_TABLES = []string{
+    `CREATE TABLE system.local (
+        key                 TEXT PRIMARY KEY,
+        broadcast_address   INET,
+        cluster_name        TEXT,
+        cql_version         TEXT,
+        data_center         TEXT,
+        partitioner         TEXT,
+        rack                TEXT,
+        release_version     TEXT,
+        schema_version      UUID
+    )`,
+    `CREATE TABLE system.peers (
+        peer                INET PRIMARY KEY,
+        data_center         TEXT,
+        rack                TEXT,
+        release_version     TEXT,
+        rpc_address         INET,
+        schema_version      UUID
+    )`,
+}
+
+// the schema tables of a cassandra 2.x node
+var LEGACY_SCHEMA_TABLES = []string{
+    `CREATE TABLE system.schema_keyspaces (
+        keyspace_name       TEXT PRIMARY KEY,
+        durable_writes      BOOLEAN,
+        strategy_class      TEXT,
+        strategy_options    TEXT
+    )`,
+    `CREATE TABLE system.schema_columnfamilies (
+        keyspace_name       TEXT,
+        columnfamily_name   TEXT,
+        bloom_filter_fp_chance DOUBLE,
+        caching             TEXT,
+        comment             TEXT,
+        compaction_strategy_class TEXT,
+        compaction_strategy_options TEXT,
+        compression_parameters TEXT,
+        default_time_to_live INT,
+        gc_grace_seconds    INT,
+        max_compaction_threshold INT,
+        min_compaction_threshold INT,
+        PRIMARY KEY (keyspace_name, columnfamily_name)
+    )`,
+    `CREATE TABLE system.schema_columns (
+        keyspace_name       TEXT,
+        columnfamily_name   TEXT,
+        column_name         TEXT,
+        component_index     INT,
+        index_name          TEXT,
+        index_options       TEXT,
+        index_type          TEXT,
+        type                TEXT,
+        validator           TEXT,
+        PRIMARY KEY (keyspace_name, columnfamily_name, column_name)
+    )`,
+    `CREATE TABLE system.schema_usertypes (
+        keyspace_name       TEXT,
+        type_name           TEXT,
+        field_names         LIST<TEXT>,
+        field_types         LIST<TEXT>,
+        PRIMARY KEY (keyspace_name, type_name)
+    )`,
+}
+
+// the schema tables user defined functions and aggregates added in cassandra 2.2
+var LEGACY_FUNCTION_TABLES = []string{
+    `CREATE TABLE system.schema_functions (
+        keyspace_name       TEXT,
+        function_name       TEXT,
+        signature           FROZEN<LIST<TEXT>>,
+        argument_names      LIST<TEXT>,
+        argument_types      LIST<TEXT>,
+        body                TEXT,
+        called_on_null_input BOOLEAN,
+        language            TEXT,
+        return_type         TEXT,
+        PRIMARY KEY (keyspace_name, function_name, signature)
+    )`,
+    `CREATE TABLE system.schema_aggregates (
+        keyspace_name       TEXT,
+        aggregate_name      TEXT,
+        signature           FROZEN<LIST<TEXT>>,
+        argument_types      LIST<TEXT>,
+        final_func          TEXT,
+        initcond            BLOB,
+        return_type         TEXT,
+        state_func          TEXT,
+        state_type          TEXT,
+        PRIMARY KEY (keyspace_name, aggregate_name, signature)
+    )`,
+}
+
+// the schema tables of a cassandra 3.0+ node, which replace the legacy ones
+var SYSTEM_SCHEMA_TABLES = []string{
+    `CREATE TABLE system_schema.keyspaces (
+        keyspace_name       TEXT PRIMARY KEY,
+        durable_writes      BOOLEAN,
+        replication         FROZEN<MAP<TEXT, TEXT>>
+    )`,
+    `CREATE TABLE system_schema.tables (
+        keyspace_name       TEXT,
+        table_name          TEXT,
+        bloom_filter_fp_chance DOUBLE,
+        caching             FROZEN<MAP<TEXT, TEXT>>,
+        comment             TEXT,
+        compaction          FROZEN<MAP<TEXT, TEXT>>,
+        compression         FROZEN<MAP<TEXT, TEXT>>,
+        default_time_to_live INT,
+        gc_grace_seconds    INT,
+        PRIMARY KEY (keyspace_name, table_name)
+    )`,
+    `CREATE TABLE system_schema.columns (
+        keyspace_name       TEXT,
+        table_name          TEXT,
+        column_name         TEXT,
+        clustering_order    TEXT,
+        kind                TEXT,
+        position            INT,
+        type                TEXT,
+        PRIMARY KEY (keyspace_name, table_name, column_name)
+    )`,
+    `CREATE TABLE system_schema.indexes (
+        keyspace_name       TEXT,
+        table_name          TEXT,
+        index_name          TEXT,
+        kind                TEXT,
+        options             FROZEN<MAP<TEXT, TEXT>>,
+        PRIMARY KEY (keyspace_name, table_name, index_name)
+    )`,
+    `CREATE TABLE system_schema.types (
+        keyspace_name       TEXT,
+        type_name           TEXT,
+        field_names         FROZEN<LIST<TEXT>>,
+        field_types         FROZEN<LIST<TEXT>>,
+        PRIMARY KEY (keyspace_name, type_name)
+    )`,
+    `CREATE TABLE system_schema.views (
+        keyspace_name       TEXT,
+        view_name           TEXT,
+        base_table_name     TEXT,
+        include_all_columns BOOLEAN,
+        where_clause        TEXT,
+        PRIMARY KEY (keyspace_name, view_name)
+    )`,
+    `CREATE TABLE system_schema.functions (
+        keyspace_name       TEXT,
+        function_name       TEXT,
+        argument_types      FROZEN<LIST<TEXT>>,
+        argument_names      FROZEN<LIST<TEXT>>,
+        body                TEXT,
+        called_on_null_input BOOLEAN,
+        language            TEXT,
+        return_type         TEXT,
+        PRIMARY KEY (keyspace_name, function_name, argument_types)
+    )`,
+    `CREATE TABLE system_schema.aggregates (
+        keyspace_name       TEXT,
+        aggregate_name      TEXT,
+        argument_types      FROZEN<LIST<TEXT>>,
+        final_func          TEXT,
+        initcond            TEXT,
+        return_type         TEXT,
+        state_func          TEXT,
+        state_type          TEXT,
+        PRIMARY KEY (keyspace_name, aggregate_name, argument_types)
+    )`,
+}
+
+//-------------------------------------------------------
+// Schema
+//-------------------------------------------------------
+
+type fakeType struct {
+    Name        string
+    Params      []fakeType
+}
+
+func (self fakeType) String() string {
+    if (len(self.Params) == 0) {
+        return self.Name
+    }
+
+    var params []string
+    for _, param := range self.Params {
+        params = append(params, param.String())
+    }
+    return self.Name + "<" + strings.Join(params, ", ") + ">"
+}
+
+//
+//  Validator
+//      The marshal class of the type, as found in system.schema_columns
+//      User types are looked up in the keyspace and, before 3.0, must be frozen
+//      Unknown types, and types with the wrong number of parameters, are errors
+//
+func (self fakeType) Validator(keyspace *fakeKeyspace, modern bool) (string, error) {
+    return self.validator(keyspace, modern, false)
+}
+
+func (self fakeType) validator(keyspace *fakeKeyspace, modern, frozen bool) (string, error) {
+    if described, user := keyspace.types[self.Name] ; user && len(self.Params) == 0 {
+        if (!frozen && !modern) {
+            return "", fmt.Errorf("Non-frozen User-Defined types are not supported, please use frozen<>")
+        }
+
+        var params = []string{ keyspace.name, hex.EncodeToString([]byte(described.name)) }
+        for i, field := range described.fields {
+            var validator, err = described.types[i].validator(keyspace, modern, true)
+            if (err != nil) {
+                return "", err
+            }
+            params = append(params, hex.EncodeToString([]byte(field)) + ":" + validator)
+        }
+        return MARSHAL_PACKAGE + "UserType(" + strings.Join(params, ",") + ")", nil
+    }
+
+    var class, known = MARSHAL_TYPES[self.Name]
+    var count = TYPE_PARAMS[self.Name]
+    if (!known || (count >= 0 && len(self.Params) != count) || (count < 0 && len(self.Params) == 0)) {
+        return "", fmt.Errorf("Unknown type %s", self)
+    }
+
+    class = MARSHAL_PACKAGE + class
+    if (len(self.Params) == 0) {
+        return class, nil
+    }
+
+    var params []string
+    for _, param := range self.Params {
+        var validator, err = param.validator(keyspace, modern, self.Name == "frozen" || self.Name == "tuple")
+        if (err != nil) {
+            return "", err
+        }
+        params = append(params, validator)
+    }
+
+    // user types and tuples are frozen without saying so
+    if (self.Name == "frozen") {
+        var _, user = keyspace.types[self.Params[0].Name]
+        if (user || self.Params[0].Name == "tuple") {
+            return params[0], nil
+        }
+    }
+    return class + "(" + strings.Join(params, ",") + ")", nil
+}
+
+
+//
+//  uses
+//      Whether the type is, or has as a parameter, the named user type
+//
+func (self fakeType) uses(name string) bool {
+    if (self.Name == name && len(self.Params) == 0) {
+        return true
+    }
+    for _, param := range self.Params {
+        if (param.uses(name)) { return true }
+    }
+    return false
+}
+
+
+type fakeKeyspace struct {
+    name        string
+    class       string
+    options     map[string]string
+    durable     bool
+    tables      map[string]*fakeTable
+    types       map[string]*fakeUserType
+    functions   map[string]*fakeFunction    // by signature, e.g. add(int,int)
+    aggregates  map[string]*fakeAggregate   // by signature
+    views       map[string]*fakeView
+}
+
+//
+//  newFakeKeyspace
+//      An empty keyspace, CREATE KEYSPACE fills in its replication afterwards
+//
+func newFakeKeyspace(name, class string) *fakeKeyspace {
+    return &fakeKeyspace{
+        name:       name,
+        class:      class,
+        options:    make(map[string]string),
+        durable:    true,
+        tables:     make(map[string]*fakeTable),
+        types:      make(map[string]*fakeUserType),
+        functions:  make(map[string]*fakeFunction),
+        aggregates: make(map[string]*fakeAggregate),
+        views:      make(map[string]*fakeView),
+    }
+}
+
+type fakeFunction struct {
+    name        string
+    arguments   []string
+    types       []fakeType
+    returns     fakeType
+    language    string
+    body        string
+    calledOnNull bool
+}
+
+type fakeAggregate struct {
+    name        string
+    types       []fakeType
+    stateFunc   string
+    stateType   fakeType
+    finalFunc   string
+    initcond    interface{}     // nil without an INITCOND
+}
+
+//
+//  fakeView
+//      A materialized view, its table holds the columns and key but never any rows
+//
+type fakeView struct {
+    table       *fakeTable
+    base        string
+    includeAll  bool
+    where       string
+}
+
+//
+//  signature
+//      The name of a function or aggregate along with its argument types, e.g. add(int,int)
+//
+func signature(name string, types []fakeType) string {
+    var names []string
+    for _, argument := range types {
+        names = append(names, argument.String())
+    }
+    return name + "(" + strings.Join(names, ",") + ")"
+}
+
+type fakeUserType struct {
+    name        string
+    fields      []string
+    types       []fakeType
+}
+
+type fakeColumn struct {
+    name        string
+    kind        string      // partition_key, clustering_key, regular or static
+    cqlType     fakeType
+    reversed    bool        // clustered in DESC order
+
+    index       string      // name of its secondary index, if any
+    indexClass  string      // set for CUSTOM indexes
+    indexTarget string      // keys, values, entries or full when the index is on part of a collection
+}
+
+type fakeRow struct {
+    key         string
+    values      map[string]interface{}
+    expires     time.Time   // zero when written without a TTL
+}
+
+type fakeTable struct {
+    keyspace    string
+    name        string
+    columns     []*fakeColumn
+    partition   []string
+    clustering  []string
+    options     map[string]interface{}  // WITH options, in the form system_schema.tables has them
+    rows        map[string]*fakeRow
+}
+
+func newFakeTable(keyspace, name string) *fakeTable {
+    return &fakeTable{
+        keyspace:   keyspace,
+        name:       name,
+        options:    map[string]interface{}{
+            "bloom_filter_fp_chance":   0.01,
+            "caching":                  map[string]string{ "keys": "ALL", "rows_per_partition": "NONE" },
+            "comment":                  "",
+            "compaction":               map[string]string{ "class": COMPACTION_PACKAGE + "SizeTieredCompactionStrategy", "max_threshold": "32", "min_threshold": "4" },
+            "compression":              map[string]string{ "chunk_length_in_kb": "64", "class": COMPRESSION_PACKAGE + "LZ4Compressor" },
+            "default_time_to_live":     0,
+            "gc_grace_seconds":         864000,
+        },
+        rows:       make(map[string]*fakeRow),
+    }
+}
+
+func (self *fakeTable) column(name string) *fakeColumn {
+    for _, column := range self.columns {
+        if (column.name == name) { return column }
+    }
+    return nil
+}
+
+func (self *fakeTable) isPrimary(name string) bool {
+    var column = self.column(name)
+    return column != nil && (column.kind == "partition_key" || column.kind == "clustering_key")
+}
+
+//
+//  markKey
+//      Set the kind of the key columns, and reverse those clustered in DESC order
+//
+func (self *fakeTable) markKey(descending []string) error {
+    for i, key := range append(append([]string{}, self.partition...), self.clustering...) {
+        var column = self.column(key)
+        if (column == nil) {
+            return fmt.Errorf("Unknown definition %s referenced in PRIMARY KEY", key)
+        }
+
+        column.kind = "clustering_key"
+        if (i < len(self.partition)) { column.kind = "partition_key" }
+    }
+    for _, name := range descending {
+        if (indexOf(self.clustering, name) < 0) {
+            return fmt.Errorf("Only clustering key columns can be defined in CLUSTERING ORDER directive")
+        }
+        self.column(name).reversed = true
+    }
+    return nil
+}
+
+//
+//  key
+//      The storage key of the row holding the given primary key values
+//
+func (self *fakeTable) key(values map[string]interface{}) (string, error) {
+    var parts []string
+    for _, name := range append(append([]string{}, self.partition...), self.clustering...) {
+        var value, given = values[name]
+        if (!given || value == nil) {
+            return "", fmt.Errorf("Missing mandatory PRIMARY KEY part %s", name)
+        }
+        parts = append(parts, fmt.Sprint(value))
+    }
+
+    return strings.Join(parts, "\x00"), nil
+}
+
+//
+//  live
+//      Rows that have not expired, in primary key order
+//
+func (self *fakeTable) live() []*fakeRow {
+    var now = time.Now()
+    var rows []*fakeRow
+    for key, row := range self.rows {
+        if (!row.expires.IsZero() && now.After(row.expires)) {
+            delete(self.rows, key)
+            continue
+        }
+        rows = append(rows, row)
+    }
+
+    sort.Sort(fakeRows(rows))
+    return rows
+}
+
+func (self *fakeTable) row(key string) *fakeRow {
+    for _, row := range self.live() {
+        if (row.key == key) { return row }
+    }
+    return nil
+}
+
+//
+//  write
+//      Upsert the given values into the row with the given key
+//
+func (self *fakeTable) write(key string, values map[string]interface{}, ttl int) {
+    var row = self.row(key)
+    if (row == nil) {
+        row = &fakeRow{ key: key, values: make(map[string]interface{}) }
+        self.rows[key] = row
+    }
+
+    for name, value := range values {
+        row.values[name] = value
+    }
+
+    row.expires = time.Time{}
+    if (ttl > 0) { row.expires = time.Now().Add(time.Duration(ttl) * time.Second) }
+}
+
+//
+//  star
+//      The columns selected by '*': the primary key, then the others by name
+//
+func (self *fakeTable) star() []string {
+    var others []string
+    for _, column := range self.columns {
+        if (!self.isPrimary(column.name)) { others = append(others, column.name) }
+    }
+    sort.Strings(others)
+
+    return append(append(append([]string{}, self.partition...), self.clustering...), others...)
+}
+
+
+type fakeRows []*fakeRow
+
+// Len is part of sort.Interface.
+func (self fakeRows) Len() int {
+    return len(self)
+}
+
+// Swap is part of sort.Interface.
+func (self fakeRows) Swap(i, j int) {
+    self[i], self[j] = self[j], self[i]
+}
+
+// Less is part of sort.Interface.
+func (self fakeRows) Less(i, j int) bool {
+    return self[i].key < self[j].key
+}
+
+
+//-------------------------------------------------------
+// Fake Session
+//-------------------------------------------------------
+
+//
+//  Fake
+//      An in-memory Session for running migrations without a cluster
+//      Keyspaces, tables and rows are kept in memory and every statement run is recorded
+//      system.local, system.peers and the schema tables are built from that state
+//      Only the CQL cmm itself needs is understood, anything else is an error
+//
+type Fake struct {
+    Peers       map[string]string   // address -> schema version of pretend peers, none by default
+    Down        map[string]bool     // peers the driver would report as down
+
+    release     string              // cassandra version the fake pretends to be
+    executed    []string
+    failures    map[string]error
+    keyspaces   map[string]*fakeKeyspace
+    keyspace    string              // set by USE
+    version     int                 // bumped on every schema change
+    lock        sync.Mutex
+}
+
+//
+//  NewFake
+//      A fake single node cassandra 2.1 cluster holding nothing but its system keyspace
+//
+func NewFake() *Fake {
+    return NewFakeRelease("2.1.20")
+}
+
+//
+//  NewFakeRelease
+//      A fake node of the given cassandra version
+//      From 3.0 on the schema is described by system_schema rather than the system.schema_* tables
+//
+func NewFakeRelease(release string) *Fake {
+    var fake = &Fake{
+        Peers:      make(map[string]string),
+        Down:       make(map[string]bool),
+        release:    release,
+        failures:   make(map[string]error),
+        keyspaces:  make(map[string]*fakeKeyspace),
+    }
+
+    var tables = append(append([]string{}, SYSTEM_TABLES...), LEGACY_SCHEMA_TABLES...)
+    var keyspaces = []string{ "system" }
+    if (fake.hasFunctions()) {
+        tables = append(tables, LEGACY_FUNCTION_TABLES...)
+    }
+    if (fake.modern()) {
+        tables = append(append([]string{}, SYSTEM_TABLES...), SYSTEM_SCHEMA_TABLES...)
+        keyspaces = append(keyspaces, "system_schema")
+    }
+
+    for _, name := range keyspaces {
+        fake.keyspaces[name] = newFakeKeyspace(name, "org.apache.cassandra.locator.LocalStrategy")
+    }
+    for _, statement := range tables {
+        if _, err := fake.execute(statement, nil) ; err != nil {
+            panic(fmt.Sprintf("invalid system table: %s", err))
+        }
+    }
+
+    return fake
+}
+
+//
+//  modern
+//      Whether the fake is a 3.0+ node
+//
+func (self *Fake) modern() bool {
+    var major, _ = strconv.Atoi(strings.SplitN(self.release, ".", 2)[0])
+    return major >= 3
+}
+
+//
+//  hasFunctions
+//      Whether the fake is 2.2 or later, which added user defined functions and aggregates
+//
+func (self *Fake) hasFunctions() bool {
+    var parts = strings.SplitN(self.release, ".", 3)
+    var major, _ = strconv.Atoi(parts[0])
+    var minor = 0
+    if (len(parts) > 1) { minor, _ = strconv.Atoi(parts[1]) }
+    return major > 2 || (major == 2 && minor >= 2)
+}
+
+//
+//  Executed
+//      Every statement run so far, in order
+//
+func (self *Fake) Executed() []string {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    return append([]string{}, self.executed...)
+}
+
+//
+//  FailOn
+//      Make every statement containing the fragment fail with the given error
+//      A nil error lets them run again
+//
+func (self *Fake) FailOn(fragment string, err error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if (err == nil) {
+        delete(self.failures, fragment)
+    } else {
+        self.failures[fragment] = err
+    }
+}
+
+//
+//  SchemaVersion
+//      The schema version the fake node reports, it changes with every schema change
+//
+func (self *Fake) SchemaVersion() string {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    return self.schemaVersion()
+}
+
+func (self *Fake) schemaVersion() string {
+    return fmt.Sprintf("%08x-0000-1000-8000-000000000000", self.version)
+}
+
+//
+//  IsDown
+//      Whether the peer is one the test marked down
+//
+func (self *Fake) IsDown(address string) bool {
+    return self.Down[address]
+}
+
+
+func (self *Fake) Query(statement string, values ...interface{}) cql.Query {
+    return &fakeQuery{ fake: self, statement: statement, values: values }
+}
+
+func (self *Fake) Close() {
+}
+
+
+//-------------------------------------------------------
+// Queries
+//-------------------------------------------------------
+
+type fakeResult struct {
+    rows        [][]interface{}
+    applied     bool
+    existing    map[string]interface{}
+}
+
+type fakeQuery struct {
+    fake        *Fake
+    statement   string
+    values      []interface{}
+}
+
+func (self *fakeQuery) Consistency(consistency gocql.Consistency) cql.Query {
+    return self
+}
+
+func (self *fakeQuery) Exec() error {
+    var _, err = self.run()
+    return err
+}
+
+func (self *fakeQuery) Scan(dest ...interface{}) error {
+    var result, err = self.run()
+    if (err != nil) {
+        return err
+    }
+
+    if (len(result.rows) == 0) {
+        return gocql.ErrNotFound
+    }
+    return scanRow(result.rows[0], dest)
+}
+
+func (self *fakeQuery) MapScanCAS(dest map[string]interface{}) (bool, error) {
+    var result, err = self.run()
+    if (err != nil) {
+        return false, err
+    }
+
+    for name, value := range result.existing {
+        dest[name] = value
+    }
+    return result.applied, nil
+}
+
+func (self *fakeQuery) Iter() cql.Iter {
+    var result, err = self.run()
+    return &fakeIter{ rows: result.rows, err: err }
+}
+
+//
+//  run
+//      Record the statement and run it against the fake's state
+//
+func (self *fakeQuery) run() (fakeResult, error) {
+    var fake = self.fake
+    fake.lock.Lock()
+    defer fake.lock.Unlock()
+
+    fake.executed = append(fake.executed, self.statement)
+    for fragment, err := range fake.failures {
+        if (strings.Contains(self.statement, fragment)) { return fakeResult{}, err }
+    }
+
+    return fake.execute(self.statement, self.values)
+}
+
+
+type fakeIter struct {
+    rows        [][]interface{}
+    err         error
+}
+
+func (self *fakeIter) Scan(dest ...interface{}) bool {
+    if (self.err != nil || len(self.rows) == 0) {
+        return false
+    }
+
+    if self.err = scanRow(self.rows[0], dest) ; self.err != nil {
+        return false
+    }
+    self.rows = self.rows[1:]
+    return true
+}
+
+func (self *fakeIter) Close() error {
+    return self.err
+}
+
+
+//
+//  scanRow
+//      Copy the values of a row into the destination pointers
+//      Numbers convert between sizes, null leaves the zero value
+//
+func scanRow(row []interface{}, dest []interface{}) error {
+    if (len(dest) != len(row)) {
+        return fmt.Errorf("not enough columns to scan into: have %d want %d", len(dest), len(row))
+    }
+
+    for i, value := range row {
+        var target = reflect.ValueOf(dest[i])
+        if (target.Kind() != reflect.Ptr || target.IsNil()) {
+            return fmt.Errorf("can not scan into non-pointer %T", dest[i])
+        }
+        target = target.Elem()
+
+        if (value == nil) {
+            target.Set(reflect.Zero(target.Type()))
+            continue
+        }
+
+        var source = reflect.ValueOf(value)
+        if (source.Type().AssignableTo(target.Type())) {
+            target.Set(source)
+        } else if (isNumeric(source.Kind()) && isNumeric(target.Kind())) {
+            target.Set(source.Convert(target.Type()))
+        } else {
+            return fmt.Errorf("can not unmarshal %T into %T", value, dest[i])
+        }
+    }
+
+    return nil
+}
+
+func isNumeric(kind reflect.Kind) bool {
+    return kind >= reflect.Int && kind <= reflect.Float64
+}
+
+func toInt(value interface{}) (int, error) {
+    var source = reflect.ValueOf(value)
+    if (value == nil || !isNumeric(source.Kind())) {
+        return 0, fmt.Errorf("expected a number, got %v", value)
+    }
+    return int(source.Convert(reflect.TypeOf(0)).Int()), nil
+}
+
+func sameValue(a, b interface{}) bool {
+    return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+
+//-------------------------------------------------------
+// Statements
+//-------------------------------------------------------
+
+//
+//  execute
+//      Parse and run a single statement (or batch) against the fake's state
+//
+func (self *Fake) execute(statement string, values []interface{}) (fakeResult, error) {
+    var p, err = newParser(statement, values)
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var result fakeResult
+    if result, err = self.statement(p) ; err != nil {
+        return result, err
+    }
+
+    return result, p.end()
+}
+
+func (self *Fake) statement(p *parser) (fakeResult, error) {
+    switch {
+        case p.accept("USE"):
+            return self.use(p)
+        case p.accept("CREATE", "KEYSPACE"):
+            return self.createKeyspace(p)
+        case p.accept("CREATE", "TABLE"), p.accept("CREATE", "COLUMNFAMILY"):
+            return self.createTable(p)
+        case p.accept("CREATE", "INDEX"):
+            return self.createIndex(p, false)
+        case p.accept("CREATE", "CUSTOM", "INDEX"):
+            return self.createIndex(p, true)
+        case p.accept("CREATE", "TYPE"):
+            return self.createType(p)
+        case p.accept("CREATE", "FUNCTION"):
+            return self.createFunction(p, false)
+        case p.accept("CREATE", "OR", "REPLACE", "FUNCTION"):
+            return self.createFunction(p, true)
+        case p.accept("CREATE", "AGGREGATE"):
+            return self.createAggregate(p, false)
+        case p.accept("CREATE", "OR", "REPLACE", "AGGREGATE"):
+            return self.createAggregate(p, true)
+        case p.accept("CREATE", "MATERIALIZED", "VIEW"):
+            return self.createView(p)
+        case p.accept("DROP", "KEYSPACE"):
+            return self.dropKeyspace(p)
+        case p.accept("DROP", "TABLE"), p.accept("DROP", "COLUMNFAMILY"):
+            return self.dropTable(p)
+        case p.accept("DROP", "INDEX"):
+            return self.dropIndex(p)
+        case p.accept("DROP", "TYPE"):
+            return self.dropType(p)
+        case p.accept("DROP", "FUNCTION"):
+            return self.dropFunction(p)
+        case p.accept("DROP", "AGGREGATE"):
+            return self.dropAggregate(p)
+        case p.accept("DROP", "MATERIALIZED", "VIEW"):
+            return self.dropView(p)
+        case p.accept("ALTER", "KEYSPACE"):
+            return self.alterKeyspace(p)
+        case p.accept("ALTER", "TYPE"):
+            return self.alterType(p)
+        case p.accept("ALTER", "TABLE"), p.accept("ALTER", "COLUMNFAMILY"):
+            return self.alterTable(p)
+        case p.accept("INSERT", "INTO"):
+            return self.insert(p)
+        case p.accept("UPDATE"):
+            return self.update(p)
+        case p.accept("DELETE"):
+            return self.delete(p)
+        case p.accept("SELECT"):
+            return self.selectRows(p)
+        case p.accept("BEGIN"):
+            return self.batch(p)
+    }
+
+    return fakeResult{}, fmt.Errorf("the fake session does not support statements starting with [%s]", p.peek().text)
+}
+
+//
+//  keyspaceNamed, table
+//      Look up schema, the current keyspace (from USE) fills in a missing one
+//
+func (self *Fake) keyspaceNamed(name string) (*fakeKeyspace, error) {
+    if (len(name) == 0) { name = self.keyspace }
+    if (len(name) == 0) {
+        return nil, fmt.Errorf("no keyspace has been specified")
+    }
+
+    var keyspace, exists = self.keyspaces[name]
+    if (!exists) {
+        return nil, fmt.Errorf("Keyspace '%s' does not exist", name)
+    }
+    return keyspace, nil
+}
+
+func (self *Fake) table(keyspaceName, name string) (*fakeTable, error) {
+    var keyspace, err = self.keyspaceNamed(keyspaceName)
+    if (err != nil) {
+        return nil, err
+    }
+
+    var table, exists = keyspace.tables[name]
+    if (!exists) {
+        if (self.modern()) { return nil, fmt.Errorf("unconfigured table %s", name) }
+        return nil, fmt.Errorf("unconfigured columnfamily %s", name)
+    }
+    return table, nil
+}
+
+func (self *Fake) writableTable(keyspaceName, name string) (*fakeTable, error) {
+    var table, err = self.table(keyspaceName, name)
+    if (err == nil && isSystem(table.keyspace)) {
+        return nil, fmt.Errorf("system keyspace is not user-modifiable.")
+    }
+    return table, err
+}
+
+
+func (self *Fake) use(p *parser) (fakeResult, error) {
+    var name, err = p.name()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if _, err = self.keyspaceNamed(name) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    self.keyspace = name
+    return fakeResult{ applied: true }, nil
+}
+
+
+func (self *Fake) createKeyspace(p *parser) (fakeResult, error) {
+    var ifNotExists = p.accept("IF", "NOT", "EXISTS")
+
+    var name, err = p.name()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+    if err = p.expect("WITH") ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var keyspace = newFakeKeyspace(name, "")
+    if err = keyspaceOptions(p, keyspace) ; err != nil {
+        return fakeResult{}, err
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if (len(keyspace.class) == 0) {
+        return fakeResult{}, fmt.Errorf("Missing mandatory replication strategy class")
+    }
+
+    if _, exists := self.keyspaces[name] ; exists {
+        if (ifNotExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("Cannot add existing keyspace \"%s\"", name)
+    }
+
+    self.keyspaces[name] = keyspace
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+
+//
+//  alterKeyspace
+//      A new replication replaces the old one entirely, its class included
+//
+func (self *Fake) alterKeyspace(p *parser) (fakeResult, error) {
+    var name, err = p.name()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+    if err = p.expect("WITH") ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(name) ; err != nil {
+        return fakeResult{}, err
+    }
+    if (isSystem(keyspace.name)) {
+        return fakeResult{}, fmt.Errorf("Cannot alter system keyspace %s", keyspace.name)
+    }
+
+    // set on a copy so a statement that fails changes nothing
+    var altered = *keyspace
+    if err = keyspaceOptions(p, &altered) ; err != nil {
+        return fakeResult{}, err
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if (len(altered.class) == 0) {
+        return fakeResult{}, fmt.Errorf("Missing mandatory replication strategy class")
+    }
+
+    keyspace.class = altered.class
+    keyspace.options = altered.options
+    keyspace.durable = altered.durable
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+
+//
+//  keyspaceOptions
+//      'REPLICATION = {...}' and 'DURABLE_WRITES = bool' joined by AND
+//      Short strategy classes are given their package
+//
+func keyspaceOptions(p *parser, keyspace *fakeKeyspace) error {
+    for {
+        var value interface{}
+        var err error
+        if (p.accept("REPLICATION", "=")) {
+            if value, err = p.value() ; err != nil {
+                return err
+            }
+
+            var replication, isMap = value.(map[string]interface{})
+            if (!isMap) {
+                return fmt.Errorf("replication must be a map, got %v", value)
+            }
+
+            keyspace.class = ""
+            keyspace.options = make(map[string]string)
+            for key, option := range replication {
+                if (key == "class") {
+                    keyspace.class = fmt.Sprint(option)
+                } else {
+                    keyspace.options[key] = fmt.Sprint(option)
+                }
+            }
+            if (len(keyspace.class) > 0 && !strings.Contains(keyspace.class, ".")) {
+                keyspace.class = "org.apache.cassandra.locator." + keyspace.class
+            }
+        } else if (p.accept("DURABLE_WRITES", "=")) {
+            if value, err = p.value() ; err != nil {
+                return err
+            }
+            keyspace.durable = sameValue(value, true)
+        } else {
+            return p.unexpected("REPLICATION or DURABLE_WRITES")
+        }
+
+        if (!p.accept("AND")) { return nil }
+    }
+}
+
+
+func (self *Fake) dropKeyspace(p *parser) (fakeResult, error) {
+    var ifExists = p.accept("IF", "EXISTS")
+
+    var name, err = p.name()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if _, exists := self.keyspaces[name] ; !exists {
+        if (ifExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("Cannot drop non existing keyspace '%s'.", name)
+    }
+
+    delete(self.keyspaces, name)
+    if (self.keyspace == name) { self.keyspace = "" }
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+
+func (self *Fake) createTable(p *parser) (fakeResult, error) {
+    var ifNotExists = p.accept("IF", "NOT", "EXISTS")
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(keyspaceName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var table = newFakeTable(keyspace.name, name)
+    var multiple = fmt.Errorf("Multiple PRIMARY KEYs specifed (exactly one required)")
+
+    if err = p.expect("(") ; err != nil {
+        return fakeResult{}, err
+    }
+    for {
+        if (p.accept("PRIMARY", "KEY")) {
+            if (len(table.partition) > 0) { return fakeResult{}, multiple }
+            if table.partition, table.clustering, err = p.primaryKey() ; err != nil {
+                return fakeResult{}, err
+            }
+        } else {
+            var column, err = p.columnDefinition()
+            if (err != nil) {
+                return fakeResult{}, err
+            }
+            if _, err = column.cqlType.Validator(keyspace, self.modern()) ; err != nil {
+                return fakeResult{}, err
+            }
+            if (table.column(column.name) != nil) {
+                return fakeResult{}, fmt.Errorf("Multiple definition of identifier %s", column.name)
+            }
+            table.columns = append(table.columns, column)
+
+            if (p.accept("PRIMARY", "KEY")) {
+                if (len(table.partition) > 0) { return fakeResult{}, multiple }
+                table.partition = []string{ column.name }
+            }
+        }
+
+        if (p.accept(")")) { break }
+        if err = p.expect(",") ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+
+    var descending []string
+    if (p.accept("WITH")) {
+        if descending, err = tableOptions(p, table) ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if (len(table.partition) == 0) {
+        return fakeResult{}, fmt.Errorf("No PRIMARY KEY specifed (exactly one required)")
+    }
+    if err = table.markKey(descending) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if _, exists := keyspace.tables[name] ; exists {
+        if (ifNotExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("Cannot add already existing column family \"%s\" to keyspace \"%s\"", name, keyspace.name)
+    }
+
+    keyspace.tables[name] = table
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+
+//
+//  tableOptions
+//      'CLUSTERING ORDER BY (...)', 'COMPACT STORAGE' and 'option = value' joined by AND
+//      Options are set on the table, the clustering columns ordered DESC are returned
+//
+func tableOptions(p *parser, table *fakeTable) ([]string, error) {
+    var descending []string
+
+    for {
+        if (p.accept("CLUSTERING", "ORDER", "BY")) {
+            if err := p.expect("(") ; err != nil {
+                return nil, err
+            }
+            for {
+                var name, err = p.name()
+                if (err != nil) {
+                    return nil, err
+                }
+                if (p.accept("DESC")) {
+                    descending = append(descending, name)
+                } else {
+                    p.accept("ASC")
+                }
+
+                if (p.accept(")")) { break }
+                if err = p.expect(",") ; err != nil {
+                    return nil, err
+                }
+            }
+        } else if (!p.accept("COMPACT", "STORAGE")) {
+            var name, err = p.name()
+            if (err != nil) {
+                return nil, err
+            }
+            if err = p.expect("=") ; err != nil {
+                return nil, err
+            }
+
+            var value interface{}
+            if value, err = p.value() ; err != nil {
+                return nil, err
+            }
+            if err = table.setOption(strings.ToLower(name), value) ; err != nil {
+                return nil, err
+            }
+        }
+
+        if (!p.accept("AND")) { return descending, nil }
+    }
+}
+
+// table options the fake accepts without keeping them
+var IGNORED_TABLE_OPTIONS = []string{
+    "cdc", "crc_check_chance", "dclocal_read_repair_chance", "extensions", "max_index_interval",
+    "memtable_flush_period_in_ms", "min_index_interval", "read_repair_chance", "speculative_retry",
+}
+
+//
+//  setOption
+//      Keep a WITH option as cassandra 3.x would, maps replace the previous one with defaults filled in
+//      Short class names are given their package and the 2.x names of compression options are renamed
+//
+func (self *fakeTable) setOption(name string, value interface{}) error {
+    var invalid = fmt.Errorf("Invalid value for property '%s'", name)
+
+    switch (name) {
+        case "comment":
+            var comment, isString = value.(string)
+            if (!isString) { return invalid }
+            self.options[name] = comment
+
+        case "default_time_to_live", "gc_grace_seconds":
+            var seconds, err = toInt(value)
+            if (err != nil || seconds < 0) { return invalid }
+            self.options[name] = seconds
+
+        case "bloom_filter_fp_chance":
+            var number = reflect.ValueOf(value)
+            if (value == nil || !isNumeric(number.Kind())) { return invalid }
+
+            var chance = number.Convert(reflect.TypeOf(0.0)).Float()
+            if (chance <= 0 || chance > 1) {
+                return fmt.Errorf("bloom_filter_fp_chance must be larger than 0 and less than or equal to 1.0 (got %v)", chance)
+            }
+            self.options[name] = chance
+
+        case "caching", "compaction", "compression":
+            var literal, isMap = value.(map[string]interface{})
+            if (!isMap) { return invalid }
+
+            var options = make(map[string]string)
+            for key, option := range literal {
+                options[key] = fmt.Sprint(option)
+            }
+
+            switch (name) {
+                case "caching":
+                    if _, given := options["keys"] ; !given { options["keys"] = "ALL" }
+                    if _, given := options["rows_per_partition"] ; !given { options["rows_per_partition"] = "NONE" }
+
+                case "compaction":
+                    if (len(options["class"]) == 0) {
+                        return fmt.Errorf("Missing sub-option 'class' for the 'compaction' option.")
+                    }
+                    if (!strings.Contains(options["class"], ".")) { options["class"] = COMPACTION_PACKAGE + options["class"] }
+                    if _, given := options["max_threshold"] ; !given { options["max_threshold"] = "32" }
+                    if _, given := options["min_threshold"] ; !given { options["min_threshold"] = "4" }
+
+                case "compression":
+                    for legacy, modern := range map[string]string{ "sstable_compression": "class", "chunk_length_kb": "chunk_length_in_kb" } {
+                        if option, given := options[legacy] ; given {
+                            options[modern] = option
+                            delete(options, legacy)
+                        }
+                    }
+                    if (len(options["class"]) > 0) {
+                        if (!strings.Contains(options["class"], ".")) { options["class"] = COMPRESSION_PACKAGE + options["class"] }
+                        if _, given := options["chunk_length_in_kb"] ; !given { options["chunk_length_in_kb"] = "64" }
+                    }
+            }
+            self.options[name] = options
+
+        default:
+            if (indexOf(IGNORED_TABLE_OPTIONS, name) < 0) {
+                return fmt.Errorf("Unknown property '%s'", name)
+            }
+    }
+
+    return nil
+}
+
+
+func (self *Fake) dropTable(p *parser) (fakeResult, error) {
+    var ifExists = p.accept("IF", "EXISTS")
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(keyspaceName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if _, exists := keyspace.tables[name] ; !exists {
+        if (ifExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("Cannot drop non existing column family '%s' in keyspace '%s'.", name, keyspace.name)
+    }
+    for _, view := range keyspace.views {
+        if (view.base == name) {
+            return fakeResult{}, fmt.Errorf("Cannot drop table when materialized views still depend on it (%s.{%s})", keyspace.name, view.table.name)
+        }
+    }
+
+    delete(keyspace.tables, name)
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+
+func (self *Fake) alterTable(p *parser) (fakeResult, error) {
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var table *fakeTable
+    if table, err = self.writableTable(keyspaceName, name) ; err != nil {
+        return fakeResult{}, err
+    }
+    var keyspace = self.keyspaces[table.keyspace]
+
+    switch {
+        case p.accept("ADD"):
+            var column, err = p.columnDefinition()
+            if (err != nil) {
+                return fakeResult{}, err
+            }
+            if _, err = column.cqlType.Validator(keyspace, self.modern()) ; err != nil {
+                return fakeResult{}, err
+            }
+            if err = p.finish() ; err != nil {
+                return fakeResult{}, err
+            }
+
+            if (table.column(column.name) != nil) {
+                return fakeResult{}, fmt.Errorf("Invalid column name %s because it conflicts with an existing column", column.name)
+            }
+            table.columns = append(table.columns, column)
+
+        case p.accept("DROP"):
+            var column, err = p.name()
+            if (err != nil) {
+                return fakeResult{}, err
+            }
+            if err = p.finish() ; err != nil {
+                return fakeResult{}, err
+            }
+
+            if (table.column(column) == nil) {
+                return fakeResult{}, fmt.Errorf("Column %s was not found in table %s", column, table.name)
+            }
+            if (table.isPrimary(column)) {
+                return fakeResult{}, fmt.Errorf("Cannot drop PRIMARY KEY part %s", column)
+            }
+            if (len(table.column(column).index) > 0) {
+                return fakeResult{}, fmt.Errorf("Cannot drop column %s because it has dependent secondary indexes (%s)", column, table.column(column).index)
+            }
+
+            for i, existing := range table.columns {
+                if (existing.name == column) {
+                    table.columns = append(table.columns[:i], table.columns[i + 1:]...)
+                    break
+                }
+            }
+            for _, row := range table.rows {
+                delete(row.values, column)
+            }
+
+        case p.accept("ALTER"):
+            var column, err = p.name()
+            if (err != nil) {
+                return fakeResult{}, err
+            }
+            if err = p.expect("TYPE") ; err != nil {
+                return fakeResult{}, err
+            }
+
+            var cqlType fakeType
+            if cqlType, err = p.cqlType() ; err != nil {
+                return fakeResult{}, err
+            }
+            if _, err = cqlType.Validator(keyspace, self.modern()) ; err != nil {
+                return fakeResult{}, err
+            }
+            if err = p.finish() ; err != nil {
+                return fakeResult{}, err
+            }
+
+            if (table.column(column) == nil) {
+                return fakeResult{}, fmt.Errorf("Column %s was not found in table %s", column, table.name)
+            }
+            table.column(column).cqlType = cqlType
+
+        case p.accept("RENAME"):
+            var from, err = p.name()
+            if (err != nil) {
+                return fakeResult{}, err
+            }
+            if err = p.expect("TO") ; err != nil {
+                return fakeResult{}, err
+            }
+
+            var to string
+            if to, err = p.name() ; err != nil {
+                return fakeResult{}, err
+            }
+            if err = p.finish() ; err != nil {
+                return fakeResult{}, err
+            }
+
+            if (!table.isPrimary(from)) {
+                return fakeResult{}, fmt.Errorf("Cannot rename non PRIMARY KEY part %s", from)
+            }
+            if (table.column(to) != nil) {
+                return fakeResult{}, fmt.Errorf("Cannot rename column %s to %s in keyspace %s; another column of that name already exist", from, to, table.keyspace)
+            }
+
+            table.column(from).name = to
+            for _, keys := range [][]string{ table.partition, table.clustering } {
+                for i, key := range keys {
+                    if (key == from) { keys[i] = to }
+                }
+            }
+            for _, row := range table.rows {
+                row.values[to] = row.values[from]
+                delete(row.values, from)
+            }
+
+        case p.accept("WITH"):
+            // set on a copy so a statement that fails changes nothing
+            var altered = *table
+            altered.options = make(map[string]interface{})
+            for name, value := range table.options {
+                altered.options[name] = value
+            }
+
+            var descending, err = tableOptions(p, &altered)
+            if (err != nil) {
+                return fakeResult{}, err
+            }
+            if err = p.finish() ; err != nil {
+                return fakeResult{}, err
+            }
+            if (len(descending) > 0) {
+                return fakeResult{}, fmt.Errorf("Cannot change the clustering order of a table")
+            }
+            table.options = altered.options
+
+        default:
+            return fakeResult{}, p.unexpected("ADD, DROP, ALTER, RENAME or WITH")
+    }
+
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+
+//
+//  createIndex
+//      '[CUSTOM] INDEX [IF NOT EXISTS] [name] ON table (column | keys(column) | values(column) | entries(column) | full(column)) [USING 'class']'
+//      Unnamed indexes are called table_column_idx, a plain index on a collection indexes its values
+//
+func (self *Fake) createIndex(p *parser, custom bool) (fakeResult, error) {
+    var ifNotExists = p.accept("IF", "NOT", "EXISTS")
+
+    var name string
+    var err error
+    if (!p.at("ON")) {
+        if name, err = p.name() ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+    if err = p.expect("ON") ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var keyspaceName, tableName string
+    if keyspaceName, tableName, err = p.tableName() ; err != nil {
+        return fakeResult{}, err
+    }
+    if err = p.expect("(") ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var columnName, target string
+    for _, function := range []string{ "KEYS", "VALUES", "ENTRIES", "FULL" } {
+        if (p.accept(function, "(")) {
+            target = strings.ToLower(function)
+            break
+        }
+    }
+    if columnName, err = p.name() ; err != nil {
+        return fakeResult{}, err
+    }
+    if (len(target) > 0) {
+        if err = p.expect(")") ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+    if err = p.expect(")") ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var class string
+    if (custom) {
+        if err = p.expect("USING") ; err != nil {
+            return fakeResult{}, err
+        }
+
+        var value interface{}
+        if value, err = p.value() ; err != nil {
+            return fakeResult{}, err
+        }
+        class = fmt.Sprint(value)
+
+        if (p.accept("WITH", "OPTIONS", "=")) {
+            if _, err = p.value() ; err != nil {
+                return fakeResult{}, err
+            }
+        }
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var table *fakeTable
+    if table, err = self.writableTable(keyspaceName, tableName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var column = table.column(columnName)
+    if (column == nil) {
+        return fakeResult{}, fmt.Errorf("No column definition found for column %s", columnName)
+    }
+    if (column.kind == "partition_key" && len(table.partition) == 1) {
+        return fakeResult{}, fmt.Errorf("Cannot create secondary index on partition key column %s", columnName)
+    }
+    var collection = column.cqlType.Name == "list" || column.cqlType.Name == "set" || column.cqlType.Name == "map"
+    switch (target) {
+        case "keys", "entries":
+            if (column.cqlType.Name != "map") {
+                return fakeResult{}, fmt.Errorf("Cannot create index on %s of column %s with non-map type", target, columnName)
+            }
+        case "values":
+            if (!collection) {
+                return fakeResult{}, fmt.Errorf("Cannot create index on values() of column %s. Non-collection columns support only simple indexes", columnName)
+            }
+        case "full":
+            if (column.cqlType.Name != "frozen") {
+                return fakeResult{}, fmt.Errorf("full() indexes can only be created on frozen collections")
+            }
+        default:
+            if (collection) { target = "values" }
+    }
+
+    if (len(name) == 0) { name = table.name + "_" + column.name + "_idx" }
+    if (len(column.index) > 0 || self.indexed(table.keyspace, name) != nil) {
+        if (ifNotExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("Index %s already exists", name)
+    }
+
+    column.index = name
+    column.indexClass = class
+    column.indexTarget = target
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+//
+//  indexed
+//      The column carrying the named index in the keyspace, nil if there is none
+//
+func (self *Fake) indexed(keyspace, name string) *fakeColumn {
+    for _, table := range self.keyspaces[keyspace].tables {
+        for _, column := range table.columns {
+            if (column.index == name) { return column }
+        }
+    }
+    return nil
+}
+
+
+func (self *Fake) dropIndex(p *parser) (fakeResult, error) {
+    var ifExists = p.accept("IF", "EXISTS")
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(keyspaceName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var column = self.indexed(keyspace.name, name)
+    if (column == nil) {
+        if (ifExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("Index '%s' could not be found in any of the tables of keyspace '%s'", name, keyspace.name)
+    }
+
+    column.index = ""
+    column.indexClass = ""
+    column.indexTarget = ""
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+
+//
+//  createType
+//      'TYPE [IF NOT EXISTS] name (field type, ...)', fields may only use the built-in types
+//
+func (self *Fake) createType(p *parser) (fakeResult, error) {
+    var ifNotExists = p.accept("IF", "NOT", "EXISTS")
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(keyspaceName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var userType = &fakeUserType{ name: name }
+    if err = p.expect("(") ; err != nil {
+        return fakeResult{}, err
+    }
+    for {
+        var column, err = p.columnDefinition()
+        if (err != nil) {
+            return fakeResult{}, err
+        }
+        if _, err = column.cqlType.Validator(keyspace, self.modern()) ; err != nil {
+            return fakeResult{}, err
+        }
+        if (indexOf(userType.fields, column.name) >= 0) {
+            return fakeResult{}, fmt.Errorf("Duplicate field name %s in type %s", column.name, name)
+        }
+        userType.fields = append(userType.fields, column.name)
+        userType.types = append(userType.types, column.cqlType)
+
+        if (p.accept(")")) { break }
+        if err = p.expect(",") ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if _, exists := keyspace.types[name] ; exists {
+        if (ifNotExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("A user type of name %s.%s already exists", keyspace.name, name)
+    }
+
+    keyspace.types[name] = userType
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+
+//
+//  alterType
+//      'TYPE name ADD field type', renaming fields is not supported
+//
+func (self *Fake) alterType(p *parser) (fakeResult, error) {
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(keyspaceName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var userType, exists = keyspace.types[name]
+    if (!exists) {
+        return fakeResult{}, fmt.Errorf("No user type named %s exists.", name)
+    }
+
+    if err = p.expect("ADD") ; err != nil {
+        return fakeResult{}, err
+    }
+    var column *fakeColumn
+    if column, err = p.columnDefinition() ; err != nil {
+        return fakeResult{}, err
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if _, err = column.cqlType.Validator(keyspace, self.modern()) ; err != nil {
+        return fakeResult{}, err
+    }
+    if (column.cqlType.uses(name)) {
+        return fakeResult{}, fmt.Errorf("Cannot add new field %s of type %s to type %s as this would create a circular reference", column.name, column.cqlType, name)
+    }
+    if (indexOf(userType.fields, column.name) >= 0) {
+        return fakeResult{}, fmt.Errorf("Cannot add new field %s to type %s: a field of the same name already exists", column.name, name)
+    }
+
+    userType.fields = append(userType.fields, column.name)
+    userType.types = append(userType.types, column.cqlType)
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+
+func (self *Fake) dropType(p *parser) (fakeResult, error) {
+    var ifExists = p.accept("IF", "EXISTS")
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(keyspaceName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if _, exists := keyspace.types[name] ; !exists {
+        if (ifExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("No user type named %s exists.", name)
+    }
+    for _, table := range keyspace.tables {
+        for _, column := range table.columns {
+            if (column.cqlType.uses(name)) {
+                return fakeResult{}, fmt.Errorf("Cannot drop user type %s.%s as it is still used by table %s.%s", keyspace.name, name, keyspace.name, table.name)
+            }
+        }
+    }
+    for _, other := range keyspace.types {
+        for _, field := range other.types {
+            if (field.uses(name)) {
+                return fakeResult{}, fmt.Errorf("Cannot drop user type %s.%s as it is still used by user type %s", keyspace.name, name, other.name)
+            }
+        }
+    }
+
+    delete(keyspace.types, name)
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+
+//
+//  createFunction
+//      CREATE [OR REPLACE] FUNCTION [IF NOT EXISTS] name (argument type, ...)
+//      (CALLED | RETURNS NULL) ON NULL INPUT RETURNS type LANGUAGE language AS 'body'
+//      The body is kept, never run
+//
+func (self *Fake) createFunction(p *parser, replace bool) (fakeResult, error) {
+    if (!self.hasFunctions()) {
+        return fakeResult{}, fmt.Errorf("Cassandra %s does not support user defined functions", self.release)
+    }
+    var ifNotExists = p.accept("IF", "NOT", "EXISTS")
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(keyspaceName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var function = &fakeFunction{ name: name }
+    if err = p.expect("(") ; err != nil {
+        return fakeResult{}, err
+    }
+    for !p.accept(")") {
+        var argument, err = p.columnDefinition()
+        if (err != nil) {
+            return fakeResult{}, err
+        }
+        if _, err = argument.cqlType.Validator(keyspace, self.modern()) ; err != nil {
+            return fakeResult{}, err
+        }
+        if (indexOf(function.arguments, argument.name) >= 0) {
+            return fakeResult{}, fmt.Errorf("duplicate argument names for given function %s with argument names %s", name, argument.name)
+        }
+        function.arguments = append(function.arguments, argument.name)
+        function.types = append(function.types, argument.cqlType)
+
+        if (!p.at(")")) {
+            if err = p.expect(",") ; err != nil {
+                return fakeResult{}, err
+            }
+        }
+    }
+
+    switch {
+        case p.accept("CALLED", "ON", "NULL", "INPUT"):
+            function.calledOnNull = true
+        case p.accept("RETURNS", "NULL", "ON", "NULL", "INPUT"):
+        default:
+            return fakeResult{}, p.unexpected("CALLED ON NULL INPUT or RETURNS NULL ON NULL INPUT")
+    }
+
+    if err = p.expect("RETURNS") ; err != nil {
+        return fakeResult{}, err
+    }
+    if function.returns, err = p.cqlType() ; err != nil {
+        return fakeResult{}, err
+    }
+    if _, err = function.returns.Validator(keyspace, self.modern()) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if err = p.expect("LANGUAGE") ; err != nil {
+        return fakeResult{}, err
+    }
+    if function.language, err = p.name() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if err = p.expect("AS") ; err != nil {
+        return fakeResult{}, err
+    }
+    if (p.peek().kind != TOKEN_STRING) {
+        return fakeResult{}, p.unexpected("the body of the function")
+    }
+    function.body = p.next().text
+
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var key = signature(name, function.types)
+    if _, exists := keyspace.functions[key] ; exists && !replace {
+        if (ifNotExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("Function %s.%s already exists", keyspace.name, key)
+    }
+
+    keyspace.functions[key] = function
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+//
+//  createAggregate
+//      CREATE [OR REPLACE] AGGREGATE [IF NOT EXISTS] name (type, ...)
+//      SFUNC function STYPE type [FINALFUNC function] [INITCOND value]
+//      The state function takes the state and then the arguments, the final function just the state
+//
+func (self *Fake) createAggregate(p *parser, replace bool) (fakeResult, error) {
+    if (!self.hasFunctions()) {
+        return fakeResult{}, fmt.Errorf("Cassandra %s does not support user defined aggregates", self.release)
+    }
+    var ifNotExists = p.accept("IF", "NOT", "EXISTS")
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(keyspaceName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var aggregate = &fakeAggregate{ name: name }
+    if aggregate.types, err = p.argumentTypes() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if err = p.expect("SFUNC") ; err != nil {
+        return fakeResult{}, err
+    }
+    if aggregate.stateFunc, err = p.name() ; err != nil {
+        return fakeResult{}, err
+    }
+    if err = p.expect("STYPE") ; err != nil {
+        return fakeResult{}, err
+    }
+    if aggregate.stateType, err = p.cqlType() ; err != nil {
+        return fakeResult{}, err
+    }
+    if (p.accept("FINALFUNC")) {
+        if aggregate.finalFunc, err = p.name() ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+    if (p.accept("INITCOND")) {
+        if aggregate.initcond, err = p.value() ; err != nil {
+            return fakeResult{}, err
+        }
+        // before 3.0 it is kept serialized
+        if (!self.modern()) {
+            if _, err = initcondBlob(aggregate.stateType, aggregate.initcond) ; err != nil {
+                return fakeResult{}, err
+            }
+        }
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var state = signature(aggregate.stateFunc, append([]fakeType{ aggregate.stateType }, aggregate.types...))
+    if _, exists := keyspace.functions[state] ; !exists {
+        return fakeResult{}, fmt.Errorf("State function %s.%s does not exist", keyspace.name, state)
+    }
+    if (len(aggregate.finalFunc) > 0) {
+        var final = signature(aggregate.finalFunc, []fakeType{ aggregate.stateType })
+        if _, exists := keyspace.functions[final] ; !exists {
+            return fakeResult{}, fmt.Errorf("Final function %s.%s does not exist", keyspace.name, final)
+        }
+    }
+
+    var key = signature(name, aggregate.types)
+    if _, exists := keyspace.aggregates[key] ; exists && !replace {
+        if (ifNotExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("Aggregate %s.%s already exists", keyspace.name, key)
+    }
+
+    keyspace.aggregates[key] = aggregate
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+//
+//  returns
+//      The type an aggregate returns, that of its final function or else its state
+//
+func (self *fakeAggregate) returns(keyspace *fakeKeyspace) fakeType {
+    if final, exists := keyspace.functions[signature(self.finalFunc, []fakeType{ self.stateType })] ; exists {
+        return final.returns
+    }
+    return self.stateType
+}
+
+//
+//  uses
+//      Whether the function of the given signature is the aggregate's state or final function
+//
+func (self *fakeAggregate) uses(function string) bool {
+    return function == signature(self.stateFunc, append([]fakeType{ self.stateType }, self.types...)) ||
+        (len(self.finalFunc) > 0 && function == signature(self.finalFunc, []fakeType{ self.stateType }))
+}
+
+//
+//  overload
+//      The signature of the function or aggregate a DROP names
+//      Without argument types the name must not be overloaded
+//
+func overload(kind, name string, typed bool, types []fakeType, signatures []string) (string, error) {
+    var matches []string
+    for _, candidate := range signatures {
+        if (typed && candidate == signature(name, types)) { return candidate, nil }
+        if (!typed && strings.HasPrefix(candidate, name + "(")) { matches = append(matches, candidate) }
+    }
+
+    if (len(matches) > 1) {
+        return "", fmt.Errorf("'DROP %s %s' matches multiple function definitions; specify the argument types by issuing a statement like 'DROP %s %s (type, type, ...)'", kind, name, kind, name)
+    }
+    if (len(matches) == 0) {
+        return "", nil
+    }
+    return matches[0], nil
+}
+
+func (self *Fake) dropFunction(p *parser) (fakeResult, error) {
+    var ifExists = p.accept("IF", "EXISTS")
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var types []fakeType
+    var typed = p.at("(")
+    if (typed) {
+        if types, err = p.argumentTypes() ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(keyspaceName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var signatures []string
+    for key := range keyspace.functions {
+        signatures = append(signatures, key)
+    }
+
+    var key string
+    if key, err = overload("FUNCTION", name, typed, types, signatures) ; err != nil {
+        return fakeResult{}, err
+    }
+    if (len(key) == 0) {
+        if (ifExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("Cannot drop non existing function '%s'", name)
+    }
+    for _, aggregate := range keyspace.aggregates {
+        if (aggregate.uses(key)) {
+            return fakeResult{}, fmt.Errorf("Cannot drop function %s.%s as it is used by aggregate %s", keyspace.name, key, aggregate.name)
+        }
+    }
+
+    delete(keyspace.functions, key)
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+func (self *Fake) dropAggregate(p *parser) (fakeResult, error) {
+    var ifExists = p.accept("IF", "EXISTS")
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var types []fakeType
+    var typed = p.at("(")
+    if (typed) {
+        if types, err = p.argumentTypes() ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(keyspaceName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var signatures []string
+    for key := range keyspace.aggregates {
+        signatures = append(signatures, key)
+    }
+
+    var key string
+    if key, err = overload("AGGREGATE", name, typed, types, signatures) ; err != nil {
+        return fakeResult{}, err
+    }
+    if (len(key) == 0) {
+        if (ifExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("Cannot drop non existing aggregate '%s'", name)
+    }
+
+    delete(keyspace.aggregates, key)
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+
+//
+//  createView
+//      CREATE MATERIALIZED VIEW [IF NOT EXISTS] name AS SELECT (* | column, ...) FROM table
+//      WHERE ... PRIMARY KEY (...) [WITH options]
+//      Views are only described, the fake never fills them with rows
+//
+func (self *Fake) createView(p *parser) (fakeResult, error) {
+    if (!self.modern()) {
+        return fakeResult{}, fmt.Errorf("Cassandra %s does not support materialized views", self.release)
+    }
+    var ifNotExists = p.accept("IF", "NOT", "EXISTS")
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(keyspaceName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if err = p.expect("AS", "SELECT") ; err != nil {
+        return fakeResult{}, err
+    }
+    var view = &fakeView{ includeAll: p.accept("*") }
+    var selected []string
+    for !view.includeAll {
+        var column, err = p.name()
+        if (err != nil) {
+            return fakeResult{}, err
+        }
+        selected = append(selected, column)
+        if (!p.accept(",")) { break }
+    }
+
+    if err = p.expect("FROM") ; err != nil {
+        return fakeResult{}, err
+    }
+    var baseKeyspace string
+    if baseKeyspace, view.base, err = p.tableName() ; err != nil {
+        return fakeResult{}, err
+    }
+    if (len(baseKeyspace) > 0 && baseKeyspace != keyspace.name) {
+        return fakeResult{}, fmt.Errorf("Cannot create a materialized view on a table in a separate keyspace")
+    }
+    var base, exists = keyspace.tables[view.base]
+    if (!exists) {
+        return fakeResult{}, fmt.Errorf("unconfigured table %s", view.base)
+    }
+
+    if err = p.expect("WHERE") ; err != nil {
+        return fakeResult{}, err
+    }
+    view.where = p.text("PRIMARY", "KEY")
+
+    view.table = newFakeTable(keyspace.name, name)
+    if err = p.expect("PRIMARY", "KEY") ; err != nil {
+        return fakeResult{}, err
+    }
+    if view.table.partition, view.table.clustering, err = p.primaryKey() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var descending []string
+    if (p.accept("WITH")) {
+        if descending, err = tableOptions(p, view.table) ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var key = append(append([]string{}, view.table.partition...), view.table.clustering...)
+    for _, column := range append(append([]string{}, selected...), key...) {
+        if (base.column(column) == nil) {
+            return fakeResult{}, fmt.Errorf("Unknown column name detected in CREATE MATERIALIZED VIEW statement: %s", column)
+        }
+    }
+    for _, column := range append(append([]string{}, base.partition...), base.clustering...) {
+        if (indexOf(key, column) < 0) {
+            return fakeResult{}, fmt.Errorf("Cannot create Materialized View %s without primary key columns from base %s (%s)", name, base.name, column)
+        }
+    }
+
+    for _, column := range base.columns {
+        if (view.includeAll || indexOf(selected, column.name) >= 0 || indexOf(key, column.name) >= 0) {
+            view.table.columns = append(view.table.columns, &fakeColumn{ name: column.name, kind: "regular", cqlType: column.cqlType })
+        }
+    }
+    if err = view.table.markKey(descending) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var _, isTable = keyspace.tables[name]
+    if _, isView := keyspace.views[name] ; isView || isTable {
+        if (ifNotExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("Cannot add already existing table \"%s\" to keyspace \"%s\"", name, keyspace.name)
+    }
+
+    keyspace.views[name] = view
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+func (self *Fake) dropView(p *parser) (fakeResult, error) {
+    var ifExists = p.accept("IF", "EXISTS")
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var keyspace *fakeKeyspace
+    if keyspace, err = self.keyspaceNamed(keyspaceName) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    if _, exists := keyspace.views[name] ; !exists {
+        if (ifExists) { return fakeResult{ applied: true }, nil }
+        return fakeResult{}, fmt.Errorf("Cannot drop non existing materialized view '%s' in keyspace '%s'.", name, keyspace.name)
+    }
+
+    delete(keyspace.views, name)
+    self.version++
+    return fakeResult{ applied: true }, nil
+}
+
+
+//
+//  check
+//      Whether the conditions hold for the row (nil when it does not exist)
+//      When they do not, existing holds the values the conditions saw
+//
+func (self ifClause) check(row *fakeRow) (applied bool, existing map[string]interface{}) {
+    existing = make(map[string]interface{})
+    if (!self.conditional) {
+        return true, existing
+    }
+
+    if (row == nil) {
+        return self.notExists, existing
+    }
+    if (self.notExists) {
+        for name, value := range row.values {
+            existing[name] = value
+        }
+        return false, existing
+    }
+
+    applied = true
+    for _, condition := range self.conditions {
+        existing[condition.column] = row.values[condition.column]
+        if (!sameValue(row.values[condition.column], condition.values[0])) { applied = false }
+    }
+    if (applied) { existing = make(map[string]interface{}) }
+    return applied, existing
+}
+
+//
+//  primaryKey
+//      The row key fixed by WHERE conditions, which may only name primary key columns
+//
+func (self *fakeTable) primaryKey(conditions []condition) (string, map[string]interface{}, error) {
+    var values = make(map[string]interface{})
+    for _, condition := range conditions {
+        if (!self.isPrimary(condition.column)) {
+            return "", nil, fmt.Errorf("Non PRIMARY KEY %s found in where clause", condition.column)
+        }
+        if (len(condition.values) != 1) {
+            return "", nil, fmt.Errorf("IN is not supported for %s by the fake session", condition.column)
+        }
+        values[condition.column] = condition.values[0]
+    }
+
+    var key, err = self.key(values)
+    return key, values, err
+}
+
+
+func (self *Fake) insert(p *parser) (fakeResult, error) {
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var columns []string
+    if columns, err = p.names() ; err != nil {
+        return fakeResult{}, err
+    }
+    if err = p.expect("VALUES", "(") ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var values = make(map[string]interface{})
+    for i := 0 ; !p.accept(")") ; i++ {
+        if (i > 0) {
+            if err = p.expect(",") ; err != nil {
+                return fakeResult{}, err
+            }
+        }
+
+        var value interface{}
+        if value, err = p.value() ; err != nil {
+            return fakeResult{}, err
+        }
+        if (i >= len(columns)) {
+            return fakeResult{}, fmt.Errorf("Unmatched column names/values")
+        }
+        values[columns[i]] = value
+    }
+    if (len(values) != len(columns)) {
+        return fakeResult{}, fmt.Errorf("Unmatched column names/values")
+    }
+
+    // IF NOT EXISTS and USING may come in either order
+    var ttl int
+    var clause ifClause
+    for {
+        if (p.at("IF")) {
+            if clause, err = p.ifClause() ; err != nil {
+                return fakeResult{}, err
+            }
+        } else if (p.accept("USING")) {
+            if ttl, err = p.using() ; err != nil {
+                return fakeResult{}, err
+            }
+        } else {
+            break
+        }
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var table *fakeTable
+    if table, err = self.writableTable(keyspaceName, name) ; err != nil {
+        return fakeResult{}, err
+    }
+    for _, column := range columns {
+        if (table.column(column) == nil) {
+            return fakeResult{}, fmt.Errorf("Unknown identifier %s", column)
+        }
+    }
+
+    var key string
+    if key, err = table.key(values) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var applied, existing = clause.check(table.row(key))
+    if (applied) { table.write(key, values, ttl) }
+
+    return fakeResult{ applied: applied, existing: existing }, nil
+}
+
+
+func (self *Fake) update(p *parser) (fakeResult, error) {
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var ttl int
+    if (p.accept("USING")) {
+        if ttl, err = p.using() ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+
+    if err = p.expect("SET") ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var assignments = make(map[string]interface{})
+    for {
+        var column, err = p.name()
+        if (err != nil) {
+            return fakeResult{}, err
+        }
+        if err = p.expect("=") ; err != nil {
+            return fakeResult{}, err
+        }
+        if assignments[column], err = p.value() ; err != nil {
+            return fakeResult{}, err
+        }
+
+        if (!p.accept(",")) { break }
+    }
+
+    var conditions []condition
+    if err = p.expect("WHERE") ; err != nil {
+        return fakeResult{}, err
+    }
+    if conditions, err = p.conditions() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var clause ifClause
+    if clause, err = p.ifClause() ; err != nil {
+        return fakeResult{}, err
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var table *fakeTable
+    if table, err = self.writableTable(keyspaceName, name) ; err != nil {
+        return fakeResult{}, err
+    }
+    for column := range assignments {
+        if (table.column(column) == nil) {
+            return fakeResult{}, fmt.Errorf("Unknown identifier %s", column)
+        }
+        if (table.isPrimary(column)) {
+            return fakeResult{}, fmt.Errorf("PRIMARY KEY part %s found in SET part", column)
+        }
+    }
+
+    var key string
+    var values map[string]interface{}
+    if key, values, err = table.primaryKey(conditions) ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var applied, existing = clause.check(table.row(key))
+    if (applied) {
+        for column, value := range assignments {
+            values[column] = value
+        }
+        table.write(key, values, ttl)
+    }
+
+    return fakeResult{ applied: applied, existing: existing }, nil
+}
+
+
+func (self *Fake) delete(p *parser) (fakeResult, error) {
+    // deleting named columns leaves the rest of the row
+    var columns []string
+    for !p.accept("FROM") {
+        var column, err = p.name()
+        if (err != nil) {
+            return fakeResult{}, err
+        }
+        columns = append(columns, column)
+        p.accept(",")
+    }
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var conditions []condition
+    if err = p.expect("WHERE") ; err != nil {
+        return fakeResult{}, err
+    }
+    if conditions, err = p.conditions() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var clause ifClause
+    if clause, err = p.ifClause() ; err != nil {
+        return fakeResult{}, err
+    }
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var table *fakeTable
+    if table, err = self.writableTable(keyspaceName, name) ; err != nil {
+        return fakeResult{}, err
+    }
+    for _, condition := range conditions {
+        if (!table.isPrimary(condition.column)) {
+            return fakeResult{}, fmt.Errorf("Non PRIMARY KEY %s found in where clause", condition.column)
+        }
+    }
+
+    var matched = matching(table.live(), conditions)
+    if (clause.conditional) {
+        var row *fakeRow
+        if (len(matched) > 0) { row = matched[0] }
+
+        var applied, existing = clause.check(row)
+        if (!applied) {
+            return fakeResult{ applied: false, existing: existing }, nil
+        }
+    }
+
+    for _, row := range matched {
+        if (len(columns) == 0) {
+            delete(table.rows, row.key)
+        }
+        for _, column := range columns {
+            delete(row.values, column)
+        }
+    }
+
+    return fakeResult{ applied: true }, nil
+}
+
+//
+//  matching
+//      The rows every condition holds for
+//
+func matching(rows []*fakeRow, conditions []condition) []*fakeRow {
+    var matched []*fakeRow
+    for _, row := range rows {
+        var matches = true
+        for _, condition := range conditions {
+            var found = false
+            for _, value := range condition.values {
+                if (sameValue(row.values[condition.column], value)) { found = true }
+            }
+            matches = matches && found
+        }
+
+        if (matches) { matched = append(matched, row) }
+    }
+
+    return matched
+}
+
+
+func (self *Fake) selectRows(p *parser) (fakeResult, error) {
+    var columns []string
+    var star = p.accept("*")
+    for !star && !p.accept("FROM") {
+        var column, err = p.name()
+        if (err != nil) {
+            return fakeResult{}, err
+        }
+        columns = append(columns, column)
+        p.accept(",")
+    }
+    if (star) {
+        if err := p.expect("FROM") ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+
+    var keyspaceName, name, err = p.tableName()
+    if (err != nil) {
+        return fakeResult{}, err
+    }
+
+    var conditions []condition
+    if (p.accept("WHERE")) {
+        if conditions, err = p.conditions() ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+
+    var limit = -1
+    if (p.accept("LIMIT")) {
+        var value interface{}
+        if value, err = p.value() ; err != nil {
+            return fakeResult{}, err
+        }
+        if limit, err = toInt(value) ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+    p.accept("ALLOW", "FILTERING")
+
+    if err = p.finish() ; err != nil {
+        return fakeResult{}, err
+    }
+
+    var table *fakeTable
+    if table, err = self.table(keyspaceName, name) ; err != nil {
+        return fakeResult{}, err
+    }
+    if (isSystem(table.keyspace)) {
+        table = self.systemView(table)
+    }
+
+    if (star) { columns = table.star() }
+    for _, column := range columns {
+        if (table.column(column) == nil) {
+            return fakeResult{}, fmt.Errorf("Undefined name %s in selection clause", column)
+        }
+    }
+    for _, condition := range conditions {
+        if (table.column(condition.column) == nil) {
+            return fakeResult{}, fmt.Errorf("Undefined name %s in where clause", condition.column)
+        }
+    }
+
+    var result = fakeResult{ applied: true }
+    for _, row := range matching(table.live(), conditions) {
+        if (limit >= 0 && len(result.rows) >= limit) { break }
+
+        var values []interface{}
+        for _, column := range columns {
+            values = append(values, row.values[column])
+        }
+        result.rows = append(result.rows, values)
+    }
+
+    return result, nil
+}
+
+
+//
+//  batch
+//      'BEGIN [UNLOGGED | COUNTER] BATCH [USING ...] statements APPLY BATCH'
+//
+func (self *Fake) batch(p *parser) (fakeResult, error) {
+    p.accept("UNLOGGED")
+    p.accept("COUNTER")
+    if err := p.expect("BATCH") ; err != nil {
+        return fakeResult{}, err
+    }
+    if (p.accept("USING")) {
+        if _, err := p.using() ; err != nil {
+            return fakeResult{}, err
+        }
+    }
+
+    p.batch = true
+    defer func() { p.batch = false }()
+
+    for !p.accept("APPLY", "BATCH") {
+        if (p.done()) {
+            return fakeResult{}, p.unexpected("APPLY BATCH")
+        }
+
+        if (!p.at("INSERT") && !p.at("UPDATE") && !p.at("DELETE")) {
+            return fakeResult{}, fmt.Errorf("only INSERT, UPDATE and DELETE are allowed in a batch")
+        }
+        if _, err := self.statement(p) ; err != nil {
+            return fakeResult{}, err
+        }
+        p.accept(";")
+    }
+
+    return fakeResult{ applied: true }, nil
+}
+
+
+//-------------------------------------------------------
+// System Tables
+//-------------------------------------------------------
+
+func isSystem(keyspace string) bool {
+    return keyspace == "system" || keyspace == "system_schema"
+}
+
+//
+//  systemView
+//      A copy of the system table filled with rows describing the fake's state
+//
+func (self *Fake) systemView(table *fakeTable) *fakeTable {
+    var view = *table
+    view.rows = make(map[string]*fakeRow)
+
+    var add = func(values map[string]interface{}) {
+        var key, _ = view.key(values)
+        view.rows[key] = &fakeRow{ key: key, values: values }
+    }
+
+    var cqlVersion = "3.2.1"
+    if (self.modern()) { cqlVersion = "3.4.4" }
+
+    switch (table.keyspace + "." + table.name) {
+        case "system.local":
+            add(map[string]interface{}{
+                "key":                  "local",
+                "broadcast_address":    "127.0.0.1",
+                "cluster_name":         "Fake Cluster",
+                "cql_version":          cqlVersion,
+                "data_center":          "datacenter1",
+                "partitioner":          "org.apache.cassandra.dht.Murmur3Partitioner",
+                "rack":                 "rack1",
+                "release_version":      self.release,
+                "schema_version":       self.schemaVersion(),
+            })
+
+        case "system.peers":
+            for address, version := range self.Peers {
+                add(map[string]interface{}{
+                    "peer":                 address,
+                    "data_center":          "datacenter1",
+                    "rack":                 "rack1",
+                    "release_version":      self.release,
+                    "rpc_address":          address,
+                    "schema_version":       version,
+                })
+            }
+
+        case "system.schema_keyspaces":
+            for _, keyspace := range self.keyspaces {
+                var options, _ = json.Marshal(keyspace.options)
+                add(map[string]interface{}{
+                    "keyspace_name":        keyspace.name,
+                    "durable_writes":       keyspace.durable,
+                    "strategy_class":       keyspace.class,
+                    "strategy_options":     string(options),
+                })
+            }
+
+        case "system.schema_columnfamilies":
+            for _, keyspace := range self.keyspaces {
+                for _, described := range keyspace.tables {
+                    add(columnFamilyRow(described))
+                }
+            }
+
+        case "system.schema_columns":
+            for _, keyspace := range self.keyspaces {
+                for _, described := range keyspace.tables {
+                    for _, column := range described.columns {
+                        add(columnRow(keyspace, described, column))
+                    }
+                }
+            }
+
+        case "system.schema_usertypes":
+            for _, keyspace := range self.keyspaces {
+                for _, described := range keyspace.types {
+                    var validators []string
+                    for _, field := range described.types {
+                        var validator, _ = field.Validator(keyspace, false)
+                        validators = append(validators, validator)
+                    }
+                    add(map[string]interface{}{
+                        "keyspace_name":        keyspace.name,
+                        "type_name":            described.name,
+                        "field_names":          append([]string{}, described.fields...),
+                        "field_types":          validators,
+                    })
+                }
+            }
+
+        case "system.schema_functions":
+            for _, keyspace := range self.keyspaces {
+                for _, function := range keyspace.functions {
+                    var signature, validators []string
+                    for _, argument := range function.types {
+                        var validator, _ = argument.Validator(keyspace, false)
+                        signature = append(signature, argument.String())
+                        validators = append(validators, validator)
+                    }
+                    var returns, _ = function.returns.Validator(keyspace, false)
+                    add(map[string]interface{}{
+                        "keyspace_name":        keyspace.name,
+                        "function_name":        function.name,
+                        "signature":            signature,
+                        "argument_names":       append([]string{}, function.arguments...),
+                        "argument_types":       validators,
+                        "body":                 function.body,
+                        "called_on_null_input": function.calledOnNull,
+                        "language":             function.language,
+                        "return_type":          returns,
+                    })
+                }
+            }
+
+        case "system.schema_aggregates":
+            for _, keyspace := range self.keyspaces {
+                for _, aggregate := range keyspace.aggregates {
+                    var signature, validators []string
+                    for _, argument := range aggregate.types {
+                        var validator, _ = argument.Validator(keyspace, false)
+                        signature = append(signature, argument.String())
+                        validators = append(validators, validator)
+                    }
+                    var returns, _ = aggregate.returns(keyspace).Validator(keyspace, false)
+                    var state, _ = aggregate.stateType.Validator(keyspace, false)
+                    var initcond, _ = initcondBlob(aggregate.stateType, aggregate.initcond)
+                    add(map[string]interface{}{
+                        "keyspace_name":        keyspace.name,
+                        "aggregate_name":       aggregate.name,
+                        "signature":            signature,
+                        "argument_types":       validators,
+                        "final_func":           aggregate.finalFunc,
+                        "initcond":             initcond,
+                        "return_type":          returns,
+                        "state_func":           aggregate.stateFunc,
+                        "state_type":           state,
+                    })
+                }
+            }
+
+        case "system_schema.keyspaces":
+            for _, keyspace := range self.keyspaces {
+                var replication = map[string]string{ "class": keyspace.class }
+                for key, value := range keyspace.options {
+                    replication[key] = value
+                }
+                add(map[string]interface{}{
+                    "keyspace_name":        keyspace.name,
+                    "durable_writes":       keyspace.durable,
+                    "replication":          replication,
+                })
+            }
+
+        case "system_schema.tables":
+            for _, keyspace := range self.keyspaces {
+                for _, described := range keyspace.tables {
+                    var row = map[string]interface{}{
+                        "keyspace_name":        keyspace.name,
+                        "table_name":           described.name,
+                    }
+                    for name, value := range described.options {
+                        row[name] = value
+                    }
+                    add(row)
+                }
+            }
+
+        case "system_schema.columns":
+            for _, keyspace := range self.keyspaces {
+                for _, described := range keyspace.tables {
+                    for _, column := range described.columns {
+                        add(schemaColumnRow(described, column))
+                    }
+                }
+                for _, view := range keyspace.views {
+                    for _, column := range view.table.columns {
+                        add(schemaColumnRow(view.table, column))
+                    }
+                }
+            }
+
+        case "system_schema.views":
+            for _, keyspace := range self.keyspaces {
+                for _, view := range keyspace.views {
+                    add(map[string]interface{}{
+                        "keyspace_name":        keyspace.name,
+                        "view_name":            view.table.name,
+                        "base_table_name":      view.base,
+                        "include_all_columns":  view.includeAll,
+                        "where_clause":         view.where,
+                    })
+                }
+            }
+
+        case "system_schema.functions":
+            for _, keyspace := range self.keyspaces {
+                for _, function := range keyspace.functions {
+                    var types []string
+                    for _, argument := range function.types {
+                        types = append(types, argument.String())
+                    }
+                    add(map[string]interface{}{
+                        "keyspace_name":        keyspace.name,
+                        "function_name":        function.name,
+                        "argument_types":       types,
+                        "argument_names":       append([]string{}, function.arguments...),
+                        "body":                 function.body,
+                        "called_on_null_input": function.calledOnNull,
+                        "language":             function.language,
+                        "return_type":          function.returns.String(),
+                    })
+                }
+            }
+
+        case "system_schema.aggregates":
+            for _, keyspace := range self.keyspaces {
+                for _, aggregate := range keyspace.aggregates {
+                    var types []string
+                    for _, argument := range aggregate.types {
+                        types = append(types, argument.String())
+                    }
+                    var row = map[string]interface{}{
+                        "keyspace_name":        keyspace.name,
+                        "aggregate_name":       aggregate.name,
+                        "argument_types":       types,
+                        "final_func":           aggregate.finalFunc,
+                        "return_type":          aggregate.returns(keyspace).String(),
+                        "state_func":           aggregate.stateFunc,
+                        "state_type":           aggregate.stateType.String(),
+                    }
+                    if (aggregate.initcond != nil) { row["initcond"] = literal(aggregate.initcond) }
+                    add(row)
+                }
+            }
+
+        case "system_schema.indexes":
+            for _, keyspace := range self.keyspaces {
+                for _, described := range keyspace.tables {
+                    for _, column := range described.columns {
+                        if (len(column.index) == 0) { continue }
+
+                        var kind, target = "COMPOSITES", column.name
+                        var options = map[string]string{}
+                        if (len(column.indexTarget) > 0) { target = column.indexTarget + "(" + target + ")" }
+                        if (len(column.indexClass) > 0) {
+                            kind = "CUSTOM"
+                            options["class_name"] = column.indexClass
+                        }
+                        options["target"] = target
+
+                        add(map[string]interface{}{
+                            "keyspace_name":        keyspace.name,
+                            "table_name":           described.name,
+                            "index_name":           column.index,
+                            "kind":                 kind,
+                            "options":              options,
+                        })
+                    }
+                }
+            }
+
+        case "system_schema.types":
+            for _, keyspace := range self.keyspaces {
+                for _, described := range keyspace.types {
+                    var types []string
+                    for _, field := range described.types {
+                        types = append(types, field.String())
+                    }
+                    add(map[string]interface{}{
+                        "keyspace_name":        keyspace.name,
+                        "type_name":            described.name,
+                        "field_names":          append([]string{}, described.fields...),
+                        "field_types":          types,
+                    })
+                }
+            }
+    }
+
+    return &view
+}
+
+//
+//  columnFamilyRow
+//      The options of a table as the 2.x system.schema_columnfamilies has them
+//      Compaction thresholds have their own columns, the other compaction and compression options are JSON
+//
+func columnFamilyRow(table *fakeTable) map[string]interface{} {
+    var strategy = table.options["compaction"].(map[string]string)
+    var compaction = make(map[string]string)
+    for key, value := range strategy {
+        if (key != "class" && key != "max_threshold" && key != "min_threshold") { compaction[key] = value }
+    }
+
+    var compression = make(map[string]string)
+    for key, value := range table.options["compression"].(map[string]string) {
+        switch (key) {
+            case "class":               compression["sstable_compression"] = value
+            case "chunk_length_in_kb":  compression["chunk_length_kb"] = value
+            default:                    compression[key] = value
+        }
+    }
+
+    var caching, _ = json.Marshal(table.options["caching"])
+    var options, _ = json.Marshal(compaction)
+    var parameters, _ = json.Marshal(compression)
+    var max, _ = strconv.Atoi(strategy["max_threshold"])
+    var min, _ = strconv.Atoi(strategy["min_threshold"])
+
+    return map[string]interface{}{
+        "keyspace_name":                table.keyspace,
+        "columnfamily_name":            table.name,
+        "bloom_filter_fp_chance":       table.options["bloom_filter_fp_chance"],
+        "caching":                      string(caching),
+        "comment":                      table.options["comment"],
+        "compaction_strategy_class":    strategy["class"],
+        "compaction_strategy_options":  string(options),
+        "compression_parameters":       string(parameters),
+        "default_time_to_live":         table.options["default_time_to_live"],
+        "gc_grace_seconds":             table.options["gc_grace_seconds"],
+        "max_compaction_threshold":     max,
+        "min_compaction_threshold":     min,
+    }
+}
+
+//
+//  schemaColumnRow
+//      The system_schema.columns row of a column
+//      position is its place in the key, -1 for every other column
+//
+func schemaColumnRow(table *fakeTable, column *fakeColumn) map[string]interface{} {
+    var row = map[string]interface{}{
+        "keyspace_name":        table.keyspace,
+        "table_name":           table.name,
+        "column_name":          column.name,
+        "clustering_order":     "none",
+        "kind":                 column.kind,
+        "position":             -1,
+        "type":                 column.cqlType.String(),
+    }
+
+    switch (column.kind) {
+        case "partition_key":
+            row["position"] = indexOf(table.partition, column.name)
+        case "clustering_key":
+            row["kind"] = "clustering"
+            row["position"] = indexOf(table.clustering, column.name)
+            row["clustering_order"] = "asc"
+            if (column.reversed) { row["clustering_order"] = "desc" }
+    }
+
+    return row
+}
+
+//
+//  literal
+//      A value as CQL, as system_schema keeps the INITCOND of an aggregate
+//
+func literal(value interface{}) string {
+    switch value := value.(type) {
+        case string:
+            return "'" + strings.Replace(value, "'", "''", -1) + "'"
+        case map[string]interface{}:
+            var keys []string
+            for key := range value {
+                keys = append(keys, key)
+            }
+            sort.Strings(keys)
+
+            var entries []string
+            for _, key := range keys {
+                entries = append(entries, literal(key) + ": " + literal(value[key]))
+            }
+            return "{" + strings.Join(entries, ", ") + "}"
+    }
+    return fmt.Sprint(value)
+}
+
+//
+//  initcondBlob
+//      The INITCOND of an aggregate serialized as its state type, as the 2.2 schema tables keep it
+//      Nil without one, only native types the fake knows how to serialize are allowed
+//
+func initcondBlob(stateType fakeType, value interface{}) ([]byte, error) {
+    if (value == nil) {
+        return nil, nil
+    }
+
+    var buffer = new(bytes.Buffer)
+    var number, isNumber = value.(int64)
+    var fraction, isFraction = value.(float64)
+    if (isNumber) { fraction, isFraction = float64(number), true }
+
+    switch {
+        case stateType.Name == "int" && isNumber:
+            binary.Write(buffer, binary.BigEndian, int32(number))
+        case stateType.Name == "bigint" && isNumber:
+            binary.Write(buffer, binary.BigEndian, number)
+        case stateType.Name == "double" && isFraction:
+            binary.Write(buffer, binary.BigEndian, fraction)
+        case stateType.Name == "float" && isFraction:
+            binary.Write(buffer, binary.BigEndian, float32(fraction))
+        case stateType.Name == "boolean":
+            var flag, isBool = value.(bool)
+            if (!isBool) { return nil, fmt.Errorf("Invalid INITCOND %v for type %s", value, stateType) }
+            if (flag) { buffer.WriteByte(1) } else { buffer.WriteByte(0) }
+        case stateType.Name == "text" || stateType.Name == "varchar" || stateType.Name == "ascii":
+            var text, isText = value.(string)
+            if (!isText) { return nil, fmt.Errorf("Invalid INITCOND %v for type %s", value, stateType) }
+            buffer.WriteString(text)
+        default:
+            return nil, fmt.Errorf("the fake session cannot serialize an INITCOND of type %s", stateType)
+    }
+
+    return buffer.Bytes(), nil
+}
+
+//
+//  columnRow
+//      The system.schema_columns row of a column
+//      component_index is its position in the key, regular columns follow the clustering columns
+//      Columns clustered in DESC order have their validator wrapped in a ReversedType
+//
+func columnRow(keyspace *fakeKeyspace, table *fakeTable, column *fakeColumn) map[string]interface{} {
+    var validator, _ = column.cqlType.Validator(keyspace, false)
+    if (column.reversed) {
+        validator = MARSHAL_PACKAGE + "ReversedType(" + validator + ")"
+    }
+    var row = map[string]interface{}{
+        "keyspace_name":        table.keyspace,
+        "columnfamily_name":    table.name,
+        "column_name":          column.name,
+        "type":                 column.kind,
+        "validator":            validator,
+    }
+
+    switch (column.kind) {
+        case "partition_key":
+            if (len(table.partition) > 1) { row["component_index"] = indexOf(table.partition, column.name) }
+        case "clustering_key":
+            row["component_index"] = indexOf(table.clustering, column.name)
+        default:
+            if (len(table.clustering) > 0) { row["component_index"] = len(table.clustering) }
+    }
+
+    if (len(column.index) > 0) {
+        row["index_name"] = column.index
+        row["index_type"] = "COMPOSITES"
+        row["index_options"] = "{}"
+        switch (column.indexTarget) {
+            case "keys":
+                row["index_options"] = `{"index_keys":""}`
+            case "entries":
+                row["index_options"] = `{"index_keys_and_values":""}`
+        }
+        if (len(column.indexClass) > 0) {
+            var options, _ = json.Marshal(map[string]string{ "class_name": column.indexClass })
+            row["index_type"] = "CUSTOM"
+            row["index_options"] = string(options)
+        }
+    }
+
+    return row
+}
+
+func indexOf(list []string, target string) int {
+    for i, value := range list {
+        if (value == target) { return i }
+    }
+    return -1
+}
\ No newline at end of file
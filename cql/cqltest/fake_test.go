@@ -0,0 +1,402 @@
+package cqltest
+
+import (
+    "testing"
+)
+
+func TestFakeSchemaTables(t *testing.T) {
+    var fake = NewFake()
+
+    var statements = []string{
+        "CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 3 }",
+        "CREATE TABLE app.events (day TEXT, at TIMEUUID, tags SET<TEXT>, counts MAP<TEXT, INT>, PRIMARY KEY (day, at))",
+        "ALTER TABLE app.events ADD source INET",
+        "ALTER TABLE app.events WITH compaction = {'class': 'LeveledCompactionStrategy'} AND compression = {'class': 'SnappyCompressor'}",
+    }
+    for _, statement := range statements {
+        if err := fake.Query(statement).Exec() ; err != nil {
+            t.Error(
+                "For", statement,
+                "expected", nil,
+                "got", err,
+            )
+        }
+    }
+
+    var options string
+    if err := fake.Query(`SELECT strategy_options FROM system.schema_keyspaces WHERE keyspace_name = ?`, "app").Scan(&options) ; options != `{"replication_factor":"3"}` {
+        t.Error(
+            "For", "strategy_options of app",
+            "expected", `{"replication_factor":"3"}`,
+            "got", options, err,
+        )
+    }
+
+    var expected = map[string]string{
+        "at":       "clustering_key org.apache.cassandra.db.marshal.TimeUUIDType",
+        "counts":   "regular org.apache.cassandra.db.marshal.MapType(org.apache.cassandra.db.marshal.UTF8Type,org.apache.cassandra.db.marshal.Int32Type)",
+        "day":      "partition_key org.apache.cassandra.db.marshal.UTF8Type",
+        "source":   "regular org.apache.cassandra.db.marshal.InetAddressType",
+        "tags":     "regular org.apache.cassandra.db.marshal.SetType(org.apache.cassandra.db.marshal.UTF8Type)",
+    }
+
+    var name, kind, validator string
+    var names []string
+    var iter = fake.Query(`SELECT column_name, type, validator FROM system.schema_columns WHERE keyspace_name = ? AND columnfamily_name = ?`, "app", "events").Iter()
+    for iter.Scan(&name, &kind, &validator) {
+        names = append(names, name)
+        if (expected[name] != kind + " " + validator) {
+            t.Error(
+                "For", "schema_columns of " + name,
+                "expected", expected[name],
+                "got", kind + " " + validator,
+            )
+        }
+    }
+    if err := iter.Close() ; err != nil || len(names) != len(expected) || names[0] != "at" {
+        t.Error(
+            "For", "schema_columns of app.events",
+            "expected", "5 columns by name",
+            "got", names, err,
+        )
+    }
+
+    // a 2.x node splits compaction over several columns and spells compression its own way
+    var class, compression string
+    var threshold int
+    if err := fake.Query(`SELECT compaction_strategy_class, max_compaction_threshold, compression_parameters FROM system.schema_columnfamilies WHERE keyspace_name = ? AND columnfamily_name = ?`, "app", "events").Scan(&class, &threshold, &compression) ; class != COMPACTION_PACKAGE + "LeveledCompactionStrategy" || threshold != 32 || compression != `{"chunk_length_kb":"64","sstable_compression":"org.apache.cassandra.io.compress.SnappyCompressor"}` {
+        t.Error(
+            "For", "schema_columnfamilies of app.events",
+            "expected", "LeveledCompactionStrategy, 32 and SnappyCompressor",
+            "got", class, threshold, compression, err,
+        )
+    }
+
+    // schema changes move the schema version
+    var before = fake.SchemaVersion()
+    fake.Query("DROP TABLE app.events").Exec()
+    if (fake.SchemaVersion() == before) {
+        t.Error(
+            "For", "SchemaVersion after DROP TABLE",
+            "expected", "a new version",
+            "got", before,
+        )
+    }
+}
+
+
+func TestFakeErrors(t *testing.T) {
+    var fake = NewFake()
+    fake.Query("CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 }").Exec()
+    fake.Query("CREATE TABLE app.users (id UUID PRIMARY KEY, name TEXT)").Exec()
+
+    // the messages migrate relies on to ignore things that already exist
+    var cases = map[string]string{
+        "CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy' }":  `Cannot add existing keyspace "app"`,
+        "CREATE TABLE app.users (id UUID PRIMARY KEY)":                            `Cannot add already existing column family "users" to keyspace "app"`,
+        "ALTER TABLE app.users ADD name TEXT":                                     `Invalid column name name because it conflicts with an existing column`,
+        "SELECT * FROM app.missing":                                               `unconfigured columnfamily missing`,
+        "INSERT INTO app.users (name) VALUES ('x')":                               `Missing mandatory PRIMARY KEY part id`,
+        "CREATE TABLE app.odd (id NUMBER PRIMARY KEY)":                            `Unknown type number`,
+        "ALTER KEYSPACE missing WITH DURABLE_WRITES = false":                      `Keyspace 'missing' does not exist`,
+        "ALTER KEYSPACE app WITH REPLICATION = { 'dc1' : 1 }":                     `Missing mandatory replication strategy class`,
+        "ALTER TABLE app.users WITH colour = 'blue'":                              `Unknown property 'colour'`,
+        "ALTER TABLE app.users WITH compaction = {'max_threshold': 8}":            `Missing sub-option 'class' for the 'compaction' option.`,
+    }
+    for statement, expected := range cases {
+        if err := fake.Query(statement).Exec() ; err == nil || err.Error() != expected {
+            t.Error(
+                "For", statement,
+                "expected", expected,
+                "got", err,
+            )
+        }
+    }
+
+    if err := fake.Query(`SELECT name FROM app.users WHERE id = ?`, "nobody").Scan(new(string)) ; err == nil || err.Error() != "not found" {
+        t.Error(
+            "For", "Scan of a missing row",
+            "expected", "not found",
+            "got", err,
+        )
+    }
+}
+
+
+func TestFakeLightweightTransactions(t *testing.T) {
+    var fake = NewFake()
+    fake.Query("CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 }").Exec()
+    fake.Query("CREATE TABLE app.lock (name TEXT PRIMARY KEY, owner TEXT)").Exec()
+
+    var existing = make(map[string]interface{})
+    if applied, err := fake.Query(`INSERT INTO app.lock (name, owner) VALUES (?, ?) IF NOT EXISTS`, "lock", "first").MapScanCAS(existing) ; !applied || err != nil {
+        t.Error(
+            "For", "INSERT IF NOT EXISTS of a new row",
+            "expected", true,
+            "got", applied, err,
+        )
+    }
+
+    if applied, _ := fake.Query(`INSERT INTO app.lock (name, owner) VALUES (?, ?) IF NOT EXISTS`, "lock", "second").MapScanCAS(existing) ; applied || existing["owner"] != "first" {
+        t.Error(
+            "For", "INSERT IF NOT EXISTS of an existing row",
+            "expected", "not applied, held by first",
+            "got", applied, existing["owner"],
+        )
+    }
+
+    existing = make(map[string]interface{})
+    if applied, _ := fake.Query(`DELETE FROM app.lock WHERE name = ? IF owner = ?`, "lock", "second").MapScanCAS(existing) ; applied || existing["owner"] != "first" {
+        t.Error(
+            "For", "DELETE IF owner of someone else",
+            "expected", "not applied, held by first",
+            "got", applied, existing["owner"],
+        )
+    }
+
+    if applied, _ := fake.Query(`DELETE FROM app.lock WHERE name = ? IF owner = ?`, "lock", "first").MapScanCAS(existing) ; !applied {
+        t.Error(
+            "For", "DELETE IF owner of the owner",
+            "expected", true,
+            "got", applied,
+        )
+    }
+
+    if executed := fake.Executed() ; len(executed) != 6 {
+        t.Error(
+            "For", "len(Executed())",
+            "expected", 6,
+            "got", len(executed),
+        )
+    }
+}
+
+
+func TestFakeBatch(t *testing.T) {
+    var fake = NewFake()
+    fake.Query("CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 }").Exec()
+    fake.Query("USE app").Exec()
+    fake.Query("CREATE TABLE users (id INT PRIMARY KEY, name TEXT)").Exec()
+
+    var err = fake.Query(`
+        BEGIN BATCH
+            INSERT INTO users (id, name) VALUES (1, 'one');
+            INSERT INTO users (id, name) VALUES (2, 'two; or so');
+            UPDATE users SET name = ? WHERE id = ?;
+        APPLY BATCH`, "uno", 1).Exec()
+    if (err != nil) {
+        t.Error(
+            "For", "BEGIN BATCH",
+            "expected", nil,
+            "got", err,
+        )
+    }
+
+    var id int
+    var name string
+    var names []string
+    var iter = fake.Query(`SELECT id, name FROM users`).Iter()
+    for iter.Scan(&id, &name) {
+        names = append(names, name)
+    }
+    if (len(names) != 2 || names[0] != "uno" || names[1] != "two; or so") {
+        t.Error(
+            "For", "rows after BEGIN BATCH",
+            "expected", []string{ "uno", "two; or so" },
+            "got", names,
+        )
+    }
+}
+
+
+func TestFakeIndexesAndTypes(t *testing.T) {
+    var fake = NewFake()
+    var statements = []string{
+        "CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 }",
+        "CREATE TYPE app.address (street TEXT, zip INT)",
+        "CREATE TABLE app.events (day TEXT, at TIMEUUID, kind TEXT, PRIMARY KEY (day, at)) WITH CLUSTERING ORDER BY (at DESC) AND comment = 'events'",
+        "CREATE INDEX by_kind ON app.events (kind)",
+        "CREATE CUSTOM INDEX ON app.events (at) USING 'org.example.Index'",
+    }
+    for _, statement := range statements {
+        if err := fake.Query(statement).Exec() ; err != nil {
+            t.Error(
+                "For", statement,
+                "expected", nil,
+                "got", err,
+            )
+        }
+    }
+
+    var expected = map[string]string{
+        "at":   "org.apache.cassandra.db.marshal.ReversedType(org.apache.cassandra.db.marshal.TimeUUIDType) events_at_idx CUSTOM {\"class_name\":\"org.example.Index\"}",
+        "day":  "org.apache.cassandra.db.marshal.UTF8Type   ",
+        "kind": "org.apache.cassandra.db.marshal.UTF8Type by_kind COMPOSITES {}",
+    }
+
+    var name, validator, index, indexType, options string
+    var iter = fake.Query(`SELECT column_name, validator, index_name, index_type, index_options FROM system.schema_columns WHERE keyspace_name = ? AND columnfamily_name = ?`, "app", "events").Iter()
+    for iter.Scan(&name, &validator, &index, &indexType, &options) {
+        if got := validator + " " + index + " " + indexType + " " + options ; got != expected[name] {
+            t.Error(
+                "For", "schema_columns of " + name,
+                "expected", expected[name],
+                "got", got,
+            )
+        }
+    }
+
+    var fields, types []string
+    if err := fake.Query(`SELECT field_names, field_types FROM system.schema_usertypes WHERE keyspace_name = ? AND type_name = ?`, "app", "address").Scan(&fields, &types) ; err != nil || len(fields) != 2 || types[1] != "org.apache.cassandra.db.marshal.Int32Type" {
+        t.Error(
+            "For", "schema_usertypes of address",
+            "expected", "street and zip INT",
+            "got", fields, types, err,
+        )
+    }
+
+    if err := fake.Query("ALTER TABLE app.events DROP kind").Exec() ; err == nil {
+        t.Error(
+            "For", "dropping an indexed column",
+            "expected", "an error",
+            "got", err,
+        )
+    }
+    fake.Query("DROP INDEX app.by_kind").Exec()
+    if err := fake.Query("ALTER TABLE app.events DROP kind").Exec() ; err != nil {
+        t.Error(
+            "For", "dropping a column after DROP INDEX",
+            "expected", nil,
+            "got", err,
+        )
+    }
+
+    // user types must be frozen before 3.0, and cannot be dropped while in use
+    var failing = []string{
+        "ALTER TABLE app.events ADD home address",
+        "ALTER TABLE app.events ADD home FROZEN<nowhere>",
+    }
+    for _, statement := range failing {
+        if err := fake.Query(statement).Exec() ; err == nil {
+            t.Error(
+                "For", statement,
+                "expected", "an error",
+                "got", err,
+            )
+        }
+    }
+
+    if err := fake.Query("ALTER TABLE app.events ADD home FROZEN<address>").Exec() ; err != nil {
+        t.Error(
+            "For", "adding a frozen user type",
+            "expected", nil,
+            "got", err,
+        )
+    }
+    fake.Query(`SELECT validator FROM system.schema_columns WHERE keyspace_name = ? AND columnfamily_name = ? AND column_name = ?`, "app", "events", "home").Scan(&validator)
+    if expected := "org.apache.cassandra.db.marshal.UserType(app,61646472657373,737472656574:org.apache.cassandra.db.marshal.UTF8Type,7a6970:org.apache.cassandra.db.marshal.Int32Type)" ; validator != expected {
+        t.Error(
+            "For", "the validator of a frozen user type",
+            "expected", expected,
+            "got", validator,
+        )
+    }
+    if err := fake.Query("DROP TYPE app.address").Exec() ; err == nil {
+        t.Error(
+            "For", "dropping a user type in use",
+            "expected", "an error",
+            "got", err,
+        )
+    }
+
+    // fields can only be added, and only once
+    if err := fake.Query("ALTER TYPE app.address ADD city TEXT").Exec() ; err != nil {
+        t.Error(
+            "For", "ALTER TYPE app.address ADD city TEXT",
+            "expected", nil,
+            "got", err,
+        )
+    }
+    fake.Query(`SELECT field_names, field_types FROM system.schema_usertypes WHERE keyspace_name = ? AND type_name = ?`, "app", "address").Scan(&fields, &types)
+    if (len(fields) != 3 || fields[2] != "city") {
+        t.Error(
+            "For", "schema_usertypes of address after ALTER TYPE",
+            "expected", "street, zip and city",
+            "got", fields,
+        )
+    }
+    for _, statement := range []string{ "ALTER TYPE app.address ADD zip INT", "ALTER TYPE app.nowhere ADD city TEXT", "ALTER TYPE app.address RENAME zip TO code" } {
+        if err := fake.Query(statement).Exec() ; err == nil {
+            t.Error(
+                "For", statement,
+                "expected", "an error",
+                "got", err,
+            )
+        }
+    }
+}
+
+func TestFakeFunctionsAndViews(t *testing.T) {
+    var fake = NewFakeRelease("3.11.4")
+    var statements = []string{
+        "CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 }",
+        "CREATE FUNCTION app.plus (state INT, value INT) CALLED ON NULL INPUT RETURNS INT LANGUAGE java AS $$return state + value;$$",
+        "CREATE FUNCTION app.plus (state BIGINT, value BIGINT) CALLED ON NULL INPUT RETURNS BIGINT LANGUAGE java AS 'return state + value;'",
+        "CREATE AGGREGATE app.total (INT) SFUNC plus STYPE INT INITCOND 0",
+        "CREATE TABLE app.scores (player TEXT, game INT, points INT, PRIMARY KEY (player, game))",
+        "CREATE MATERIALIZED VIEW app.by_points AS SELECT * FROM app.scores WHERE points IS NOT NULL AND player IS NOT NULL AND game IS NOT NULL PRIMARY KEY (points, player, game)",
+    }
+    for _, statement := range statements {
+        if err := fake.Query(statement).Exec() ; err != nil {
+            t.Error(
+                "For", statement,
+                "expected", nil,
+                "got", err,
+            )
+        }
+    }
+
+    var where string
+    if err := fake.Query(`SELECT where_clause FROM system_schema.views WHERE keyspace_name = ? AND view_name = ?`, "app", "by_points").Scan(&where) ; where != "points IS NOT NULL AND player IS NOT NULL AND game IS NOT NULL" {
+        t.Error(
+            "For", "where_clause of by_points",
+            "expected", "points IS NOT NULL AND player IS NOT NULL AND game IS NOT NULL",
+            "got", where, err,
+        )
+    }
+
+    // what depends on something keeps it from being dropped
+    var failing = []string{
+        "DROP FUNCTION app.plus",
+        "DROP FUNCTION app.plus (INT, INT)",
+        "DROP TABLE app.scores",
+        "CREATE AGGREGATE app.count (TEXT) SFUNC plus STYPE INT",
+        "CREATE MATERIALIZED VIEW app.by_game AS SELECT * FROM app.scores WHERE game IS NOT NULL PRIMARY KEY (game, points)",
+    }
+    for _, statement := range failing {
+        if err := fake.Query(statement).Exec() ; err == nil {
+            t.Error(
+                "For", statement,
+                "expected", "an error",
+                "got", err,
+            )
+        }
+    }
+
+    var cleanup = []string{
+        "DROP MATERIALIZED VIEW app.by_points",
+        "DROP TABLE app.scores",
+        "DROP AGGREGATE app.total",
+        "DROP FUNCTION app.plus (INT, INT)",
+        "DROP FUNCTION app.plus",
+    }
+    for _, statement := range cleanup {
+        if err := fake.Query(statement).Exec() ; err != nil {
+            t.Error(
+                "For", statement,
+                "expected", nil,
+                "got", err,
+            )
+        }
+    }
+}
\ No newline at end of file
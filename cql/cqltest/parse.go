@@ -0,0 +1,560 @@
+package cqltest
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+//-------------------------------------------------------
+// Tokens
+//-------------------------------------------------------
+
+const (
+    TOKEN_WORD      = iota;     // keyword or identifier, quoted identifiers keep their case
+    TOKEN_STRING;               // 'single quoted' literal
+    TOKEN_NUMBER;
+    TOKEN_SYMBOL;               // punctuation, one character
+    TOKEN_END;
+)
+
+type token struct {
+    kind        int
+    text        string
+    quoted      bool
+}
+
+//
+//  tokenize
+//      Split a statement into words, literals and symbols
+//      Comments and whitespace are dropped
+//
+func tokenize(statement string) ([]token, error) {
+    var tokens []token
+    var i = 0
+
+    for i < len(statement) {
+        var c = statement[i]
+
+        switch {
+            case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+                i++
+
+            case strings.HasPrefix(statement[i:], "--") || strings.HasPrefix(statement[i:], "//"):
+                for i < len(statement) && statement[i] != '\n' { i++ }
+
+            case strings.HasPrefix(statement[i:], "/*"):
+                var end = strings.Index(statement[i + 2:], "*/")
+                if (end < 0) { return nil, fmt.Errorf("unterminated comment") }
+                i += end + 4
+
+            case strings.HasPrefix(statement[i:], "$$"):
+                // function bodies may be $$ quoted, nothing inside is escaped
+                var end = strings.Index(statement[i + 2:], "$$")
+                if (end < 0) { return nil, fmt.Errorf("unterminated $$ string") }
+                tokens = append(tokens, token{ kind: TOKEN_STRING, text: statement[i + 2 : i + 2 + end] })
+                i += end + 4
+
+            case c == '\'' || c == '"':
+                var text []byte
+                var closed = false
+                for i++ ; i < len(statement) ; i++ {
+                    if (statement[i] == c) {
+                        // doubled quotes escape themselves
+                        if (i + 1 < len(statement) && statement[i + 1] == c) {
+                            text = append(text, c)
+                            i++
+                            continue
+                        }
+                        closed = true
+                        i++
+                        break
+                    }
+                    text = append(text, statement[i])
+                }
+                if (!closed) { return nil, fmt.Errorf("unterminated quote") }
+
+                if (c == '\'') {
+                    tokens = append(tokens, token{ kind: TOKEN_STRING, text: string(text) })
+                } else {
+                    tokens = append(tokens, token{ kind: TOKEN_WORD, text: string(text), quoted: true })
+                }
+
+            case isDigit(c) || (c == '-' && i + 1 < len(statement) && isDigit(statement[i + 1])):
+                var start = i
+                for i++ ; i < len(statement) && (isDigit(statement[i]) || statement[i] == '.' || statement[i] == 'e' || statement[i] == 'E') ; i++ {}
+                tokens = append(tokens, token{ kind: TOKEN_NUMBER, text: statement[start:i] })
+
+            case isLetter(c):
+                var start = i
+                for i++ ; i < len(statement) && (isLetter(statement[i]) || isDigit(statement[i])) ; i++ {}
+                tokens = append(tokens, token{ kind: TOKEN_WORD, text: statement[start:i] })
+
+            default:
+                tokens = append(tokens, token{ kind: TOKEN_SYMBOL, text: string(c) })
+                i++
+        }
+    }
+
+    return append(tokens, token{ kind: TOKEN_END }), nil
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+    return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+
+//-------------------------------------------------------
+// Parser
+//-------------------------------------------------------
+
+//
+//  parser
+//      Walks the tokens of a statement, binding '?' markers to values in order
+//
+type parser struct {
+    tokens      []token
+    pos         int
+    values      []interface{}
+    bound       int
+    batch       bool        // statements may also end at APPLY BATCH
+}
+
+func newParser(statement string, values []interface{}) (*parser, error) {
+    var tokens, err = tokenize(statement)
+    if (err != nil) {
+        return nil, err
+    }
+
+    return &parser{ tokens: tokens, values: values }, nil
+}
+
+func (self *parser) peek() token {
+    return self.tokens[self.pos]
+}
+
+func (self *parser) next() token {
+    var current = self.tokens[self.pos]
+    if (current.kind != TOKEN_END) { self.pos++ }
+    return current
+}
+
+func (self *parser) done() bool {
+    return self.peek().kind == TOKEN_END
+}
+
+//
+//  at, accept
+//      Whether the given keywords and symbols come next, ignoring case
+//      Accept also consumes them
+//
+func (self *parser) at(words ...string) bool {
+    for i, word := range words {
+        var current = self.tokens[self.pos + i]
+        if (current.kind == TOKEN_END || current.kind == TOKEN_STRING || current.quoted || !strings.EqualFold(current.text, word)) {
+            return false
+        }
+    }
+    return true
+}
+
+func (self *parser) accept(words ...string) bool {
+    if (!self.at(words...)) {
+        return false
+    }
+
+    self.pos += len(words)
+    return true
+}
+
+func (self *parser) expect(words ...string) error {
+    if (!self.accept(words...)) {
+        return self.unexpected(strings.Join(words, " "))
+    }
+    return nil
+}
+
+func (self *parser) unexpected(expected string) error {
+    var current = self.peek()
+    if (current.kind == TOKEN_END) {
+        return fmt.Errorf("line 1:%d mismatched input at end of statement, expecting %s", self.pos, expected)
+    }
+    return fmt.Errorf("line 1:%d no viable alternative at input '%s', expecting %s", self.pos, current.text, expected)
+}
+
+//
+//  name
+//      An identifier, lower cased unless it was quoted
+//
+func (self *parser) name() (string, error) {
+    var current = self.peek()
+    if (current.kind != TOKEN_WORD) {
+        return "", self.unexpected("a name")
+    }
+    self.next()
+
+    if (current.quoted) { return current.text, nil }
+    return strings.ToLower(current.text), nil
+}
+
+//
+//  tableName
+//      A [keyspace.]table pair, the keyspace is empty when not given
+//
+func (self *parser) tableName() (keyspace string, table string, err error) {
+    if table, err = self.name() ; err != nil {
+        return
+    }
+    if (self.accept(".")) {
+        keyspace = table
+        table, err = self.name()
+    }
+    return
+}
+
+//
+//  names
+//      A parenthesized, comma separated list of identifiers
+//
+func (self *parser) names() ([]string, error) {
+    var names []string
+    if err := self.expect("(") ; err != nil {
+        return nil, err
+    }
+
+    for {
+        var name, err = self.name()
+        if (err != nil) {
+            return nil, err
+        }
+        names = append(names, name)
+
+        if (self.accept(")")) { return names, nil }
+        if err = self.expect(",") ; err != nil {
+            return nil, err
+        }
+    }
+}
+
+//
+//  primaryKey
+//      '(partition, clustering...)' after PRIMARY KEY, a composite partition key is parenthesized
+//
+func (self *parser) primaryKey() (partition []string, clustering []string, err error) {
+    if err = self.expect("(") ; err != nil {
+        return
+    }
+
+    if (self.at("(")) {
+        partition, err = self.names()
+    } else {
+        var name string
+        name, err = self.name()
+        partition = []string{ name }
+    }
+    if (err != nil) {
+        return
+    }
+
+    for self.accept(",") {
+        var name string
+        if name, err = self.name() ; err != nil {
+            return
+        }
+        clustering = append(clustering, name)
+    }
+
+    err = self.expect(")")
+    return
+}
+
+//
+//  text
+//      The statement up to the given keywords, as CQL with one space between tokens
+//      Used for clauses the fake keeps but does not evaluate, like the WHERE of a view
+//
+func (self *parser) text(until ...string) string {
+    var parts []string
+    for !self.done() && !self.at(";") && !self.at(until...) {
+        var current = self.next()
+        switch {
+            case current.kind == TOKEN_STRING:
+                parts = append(parts, "'" + strings.Replace(current.text, "'", "''", -1) + "'")
+            case current.quoted:
+                parts = append(parts, `"` + strings.Replace(current.text, `"`, `""`, -1) + `"`)
+            default:
+                parts = append(parts, current.text)
+        }
+    }
+    return strings.Join(parts, " ")
+}
+
+//
+//  value
+//      A bind marker or a literal: string, number, boolean, null, or a {map}
+//
+func (self *parser) value() (interface{}, error) {
+    var current = self.peek()
+
+    switch {
+        case current.kind == TOKEN_SYMBOL && current.text == "?":
+            self.next()
+            if (self.bound >= len(self.values)) {
+                return nil, fmt.Errorf("not enough values for the bind markers of the statement")
+            }
+            self.bound++
+            return self.values[self.bound - 1], nil
+
+        case current.kind == TOKEN_STRING:
+            self.next()
+            return current.text, nil
+
+        case current.kind == TOKEN_NUMBER:
+            self.next()
+            if number, err := strconv.ParseInt(current.text, 10, 64) ; err == nil {
+                return number, nil
+            }
+            return strconv.ParseFloat(current.text, 64)
+
+        case self.accept("true"):
+            return true, nil
+
+        case self.accept("false"):
+            return false, nil
+
+        case self.accept("null"):
+            return nil, nil
+
+        case self.accept("{"):
+            var literal = make(map[string]interface{})
+            if (self.accept("}")) { return literal, nil }
+
+            for {
+                var key, err = self.value()
+                if (err != nil) {
+                    return nil, err
+                }
+                if err = self.expect(":") ; err != nil {
+                    return nil, err
+                }
+
+                var value interface{}
+                if value, err = self.value() ; err != nil {
+                    return nil, err
+                }
+                literal[fmt.Sprint(key)] = value
+
+                if (self.accept("}")) { return literal, nil }
+                if err = self.expect(",") ; err != nil {
+                    return nil, err
+                }
+            }
+    }
+
+    return nil, self.unexpected("a value")
+}
+
+//
+//  cqlType
+//      A column type, such as text or map<uuid, frozen<list<int>>>
+//
+func (self *parser) cqlType() (fakeType, error) {
+    var name, err = self.name()
+    if (err != nil) {
+        return fakeType{}, err
+    }
+
+    var result = fakeType{ Name: name }
+    if (!self.accept("<")) {
+        return result, nil
+    }
+
+    for {
+        var param, err = self.cqlType()
+        if (err != nil) {
+            return result, err
+        }
+        result.Params = append(result.Params, param)
+
+        if (self.accept(">")) { return result, nil }
+        if err = self.expect(",") ; err != nil {
+            return result, err
+        }
+    }
+}
+
+//
+//  argumentTypes
+//      '(type, ...)', the signature of a function or aggregate
+//
+func (self *parser) argumentTypes() ([]fakeType, error) {
+    var types []fakeType
+    if err := self.expect("(") ; err != nil {
+        return nil, err
+    }
+
+    for !self.accept(")") {
+        var argument, err = self.cqlType()
+        if (err != nil) {
+            return nil, err
+        }
+        types = append(types, argument)
+
+        if (!self.at(")")) {
+            if err = self.expect(",") ; err != nil {
+                return nil, err
+            }
+        }
+    }
+    return types, nil
+}
+
+//
+//  condition
+//      A single 'column = value' (or 'column IN (values)') of a WHERE or IF clause
+//
+type condition struct {
+    column      string
+    values      []interface{}
+}
+
+func (self *parser) conditions() ([]condition, error) {
+    var conditions []condition
+
+    for {
+        var column, err = self.name()
+        if (err != nil) {
+            return nil, err
+        }
+
+        var current = condition{ column: column }
+        if (self.accept("IN")) {
+            if err = self.expect("(") ; err != nil {
+                return nil, err
+            }
+            for !self.accept(")") {
+                var value, err = self.value()
+                if (err != nil) {
+                    return nil, err
+                }
+                current.values = append(current.values, value)
+                self.accept(",")
+            }
+        } else {
+            if err = self.expect("=") ; err != nil {
+                return nil, err
+            }
+
+            var value, err = self.value()
+            if (err != nil) {
+                return nil, err
+            }
+            current.values = []interface{}{ value }
+        }
+        conditions = append(conditions, current)
+
+        if (!self.accept("AND")) { return conditions, nil }
+    }
+}
+
+//
+//  columnDefinition
+//      'name type [STATIC]', the caller checks the type against its keyspace
+//
+func (self *parser) columnDefinition() (*fakeColumn, error) {
+    var name, err = self.name()
+    if (err != nil) {
+        return nil, err
+    }
+
+    var column = &fakeColumn{ name: name, kind: "regular" }
+    if column.cqlType, err = self.cqlType() ; err != nil {
+        return nil, err
+    }
+    if (self.accept("STATIC")) { column.kind = "static" }
+
+    return column, nil
+}
+
+//
+//  using
+//      'USING TTL n [AND TIMESTAMP n]', only the TTL matters to the fake
+//
+func (self *parser) using() (int, error) {
+    var ttl = 0
+    for {
+        if (self.accept("TTL")) {
+            var value, err = self.value()
+            if (err != nil) {
+                return 0, err
+            }
+            if ttl, err = toInt(value) ; err != nil {
+                return 0, err
+            }
+        } else if (self.accept("TIMESTAMP")) {
+            if _, err := self.value() ; err != nil {
+                return 0, err
+            }
+        } else {
+            return 0, self.unexpected("TTL or TIMESTAMP")
+        }
+
+        if (!self.accept("AND")) { return ttl, nil }
+    }
+}
+
+//
+//  ifClause
+//      'IF EXISTS', 'IF NOT EXISTS' or 'IF column = value [AND ...]'
+//      Conditional is false when the statement has none
+//
+type ifClause struct {
+    conditional bool
+    exists      bool
+    notExists   bool
+    conditions  []condition
+}
+
+func (self *parser) ifClause() (clause ifClause, err error) {
+    if (!self.accept("IF")) {
+        return
+    }
+
+    clause.conditional = true
+    if (self.accept("NOT", "EXISTS")) {
+        clause.notExists = true
+    } else if (self.accept("EXISTS")) {
+        clause.exists = true
+    } else {
+        clause.conditions, err = self.conditions()
+    }
+    return
+}
+
+//
+//  end
+//      The statement must be over, allowing a trailing ';'
+//
+func (self *parser) end() error {
+    self.accept(";")
+    if (!self.done()) {
+        return self.unexpected("end of statement")
+    }
+    return nil
+}
+
+//
+//  finish
+//      Make sure nothing of the statement is left before applying it
+//      The ';' itself is left for the batch or execute
+//
+func (self *parser) finish() error {
+    if (self.done() || self.at(";") || (self.batch && self.at("APPLY"))) {
+        return nil
+    }
+    return self.unexpected("end of statement")
+}
\ No newline at end of file
@@ -0,0 +1,286 @@
+//
+//  Package cql
+//      The narrow slice of a Cassandra session cmm runs its queries through
+//      A live cluster is used through Connect or Wrap, while cqltest.NewFake keeps everything in memory
+//      so migrations, the completion table and schema descriptions can be tested offline
+//
+//      var session, err = cql.Connect(cluster)
+//      var fake = cqltest.NewFake()
+//
+package cql
+
+import (
+    "sync"
+    "context"
+
+    "github.com/tux21b/gocql"
+)
+
+//
+//  Session
+//      Creates queries against a cluster, or something pretending to be one
+//
+type Session interface {
+    Query(statement string, values ...interface{}) Query
+    Close()
+}
+
+//
+//  Query
+//      A statement and its bound values
+//      Nothing is sent until one of Exec, Scan, MapScanCAS or Iter is called
+//
+type Query interface {
+    Consistency(consistency gocql.Consistency) Query
+    Exec() error
+    Scan(dest ...interface{}) error
+    MapScanCAS(dest map[string]interface{}) (bool, error)
+    Iter() Iter
+}
+
+//
+//  Iter
+//      The rows of a query, scanned one at a time
+//      Close returns the error of the query, if any
+//
+type Iter interface {
+    Scan(dest ...interface{}) bool
+    Close() error
+}
+
+//
+//  HostStates
+//      Implemented by sessions that know which nodes the driver has marked down
+//      A down node keeps its last schema version in system.peers, so it is left out of schema agreement
+//
+type HostStates interface {
+    IsDown(address string) bool
+}
+
+//
+//  Pinned
+//      Implemented by sessions that can send several queries to the same node
+//      Every query of the Session Pin returns goes to the node the first of them reached
+//      So system.local and system.peers can be read from one coordinator, as the driver does for schema agreement
+//
+type Pinned interface {
+    Pin() Session
+}
+
+
+//-------------------------------------------------------
+// gocql
+//-------------------------------------------------------
+
+//
+//  Wrap
+//      Use a gocql session as a Session
+//      Nodes are never reported down, Connect creates a session that knows
+//
+func Wrap(session *gocql.Session) Session {
+    return gocqlSession{ session, nil, nil }
+}
+
+//
+//  Connect
+//      Create a session for the cluster that follows the up and down events of the driver
+//      The host selection policy of the cluster is kept, and told about every event as before
+//
+func Connect(cluster *gocql.ClusterConfig) (Session, error) {
+    var policy = cluster.PoolConfig.HostSelectionPolicy
+    if (policy == nil) {
+        policy = gocql.RoundRobinHostPolicy()
+    }
+
+    var hosts = &hostWatcher{ HostSelectionPolicy: policy, down: make(map[string]bool) }
+    cluster.PoolConfig.HostSelectionPolicy = hosts
+
+    var session, err = cluster.CreateSession()
+    if (err != nil) {
+        return nil, err
+    }
+
+    return gocqlSession{ session, hosts, nil }, nil
+}
+
+type gocqlSession struct {
+    session     *gocql.Session
+    hosts       *hostWatcher
+    pin         *pin
+}
+
+//  A session from Wrap has no say in the node each query goes to, and is returned as it is
+func (self gocqlSession) Pin() Session {
+    if (self.hosts == nil) {
+        return self
+    }
+    return gocqlSession{ self.session, self.hosts, &pin{} }
+}
+
+func (self gocqlSession) IsDown(address string) bool {
+    return self.hosts != nil && self.hosts.isDown(address)
+}
+
+func (self gocqlSession) Query(statement string, values ...interface{}) Query {
+    var query = self.session.Query(statement, values...)
+    if (self.pin != nil) {
+        query = query.WithContext(context.WithValue(context.Background(), pinKey{}, self.pin))
+    }
+    return gocqlQuery{ query }
+}
+
+func (self gocqlSession) Close() {
+    self.session.Close()
+}
+
+
+type gocqlQuery struct {
+    query       *gocql.Query
+}
+
+func (self gocqlQuery) Consistency(consistency gocql.Consistency) Query {
+    return gocqlQuery{ self.query.Consistency(consistency) }
+}
+
+func (self gocqlQuery) Exec() error {
+    return self.query.Exec()
+}
+
+func (self gocqlQuery) Scan(dest ...interface{}) error {
+    return self.query.Scan(dest...)
+}
+
+func (self gocqlQuery) MapScanCAS(dest map[string]interface{}) (bool, error) {
+    return self.query.MapScanCAS(dest)
+}
+
+func (self gocqlQuery) Iter() Iter {
+    return self.query.Iter()
+}
+
+
+//
+//  hostWatcher
+//      A host selection policy noting which nodes are down before passing every event on
+//      Nodes are known by their broadcast address, as system.peers has them, and the address connected to
+//
+type hostWatcher struct {
+    gocql.HostSelectionPolicy
+
+    down        map[string]bool
+    lock        sync.Mutex
+}
+
+func (self *hostWatcher) mark(host *gocql.HostInfo, down bool) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    for _, address := range []string{ host.Peer().String(), host.ConnectAddress().String() } {
+        if (down) {
+            self.down[address] = true
+        } else {
+            delete(self.down, address)
+        }
+    }
+}
+
+func (self *hostWatcher) isDown(address string) bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    return self.down[address]
+}
+
+//
+//  Pick
+//      The hosts the policy picks, unless the query is pinned
+//      A pinned query only goes to the node the first query of its session reached, and fails if that node does not answer
+//
+func (self *hostWatcher) Pick(query gocql.ExecutableQuery) gocql.NextHost {
+    var pinned *pin
+    if q, isQuery := query.(*gocql.Query) ; isQuery {
+        pinned, _ = q.Context().Value(pinKey{}).(*pin)
+    }
+    if (pinned == nil) {
+        return self.HostSelectionPolicy.Pick(query)
+    }
+
+    if host := pinned.get() ; host != nil {
+        var picked = false
+        return func() gocql.SelectedHost {
+            if (picked) { return nil }
+            picked = true
+            return pinnedHost{ host }
+        }
+    }
+
+    var next = self.HostSelectionPolicy.Pick(query)
+    return func() gocql.SelectedHost {
+        var selected = next()
+        if (selected == nil) { return nil }
+        return pinningHost{ selected, pinned }
+    }
+}
+
+func (self *hostWatcher) HostUp(host *gocql.HostInfo) {
+    self.mark(host, false)
+    self.HostSelectionPolicy.HostUp(host)
+}
+
+func (self *hostWatcher) HostDown(host *gocql.HostInfo) {
+    self.mark(host, true)
+    self.HostSelectionPolicy.HostDown(host)
+}
+
+func (self *hostWatcher) RemoveHost(host *gocql.HostInfo) {
+    self.mark(host, false)
+    self.HostSelectionPolicy.RemoveHost(host)
+}
+
+
+//
+//  pin
+//      The node the queries of a pinned session go to, unset until the first of them is answered
+//
+type pin struct {
+    host        *gocql.HostInfo
+    lock        sync.Mutex
+}
+
+type pinKey struct {}
+
+func (self *pin) get() *gocql.HostInfo {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    return self.host
+}
+
+func (self *pin) set(host *gocql.HostInfo) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if (self.host == nil) { self.host = host }
+}
+
+//  a host picked by the policy, which becomes the pinned one once it answers
+type pinningHost struct {
+    gocql.SelectedHost
+    pin         *pin
+}
+
+func (self pinningHost) Mark(err error) {
+    if (err == nil) { self.pin.set(self.Info()) }
+    self.SelectedHost.Mark(err)
+}
+
+//  the pinned host, picked again
+type pinnedHost struct {
+    host        *gocql.HostInfo
+}
+
+func (self pinnedHost) Info() *gocql.HostInfo {
+    return self.host
+}
+
+func (self pinnedHost) Mark(err error) {}
\ No newline at end of file
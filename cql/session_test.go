@@ -0,0 +1,87 @@
+package cql
+
+import (
+    "context"
+    "testing"
+
+    "github.com/tux21b/gocql"
+)
+
+//  picks its hosts in turn, one per query, as a round robin would
+type turnPolicy struct {
+    gocql.HostSelectionPolicy
+
+    hosts       []*gocql.HostInfo
+    next        int
+}
+
+type turnHost struct {
+    host        *gocql.HostInfo
+}
+
+func (self turnHost) Info() *gocql.HostInfo { return self.host }
+func (self turnHost) Mark(err error) {}
+
+func (self *turnPolicy) Pick(query gocql.ExecutableQuery) gocql.NextHost {
+    var host = self.hosts[self.next % len(self.hosts)]
+    self.next++
+
+    var picked = false
+    return func() gocql.SelectedHost {
+        if (picked) { return nil }
+        picked = true
+        return turnHost{ host }
+    }
+}
+
+func TestPinnedQueries(t *testing.T) {
+    var first, second = &gocql.HostInfo{}, &gocql.HostInfo{}
+    var hosts = &hostWatcher{ HostSelectionPolicy: &turnPolicy{ hosts: []*gocql.HostInfo{ first, second } }, down: make(map[string]bool) }
+
+    // queries that are not pinned take turns
+    var query = new(gocql.Query)
+    if picked := hosts.Pick(query)().Info() ; picked != first {
+        t.Error(
+            "For", "the first query",
+            "expected", "the first host",
+            "got", picked,
+        )
+    }
+    if picked := hosts.Pick(query)().Info() ; picked != second {
+        t.Error(
+            "For", "the second query",
+            "expected", "the second host",
+            "got", picked,
+        )
+    }
+
+    // pinned ones go where the first of them was answered
+    var pinned = query.WithContext(context.WithValue(context.Background(), pinKey{}, &pin{}))
+    var selected = hosts.Pick(pinned)()
+    selected.Mark(nil)
+    if (selected.Info() != first) {
+        t.Error(
+            "For", "the first pinned query",
+            "expected", "the host the policy picks",
+            "got", selected.Info(),
+        )
+    }
+
+    for i := 0 ; i < 3 ; i++ {
+        var next = hosts.Pick(pinned)
+        if picked := next().Info() ; picked != first {
+            t.Error(
+                "For", "a later pinned query",
+                "expected", "the pinned host",
+                "got", picked,
+            )
+        }
+        if other := next() ; other != nil {
+            t.Error(
+                "For", "a retry of a pinned query",
+                "expected", "no other host",
+                "got", other.Info(),
+            )
+        }
+    }
+}
\ No newline at end of file
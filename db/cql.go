@@ -0,0 +1,368 @@
+package db
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+const LOCATOR_PACKAGE = "org.apache.cassandra.locator."
+
+//
+//  CQL
+//      The statements recreating the keyspace: CREATE KEYSPACE, then its types, functions, aggregates,
+//      tables with their indexes and lastly views
+//      Each comes after everything it depends on, as with cqlsh DESCRIBE KEYSPACE
+//
+func (self KeyspaceDescriptor) CQL() string {
+    var statements = []string{
+        fmt.Sprintf("CREATE KEYSPACE %s WITH replication = %s AND durable_writes = %t;", quoteName(self.Name), self.Replication(), self.DurableWrites),
+    }
+    for _, described := range OrderTypes(self.Types) {
+        statements = append(statements, described.CQL())
+    }
+    for _, function := range self.Functions {
+        statements = append(statements, function.CQL())
+    }
+    for _, aggregate := range self.Aggregates {
+        statements = append(statements, aggregate.CQL())
+    }
+    for _, table := range self.Tables {
+        statements = append(statements, table.CQL())
+    }
+    for _, view := range self.Views {
+        statements = append(statements, view.CQL())
+    }
+
+    return strings.Join(statements, "\n\n")
+}
+
+
+//
+//  Replication
+//      The class and options of the keyspace as a CQL map, e.g. {'class': 'SimpleStrategy', 'replication_factor': '3'}
+//
+func (self KeyspaceDescriptor) Replication() string {
+    var replication = []string{ fmt.Sprintf("'class': %s", quoteString(strings.TrimPrefix(self.Class, LOCATOR_PACKAGE))) }
+
+    var keys []string
+    for key := range self.Options {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        replication = append(replication, fmt.Sprintf("%s: %s", quoteString(key), quoteString(fmt.Sprint(self.Options[key]))))
+    }
+
+    return "{" + strings.Join(replication, ", ") + "}"
+}
+
+
+//
+//  CQL
+//      The CREATE TABLE statement of the table, followed by one CREATE INDEX per index
+//      Key columns come first, in key order, then the others by name
+//      Options left at cassandra's defaults are left out, as cqlsh would print them all
+//
+func (self TableDescriptor) CQL() string {
+    var partition = self.keyColumns("partition_key")
+    var clustering = self.keyColumns("clustering_key")
+
+    var lines []string
+    for _, column := range append(append(partition, clustering...), self.otherColumns()...) {
+        var line = fmt.Sprintf("    %s %s", quoteName(column.Name), column.Type)
+        if (column.Kind == "static") { line += " STATIC" }
+        lines = append(lines, line)
+    }
+
+    lines = append(lines, fmt.Sprintf("    PRIMARY KEY %s", self.PrimaryKey()))
+
+    var properties = optionsCQL(self.Options)
+    if (len(clustering) > 0) {
+        properties = append([]string{ "CLUSTERING ORDER BY " + self.ClusteringOrder() }, properties...)
+    }
+
+    var statement = fmt.Sprintf("CREATE TABLE %s (\n%s\n)", self.qualifiedName(), strings.Join(lines, ",\n"))
+    if (len(properties) > 0) {
+        statement += " WITH " + strings.Join(properties, "\n    AND ")
+    }
+
+    var statements = []string{ statement + ";" }
+    for _, index := range self.Indexes {
+        statements = append(statements, index.CQL(self))
+    }
+
+    return strings.Join(statements, "\n\n")
+}
+
+//
+//  PrimaryKey
+//      The key as written in CQL, e.g. ((a, b), c, d)
+//      A composite partition key is parenthesized
+//
+func (self TableDescriptor) PrimaryKey() string {
+    var partition = self.keyColumns("partition_key")
+    var clustering = self.keyColumns("clustering_key")
+
+    var key = columnNames(partition)
+    if (len(partition) > 1) { key = "(" + key + ")" }
+    if (len(clustering) > 0) { key += ", " + columnNames(clustering) }
+
+    return "(" + key + ")"
+}
+
+//
+//  ClusteringOrder
+//      The order of each clustering column, e.g. (c DESC, d ASC)
+//      Empty when the table has none
+//
+func (self TableDescriptor) ClusteringOrder() string {
+    var orders []string
+    for _, column := range self.keyColumns("clustering_key") {
+        var order = column.Order
+        if (len(order) == 0) { order = "ASC" }
+        orders = append(orders, quoteName(column.Name) + " " + order)
+    }
+
+    if (len(orders) == 0) { return "" }
+    return "(" + strings.Join(orders, ", ") + ")"
+}
+
+func (self TableDescriptor) qualifiedName() string {
+    return quoteName(self.Keyspace) + "." + quoteName(self.Name)
+}
+
+//
+//  keyColumns
+//      Columns of the given kind ordered by their position in the key
+//
+func (self TableDescriptor) keyColumns(kind string) []ColumnDescriptor {
+    var columns = make([]ColumnDescriptor, 0)
+    for _, column := range self.Columns {
+        // descriptors without a kind only know whether a column is the partition key
+        if (column.Kind == kind || (len(column.Kind) == 0 && column.Primary && kind == "partition_key")) {
+            columns = append(columns, column)
+        }
+    }
+
+    sort.Sort(byPosition(columns))
+    return columns
+}
+
+func (self TableDescriptor) otherColumns() []ColumnDescriptor {
+    var columns = make([]ColumnDescriptor, 0)
+    for _, column := range self.Columns {
+        if (column.Kind == "regular" || column.Kind == "static" || (len(column.Kind) == 0 && !column.Primary)) {
+            columns = append(columns, column)
+        }
+    }
+    return columns
+}
+
+func columnNames(columns []ColumnDescriptor) string {
+    var names []string
+    for _, column := range columns {
+        names = append(names, quoteName(column.Name))
+    }
+    return strings.Join(names, ", ")
+}
+
+
+type byPosition []ColumnDescriptor
+
+// Len is part of sort.Interface.
+func (self byPosition) Len() int {
+    return len(self)
+}
+
+// Swap is part of sort.Interface.
+func (self byPosition) Swap(i, j int) {
+    self[i], self[j] = self[j], self[i]
+}
+
+// Less is part of sort.Interface.
+func (self byPosition) Less(i, j int) bool {
+    return self[i].Position < self[j].Position
+}
+
+
+//
+//  CQL
+//      The CREATE INDEX statement of an index on the given table
+//
+func (self IndexDescriptor) CQL(table TableDescriptor) string {
+    var target = quoteName(self.Column)
+    if (len(self.Target) > 0) { target = self.Target + "(" + target + ")" }
+
+    if (len(self.Class) > 0) {
+        return fmt.Sprintf("CREATE CUSTOM INDEX %s ON %s (%s) USING %s;", quoteName(self.Name), table.qualifiedName(), target, quoteString(self.Class))
+    }
+    return fmt.Sprintf("CREATE INDEX %s ON %s (%s);", quoteName(self.Name), table.qualifiedName(), target)
+}
+
+
+//
+//  CQL
+//      The CREATE TYPE statement of the user defined type
+//
+func (self TypeDescriptor) CQL() string {
+    var lines []string
+    for _, field := range self.Fields {
+        lines = append(lines, fmt.Sprintf("    %s %s", quoteName(field.Name), field.Type))
+    }
+
+    return fmt.Sprintf("CREATE TYPE %s.%s (\n%s\n);", quoteName(self.Keyspace), quoteName(self.Name), strings.Join(lines, ",\n"))
+}
+
+//
+//  OrderTypes
+//      Sort types so each comes after the types its fields use
+//
+func OrderTypes(types []TypeDescriptor) []TypeDescriptor {
+    var ordered []TypeDescriptor
+    var created = make(map[string]bool)
+
+    for len(ordered) < len(types) {
+        var progress = false
+        for _, described := range types {
+            if (created[described.Name]) { continue }
+
+            var ready = true
+            for _, other := range types {
+                if (other.Name != described.Name && !created[other.Name] && described.uses(other.Name)) { ready = false }
+            }
+            if (ready) {
+                ordered = append(ordered, described)
+                created[described.Name] = true
+                progress = true
+            }
+        }
+
+        // types cannot depend on each other in a cycle, but do not loop forever if they seem to
+        if (!progress) {
+            for _, described := range types {
+                if (!created[described.Name]) { ordered = append(ordered, described) }
+            }
+            break
+        }
+    }
+
+    return ordered
+}
+
+//
+//  uses
+//      Whether the name appears as a word in the type of any field
+//
+func (self TypeDescriptor) uses(name string) bool {
+    var isPart = func(c rune) bool {
+        return c == '_' || c == '"' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+    }
+
+    for _, field := range self.Fields {
+        for _, word := range strings.FieldsFunc(field.Type, func(c rune) bool { return !isPart(c) }) {
+            if (strings.Trim(word, `"`) == name || strings.ToLower(word) == name) { return true }
+        }
+    }
+    return false
+}
+
+
+//
+//  CQL
+//      The CREATE FUNCTION statement of the function, its body $$ quoted unless it holds $$ itself
+//
+func (self FunctionDescriptor) CQL() string {
+    var arguments []string
+    for _, argument := range self.Arguments {
+        arguments = append(arguments, quoteName(argument.Name) + " " + argument.Type)
+    }
+
+    var onNull = "RETURNS NULL ON NULL INPUT"
+    if (self.CalledOnNullInput) { onNull = "CALLED ON NULL INPUT" }
+
+    var body = "$$" + self.Body + "$$"
+    if (strings.Contains(self.Body, "$$")) { body = quoteString(self.Body) }
+
+    return fmt.Sprintf("CREATE FUNCTION %s.%s(%s)\n    %s\n    RETURNS %s\n    LANGUAGE %s\n    AS %s;", quoteName(self.Keyspace), quoteName(self.Name), strings.Join(arguments, ", "), onNull, self.ReturnType, self.Language, body)
+}
+
+
+//
+//  CQL
+//      The CREATE AGGREGATE statement of the aggregate
+//
+func (self AggregateDescriptor) CQL() string {
+    var lines = []string{
+        fmt.Sprintf("CREATE AGGREGATE %s.%s(%s)", quoteName(self.Keyspace), quoteName(self.Name), strings.Join(self.ArgumentTypes, ", ")),
+        "SFUNC " + quoteName(self.StateFunction),
+        "STYPE " + self.StateType,
+    }
+    if (len(self.FinalFunction) > 0) {
+        lines = append(lines, "FINALFUNC " + quoteName(self.FinalFunction))
+    }
+    if (len(self.InitialCondition) > 0) {
+        lines = append(lines, "INITCOND " + self.InitialCondition)
+    }
+
+    return strings.Join(lines, "\n    ") + ";"
+}
+
+
+//
+//  CQL
+//      The CREATE MATERIALIZED VIEW statement of the view
+//      Its key and clustering order are written as a table's are
+//
+func (self ViewDescriptor) CQL() string {
+    var table = TableDescriptor{ Name: self.Name, Keyspace: self.Keyspace, Columns: self.Columns }
+
+    var selected = "*"
+    if (!self.IncludeAllColumns) {
+        var columns = append(append(table.keyColumns("partition_key"), table.keyColumns("clustering_key")...), table.otherColumns()...)
+        selected = columnNames(columns)
+    }
+
+    var statement = fmt.Sprintf("CREATE MATERIALIZED VIEW %s AS\n    SELECT %s\n    FROM %s.%s\n    WHERE %s\n    PRIMARY KEY %s", table.qualifiedName(), selected, quoteName(self.Keyspace), quoteName(self.Table), self.Where, table.PrimaryKey())
+    if (len(table.keyColumns("clustering_key")) > 0) {
+        statement += "\n    WITH CLUSTERING ORDER BY " + table.ClusteringOrder()
+    }
+
+    return statement + ";"
+}
+
+
+// the reserved words of CQL, which are only names when double quoted
+// KEY is not reserved, a column called key is quoted all the same so it is not misread
+var RESERVED_WORDS = map[string]bool{
+    "add": true, "allow": true, "alter": true, "and": true, "apply": true, "asc": true, "authorize": true,
+    "batch": true, "begin": true, "by": true, "columnfamily": true, "create": true, "default": true, "delete": true,
+    "desc": true, "describe": true, "drop": true, "entries": true, "execute": true, "from": true, "full": true,
+    "grant": true, "if": true, "in": true, "index": true, "infinity": true, "insert": true, "into": true, "is": true,
+    "key": true, "keyspace": true, "limit": true, "materialized": true, "mbean": true, "mbeans": true, "modify": true,
+    "nan": true, "norecursive": true, "not": true, "null": true, "of": true, "on": true, "or": true, "order": true,
+    "primary": true, "rename": true, "replace": true, "revoke": true, "schema": true, "select": true, "set": true,
+    "table": true, "to": true, "token": true, "truncate": true, "unlogged": true, "unset": true, "update": true,
+    "use": true, "using": true, "view": true, "where": true, "with": true,
+}
+
+//
+//  quoteName
+//      Identifiers that would not survive as written are double quoted, as are reserved words
+//
+func quoteName(name string) string {
+    if (RESERVED_WORDS[name]) {
+        return `"` + name + `"`
+    }
+
+    for i, c := range name {
+        if (!(c >= 'a' && c <= 'z') && !(c == '_' && i > 0) && !(c >= '0' && c <= '9' && i > 0)) {
+            return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+        }
+    }
+    return name
+}
+
+func quoteString(value string) string {
+    return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
\ No newline at end of file
@@ -1,42 +1,150 @@
 package db
 
 import (
-    "os"
     "fmt"
+    "math"
     "strings"
     "strconv"
+    "encoding/hex"
     "encoding/json"
+    "encoding/binary"
 
-    "github.com/tux21b/gocql"
+    "github.com/zmarcantel/cmm/cql"
 )
 
 type ColumnDescriptor struct {
     Name        string
     Type        string
     Primary     bool
+    Kind        string                  // partition_key, clustering_key, regular or static
+    Position    int     `json:",omitempty"`    // place within the partition or clustering key
+    Order       string  `json:",omitempty"`    // ASC or DESC, for clustering columns
+}
+
+type IndexDescriptor struct {
+    Name        string
+    Column      string
+    Target      string  `json:",omitempty"`    // keys, entries or full of a collection column, its values when empty
+    Class       string  `json:",omitempty"`    // implementation of a CUSTOM index
 }
 
 type TableDescriptor struct {
     Name        string
     Keyspace    string
     Columns     []ColumnDescriptor
+    Indexes     []IndexDescriptor   `json:",omitempty"`
+    Options     map[string]interface{}  `json:",omitempty"`    // WITH options, see TABLE_OPTIONS
 }
 
-type KeyspaceDescriptor struct {
+//
+//  Column
+//      The column of the given name, found is false when the table has none
+//
+func (self TableDescriptor) Column(name string) (column ColumnDescriptor, found bool) {
+    for _, column = range self.Columns {
+        if (column.Name == name) { return column, true }
+    }
+    return ColumnDescriptor{}, false
+}
+
+type FieldDescriptor struct {
     Name        string
-    Options     map[string]interface{}
-    Tables      []TableDescriptor
+    Type        string
+}
+
+type TypeDescriptor struct {
+    Name        string
+    Keyspace    string
+    Fields      []FieldDescriptor
+}
+
+type FunctionDescriptor struct {
+    Name                string
+    Keyspace            string
+    Arguments           []FieldDescriptor
+    ReturnType          string
+    Language            string
+    Body                string
+    CalledOnNullInput   bool
+}
+
+type AggregateDescriptor struct {
+    Name                string
+    Keyspace            string
+    ArgumentTypes       []string
+    StateFunction       string
+    StateType           string
+    FinalFunction       string  `json:",omitempty"`
+    InitialCondition    string  `json:",omitempty"`    // as a CQL literal
+    ReturnType          string
+}
+
+type ViewDescriptor struct {
+    Name                string
+    Keyspace            string
+    Table               string                  // the base table
+    Columns             []ColumnDescriptor
+    IncludeAllColumns   bool
+    Where               string
+}
+
+type KeyspaceDescriptor struct {
+    Name            string
+    Class           string
+    Options         map[string]interface{}
+    DurableWrites   bool
+    Types           []TypeDescriptor        `json:",omitempty"`
+    Functions       []FunctionDescriptor    `json:",omitempty"`
+    Aggregates      []AggregateDescriptor   `json:",omitempty"`
+    Tables          []TableDescriptor
+    Views           []ViewDescriptor        `json:",omitempty"`
+
+    DropMissing     bool    `json:"drop_missing,omitempty"`     // only set by declared schemas, drop what they leave out
 }
 
 // save a DB session on init
-var Session *gocql.Session
+var Session cql.Session
+
+// cassandra version of the session, looked up once
+var release string
 
 //
 //  Init
 //      Initialize the DB lookup -- mainly saves the session
 //
-func Init(session *gocql.Session) {
+func Init(session cql.Session) {
     Session = session
+    release = ""
+}
+
+
+//
+//  Release
+//      The cassandra version of the node the session is connected to, e.g. 2.1.20
+//
+func Release() (string, error) {
+    if (len(release) == 0) {
+        if err := Session.Query(`SELECT release_version FROM system.local WHERE key = 'local';`).Scan(&release) ; err != nil {
+            return "", err
+        }
+    }
+
+    return release, nil
+}
+
+//
+//  hasSystemSchema
+//      Whether the schema is found in the system_schema keyspace of 3.0+
+//      rather than the system.schema_* tables of 2.x
+//
+func hasSystemSchema() (bool, error) {
+    var version, err = Release()
+    if (err != nil) {
+        return false, err
+    }
+
+    var major, _ = strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+    return major >= 3, nil
 }
 
 
@@ -45,31 +153,39 @@ func Init(session *gocql.Session) {
 //      Retrive all keyspaces and all nested attributes
 //
 func AllKeyspaces() ([]KeyspaceDescriptor, error) {
-    var name string
-    var options string
+    if modern, err := hasSystemSchema() ; err != nil {
+        return nil, err
+    } else if (modern) {
+        return allKeyspacesSince3()
+    }
+
+    var name, class, options string
+    var durable bool
     var keyspaces = make([]KeyspaceDescriptor, 0)
 
     // create an iterator over keyspace descriptors
-    var iter = Session.Query(`SELECT keyspace_name, strategy_options FROM system.schema_keyspaces;`).Iter()
+    var iter = Session.Query(`SELECT keyspace_name, strategy_class, strategy_options, durable_writes FROM system.schema_keyspaces;`).Iter()
 
     // iterate over the results
-    for iter.Scan(&name, &options) {
-        var parsedOption = parseOptions(options)
-
-        var tables, err = AllTables(name)
+    for iter.Scan(&name, &class, &options, &durable) {
+        var parsedOption, err = parseOptions(options)
         if (err != nil) {
             return nil, err
         }
 
         // make the keyspace descriptor
-        keyspaces = append(keyspaces, KeyspaceDescriptor{
-            Name:       name,
-            Options:    parsedOption,
-            Tables:     tables,
-        })
+        var keyspace = KeyspaceDescriptor{
+            Name:           name,
+            Class:          class,
+            Options:        parsedOption,
+            DurableWrites:  durable,
+        }
+        if err = keyspace.load() ; err != nil {
+            return nil, err
+        }
+        keyspaces = append(keyspaces, keyspace)
     }
     if err := iter.Close(); err != nil {
-        fmt.Printf("ERROR: could not get keyspaces list:\n%s\n", err)
         return nil, err
     }
 
@@ -83,24 +199,62 @@ func AllKeyspaces() ([]KeyspaceDescriptor, error) {
 //      Includes a list of tables and their columns
 //
 func Keyspace(name string) (KeyspaceDescriptor, error) {
-    var options string
+    if modern, err := hasSystemSchema() ; err != nil {
+        return KeyspaceDescriptor{}, err
+    } else if (modern) {
+        return keyspaceSince3(name)
+    }
+
+    var class, options string
+    var durable bool
 
     // create an iterator over keyspace descriptors
-    var err = Session.Query(`SELECT strategy_options FROM system.schema_keyspaces WHERE keyspace_name = ?;`, name).Scan(&options)
+    var err = Session.Query(`SELECT strategy_class, strategy_options, durable_writes FROM system.schema_keyspaces WHERE keyspace_name = ?;`, name).Scan(&class, &options, &durable)
     if err != nil {
         return KeyspaceDescriptor{}, err
     }
 
-    var tables, tblErr = AllTables(name)
-    if (tblErr != nil) {
-        return KeyspaceDescriptor{}, tblErr
+    var parsedOption, optErr = parseOptions(options)
+    if (optErr != nil) {
+        return KeyspaceDescriptor{}, optErr
     }
 
-    return KeyspaceDescriptor{
-        Name:       name,
-        Options:    parseOptions(options),
-        Tables:     tables,
-    }, nil
+    var keyspace = KeyspaceDescriptor{
+        Name:           name,
+        Class:          class,
+        Options:        parsedOption,
+        DurableWrites:  durable,
+    }
+    if err = keyspace.load() ; err != nil {
+        return KeyspaceDescriptor{}, err
+    }
+
+    return keyspace, nil
+}
+
+
+//
+//  load
+//      Fill in everything the keyspace holds: types, functions, aggregates, tables and views
+//
+func (self *KeyspaceDescriptor) load() (err error) {
+    if self.Types, err = Types(self.Name) ; err != nil {
+        return err
+    }
+    if self.Functions, err = Functions(self.Name) ; err != nil {
+        return err
+    }
+    if self.Aggregates, err = Aggregates(self.Name) ; err != nil {
+        return err
+    }
+    if self.Tables, err = AllTables(self.Name) ; err != nil {
+        return err
+    }
+    if self.Views, err = Views(self.Name) ; err != nil {
+        return err
+    }
+
+    return nil
 }
 
 
@@ -108,7 +262,7 @@ func Keyspace(name string) (KeyspaceDescriptor, error) {
 //  parseOptions
 //      Parse the strategy options JSON of the table
 //
-func parseOptions(options string) map[string]interface{} {
+func parseOptions(options string) (map[string]interface{}, error) {
     // map of top-level JSON keys to first-level values (or stringified object)
     var finalMap map[string]interface{}
 
@@ -134,8 +288,7 @@ func parseOptions(options string) map[string]interface{} {
                 var err error
                 value, err = strconv.Unquote(string(*objmap[i]))
                 if (err != nil) {
-                    fmt.Printf("ERROR: could not unquote value\n%s\n", err)
-                    os.Exit(1)
+                    return nil, fmt.Errorf("could not unquote value of option [%s]: %s", i, err)
                 }
             }
 
@@ -144,7 +297,7 @@ func parseOptions(options string) map[string]interface{} {
         }
     }
 
-    return finalMap
+    return finalMap, nil
 }
 
 
@@ -153,6 +306,12 @@ func parseOptions(options string) map[string]interface{} {
 //      Get descriptors of all the tables in a given keyspace
 //
 func AllTables(keyspace string) (result []TableDescriptor, err error) {
+    if modern, err := hasSystemSchema() ; err != nil {
+        return nil, err
+    } else if (modern) {
+        return allTablesSince3(keyspace)
+    }
+
     var name string
 
     // create an iterator over keyspace descriptors
@@ -165,15 +324,26 @@ func AllTables(keyspace string) (result []TableDescriptor, err error) {
             return result, err
         }
 
+        indexes, err := Indexes(keyspace, name)
+        if (err != nil) {
+            return result, err
+        }
+
+        options, err := Options(keyspace, name)
+        if (err != nil) {
+            return result, err
+        }
+
         result = append(result, TableDescriptor{
             Name:           name,
             Keyspace:       keyspace,
             Columns:        columns,
+            Indexes:        indexes,
+            Options:        options,
         })
     }
     if err := iter.Close(); err != nil {
         return result, err
-        fmt.Printf("ERROR: could not get keyspaces list:\n%s\n", err)
     }
 
     return result, nil
@@ -185,8 +355,17 @@ func AllTables(keyspace string) (result []TableDescriptor, err error) {
 //      Get the table descriptor for a single table in a given keyspace
 //
 func Table(keyspace, table string) (result TableDescriptor, err error) {
+    var modern bool
+    if modern, err = hasSystemSchema() ; err != nil {
+        return result, err
+    }
+
     var name string
-    err = Session.Query(`SELECT columnfamily_name FROM system.schema_columnfamilies WHERE keyspace_name = ? AND columnfamily_name = ?;`, keyspace, table).Scan(&name)
+    if (modern) {
+        err = Session.Query(`SELECT table_name FROM system_schema.tables WHERE keyspace_name = ? AND table_name = ?;`, keyspace, table).Scan(&name)
+    } else {
+        err = Session.Query(`SELECT columnfamily_name FROM system.schema_columnfamilies WHERE keyspace_name = ? AND columnfamily_name = ?;`, keyspace, table).Scan(&name)
+    }
     if (err != nil) {
         return result, err
     }
@@ -196,56 +375,336 @@ func Table(keyspace, table string) (result TableDescriptor, err error) {
         return result, err
     }
 
+    indexes, err := Indexes(keyspace, table)
+    if (err != nil) {
+        return result, err
+    }
+
+    options, err := Options(keyspace, table)
+    if (err != nil) {
+        return result, err
+    }
+
     return TableDescriptor{
         Name:           table,
         Keyspace:       keyspace,
         Columns:        columns,
+        Indexes:        indexes,
+        Options:        options,
     }, nil
 }
 
 
 //
 //  Columns
-//      Get mapping of name -> type mapping for all columns in keyspace.table
+//      Get the columns of keyspace.table, with their type and place in the primary key
 //
 func Columns(keyspace, table string) (result []ColumnDescriptor, err error) {
+    if modern, err := hasSystemSchema() ; err != nil {
+        return nil, err
+    } else if (modern) {
+        return columnsSince3(keyspace, table)
+    }
+
     var name string
     var columnType string
     var datatype string
+    var position int
 
     // create an iterator over keyspace descriptors
-    var iter = Session.Query(`SELECT column_name,type,validator FROM system.schema_columns WHERE keyspace_name = ? AND columnfamily_name = ?;`, keyspace, table).Iter()
+    var iter = Session.Query(`SELECT column_name,type,validator,component_index FROM system.schema_columns WHERE keyspace_name = ? AND columnfamily_name = ?;`, keyspace, table).Iter()
 
     // iterate over the results
-    for iter.Scan(&name,&columnType,&datatype) {
-        var parts = strings.Split(datatype, "Type")
-        for i, val := range parts {
-            parts[i] = val[strings.LastIndex(val, ".") + 1:]
+    for iter.Scan(&name,&columnType,&datatype,&position) {
+        var column = ColumnDescriptor{
+            Name:           name,
+            Primary:        columnType == "partition_key",
+            Kind:           columnType,
         }
 
-        var finalType string
-        if (len(parts) == 2) { // target + split
-            finalType = parts[0]
-        } else if (len(parts) == 3) { // (target + split)*2
-            finalType = fmt.Sprintf("%s<%s>", parts[0], parts[1])
-        } else if (len(parts) == 4) { // (target + split)*3
-            finalType = fmt.Sprintf("%s<%s, %s>", parts[0], parts[1], parts[2])
-        } else {
-            finalType = columnType
+        // clustering columns in DESC order have their type reversed
+        var parsed, reversed, err = ParseMarshalType(datatype)
+        if (err != nil) {
+            iter.Close()
+            return result, fmt.Errorf("could not read the type of %s.%s.%s: %s", keyspace, table, name, err)
+        }
+
+        column.Type = parsed.String()
+        if (reversed) {
+            column.Order = "DESC"
+        } else if (columnType == "clustering_key") {
+            column.Order = "ASC"
+        }
+        if (columnType == "partition_key" || columnType == "clustering_key") {
+            column.Position = position
         }
 
-        finalType = strings.Replace(finalType, "UTF8", "Text", -1)
+        result = append(result, column)
+    }
+    if err = iter.Close(); err != nil {
+        return result, err
+    }
+
+    return result, nil
+}
+
+
+//
+//  Indexes
+//      Get the secondary indexes on columns of keyspace.table
+//
+func Indexes(keyspace, table string) (result []IndexDescriptor, err error) {
+    if modern, err := hasSystemSchema() ; err != nil {
+        return nil, err
+    } else if (modern) {
+        return indexesSince3(keyspace, table)
+    }
+
+    var column, name, options string
+
+    var iter = Session.Query(`SELECT column_name,index_name,index_options FROM system.schema_columns WHERE keyspace_name = ? AND columnfamily_name = ?;`, keyspace, table).Iter()
+
+    for iter.Scan(&column,&name,&options) {
+        if (len(name) == 0) { continue }
 
-        result = append(result, ColumnDescriptor{
+        var parsed map[string]string
+        if (len(options) > 0) {
+            if err = json.Unmarshal([]byte(options), &parsed) ; err != nil {
+                return result, fmt.Errorf("could not parse options of index [%s]: %s", name, err)
+            }
+        }
+
+        var target string
+        if _, keys := parsed["index_keys"] ; keys {
+            target = "keys"
+        } else if _, entries := parsed["index_keys_and_values"] ; entries {
+            target = "entries"
+        }
+        result = append(result, IndexDescriptor{
             Name:           name,
-            Type:           strings.ToUpper(finalType),
-            Primary:        columnType == "partition_key",
+            Column:         column,
+            Target:         target,
+            Class:          parsed["class_name"],
         })
     }
     if err = iter.Close(); err != nil {
-        fmt.Printf("ERROR: could not get keyspaces list:\n%s\n", err)
         return result, err
     }
 
     return result, nil
 }
+
+
+//
+//  Options
+//      Get the WITH options of keyspace.table, in the form 3.0 describes them whatever the version
+//
+func Options(keyspace, table string) (map[string]interface{}, error) {
+    if modern, err := hasSystemSchema() ; err != nil {
+        return nil, err
+    } else if (modern) {
+        return optionsSince3(keyspace, table)
+    }
+
+    var chance float64
+    var caching, comment, compactionClass, compactionOptions, compression string
+    var ttl, gcGrace, maxThreshold, minThreshold int
+
+    var err = Session.Query(`SELECT bloom_filter_fp_chance,caching,comment,compaction_strategy_class,compaction_strategy_options,compression_parameters,default_time_to_live,gc_grace_seconds,max_compaction_threshold,min_compaction_threshold FROM system.schema_columnfamilies WHERE keyspace_name = ? AND columnfamily_name = ?;`, keyspace, table).Scan(&chance,&caching,&comment,&compactionClass,&compactionOptions,&compression,&ttl,&gcGrace,&maxThreshold,&minThreshold)
+    if (err != nil) {
+        return nil, err
+    }
+
+    return legacyOptions(chance, caching, comment, compactionClass, compactionOptions, compression, ttl, gcGrace, maxThreshold, minThreshold)
+}
+
+
+//
+//  Types
+//      Get the user defined types of a keyspace
+//      Nodes older than 2.1 have none
+//
+func Types(keyspace string) (result []TypeDescriptor, err error) {
+    if modern, err := hasSystemSchema() ; err != nil {
+        return nil, err
+    } else if (modern) {
+        return typesSince3(keyspace)
+    }
+
+    var name string
+    var fields, validators []string
+
+    var iter = Session.Query(`SELECT type_name,field_names,field_types FROM system.schema_usertypes WHERE keyspace_name = ?;`, keyspace).Iter()
+
+    for iter.Scan(&name,&fields,&validators) {
+        var described = TypeDescriptor{ Name: name, Keyspace: keyspace }
+        for i, field := range fields {
+            var fieldType, _, err = ParseMarshalType(validators[i])
+            if (err != nil) {
+                iter.Close()
+                return result, fmt.Errorf("could not read the type of field %s of %s.%s: %s", field, keyspace, name, err)
+            }
+            described.Fields = append(described.Fields, FieldDescriptor{ Name: field, Type: fieldType.String() })
+        }
+
+        result = append(result, described)
+    }
+    if err = iter.Close(); err != nil {
+        if (strings.Contains(err.Error(), "unconfigured columnfamily")) {
+            return nil, nil
+        }
+        return result, err
+    }
+
+    return result, nil
+}
+
+//
+//  Functions
+//      Get the user defined functions of a keyspace, each overload on its own
+//      Nodes older than 2.2 have none
+//
+func Functions(keyspace string) (result []FunctionDescriptor, err error) {
+    if modern, err := hasSystemSchema() ; err != nil {
+        return nil, err
+    } else if (modern) {
+        return functionsSince3(keyspace)
+    }
+
+    var name, body, language, returns string
+    var names, validators []string
+    var calledOnNull bool
+
+    var iter = Session.Query(`SELECT function_name,argument_names,argument_types,body,called_on_null_input,language,return_type FROM system.schema_functions WHERE keyspace_name = ?;`, keyspace).Iter()
+
+    for iter.Scan(&name,&names,&validators,&body,&calledOnNull,&language,&returns) {
+        var described = FunctionDescriptor{
+            Name:               name,
+            Keyspace:           keyspace,
+            Language:           language,
+            Body:               body,
+            CalledOnNullInput:  calledOnNull,
+        }
+
+        var parsed, _, err = ParseMarshalType(returns)
+        if (err != nil) {
+            iter.Close()
+            return result, fmt.Errorf("could not read the return type of function %s.%s: %s", keyspace, name, err)
+        }
+        described.ReturnType = parsed.String()
+
+        for i, argument := range names {
+            if parsed, _, err = ParseMarshalType(validators[i]) ; err != nil {
+                iter.Close()
+                return result, fmt.Errorf("could not read the type of argument %s of function %s.%s: %s", argument, keyspace, name, err)
+            }
+            described.Arguments = append(described.Arguments, FieldDescriptor{ Name: argument, Type: parsed.String() })
+        }
+
+        result = append(result, described)
+    }
+    if err = iter.Close(); err != nil {
+        if (strings.Contains(err.Error(), "unconfigured columnfamily")) {
+            return nil, nil
+        }
+        return result, err
+    }
+
+    return result, nil
+}
+
+
+//
+//  Aggregates
+//      Get the user defined aggregates of a keyspace
+//      Nodes older than 2.2 have none
+//
+func Aggregates(keyspace string) (result []AggregateDescriptor, err error) {
+    if modern, err := hasSystemSchema() ; err != nil {
+        return nil, err
+    } else if (modern) {
+        return aggregatesSince3(keyspace)
+    }
+
+    var name, final, returns, stateFunction, stateType string
+    var validators []string
+    var initcond []byte
+
+    var iter = Session.Query(`SELECT aggregate_name,argument_types,final_func,initcond,return_type,state_func,state_type FROM system.schema_aggregates WHERE keyspace_name = ?;`, keyspace).Iter()
+
+    for iter.Scan(&name,&validators,&final,&initcond,&returns,&stateFunction,&stateType) {
+        var described = AggregateDescriptor{
+            Name:               name,
+            Keyspace:           keyspace,
+            StateFunction:      stateFunction,
+            FinalFunction:      final,
+        }
+
+        var types = append([]string{ returns, stateType }, validators...)
+        var parsed = make([]CQLType, len(types))
+        for i, validator := range types {
+            var err error
+            if parsed[i], _, err = ParseMarshalType(validator) ; err != nil {
+                iter.Close()
+                return result, fmt.Errorf("could not read the types of aggregate %s.%s: %s", keyspace, name, err)
+            }
+        }
+
+        described.ReturnType = parsed[0].String()
+        described.StateType = parsed[1].String()
+        for _, argument := range parsed[2:] {
+            described.ArgumentTypes = append(described.ArgumentTypes, argument.String())
+        }
+        if (initcond != nil) {
+            described.InitialCondition = initialCondition(parsed[1], initcond)
+        }
+
+        result = append(result, described)
+    }
+    if err = iter.Close(); err != nil {
+        if (strings.Contains(err.Error(), "unconfigured columnfamily")) {
+            return nil, nil
+        }
+        return result, err
+    }
+
+    return result, nil
+}
+
+//
+//  initialCondition
+//      The INITCOND of an aggregate as CQL, 2.2 keeps it serialized as the state type
+//      Types not read here are given as a blob
+//
+func initialCondition(stateType CQLType, value []byte) string {
+    switch {
+        case stateType.Name == "int" && len(value) == 4:
+            return fmt.Sprint(int32(binary.BigEndian.Uint32(value)))
+        case stateType.Name == "bigint" && len(value) == 8:
+            return fmt.Sprint(int64(binary.BigEndian.Uint64(value)))
+        case stateType.Name == "double" && len(value) == 8:
+            return fmt.Sprint(math.Float64frombits(binary.BigEndian.Uint64(value)))
+        case stateType.Name == "float" && len(value) == 4:
+            return fmt.Sprint(math.Float32frombits(binary.BigEndian.Uint32(value)))
+        case stateType.Name == "boolean" && len(value) == 1:
+            return fmt.Sprint(value[0] != 0)
+        case stateType.Name == "text" || stateType.Name == "ascii":
+            return quoteString(string(value))
+    }
+
+    return "0x" + hex.EncodeToString(value)
+}
+
+
+//
+//  Views
+//      Get the materialized views of a keyspace
+//      Only 3.0 and later have them
+//
+func Views(keyspace string) ([]ViewDescriptor, error) {
+    if modern, err := hasSystemSchema() ; err != nil || !modern {
+        return nil, err
+    }
+
+    return viewsSince3(keyspace)
+}
\ No newline at end of file
@@ -0,0 +1,466 @@
+package db
+
+import (
+    "strings"
+    "testing"
+    "encoding/json"
+
+    "github.com/zmarcantel/cmm/cql/cqltest"
+)
+
+var SCHEMA = []string{
+    "CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'NetworkTopologyStrategy', 'dc1' : 3, 'dc2' : 2 } AND DURABLE_WRITES = false",
+    "CREATE TYPE app.address (street TEXT, zip INT)",
+    "CREATE TABLE app.events (tenant TEXT, day TEXT, at TIMEUUID, owner TEXT STATIC, tags MAP<TEXT, BIGINT>, PRIMARY KEY ((tenant, day), at)) WITH CLUSTERING ORDER BY (at DESC) AND gc_grace_seconds = 3600 AND caching = {'keys': 'NONE'} AND compression = {'sstable_compression': 'DeflateCompressor', 'chunk_length_kb': 128}",
+    "CREATE INDEX ON app.events (keys(tags))",
+    "CREATE CUSTOM INDEX by_owner ON app.events (owner) USING 'org.example.Index'",
+    "CREATE TABLE app.users (id UUID PRIMARY KEY, email TEXT, home FROZEN<address>, visits MAP<TEXT, FROZEN<LIST<TIMESTAMP>>>, seen TUPLE<INET, TIMESTAMP>)",
+}
+
+//
+//  describeOn
+//      The JSON of keyspace app after creating SCHEMA on a fake node of the given version
+//
+func describeOn(t *testing.T, release string) string {
+    var fake = cqltest.NewFakeRelease(release)
+    for _, statement := range SCHEMA {
+        if err := fake.Query(statement).Exec() ; err != nil {
+            t.Fatal(
+                "For", statement,
+                "expected", nil,
+                "got", err,
+            )
+        }
+    }
+    Init(fake)
+
+    if version, err := Release() ; version != release {
+        t.Error(
+            "For", "Release()",
+            "expected", release,
+            "got", version, err,
+        )
+    }
+
+    var keyspace, err = Keyspace("app")
+    if (err != nil) {
+        t.Error(
+            "For", "Keyspace(app) on " + release,
+            "expected", nil,
+            "got", err,
+        )
+    }
+
+    var all []KeyspaceDescriptor
+    if all, err = AllKeyspaces() ; err != nil || len(all) < 2 {
+        t.Error(
+            "For", "AllKeyspaces() on " + release,
+            "expected", "app and the system keyspaces",
+            "got", all, err,
+        )
+    }
+
+    var described, _ = json.MarshalIndent(keyspace, "", "    ")
+    return string(described)
+}
+
+
+func TestSystemSchema(t *testing.T) {
+    var legacy = describeOn(t, "2.1.20")
+
+    for _, release := range []string{ "3.11.4", "4.0.0" } {
+        if described := describeOn(t, release) ; described != legacy {
+            t.Error(
+                "For", "Keyspace(app) on " + release,
+                "\nexpected", legacy,
+                "\n     got", described,
+            )
+        }
+    }
+
+    var table, err = Table("app", "events")
+    if (err != nil || len(table.Columns) != 5 || table.Columns[0].Name != "at" || table.Columns[0].Order != "DESC") {
+        t.Error(
+            "For", "Table(app, events) on 4.0.0",
+            "expected", "5 columns, at clustered DESC",
+            "got", table, err,
+        )
+    }
+
+    // options read from the 2.x tables are described as system_schema has them
+    var options = "CLUSTERING ORDER BY (at DESC)\n" +
+        "    AND caching = {'keys': 'NONE', 'rows_per_partition': 'NONE'}\n" +
+        "    AND compression = {'chunk_length_in_kb': '128', 'class': 'org.apache.cassandra.io.compress.DeflateCompressor'}\n" +
+        "    AND gc_grace_seconds = 3600;"
+    if (!strings.Contains(table.CQL(), options)) {
+        t.Error(
+            "For", "the options of CQL() of app.events",
+            "\nexpected", options,
+            "\n     got", table.CQL(),
+        )
+    }
+
+    var types = map[string]string{
+        "home":     "FROZEN<address>",
+        "visits":   "MAP<TEXT, FROZEN<LIST<TIMESTAMP>>>",
+        "seen":     "FROZEN<TUPLE<INET, TIMESTAMP>>",
+    }
+    for _, release := range []string{ "2.1.20", "4.0.0" } {
+        describeOn(t, release)
+
+        table, err = Table("app", "users")
+        for name, expected := range types {
+            if column, _ := table.Column(name) ; column.Type != expected {
+                t.Error(
+                    "For", "the type of users." + name + " on " + release,
+                    "expected", expected,
+                    "got", column.Type, err,
+                )
+            }
+        }
+    }
+
+    if _, err = Table("app", "missing") ; err == nil || err.Error() != "not found" {
+        t.Error(
+            "For", "Table(app, missing) on 4.0.0",
+            "expected", "not found",
+            "got", err,
+        )
+    }
+}
+
+
+func TestSameOption(t *testing.T) {
+    var current = map[string]interface{}{
+        "compaction":   map[string]string{ "class": COMPACTION_PACKAGE + "LeveledCompactionStrategy", "max_threshold": "32", "min_threshold": "4" },
+        "compression":  map[string]string{ "chunk_length_in_kb": "64", "class": COMPRESSION_PACKAGE + "LZ4Compressor" },
+        "comment":      "",
+        "gc_grace_seconds": 864000,
+    }
+
+    var same = map[string]interface{}{
+        "compaction":   map[string]interface{}{ "class": "LeveledCompactionStrategy" },
+        "compression":  map[string]interface{}{ "sstable_compression": "LZ4Compressor", "chunk_length_kb": 64.0 },
+        "gc_grace_seconds": 864000.0,
+    }
+    for name, desired := range same {
+        if (!SameOption(name, current[name], desired)) {
+            t.Error(
+                "For", name, desired,
+                "expected", "the same option as", current[name],
+                "got", "a different one",
+            )
+        }
+    }
+
+    var different = map[string]interface{}{
+        "compaction":   map[string]interface{}{ "class": "LeveledCompactionStrategy", "max_threshold": 16 },
+        "compression":  map[string]interface{}{ "class": "DeflateCompressor" },
+        "comment":      "users",
+        "gc_grace_seconds": 0,
+    }
+    for name, desired := range different {
+        if (SameOption(name, current[name], desired)) {
+            t.Error(
+                "For", name, desired,
+                "expected", "a different option than", current[name],
+                "got", "the same",
+            )
+        }
+    }
+
+    // caching held as text by 2.x is compared as the map it stands for
+    var caching = map[string]string{ "keys": "ALL", "rows_per_partition": "NONE" }
+    var cachingText = map[string]bool{
+        `{"keys":"ALL", "rows_per_partition":"NONE"}`:  true,
+        "KEYS_ONLY":                                    true,
+        "keys_only":                                    true,
+        `{"keys":"ALL", "rows_per_partition":"ALL"}`:   false,
+        "ROWS_ONLY":                                    false,
+    }
+    for text, same := range cachingText {
+        if (SameOption("caching", caching, text) != same || SameOption("caching", text, caching) != same) {
+            t.Error(
+                "For", "caching", text,
+                "expected", "the same option as", caching, same,
+                "got", !same,
+            )
+        }
+    }
+
+    for _, invalid := range []string{ "gc_grace_seconds", "bloom_filter_fp_chance", "compaction", "speculative_retry" } {
+        if _, err := TableOption(invalid, "never") ; err == nil {
+            t.Error(
+                "For", "TableOption(" + invalid + ", never)",
+                "expected", "an error",
+                "got", err,
+            )
+        }
+    }
+}
+
+
+func TestQuoteName(t *testing.T) {
+    var cases = map[string]string{
+        "points":       "points",
+        "top_10":       "top_10",
+        "Points":       `"Points"`,
+        "10th":         `"10th"`,
+        `say "hi"`:     `"say ""hi"""`,
+        "order":        `"order"`,
+        "key":          `"key"`,
+        "select":       `"select"`,
+        "Order":        `"Order"`,
+    }
+
+    for name, expected := range cases {
+        if quoted := quoteName(name) ; quoted != expected {
+            t.Error(
+                "For", "quoteName(" + name + ")",
+                "expected", expected,
+                "got", quoted,
+            )
+        }
+    }
+}
+
+
+func TestParseMarshalType(t *testing.T) {
+    var cases = map[string]string{
+        "org.apache.cassandra.db.marshal.UTF8Type":                                   "TEXT",
+        "org.apache.cassandra.db.marshal.DateType":                                   "TIMESTAMP",
+        "org.apache.cassandra.db.marshal.MapType(org.apache.cassandra.db.marshal.UUIDType,org.apache.cassandra.db.marshal.FloatType)":  "MAP<UUID, FLOAT>",
+        "org.apache.cassandra.db.marshal.ListType(org.apache.cassandra.db.marshal.FrozenType(org.apache.cassandra.db.marshal.SetType(org.apache.cassandra.db.marshal.Int32Type)))":    "LIST<FROZEN<SET<INT>>>",
+        "org.apache.cassandra.db.marshal.TupleType(org.apache.cassandra.db.marshal.Int32Type,org.apache.cassandra.db.marshal.UTF8Type)":  "FROZEN<TUPLE<INT, TEXT>>",
+        "org.apache.cassandra.db.marshal.UserType(app,61646472657373,737472656574:org.apache.cassandra.db.marshal.UTF8Type,7a6970:org.apache.cassandra.db.marshal.Int32Type)":  "FROZEN<address>",
+        "org.apache.cassandra.db.marshal.FrozenType(org.apache.cassandra.db.marshal.UserType(app,41646472657373))":  `FROZEN<"Address">`,
+        "org.apache.cassandra.db.marshal.CompositeType(org.apache.cassandra.db.marshal.ReversedType(org.apache.cassandra.db.marshal.LongType),org.apache.cassandra.db.marshal.UTF8Type)":  "COMPOSITE<BIGINT, TEXT>",
+        "org.apache.cassandra.db.marshal.ColumnToCollectionType(74616773:org.apache.cassandra.db.marshal.ListType(org.apache.cassandra.db.marshal.UTF8Type))":  "'org.apache.cassandra.db.marshal.ColumnToCollectionType(74616773:org.apache.cassandra.db.marshal.ListType(org.apache.cassandra.db.marshal.UTF8Type))'",
+        "org.example.Custom":                                                         "'org.example.Custom'",
+    }
+
+    for validator, expected := range cases {
+        var parsed, reversed, err = ParseMarshalType(validator)
+        if (err != nil || reversed || parsed.String() != expected) {
+            t.Error(
+                "For", validator,
+                "expected", expected,
+                "got", parsed.String(), reversed, err,
+            )
+        }
+    }
+
+    var parsed, reversed, err = ParseMarshalType("org.apache.cassandra.db.marshal.ReversedType(org.apache.cassandra.db.marshal.TimeUUIDType)")
+    if (err != nil || !reversed || parsed.String() != "TIMEUUID") {
+        t.Error(
+            "For", "ReversedType(TimeUUIDType)",
+            "expected", "TIMEUUID reversed",
+            "got", parsed.String(), reversed, err,
+        )
+    }
+
+    for _, validator := range []string{ "", "MapType(UTF8Type)", "ListType(UTF8Type", "UTF8Type)", "UserType(app,zz)" } {
+        if parsed, _, err := ParseMarshalType(validator) ; err == nil {
+            t.Error(
+                "For", validator,
+                "expected", "an error",
+                "got", parsed.String(),
+            )
+        }
+    }
+}
+
+
+func TestParseCQLType(t *testing.T) {
+    var cases = map[string]string{
+        "text":                             "TEXT",
+        "varchar":                          "TEXT",
+        "map<uuid,float>":                  "MAP<UUID, FLOAT>",
+        "MAP < UUID , FLOAT >":             "MAP<UUID, FLOAT>",
+        "list<frozen<map<text, int>>>":     "LIST<FROZEN<MAP<TEXT, INT>>>",
+        "tuple<int, text>":                 "FROZEN<TUPLE<INT, TEXT>>",
+        "frozen<tuple<int, text>>":         "FROZEN<TUPLE<INT, TEXT>>",
+        "frozen<Address>":                  "FROZEN<address>",
+        `frozen<"Address">`:                `FROZEN<"Address">`,
+        "app.address":                      "address",
+        `"int"`:                            `"int"`,
+        "'org.example.Custom'":             "'org.example.Custom'",
+    }
+
+    for text, expected := range cases {
+        if parsed, err := ParseCQLType(text) ; err != nil || parsed.String() != expected {
+            t.Error(
+                "For", text,
+                "expected", expected,
+                "got", parsed.String(), err,
+            )
+        }
+    }
+
+    for _, text := range []string{ "", "map<text>", "list<int", "int<text>", "set<int> text", "'org.example.Custom" } {
+        if parsed, err := ParseCQLType(text) ; err == nil {
+            t.Error(
+                "For", text,
+                "expected", "an error",
+                "got", parsed.String(),
+            )
+        }
+    }
+
+    var same = map[[2]string]bool{
+        { "MAP<UUID,FLOAT>", "map<uuid, float>" }:      true,
+        { "VARCHAR", "text" }:                          true,
+        { "int", "BIGINT" }:                            false,
+        { "frozen<address>", "address" }:               false,
+    }
+    for types, expected := range same {
+        if (SameType(types[0], types[1]) != expected) {
+            t.Error(
+                "For", "SameType", types,
+                "expected", expected,
+                "got", !expected,
+            )
+        }
+    }
+}
+
+var ROUTINES = []string{
+    "CREATE KEYSPACE calc WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 }",
+    "CREATE FUNCTION calc.plus (state INT, value INT) CALLED ON NULL INPUT RETURNS INT LANGUAGE java AS 'return state + value;'",
+    "CREATE FUNCTION calc.half (state INT) RETURNS NULL ON NULL INPUT RETURNS DOUBLE LANGUAGE java AS $$return state / 2.0;$$",
+    "CREATE AGGREGATE calc.total (INT) SFUNC plus STYPE INT INITCOND 0",
+    "CREATE AGGREGATE calc.middle (INT) SFUNC plus STYPE INT FINALFUNC half INITCOND 10",
+    "CREATE TABLE calc.scores (player TEXT, game INT, points INT, PRIMARY KEY (player, game))",
+}
+
+const VIEW = "CREATE MATERIALIZED VIEW calc.by_points AS SELECT player, game, points FROM calc.scores WHERE points IS NOT NULL AND player IS NOT NULL AND game IS NOT NULL PRIMARY KEY (points, player, game) WITH CLUSTERING ORDER BY (player DESC)"
+
+//
+//  fakeOn
+//      A fake node of the given version the statements ran on, set as the session
+//
+func fakeOn(t *testing.T, release string, statements []string) *cqltest.Fake {
+    var fake = cqltest.NewFakeRelease(release)
+    for _, statement := range statements {
+        if err := fake.Query(statement).Exec() ; err != nil {
+            t.Fatal(
+                "For", statement + " on " + release,
+                "expected", nil,
+                "got", err,
+            )
+        }
+    }
+
+    Init(fake)
+    return fake
+}
+
+
+func TestFunctionsAndViews(t *testing.T) {
+    if err := cqltest.NewFake().Query(ROUTINES[1]).Exec() ; err == nil {
+        t.Error(
+            "For", "CREATE FUNCTION on 2.1.20",
+            "expected", "an error",
+            "got", err,
+        )
+    }
+
+    // functions and aggregates read the same from the 2.2 tables as from system_schema
+    var described []string
+    for _, release := range []string{ "2.2.19", "3.11.4" } {
+        fakeOn(t, release, ROUTINES)
+
+        var keyspace, err = Keyspace("calc")
+        if (err != nil || len(keyspace.Functions) != 2 || len(keyspace.Aggregates) != 2) {
+            t.Error(
+                "For", "Keyspace(calc) on " + release,
+                "expected", "2 functions and 2 aggregates",
+                "got", keyspace, err,
+            )
+        }
+
+        var encoded, _ = json.MarshalIndent(keyspace, "", "    ")
+        described = append(described, string(encoded))
+    }
+    if (described[0] != described[1]) {
+        t.Error(
+            "For", "Keyspace(calc) on 3.11.4",
+            "\nexpected", described[0],
+            "\n     got", described[1],
+        )
+    }
+
+    fakeOn(t, "3.11.4", append(append([]string{}, ROUTINES...), VIEW))
+    var keyspace, err = Keyspace("calc")
+    if (err != nil || len(keyspace.Views) != 1 || keyspace.Views[0].Table != "scores" || len(keyspace.Views[0].Columns) != 3) {
+        t.Fatal(
+            "For", "Keyspace(calc) with a view",
+            "expected", "view by_points of scores",
+            "got", keyspace.Views, err,
+        )
+    }
+
+    var expected = "CREATE MATERIALIZED VIEW calc.by_points AS\n" +
+        "    SELECT points, player, game\n" +
+        "    FROM calc.scores\n" +
+        "    WHERE points IS NOT NULL AND player IS NOT NULL AND game IS NOT NULL\n" +
+        "    PRIMARY KEY (points, player, game)\n" +
+        "    WITH CLUSTERING ORDER BY (player DESC, game ASC);"
+    if (keyspace.Views[0].CQL() != expected) {
+        t.Error(
+            "For", "CQL() of view by_points",
+            "\nexpected", expected,
+            "\n     got", keyspace.Views[0].CQL(),
+        )
+    }
+
+    // indexes on part of a collection keep what they index, a plain one indexes the values
+    var collections = []string{
+        "CREATE TABLE calc.boards (game INT PRIMARY KEY, ranks MAP<TEXT, INT>, tags SET<TEXT>, top FROZEN<LIST<TEXT>>)",
+        "CREATE INDEX boards_rank_entries ON calc.boards (entries(ranks))",
+        "CREATE INDEX boards_tag_values ON calc.boards (tags)",
+        "CREATE INDEX boards_top_full ON calc.boards (full(top))",
+    }
+    fakeOn(t, "3.11.4", append(append(append([]string{}, ROUTINES...), VIEW), collections...))
+    if keyspace, err = Keyspace("calc") ; err != nil {
+        t.Fatal(
+            "For", "Keyspace(calc) with indexed collections",
+            "expected", nil,
+            "got", err,
+        )
+    }
+
+    var indexes = map[string]string{
+        "boards_rank_entries":  "CREATE INDEX boards_rank_entries ON calc.boards (entries(ranks));",
+        "boards_tag_values":    "CREATE INDEX boards_tag_values ON calc.boards (tags);",
+        "boards_top_full":      "CREATE INDEX boards_top_full ON calc.boards (full(top));",
+    }
+    var boards, _ = Table("calc", "boards")
+    for _, index := range boards.Indexes {
+        if (index.CQL(boards) != indexes[index.Name]) {
+            t.Error(
+                "For", "CQL() of index " + index.Name,
+                "expected", indexes[index.Name],
+                "got", index.CQL(boards),
+            )
+        }
+    }
+    if (len(boards.Indexes) != len(indexes)) {
+        t.Error(
+            "For", "indexes of calc.boards",
+            "expected", len(indexes),
+            "got", boards.Indexes,
+        )
+    }
+
+    // the statements of the keyspace recreate it
+    var output = keyspace.CQL()
+    fakeOn(t, "3.11.4", strings.Split(strings.TrimSuffix(output, ";"), ";\n\n"))
+    if recreated, err := Keyspace("calc") ; err != nil || recreated.CQL() != output {
+        t.Error(
+            "For", "CQL() after running its statements",
+            "\nexpected", output,
+            "\n     got", recreated.CQL(), err,
+        )
+    }
+}
\ No newline at end of file
@@ -0,0 +1,289 @@
+package db
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "encoding/json"
+)
+
+//-------------------------------------------------------
+// Table Options
+//-------------------------------------------------------
+
+const COMPACTION_PACKAGE = "org.apache.cassandra.db.compaction."
+const COMPRESSION_PACKAGE = "org.apache.cassandra.io.compress."
+
+// the WITH options of a table that are described and backfilled, by their CQL name
+var TABLE_OPTIONS = []string{
+    "bloom_filter_fp_chance",
+    "caching",
+    "comment",
+    "compaction",
+    "compression",
+    "default_time_to_live",
+    "gc_grace_seconds",
+}
+
+// what cassandra gives a table created without options, in the form 3.0 describes them
+var DEFAULT_TABLE_OPTIONS = map[string]interface{}{
+    "bloom_filter_fp_chance":   0.01,
+    "caching":                  map[string]string{ "keys": "ALL", "rows_per_partition": "NONE" },
+    "comment":                  "",
+    "compaction":               map[string]string{ "class": COMPACTION_PACKAGE + "SizeTieredCompactionStrategy", "max_threshold": "32", "min_threshold": "4" },
+    "compression":              map[string]string{ "chunk_length_in_kb": "64", "class": COMPRESSION_PACKAGE + "LZ4Compressor" },
+    "default_time_to_live":     0,
+    "gc_grace_seconds":         864000,
+}
+
+//
+//  TableOption
+//      Check the value of a table option and give it the type descriptors hold it as:
+//      a string comment, int seconds, a float64 chance, and string maps for caching, compaction and compression
+//      Numbers may be given as JSON numbers or strings
+//
+func TableOption(name string, value interface{}) (interface{}, error) {
+    var invalid = fmt.Errorf("invalid value for table option [%s]: %v", name, value)
+
+    switch (name) {
+        case "comment":
+            if comment, isString := value.(string) ; isString {
+                return comment, nil
+            }
+
+        case "default_time_to_live", "gc_grace_seconds":
+            var seconds, err = strconv.ParseFloat(fmt.Sprint(value), 64)
+            if (err == nil && seconds >= 0 && seconds == float64(int(seconds))) {
+                return int(seconds), nil
+            }
+
+        case "bloom_filter_fp_chance":
+            var chance, err = strconv.ParseFloat(fmt.Sprint(value), 64)
+            if (err == nil && chance > 0 && chance <= 1) {
+                return chance, nil
+            }
+
+        case "caching", "compaction", "compression":
+            var options = make(map[string]string)
+            switch literal := value.(type) {
+                case map[string]string:
+                    for key, option := range literal {
+                        options[key] = option
+                    }
+                case map[string]interface{}:
+                    for key, option := range literal {
+                        options[key] = fmt.Sprint(option)
+                    }
+                default:
+                    return nil, invalid
+            }
+
+            if (name == "compaction" && len(options["class"]) == 0) {
+                return nil, fmt.Errorf("table option [compaction] needs a class")
+            }
+            return options, nil
+
+        default:
+            return nil, fmt.Errorf("unknown table option [%s], expected one of %s", name, strings.Join(TABLE_OPTIONS, ", "))
+    }
+
+    return nil, invalid
+}
+
+//
+//  canonicalOption
+//      The value of an option in the form 3.0 describes it
+//      Classes are given their package and the 2.x names of compression options are renamed
+//      Caching given as text, the JSON of 2.1 or the single word of 2.0, becomes its map
+//
+func canonicalOption(name string, value interface{}) interface{} {
+    if text, isText := value.(string) ; isText && name == "caching" {
+        if options, known := legacyCaching(text) ; known {
+            value = options
+        }
+    }
+
+    var typed, err = TableOption(name, value)
+    if (err != nil) {
+        return value
+    }
+
+    var options, isMap = typed.(map[string]string)
+    if (!isMap) {
+        return typed
+    }
+
+    switch (name) {
+        case "compaction":
+            if (!strings.Contains(options["class"], ".")) { options["class"] = COMPACTION_PACKAGE + options["class"] }
+
+        case "compression":
+            for legacy, modern := range map[string]string{ "sstable_compression": "class", "chunk_length_kb": "chunk_length_in_kb" } {
+                if option, given := options[legacy] ; given {
+                    options[modern] = option
+                    delete(options, legacy)
+                }
+            }
+            if (len(options["class"]) > 0 && !strings.Contains(options["class"], ".")) {
+                options["class"] = COMPRESSION_PACKAGE + options["class"]
+            }
+    }
+    return options
+}
+
+//
+//  SameOption
+//      Whether the current value of a table option is the desired one
+//      Only the sub-options a desired map gives are compared, cassandra fills in the rest itself
+//
+func SameOption(name string, current, desired interface{}) bool {
+    current = canonicalOption(name, current)
+    desired = canonicalOption(name, desired)
+
+    var wanted, isMap = desired.(map[string]string)
+    if (!isMap) {
+        return fmt.Sprint(current) == fmt.Sprint(desired)
+    }
+
+    var existing, _ = current.(map[string]string)
+    for key, value := range wanted {
+        if (existing[key] != value) { return false }
+    }
+    return true
+}
+
+//
+//  OptionCQL
+//      The value of a table option as a CQL literal, maps have their keys sorted
+//
+func OptionCQL(value interface{}) string {
+    switch literal := value.(type) {
+        case string:
+            return quoteString(literal)
+
+        case map[string]string:
+            var keys []string
+            for key := range literal {
+                keys = append(keys, key)
+            }
+            sort.Strings(keys)
+
+            var entries []string
+            for _, key := range keys {
+                entries = append(entries, quoteString(key) + ": " + quoteString(literal[key]))
+            }
+            return "{" + strings.Join(entries, ", ") + "}"
+
+        case map[string]interface{}:
+            var options = make(map[string]string)
+            for key, option := range literal {
+                options[key] = fmt.Sprint(option)
+            }
+            return OptionCQL(options)
+    }
+
+    return fmt.Sprint(value)
+}
+
+//
+//  optionsCQL
+//      The options of a table that differ from cassandra's defaults, as name = value, sorted by name
+//
+func optionsCQL(options map[string]interface{}) []string {
+    var names []string
+    for name := range options {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var result []string
+    for _, name := range names {
+        var standard, known = DEFAULT_TABLE_OPTIONS[name]
+        if (known && SameOption(name, options[name], standard) && SameOption(name, standard, options[name])) { continue }
+        result = append(result, name + " = " + OptionCQL(options[name]))
+    }
+    return result
+}
+
+// the caching of 2.0, by the keys and rows_per_partition 2.1 turned it into
+var LEGACY_CACHING = map[string][2]string{
+    "ALL":          { "ALL", "ALL" },
+    "KEYS_ONLY":    { "ALL", "NONE" },
+    "ROWS_ONLY":    { "NONE", "ALL" },
+    "NONE":         { "NONE", "NONE" },
+}
+
+//
+//  legacyCaching
+//      The map of a caching option given as text, either JSON as 2.1 holds it or a word of 2.0
+//
+func legacyCaching(text string) (map[string]string, bool) {
+    if words, isWord := LEGACY_CACHING[strings.ToUpper(strings.TrimSpace(text))] ; isWord {
+        return map[string]string{ "keys": words[0], "rows_per_partition": words[1] }, true
+    }
+
+    var parsed map[string]interface{}
+    if err := json.Unmarshal([]byte(text), &parsed) ; err != nil {
+        return nil, false
+    }
+
+    var options = make(map[string]string)
+    for key, value := range parsed {
+        options[key] = fmt.Sprint(value)
+    }
+    return options, true
+}
+
+//
+//  legacyOptions
+//      Gather the options of a 2.x table into the form system_schema has them
+//      Compaction is split over a class, JSON options and threshold columns, compression and caching are JSON
+//
+func legacyOptions(chance float64, caching, comment, compactionClass, compactionOptions, compression string, ttl, gcGrace, maxThreshold, minThreshold int) (map[string]interface{}, error) {
+    var options = map[string]interface{}{
+        "bloom_filter_fp_chance":   chance,
+        "comment":                  comment,
+        "default_time_to_live":     ttl,
+        "gc_grace_seconds":         gcGrace,
+    }
+
+    var parse = func(name, encoded string) (map[string]string, error) {
+        var parsed map[string]interface{}
+        if (len(encoded) > 0) {
+            if err := json.Unmarshal([]byte(encoded), &parsed) ; err != nil {
+                return nil, fmt.Errorf("could not parse the %s of a table: %s", name, err)
+            }
+        }
+
+        var result = make(map[string]string)
+        for key, value := range parsed {
+            result[key] = fmt.Sprint(value)
+        }
+        return result, nil
+    }
+
+    var compaction, err = parse("compaction options", compactionOptions)
+    if (err != nil) {
+        return nil, err
+    }
+    compaction["class"] = compactionClass
+    compaction["max_threshold"] = strconv.Itoa(maxThreshold)
+    compaction["min_threshold"] = strconv.Itoa(minThreshold)
+    options["compaction"] = canonicalOption("compaction", compaction)
+
+    var parameters map[string]string
+    if parameters, err = parse("compression parameters", compression) ; err != nil {
+        return nil, err
+    }
+    options["compression"] = canonicalOption("compression", parameters)
+
+    // 2.0 has a single word, such as KEYS_ONLY, rather than a map
+    if cache, err := parse("caching", caching) ; err == nil {
+        options["caching"] = cache
+    } else {
+        options["caching"] = caching
+    }
+
+    return options, nil
+}
\ No newline at end of file
@@ -0,0 +1,343 @@
+package db
+
+import (
+    "strings"
+)
+
+//-------------------------------------------------------
+// system_schema
+//
+// Cassandra 3.0 replaced the system.schema_* tables with the system_schema keyspace
+// These read it into the same descriptors the legacy tables give
+//-------------------------------------------------------
+
+func allKeyspacesSince3() ([]KeyspaceDescriptor, error) {
+    var name string
+    var names []string
+
+    var iter = Session.Query(`SELECT keyspace_name FROM system_schema.keyspaces;`).Iter()
+    for iter.Scan(&name) {
+        names = append(names, name)
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+
+    var keyspaces = make([]KeyspaceDescriptor, 0)
+    for _, name := range names {
+        var keyspace, err = keyspaceSince3(name)
+        if (err != nil) {
+            return nil, err
+        }
+        keyspaces = append(keyspaces, keyspace)
+    }
+
+    return keyspaces, nil
+}
+
+
+//
+//  keyspaceSince3
+//      The class is kept in the replication map along with the strategy options
+//
+func keyspaceSince3(name string) (KeyspaceDescriptor, error) {
+    var described = KeyspaceDescriptor{ Name: name, Options: make(map[string]interface{}) }
+
+    var replication map[string]string
+    var err = Session.Query(`SELECT durable_writes, replication FROM system_schema.keyspaces WHERE keyspace_name = ?;`, name).Scan(&described.DurableWrites, &replication)
+    if (err != nil) {
+        return KeyspaceDescriptor{}, err
+    }
+
+    for key, value := range replication {
+        if (key == "class") {
+            described.Class = value
+        } else {
+            described.Options[key] = value
+        }
+    }
+
+    if err = described.load() ; err != nil {
+        return KeyspaceDescriptor{}, err
+    }
+
+    return described, nil
+}
+
+
+func allTablesSince3(keyspace string) (result []TableDescriptor, err error) {
+    var name string
+    var names []string
+
+    var iter = Session.Query(`SELECT table_name FROM system_schema.tables WHERE keyspace_name = ?;`, keyspace).Iter()
+    for iter.Scan(&name) {
+        names = append(names, name)
+    }
+    if err = iter.Close(); err != nil {
+        return result, err
+    }
+
+    for _, name := range names {
+        var columns, err = columnsSince3(keyspace, name)
+        if (err != nil) {
+            return result, err
+        }
+
+        indexes, err := indexesSince3(keyspace, name)
+        if (err != nil) {
+            return result, err
+        }
+
+        options, err := optionsSince3(keyspace, name)
+        if (err != nil) {
+            return result, err
+        }
+
+        result = append(result, TableDescriptor{
+            Name:           name,
+            Keyspace:       keyspace,
+            Columns:        columns,
+            Indexes:        indexes,
+            Options:        options,
+        })
+    }
+
+    return result, nil
+}
+
+
+//
+//  columnsSince3
+//      Types are already CQL, clustering columns are of kind clustering rather than clustering_key
+//      and regular columns have a position of -1
+//
+func columnsSince3(keyspace, table string) (result []ColumnDescriptor, err error) {
+    var name, kind, order, datatype string
+    var position int
+
+    var iter = Session.Query(`SELECT column_name,kind,position,clustering_order,type FROM system_schema.columns WHERE keyspace_name = ? AND table_name = ?;`, keyspace, table).Iter()
+
+    for iter.Scan(&name,&kind,&position,&order,&datatype) {
+        if (kind == "clustering") { kind = "clustering_key" }
+
+        var column = ColumnDescriptor{
+            Name:           name,
+            Type:           schemaType(datatype),
+            Primary:        kind == "partition_key",
+            Kind:           kind,
+        }
+        if (kind == "partition_key" || kind == "clustering_key") {
+            column.Position = position
+        }
+        if (kind == "clustering_key") {
+            column.Order = strings.ToUpper(order)
+        }
+
+        result = append(result, column)
+    }
+    if err = iter.Close(); err != nil {
+        return result, err
+    }
+
+    return result, nil
+}
+
+
+//
+//  indexesSince3
+//      The indexed column is the target option, wrapped in keys(), entries() or full() for part of a collection
+//      values() is what a plain index on a collection indexes, so it is left out as CREATE INDEX leaves it out
+//
+func indexesSince3(keyspace, table string) (result []IndexDescriptor, err error) {
+    var name, kind string
+    var options map[string]string
+
+    var iter = Session.Query(`SELECT index_name,kind,options FROM system_schema.indexes WHERE keyspace_name = ? AND table_name = ?;`, keyspace, table).Iter()
+
+    for iter.Scan(&name,&kind,&options) {
+        var target = options["target"]
+        var index = IndexDescriptor{ Name: name }
+
+        for _, function := range []string{ "keys", "entries", "full", "values" } {
+            if (strings.HasPrefix(target, function + "(") && strings.HasSuffix(target, ")")) {
+                target = target[len(function) + 1 : len(target) - 1]
+                if (function != "values") { index.Target = function }
+                break
+            }
+        }
+        index.Column = unquoteName(target)
+
+        if (kind == "CUSTOM") { index.Class = options["class_name"] }
+
+        result = append(result, index)
+    }
+    if err = iter.Close(); err != nil {
+        return result, err
+    }
+
+    return result, nil
+}
+
+
+func optionsSince3(keyspace, table string) (map[string]interface{}, error) {
+    var chance float64
+    var comment string
+    var ttl, gcGrace int
+    var caching, compaction, compression map[string]string
+
+    var err = Session.Query(`SELECT bloom_filter_fp_chance,caching,comment,compaction,compression,default_time_to_live,gc_grace_seconds FROM system_schema.tables WHERE keyspace_name = ? AND table_name = ?;`, keyspace, table).Scan(&chance,&caching,&comment,&compaction,&compression,&ttl,&gcGrace)
+    if (err != nil) {
+        return nil, err
+    }
+
+    return map[string]interface{}{
+        "bloom_filter_fp_chance":   chance,
+        "caching":                  caching,
+        "comment":                  comment,
+        "compaction":               compaction,
+        "compression":              compression,
+        "default_time_to_live":     ttl,
+        "gc_grace_seconds":         gcGrace,
+    }, nil
+}
+
+
+func typesSince3(keyspace string) (result []TypeDescriptor, err error) {
+    var name string
+    var fields, types []string
+
+    var iter = Session.Query(`SELECT type_name,field_names,field_types FROM system_schema.types WHERE keyspace_name = ?;`, keyspace).Iter()
+
+    for iter.Scan(&name,&fields,&types) {
+        var described = TypeDescriptor{ Name: name, Keyspace: keyspace }
+        for i, field := range fields {
+            described.Fields = append(described.Fields, FieldDescriptor{ Name: field, Type: schemaType(types[i]) })
+        }
+
+        result = append(result, described)
+    }
+    if err = iter.Close(); err != nil {
+        return result, err
+    }
+
+    return result, nil
+}
+
+
+func functionsSince3(keyspace string) (result []FunctionDescriptor, err error) {
+    var name, body, language, returns string
+    var names, types []string
+    var calledOnNull bool
+
+    var iter = Session.Query(`SELECT function_name,argument_names,argument_types,body,called_on_null_input,language,return_type FROM system_schema.functions WHERE keyspace_name = ?;`, keyspace).Iter()
+
+    for iter.Scan(&name,&names,&types,&body,&calledOnNull,&language,&returns) {
+        var described = FunctionDescriptor{
+            Name:               name,
+            Keyspace:           keyspace,
+            ReturnType:         schemaType(returns),
+            Language:           language,
+            Body:               body,
+            CalledOnNullInput:  calledOnNull,
+        }
+        for i, argument := range names {
+            described.Arguments = append(described.Arguments, FieldDescriptor{ Name: argument, Type: schemaType(types[i]) })
+        }
+
+        result = append(result, described)
+    }
+    if err = iter.Close(); err != nil {
+        return result, err
+    }
+
+    return result, nil
+}
+
+
+//
+//  aggregatesSince3
+//      The INITCOND is already CQL
+//
+func aggregatesSince3(keyspace string) (result []AggregateDescriptor, err error) {
+    var name, final, initcond, returns, stateFunction, stateType string
+    var types []string
+
+    var iter = Session.Query(`SELECT aggregate_name,argument_types,final_func,initcond,return_type,state_func,state_type FROM system_schema.aggregates WHERE keyspace_name = ?;`, keyspace).Iter()
+
+    for iter.Scan(&name,&types,&final,&initcond,&returns,&stateFunction,&stateType) {
+        var described = AggregateDescriptor{
+            Name:               name,
+            Keyspace:           keyspace,
+            StateFunction:      stateFunction,
+            StateType:          schemaType(stateType),
+            FinalFunction:      final,
+            InitialCondition:   initcond,
+            ReturnType:         schemaType(returns),
+        }
+        for _, argument := range types {
+            described.ArgumentTypes = append(described.ArgumentTypes, schemaType(argument))
+        }
+
+        result = append(result, described)
+    }
+    if err = iter.Close(); err != nil {
+        return result, err
+    }
+
+    return result, nil
+}
+
+
+//
+//  viewsSince3
+//      The columns of a view are in system_schema.columns under its own name, as a table's are
+//
+func viewsSince3(keyspace string) (result []ViewDescriptor, err error) {
+    var name, base, where string
+    var includeAll bool
+    var views []ViewDescriptor
+
+    var iter = Session.Query(`SELECT view_name,base_table_name,include_all_columns,where_clause FROM system_schema.views WHERE keyspace_name = ?;`, keyspace).Iter()
+    for iter.Scan(&name,&base,&includeAll,&where) {
+        views = append(views, ViewDescriptor{
+            Name:               name,
+            Keyspace:           keyspace,
+            Table:              base,
+            IncludeAllColumns:  includeAll,
+            Where:              where,
+        })
+    }
+    if err = iter.Close(); err != nil {
+        return result, err
+    }
+
+    for _, view := range views {
+        if view.Columns, err = columnsSince3(keyspace, view.Name) ; err != nil {
+            return result, err
+        }
+        result = append(result, view)
+    }
+
+    return result, nil
+}
+
+
+//
+//  schemaType
+//      The canonical form of a CQL type, as the legacy path gives it
+//      A type that does not parse is kept as Cassandra wrote it
+//
+func schemaType(cqlType string) string {
+    var parsed, err = ParseCQLType(cqlType)
+    if (err != nil) {
+        return cqlType
+    }
+    return parsed.String()
+}
+
+func unquoteName(name string) string {
+    if (len(name) > 1 && strings.HasPrefix(name, `"`) && strings.HasSuffix(name, `"`)) {
+        return strings.Replace(name[1:len(name) - 1], `""`, `"`, -1)
+    }
+    return name
+}
\ No newline at end of file
@@ -0,0 +1,421 @@
+package db
+
+import (
+    "fmt"
+    "strings"
+    "encoding/hex"
+)
+
+//-------------------------------------------------------
+// Types
+//-------------------------------------------------------
+
+const MARSHAL_PACKAGE = "org.apache.cassandra.db.marshal."
+
+// CQL names of the marshal classes of the native types
+var NATIVE_TYPES = map[string]string{
+    "AsciiType":            "ascii",
+    "BooleanType":          "boolean",
+    "ByteType":             "tinyint",
+    "BytesType":            "blob",
+    "CounterColumnType":    "counter",
+    "DateType":             "timestamp",
+    "DecimalType":          "decimal",
+    "DoubleType":           "double",
+    "DurationType":         "duration",
+    "FloatType":            "float",
+    "InetAddressType":      "inet",
+    "Int32Type":            "int",
+    "IntegerType":          "varint",
+    "LongType":             "bigint",
+    "ShortType":            "smallint",
+    "SimpleDateType":       "date",
+    "TimeType":             "time",
+    "TimeUUIDType":         "timeuuid",
+    "TimestampType":        "timestamp",
+    "UTF8Type":             "text",
+    "UUIDType":             "uuid",
+}
+
+// how many parameters each parameterized type takes, -1 for at least one
+var TYPE_PARAMS = map[string]int{
+    "list":     1,
+    "set":      1,
+    "map":      2,
+    "frozen":   1,
+    "tuple":    -1,
+}
+
+//
+//  CQLType
+//      A column type, parsed from a marshal class or from CQL
+//      Tuples are always frozen, as are user types read from a marshal class since only 3.x has unfrozen ones
+//
+type CQLType struct {
+    Name        string      // native type, list, set, map, frozen or tuple -- or the name of a user type
+    Keyspace    string      // of a user type, when known
+    User        bool        // a user defined type
+    Params      []CQLType   // of collections, frozen and tuples
+    Custom      string      // class of a custom type, Name is then empty
+}
+
+//
+//  String
+//      The type in CQL, with native and collection types in upper case, e.g. MAP<TEXT, FROZEN<address>>
+//      Two types are the same when their strings are
+//
+func (self CQLType) String() string {
+    if (len(self.Custom) > 0) {
+        return quoteString(self.Custom)
+    }
+    if (self.User) {
+        // a user type named like a native one must stay quoted to mean the user type
+        var _, parameterized = TYPE_PARAMS[self.Name]
+        if (isNative(self.Name) || parameterized || self.Name == "varchar") {
+            return `"` + self.Name + `"`
+        }
+        return quoteName(self.Name)
+    }
+    if (len(self.Params) == 0) {
+        return strings.ToUpper(self.Name)
+    }
+
+    var params []string
+    for _, param := range self.Params {
+        params = append(params, param.String())
+    }
+    return strings.ToUpper(self.Name) + "<" + strings.Join(params, ", ") + ">"
+}
+
+func frozen(inner CQLType) CQLType {
+    if (inner.Name == "frozen" && !inner.User) {
+        return inner
+    }
+    return CQLType{ Name: "frozen", Params: []CQLType{ inner } }
+}
+
+//
+//  SameType
+//      Whether two CQL types are the same, whatever their case and spacing
+//      Types that do not parse are compared ignoring case
+//
+func SameType(a, b string) bool {
+    var left, leftErr = ParseCQLType(a)
+    var right, rightErr = ParseCQLType(b)
+    if (leftErr != nil || rightErr != nil) {
+        return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+    }
+
+    return left.String() == right.String()
+}
+
+
+//-------------------------------------------------------
+// Marshal Classes
+//-------------------------------------------------------
+
+//
+//  ParseMarshalType
+//      Read a validator of the 2.x schema tables, e.g. org.apache.cassandra.db.marshal.MapType(UTF8Type,Int32Type)
+//      Reversed is set when it was wrapped in a ReversedType, as clustering columns in DESC order are
+//      Unknown classes become custom types
+//
+func ParseMarshalType(validator string) (result CQLType, reversed bool, err error) {
+    var p = &marshalParser{ text: validator }
+    if result, reversed, err = p.parse() ; err != nil {
+        return
+    }
+    if (p.pos < len(p.text)) {
+        return result, reversed, fmt.Errorf("unexpected [%s] at %d of marshal class [%s]", p.text[p.pos:], p.pos, validator)
+    }
+    return
+}
+
+type marshalParser struct {
+    text        string
+    pos         int
+}
+
+func (self *marshalParser) accept(c byte) bool {
+    if (self.pos < len(self.text) && self.text[self.pos] == c) {
+        self.pos++
+        return true
+    }
+    return false
+}
+
+//
+//  word
+//      A class name, keyspace or hex encoded name, up to the next delimiter
+//
+func (self *marshalParser) word() string {
+    var start = self.pos
+    for self.pos < len(self.text) && !strings.ContainsRune("(),:", rune(self.text[self.pos])) {
+        self.pos++
+    }
+    return strings.TrimSpace(self.text[start:self.pos])
+}
+
+func (self *marshalParser) parse() (CQLType, bool, error) {
+    var start = self.pos
+    var class = strings.TrimPrefix(self.word(), MARSHAL_PACKAGE)
+    if (len(class) == 0) {
+        return CQLType{}, false, fmt.Errorf("expected a marshal class at %d of [%s]", self.pos, self.text)
+    }
+
+    if (class == "UserType") {
+        var result, err = self.userType()
+        return result, false, err
+    }
+
+    var params []CQLType
+    if (self.accept('(')) {
+        for !self.accept(')') {
+            if (self.pos >= len(self.text)) {
+                return CQLType{}, false, fmt.Errorf("unbalanced parentheses in marshal class [%s]", self.text)
+            }
+
+            var param, _, err = self.parse()
+            if (err != nil) {
+                return CQLType{}, false, err
+            }
+
+            // ColumnToCollectionType names each collection -- hex:class
+            if (self.accept(':')) {
+                if param, _, err = self.parse() ; err != nil {
+                    return CQLType{}, false, err
+                }
+            }
+
+            params = append(params, param)
+            self.accept(',')
+        }
+    }
+
+    switch (class) {
+        case "ReversedType":
+            if (len(params) == 1) { return params[0], true, nil }
+
+        case "FrozenType":
+            if (len(params) == 1) { return frozen(params[0]), false, nil }
+
+        case "ListType", "SetType", "MapType":
+            var name = strings.ToLower(strings.TrimSuffix(class, "Type"))
+            if (len(params) == TYPE_PARAMS[name]) {
+                return CQLType{ Name: name, Params: params }, false, nil
+            }
+
+        case "TupleType":
+            if (len(params) > 0) { return frozen(CQLType{ Name: "tuple", Params: params }), false, nil }
+
+        case "CompositeType":
+            // only found in the comparators of tables, it is not a column type
+            return CQLType{ Name: "composite", Params: params }, false, nil
+
+        default:
+            if name, native := NATIVE_TYPES[class] ; native && len(params) == 0 {
+                return CQLType{ Name: name }, false, nil
+            }
+            return CQLType{ Custom: strings.TrimSpace(self.text[start:self.pos]) }, false, nil
+    }
+
+    return CQLType{}, false, fmt.Errorf("wrong number of parameters to %s in [%s]", class, self.text)
+}
+
+//
+//  userType
+//      UserType(keyspace,hex name,hex field:class,...), the name of the type and its fields are hex encoded
+//
+func (self *marshalParser) userType() (CQLType, error) {
+    var malformed = fmt.Errorf("malformed UserType in [%s]", self.text)
+    if (!self.accept('(')) {
+        return CQLType{}, malformed
+    }
+
+    var keyspace = self.word()
+    if (!self.accept(',')) {
+        return CQLType{}, malformed
+    }
+
+    var name, err = hex.DecodeString(self.word())
+    if (err != nil) {
+        return CQLType{}, fmt.Errorf("could not decode the name of a UserType in [%s]: %s", self.text, err)
+    }
+
+    // the fields are part of the type's own definition, not of the column's
+    for self.accept(',') {
+        self.word()
+        if (!self.accept(':')) {
+            return CQLType{}, malformed
+        }
+        if _, _, err = self.parse() ; err != nil {
+            return CQLType{}, err
+        }
+    }
+    if (!self.accept(')')) {
+        return CQLType{}, malformed
+    }
+
+    return frozen(CQLType{ Name: string(name), Keyspace: keyspace, User: true }), nil
+}
+
+
+//-------------------------------------------------------
+// CQL
+//-------------------------------------------------------
+
+//
+//  ParseCQLType
+//      Read a type as written in CQL, e.g. map<text, frozen<list<int>>>, as system_schema and backfill files have them
+//      Names that are neither native nor parameterized are user types
+//
+func ParseCQLType(text string) (CQLType, error) {
+    var p = &cqlTypeParser{ text: text }
+    var result, err = p.parse()
+    if (err != nil) {
+        return result, err
+    }
+
+    p.space()
+    if (p.pos < len(p.text)) {
+        return result, fmt.Errorf("unexpected [%s] at %d of type [%s]", p.text[p.pos:], p.pos, text)
+    }
+    return result, nil
+}
+
+type cqlTypeParser struct {
+    text        string
+    pos         int
+}
+
+func (self *cqlTypeParser) space() {
+    for self.pos < len(self.text) && strings.ContainsRune(" \t\r\n", rune(self.text[self.pos])) {
+        self.pos++
+    }
+}
+
+func (self *cqlTypeParser) accept(c byte) bool {
+    self.space()
+    if (self.pos < len(self.text) && self.text[self.pos] == c) {
+        self.pos++
+        return true
+    }
+    return false
+}
+
+//
+//  quoted
+//      The text up to the closing quote, which escapes itself by doubling
+//
+func (self *cqlTypeParser) quoted(quote byte) (string, error) {
+    var text []byte
+    for self.pos < len(self.text) {
+        var c = self.text[self.pos]
+        self.pos++
+
+        if (c == quote) {
+            if (self.pos < len(self.text) && self.text[self.pos] == quote) {
+                self.pos++
+            } else {
+                return string(text), nil
+            }
+        }
+        text = append(text, c)
+    }
+    return "", fmt.Errorf("unterminated quote in type [%s]", self.text)
+}
+
+//
+//  name
+//      An identifier, lower cased unless it was quoted
+//
+func (self *cqlTypeParser) name() (string, error) {
+    if (self.accept('"')) {
+        return self.quoted('"')
+    }
+
+    var start = self.pos
+    for self.pos < len(self.text) && (isIdentifier(self.text[self.pos])) {
+        self.pos++
+    }
+    if (self.pos == start) {
+        return "", fmt.Errorf("expected a type at %d of [%s]", self.pos, self.text)
+    }
+    return strings.ToLower(self.text[start:self.pos]), nil
+}
+
+func isIdentifier(c byte) bool {
+    return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (self *cqlTypeParser) parse() (CQLType, error) {
+    if (self.accept('\'')) {
+        var class, err = self.quoted('\'')
+        return CQLType{ Custom: class }, err
+    }
+
+    self.space()
+    var quoted = self.pos < len(self.text) && self.text[self.pos] == '"'
+    var name, err = self.name()
+    if (err != nil) {
+        return CQLType{}, err
+    }
+
+    // user types may be qualified by their keyspace
+    var keyspace string
+    if (self.accept('.')) {
+        keyspace = name
+        if name, err = self.name() ; err != nil {
+            return CQLType{}, err
+        }
+        quoted = true
+    }
+
+    var params []CQLType
+    if (self.accept('<')) {
+        for {
+            var param, err = self.parse()
+            if (err != nil) {
+                return CQLType{}, err
+            }
+            params = append(params, param)
+
+            if (self.accept('>')) { break }
+            if (!self.accept(',')) {
+                return CQLType{}, fmt.Errorf("expected , or > at %d of [%s]", self.pos, self.text)
+            }
+        }
+    }
+
+    if count, parameterized := TYPE_PARAMS[name] ; parameterized && !quoted {
+        if (len(params) != count && !(count < 0 && len(params) > 0)) {
+            return CQLType{}, fmt.Errorf("wrong number of parameters to %s in [%s]", name, self.text)
+        }
+
+        switch (name) {
+            case "frozen":
+                return frozen(params[0]), nil
+            case "tuple":
+                return frozen(CQLType{ Name: name, Params: params }), nil
+        }
+        return CQLType{ Name: name, Params: params }, nil
+    }
+
+    if (len(params) > 0) {
+        return CQLType{}, fmt.Errorf("%s does not take parameters in [%s]", name, self.text)
+    }
+    if (name == "varchar" && !quoted) {
+        return CQLType{ Name: "text" }, nil
+    }
+    if (!quoted && isNative(name)) {
+        return CQLType{ Name: name }, nil
+    }
+    return CQLType{ Name: name, Keyspace: keyspace, User: true }, nil
+}
+
+func isNative(name string) bool {
+    for _, native := range NATIVE_TYPES {
+        if (native == name) { return true }
+    }
+    return false
+}
\ No newline at end of file
@@ -0,0 +1,294 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "sort"
+    "strings"
+    "io/ioutil"
+
+    "github.com/zmarcantel/cmm/db"
+    "github.com/zmarcantel/cmm/migrate"
+)
+
+//-------------------------------------------------------
+// Schema Diff
+//-------------------------------------------------------
+
+//
+//  SchemaChange
+//      One difference between two schemas, such as a column whose type changed
+//      From and To are written as CQL has them, and left out for the side an item is missing from
+//
+type SchemaChange struct {
+    Change      string                      // added, removed or changed
+    Kind        string                      // keyspace, replication, durable_writes, type, function, aggregate, table, column, key, option, index or view
+    Name        string                      // with its keyspace, and its table for columns and options
+    From        string  `json:",omitempty"`
+    To          string  `json:",omitempty"`
+}
+
+//
+//  DescribeSource
+//      The keyspaces of one side of a diff, read from a --describe JSON file or described by a live cluster
+//      A source that ends in .json or names a file is a file, anything else a comma-separated host list
+//      The system keyspaces differ between versions of cassandra and are left out
+//
+func DescribeSource(source string) ([]db.KeyspaceDescriptor, error) {
+    var keyspaces []db.KeyspaceDescriptor
+
+    if info, statErr := os.Stat(source) ; strings.HasSuffix(source, ".json") || (statErr == nil && !info.IsDir()) {
+        var contents, err = ioutil.ReadFile(source)
+        if (err != nil) {
+            return nil, fmt.Errorf("could not read descriptor JSON [%s]: %s", source, err)
+        }
+
+        var tables []db.TableDescriptor
+        if keyspaces, tables, err = readDescriptors(contents) ; err != nil {
+            return nil, fmt.Errorf("could not parse descriptor JSON [%s]: %s", source, err)
+        }
+        if (len(tables) > 0) {
+            return nil, migrate.ErrConfig{ Option: "diff", Reason: fmt.Sprintf("[%s] describes a table, diff compares keyspaces (--describe KEYSPACE) or clusters (--describe all)", source) }
+        }
+
+        for i := range keyspaces {
+            if (isSystemKeyspace(keyspaces[i].Name)) { continue }
+
+            if err = declare(&keyspaces[i]) ; err != nil {
+                if config, isConfig := err.(migrate.ErrConfig) ; isConfig {
+                    config.Option = "diff"
+                    return nil, config
+                }
+                return nil, err
+            }
+        }
+    } else {
+        var _, session, err = connectHosts(strings.Split(source, ","))
+        if (err != nil) {
+            return nil, err
+        }
+        defer session.Close()
+
+        db.Init(session)
+        if keyspaces, err = db.AllKeyspaces() ; err != nil {
+            return nil, fmt.Errorf("could not get keyspaces of [%s]: %s", source, err)
+        }
+    }
+
+    var result []db.KeyspaceDescriptor
+    for _, keyspace := range keyspaces {
+        if (!isSystemKeyspace(keyspace.Name)) { result = append(result, keyspace) }
+    }
+    return result, nil
+}
+
+func isSystemKeyspace(name string) bool {
+    return name == "system" || strings.HasPrefix(name, "system_")
+}
+
+//
+//  DiffSchemas
+//      Every difference between two schemas, keyspace by keyspace and item by item, each sorted by name
+//      A keyspace or table found on one side only is a single change, what is in it is not listed
+//
+func DiffSchemas(from, to []db.KeyspaceDescriptor) []SchemaChange {
+    var changes = make([]SchemaChange, 0)
+    var note = func(change, kind, name, from, to string) {
+        changes = append(changes, SchemaChange{ Change: change, Kind: kind, Name: name, From: from, To: to })
+    }
+
+    // items found by name, with the text that tells whether they changed
+    var compare = func(kind, prefix string, before, after map[string]string) {
+        for _, name := range sortedUnion(before, after) {
+            var old, inFrom = before[name]
+            var current, inTo = after[name]
+            if (!inFrom) {
+                note("added", kind, prefix + name, "", current)
+            } else if (!inTo) {
+                note("removed", kind, prefix + name, old, "")
+            } else if (old != current) {
+                note("changed", kind, prefix + name, old, current)
+            }
+        }
+    }
+
+    var before = make(map[string]db.KeyspaceDescriptor)
+    var after = make(map[string]db.KeyspaceDescriptor)
+    var names = make(map[string]string)
+    for _, keyspace := range from {
+        before[keyspace.Name] = keyspace
+        names[keyspace.Name] = ""
+    }
+    for _, keyspace := range to {
+        after[keyspace.Name] = keyspace
+        names[keyspace.Name] = ""
+    }
+
+    for _, name := range sortedUnion(names, nil) {
+        var old, inFrom = before[name]
+        var current, inTo = after[name]
+        if (!inFrom) {
+            note("added", "keyspace", name, "", current.Replication())
+            continue
+        }
+        if (!inTo) {
+            note("removed", "keyspace", name, old.Replication(), "")
+            continue
+        }
+
+        var prefix = name + "."
+        var replication, durable = keyspaceChanges(old, current)
+        if (replication) { note("changed", "replication", name, old.Replication(), current.Replication()) }
+        if (durable) { note("changed", "durable_writes", name, fmt.Sprint(old.DurableWrites), fmt.Sprint(current.DurableWrites)) }
+
+        compare("type", prefix, typeFields(old.Types), typeFields(current.Types))
+        compare("function", prefix, functionStatements(old.Functions), functionStatements(current.Functions))
+        compare("aggregate", prefix, aggregateStatements(old.Aggregates), aggregateStatements(current.Aggregates))
+
+        var tables = make(map[string]string)
+        for _, table := range old.Tables { tables[table.Name] = "" }
+        for _, table := range current.Tables { tables[table.Name] = "" }
+
+        for _, tableName := range sortedUnion(tables, nil) {
+            var oldTable, inFrom = findTable(old.Tables, tableName)
+            var newTable, inTo = findTable(current.Tables, tableName)
+            if (!inFrom) {
+                note("added", "table", prefix + tableName, "", keyDefinition(newTable))
+                continue
+            }
+            if (!inTo) {
+                note("removed", "table", prefix + tableName, keyDefinition(oldTable), "")
+                continue
+            }
+
+            var tablePrefix = prefix + tableName + "."
+            if (keyDefinition(oldTable) != keyDefinition(newTable)) {
+                note("changed", "key", prefix + tableName, keyDefinition(oldTable), keyDefinition(newTable))
+            }
+            compare("column", tablePrefix, columnTypes(oldTable), columnTypes(newTable))
+
+            var options = make(map[string]string)
+            for option := range oldTable.Options { options[option] = "" }
+            for option := range newTable.Options { options[option] = "" }
+            for _, option := range sortedUnion(options, nil) {
+                var oldValue, inFrom = oldTable.Options[option]
+                var newValue, inTo = newTable.Options[option]
+                if (!inFrom) {
+                    note("added", "option", tablePrefix + option, "", db.OptionCQL(newValue))
+                } else if (!inTo) {
+                    note("removed", "option", tablePrefix + option, db.OptionCQL(oldValue), "")
+                } else if (!db.SameOption(option, oldValue, newValue) || !db.SameOption(option, newValue, oldValue)) {
+                    note("changed", "option", tablePrefix + option, db.OptionCQL(oldValue), db.OptionCQL(newValue))
+                }
+            }
+
+            compare("index", prefix, indexStatements(oldTable), indexStatements(newTable))
+        }
+
+        compare("view", prefix, viewStatements(old.Views), viewStatements(current.Views))
+    }
+
+    return changes
+}
+
+//
+//  DiffMigrations
+//      The migrations turning one schema into the other, as generate would make them
+//      followed by DROP KEYSPACE for the keyspaces only the first has
+//      Both schemas are complete, so what the second leaves out is dropped as if it set drop_missing
+//
+func DiffMigrations(from, to []db.KeyspaceDescriptor) (migrate.MigrationCollection, error) {
+    var complete = make([]db.KeyspaceDescriptor, len(to))
+    for i, keyspace := range to {
+        keyspace.DropMissing = true
+        complete[i] = keyspace
+    }
+
+    var result, err = SchemaMigrations(from, complete)
+    if (err != nil) {
+        if config, isConfig := err.(migrate.ErrConfig) ; isConfig {
+            config.Option = "diff"
+            return nil, config
+        }
+        return nil, err
+    }
+
+    for _, keyspace := range from {
+        var kept = false
+        for _, other := range to {
+            if (other.Name == keyspace.Name) { kept = true }
+        }
+        if (!kept) {
+            result = append(result, StatementMigration("drop_keyspace_" + keyspace.Name, "DROP KEYSPACE " + keyspace.Name + ";"))
+        }
+    }
+
+    return result, nil
+}
+
+
+func sortedUnion(a, b map[string]string) []string {
+    var seen = make(map[string]bool)
+    var names []string
+    for _, items := range []map[string]string{ a, b } {
+        for name := range items {
+            if (!seen[name]) { names = append(names, name) }
+            seen[name] = true
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+func typeFields(types []db.TypeDescriptor) map[string]string {
+    var result = make(map[string]string)
+    for _, described := range types {
+        var fields []string
+        for _, field := range described.Fields {
+            fields = append(fields, field.Name + " " + field.Type)
+        }
+        result[described.Name] = "(" + strings.Join(fields, ", ") + ")"
+    }
+    return result
+}
+
+func functionStatements(functions []db.FunctionDescriptor) map[string]string {
+    var result = make(map[string]string)
+    for _, function := range functions {
+        result[functionSignature(function.Name, argumentTypes(function))] = function.CQL()
+    }
+    return result
+}
+
+func aggregateStatements(aggregates []db.AggregateDescriptor) map[string]string {
+    var result = make(map[string]string)
+    for _, aggregate := range aggregates {
+        result[functionSignature(aggregate.Name, aggregate.ArgumentTypes)] = aggregate.CQL()
+    }
+    return result
+}
+
+func columnTypes(table db.TableDescriptor) map[string]string {
+    var result = make(map[string]string)
+    for _, column := range table.Columns {
+        result[column.Name] = column.Type
+        if (column.Kind == "static") { result[column.Name] += " STATIC" }
+    }
+    return result
+}
+
+func indexStatements(table db.TableDescriptor) map[string]string {
+    var result = make(map[string]string)
+    for _, index := range table.Indexes {
+        result[index.Name] = index.CQL(table)
+    }
+    return result
+}
+
+func viewStatements(views []db.ViewDescriptor) map[string]string {
+    var result = make(map[string]string)
+    for _, view := range views {
+        result[view.Name] = view.CQL()
+    }
+    return result
+}
\ No newline at end of file
@@ -0,0 +1,599 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+
+    "github.com/zmarcantel/cmm/db"
+    "github.com/zmarcantel/cmm/migrate"
+)
+
+//-------------------------------------------------------
+// Declared Schema
+//-------------------------------------------------------
+
+//
+//  LoadSchema
+//      Read the keyspaces declared by the .json files below a directory, in the form --describe prints them
+//      A file holds a keyspace, an array of keyspaces as from --describe all, or a single table
+//      which joins the keyspace its Keyspace names
+//      The system keyspaces of a --describe all are cassandra's own and are left out
+//
+func LoadSchema(directory string) ([]db.KeyspaceDescriptor, error) {
+    if info, err := os.Stat(directory) ; err != nil || !info.IsDir() {
+        return nil, migrate.ErrNotFound{ Kind: "schema directory", Name: directory }
+    }
+
+    var keyspaces []db.KeyspaceDescriptor
+    var tables []db.TableDescriptor
+    var files = make(map[string]string)     // file each keyspace comes from
+    var tableFiles []string
+
+    var walkErr = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+        if (err != nil) {
+            return err
+        }
+        if (info.IsDir() || filepath.Ext(path) != ".json") {
+            return nil
+        }
+
+        var contents, readErr = ioutil.ReadFile(path)
+        if (readErr != nil) {
+            return fmt.Errorf("could not read descriptor JSON [%s]: %s", path, readErr)
+        }
+
+        var declared, declaredTables, jsonErr = readDescriptors(contents)
+        if (jsonErr != nil) {
+            return fmt.Errorf("could not parse descriptor JSON [%s]: %s", path, jsonErr)
+        }
+        for _, table := range declaredTables {
+            tables = append(tables, table)
+            tableFiles = append(tableFiles, path)
+        }
+
+        for _, keyspace := range declared {
+            if (keyspace.Name == "system" || strings.HasPrefix(keyspace.Name, "system_")) { continue }
+
+            if (len(keyspace.Name) == 0) {
+                return schemaError("a keyspace in [%s] has no Name", path)
+            }
+            if other, found := files[keyspace.Name] ; found {
+                return schemaError("keyspace [%s] is declared in both [%s] and [%s]", keyspace.Name, other, path)
+            }
+            files[keyspace.Name] = path
+            keyspaces = append(keyspaces, keyspace)
+        }
+        return nil
+    })
+    if (walkErr != nil) {
+        return nil, walkErr
+    }
+
+    for i, table := range tables {
+        var found = false
+        for j := range keyspaces {
+            if (keyspaces[j].Name == table.Keyspace) {
+                keyspaces[j].Tables = append(keyspaces[j].Tables, table)
+                found = true
+            }
+        }
+        if (!found) {
+            return nil, schemaError("table [%s] in [%s] belongs to keyspace [%s], which no file declares", table.Name, tableFiles[i], table.Keyspace)
+        }
+    }
+
+    for i := range keyspaces {
+        if err := declare(&keyspaces[i]) ; err != nil {
+            return nil, err
+        }
+    }
+
+    return keyspaces, nil
+}
+
+//
+//  readDescriptors
+//      The keyspaces and tables of one file
+//      Keyspaces start out with durable writes, as cassandra's do, so a file may leave it out
+//
+func readDescriptors(contents []byte) (keyspaces []db.KeyspaceDescriptor, tables []db.TableDescriptor, err error) {
+    var objects []json.RawMessage
+    if (strings.HasPrefix(strings.TrimSpace(string(contents)), "[")) {
+        if err = json.Unmarshal(contents, &objects) ; err != nil {
+            return nil, nil, err
+        }
+    } else {
+        objects = append(objects, json.RawMessage(contents))
+    }
+
+    for _, object := range objects {
+        var fields map[string]json.RawMessage
+        if err = json.Unmarshal(object, &fields) ; err != nil {
+            return nil, nil, err
+        }
+
+        if _, isTable := fields["Columns"] ; isTable {
+            var table db.TableDescriptor
+            if err = json.Unmarshal(object, &table) ; err != nil {
+                return nil, nil, err
+            }
+            if (len(table.Keyspace) == 0) {
+                return nil, nil, fmt.Errorf("table [%s] needs the Keyspace it belongs to", table.Name)
+            }
+            tables = append(tables, table)
+            continue
+        }
+
+        var keyspace = db.KeyspaceDescriptor{ DurableWrites: true }
+        if err = json.Unmarshal(object, &keyspace) ; err != nil {
+            return nil, nil, err
+        }
+        keyspaces = append(keyspaces, keyspace)
+    }
+
+    return keyspaces, tables, nil
+}
+
+
+//
+//  declare
+//      Check a declared keyspace and fill in what a hand written file may leave out
+//      Everything within is given the keyspace's name, types are written as describe has them,
+//      unnamed indexes are named as cassandra names them, and table options are typed as TargetTable does
+//
+func declare(keyspace *db.KeyspaceDescriptor) error {
+    if (len(keyspace.Class) == 0) {
+        return schemaError("keyspace [%s] needs a replication Class", keyspace.Name)
+    }
+    if (keyspace.Options == nil) {
+        keyspace.Options = make(map[string]interface{})
+    }
+
+    var names = make(map[string]bool)
+    var unique = func(kind, name string) error {
+        if (len(name) == 0) {
+            return schemaError("a %s of keyspace [%s] has no Name", kind, keyspace.Name)
+        }
+        if (names[kind + " " + name]) {
+            return schemaError("%s [%s.%s] is declared more than once", kind, keyspace.Name, name)
+        }
+        names[kind + " " + name] = true
+        return nil
+    }
+
+    for i := range keyspace.Types {
+        var described = &keyspace.Types[i]
+        if err := unique("type", described.Name) ; err != nil {
+            return err
+        }
+        described.Keyspace = keyspace.Name
+        for j := range described.Fields {
+            described.Fields[j].Type = canonicalType(described.Fields[j].Type)
+        }
+    }
+
+    for i := range keyspace.Functions {
+        var function = &keyspace.Functions[i]
+        function.Keyspace = keyspace.Name
+        function.ReturnType = canonicalType(function.ReturnType)
+        for j := range function.Arguments {
+            function.Arguments[j].Type = canonicalType(function.Arguments[j].Type)
+        }
+        if err := unique("function", functionSignature(function.Name, argumentTypes(*function))) ; err != nil {
+            return err
+        }
+    }
+
+    for i := range keyspace.Aggregates {
+        var aggregate = &keyspace.Aggregates[i]
+        aggregate.Keyspace = keyspace.Name
+        aggregate.StateType = canonicalType(aggregate.StateType)
+        aggregate.ReturnType = canonicalType(aggregate.ReturnType)
+        for j := range aggregate.ArgumentTypes {
+            aggregate.ArgumentTypes[j] = canonicalType(aggregate.ArgumentTypes[j])
+        }
+        if err := unique("aggregate", functionSignature(aggregate.Name, aggregate.ArgumentTypes)) ; err != nil {
+            return err
+        }
+    }
+
+    // tables and views share their names, as do the indexes of every table
+    for i := range keyspace.Tables {
+        var table = &keyspace.Tables[i]
+        if err := unique("table or view", table.Name) ; err != nil {
+            return err
+        }
+        table.Keyspace = keyspace.Name
+        for j := range table.Columns {
+            table.Columns[j].Type = canonicalType(table.Columns[j].Type)
+        }
+
+        for j := range table.Indexes {
+            var index = &table.Indexes[j]
+            if (len(index.Name) == 0) { index.Name = table.Name + "_" + index.Column + "_idx" }
+            if err := unique("index", index.Name) ; err != nil {
+                return err
+            }
+        }
+
+        var options = table.Options
+        table.Options = nil
+        for name, value := range options {
+            var typed, err = db.TableOption(strings.ToLower(name), value)
+            if (err != nil) {
+                return schemaError("table [%s.%s]: %s", keyspace.Name, table.Name, err)
+            }
+            if (table.Options == nil) { table.Options = make(map[string]interface{}) }
+            table.Options[strings.ToLower(name)] = typed
+        }
+    }
+
+    for i := range keyspace.Views {
+        var view = &keyspace.Views[i]
+        if err := unique("table or view", view.Name) ; err != nil {
+            return err
+        }
+        view.Keyspace = keyspace.Name
+        for j := range view.Columns {
+            view.Columns[j].Type = canonicalType(view.Columns[j].Type)
+        }
+    }
+
+    return nil
+}
+
+//
+//  canonicalType
+//      A type as describe writes it, e.g. map<uuid,float> is MAP<UUID, FLOAT>
+//      Types that do not parse are left for cassandra to reject
+//
+func canonicalType(text string) string {
+    if parsed, err := db.ParseCQLType(text) ; err == nil {
+        return parsed.String()
+    }
+    return text
+}
+
+func schemaError(format string, args ...interface{}) error {
+    return migrate.ErrConfig{ Option: "generate", Reason: fmt.Sprintf(format, args...) }
+}
+
+
+//-------------------------------------------------------
+// Schema Migrations
+//-------------------------------------------------------
+
+// a step of SchemaMigrations, run on each desired keyspace and its current state in turn
+type schemaPhase func(current, desired db.KeyspaceDescriptor) (migrate.MigrationCollection, error)
+
+//
+//  SchemaMigrations
+//      The migrations turning the current keyspaces into the desired ones, in the order they have to run:
+//      keyspaces, then types, functions and aggregates, tables, and lastly indexes and views
+//      Views and indexes that changed are dropped before anything else is, the types, functions and aggregates
+//      no longer declared after everything that could use them
+//      Keyspaces that are not desired are left as they are
+//      Within one that is, whatever is not desired is only dropped when it sets DropMissing, and warned about otherwise
+//
+func SchemaMigrations(current, desired []db.KeyspaceDescriptor) (migrate.MigrationCollection, error) {
+    // a keyspace that does not exist yet has nothing in it, not even a name
+    var existing = make(map[string]db.KeyspaceDescriptor)
+    for _, keyspace := range current {
+        existing[keyspace.Name] = keyspace
+    }
+
+    var phases = []schemaPhase{
+        keyspaceMigrations,
+        dropIndexesAndViews,
+        typeMigrations,
+        functionMigrations,
+        tableMigrations,
+        createIndexesAndViews,
+        dropUnused,
+    }
+
+    var result migrate.MigrationCollection
+    for _, phase := range phases {
+        for _, keyspace := range desired {
+            var migs, err = phase(existing[keyspace.Name], keyspace)
+            if (err != nil) {
+                return nil, err
+            }
+            result = append(result, migs...)
+        }
+    }
+
+    return result, nil
+}
+
+//
+//  keyspaceMigrations
+//      CREATE KEYSPACE, or ALTER KEYSPACE when the replication or durable writes differ
+//
+func keyspaceMigrations(current, desired db.KeyspaceDescriptor) (migrate.MigrationCollection, error) {
+    if (len(current.Name) == 0) {
+        var created = db.KeyspaceDescriptor{ Name: desired.Name, Class: desired.Class, Options: desired.Options, DurableWrites: desired.DurableWrites }
+        return migrate.MigrationCollection{ StatementMigration("create_keyspace_" + desired.Name, created.CQL()) }, nil
+    }
+
+    if replication, durable := keyspaceChanges(current, desired) ; replication || durable {
+        return migrate.MigrationCollection{ AlterKeyspaceMigration(desired, replication, durable) }, nil
+    }
+    return nil, nil
+}
+
+//
+//  dropIndexesAndViews
+//      Views and indexes that are no longer desired, or are desired differently
+//      They go first as a column cannot be dropped or changed while they use it
+//      Those of tables that are dropped go with their table
+//
+func dropIndexesAndViews(current, desired db.KeyspaceDescriptor) (migrate.MigrationCollection, error) {
+    var result migrate.MigrationCollection
+
+    for _, view := range current.Views {
+        var query = "DROP MATERIALIZED VIEW " + current.Name + "." + view.Name + ";"
+        if wanted, found := findView(desired.Views, view.Name) ; !found {
+            result = append(result, dropMissing(desired, "view", view.Name, "drop_view_" + current.Name + "_" + view.Name, query)...)
+        } else if (wanted.CQL() != view.CQL()) {
+            result = append(result, StatementMigration("drop_view_" + current.Name + "_" + view.Name, query))
+        }
+    }
+
+    for _, table := range current.Tables {
+        var wanted, found = findTable(desired.Tables, table.Name)
+        if (!found) { continue }
+
+        for _, index := range table.Indexes {
+            if (hasIndex(wanted.Indexes, index)) { continue }
+
+            var query = "DROP INDEX " + current.Name + "." + index.Name + ";"
+            if (hasIndexNamed(wanted.Indexes, index.Name)) {
+                result = append(result, StatementMigration("drop_index_" + current.Name + "_" + index.Name, query))
+            } else {
+                result = append(result, dropMissing(desired, "index", index.Name, "drop_index_" + current.Name + "_" + index.Name, query)...)
+            }
+        }
+    }
+
+    return result, nil
+}
+
+//
+//  typeMigrations
+//      CREATE TYPE for new types, each after the types it uses, and ALTER TYPE ADD for new fields
+//      Fields can only be added to the end of a type, anything else is an error
+//
+func typeMigrations(current, desired db.KeyspaceDescriptor) (migrate.MigrationCollection, error) {
+    var result migrate.MigrationCollection
+
+    for _, described := range db.OrderTypes(desired.Types) {
+        var existing, found = findType(current.Types, described.Name)
+        if (!found) {
+            result = append(result, StatementMigration("create_type_" + desired.Name + "_" + described.Name, described.CQL()))
+            continue
+        }
+
+        var kept = len(existing.Fields) <= len(described.Fields)
+        for i := 0 ; kept && i < len(existing.Fields) ; i++ {
+            kept = existing.Fields[i].Name == described.Fields[i].Name && db.SameType(existing.Fields[i].Type, described.Fields[i].Type)
+        }
+        if (!kept) {
+            return nil, schemaError("cannot remove, reorder or change the fields of type %s.%s, only add to them", desired.Name, described.Name)
+        }
+
+        for _, field := range described.Fields[len(existing.Fields):] {
+            var query = "ALTER TYPE " + desired.Name + "." + described.Name + " ADD " + field.Name + " " + field.Type + ";"
+            result = append(result, StatementMigration("add_" + field.Name + "_to_type_" + desired.Name + "_" + described.Name, query))
+        }
+    }
+
+    return result, nil
+}
+
+//
+//  functionMigrations
+//      CREATE FUNCTION and CREATE AGGREGATE for new ones, CREATE OR REPLACE for those that changed
+//      Both are told apart by their argument types, as cassandra overloads them
+//
+func functionMigrations(current, desired db.KeyspaceDescriptor) (migrate.MigrationCollection, error) {
+    var result migrate.MigrationCollection
+
+    for _, function := range desired.Functions {
+        var existing, found = findFunction(current.Functions, function)
+        if (!found) {
+            result = append(result, StatementMigration("create_function_" + desired.Name + "_" + function.Name, function.CQL()))
+        } else if (existing.CQL() != function.CQL()) {
+            var query = strings.Replace(function.CQL(), "CREATE FUNCTION", "CREATE OR REPLACE FUNCTION", 1)
+            result = append(result, StatementMigration("replace_function_" + desired.Name + "_" + function.Name, query))
+        }
+    }
+
+    for _, aggregate := range desired.Aggregates {
+        var existing, found = findAggregate(current.Aggregates, aggregate)
+        if (!found) {
+            result = append(result, StatementMigration("create_aggregate_" + desired.Name + "_" + aggregate.Name, aggregate.CQL()))
+        } else if (existing.CQL() != aggregate.CQL()) {
+            var query = strings.Replace(aggregate.CQL(), "CREATE AGGREGATE", "CREATE OR REPLACE AGGREGATE", 1)
+            result = append(result, StatementMigration("replace_aggregate_" + desired.Name + "_" + aggregate.Name, query))
+        }
+    }
+
+    return result, nil
+}
+
+//
+//  tableMigrations
+//      CREATE TABLE for new tables, without their indexes, the changes AlterTable finds for existing ones,
+//      then DROP TABLE for those no longer desired, as dropMissing allows
+//
+func tableMigrations(current, desired db.KeyspaceDescriptor) (migrate.MigrationCollection, error) {
+    var result migrate.MigrationCollection
+
+    for _, table := range desired.Tables {
+        var existing, found = findTable(current.Tables, table.Name)
+        if (!found) {
+            var created = table
+            created.Indexes = nil
+            result = append(result, StatementMigration("create_table_" + desired.Name + "_" + table.Name, created.CQL()))
+            continue
+        }
+
+        var migs, err = AlterTable(existing, table)
+        if (err != nil) {
+            return nil, err
+        }
+        result = append(result, migs...)
+    }
+
+    for _, table := range current.Tables {
+        if _, found := findTable(desired.Tables, table.Name) ; !found {
+            result = append(result, dropMissing(desired, "table", table.Name, "drop_table_" + table.Keyspace + "_" + table.Name, "DROP TABLE " + table.Keyspace + "." + table.Name + ";")...)
+        }
+    }
+
+    return result, nil
+}
+
+//
+//  createIndexesAndViews
+//      CREATE INDEX and CREATE MATERIALIZED VIEW for those that are new or were dropped for changing
+//
+func createIndexesAndViews(current, desired db.KeyspaceDescriptor) (migrate.MigrationCollection, error) {
+    var result migrate.MigrationCollection
+
+    for _, table := range desired.Tables {
+        var existing, _ = findTable(current.Tables, table.Name)
+        for _, index := range table.Indexes {
+            if (!hasIndex(existing.Indexes, index)) {
+                result = append(result, StatementMigration("create_index_" + desired.Name + "_" + index.Name, index.CQL(table)))
+            }
+        }
+    }
+
+    for _, view := range desired.Views {
+        if existing, found := findView(current.Views, view.Name) ; !found || existing.CQL() != view.CQL() {
+            result = append(result, StatementMigration("create_view_" + desired.Name + "_" + view.Name, view.CQL()))
+        }
+    }
+
+    return result, nil
+}
+
+//
+//  dropUnused
+//      DROP the aggregates, functions and types that are no longer desired, in that order, as dropMissing allows
+//      Types are dropped after the types that use them
+//
+func dropUnused(current, desired db.KeyspaceDescriptor) (migrate.MigrationCollection, error) {
+    var result migrate.MigrationCollection
+
+    for _, aggregate := range current.Aggregates {
+        if _, found := findAggregate(desired.Aggregates, aggregate) ; !found {
+            var signature = functionSignature(aggregate.Name, aggregate.ArgumentTypes)
+            result = append(result, dropMissing(desired, "aggregate", signature, "drop_aggregate_" + current.Name + "_" + aggregate.Name, "DROP AGGREGATE " + current.Name + "." + signature + ";")...)
+        }
+    }
+
+    for _, function := range current.Functions {
+        if _, found := findFunction(desired.Functions, function) ; !found {
+            var signature = functionSignature(function.Name, argumentTypes(function))
+            result = append(result, dropMissing(desired, "function", signature, "drop_function_" + current.Name + "_" + function.Name, "DROP FUNCTION " + current.Name + "." + signature + ";")...)
+        }
+    }
+
+    var ordered = db.OrderTypes(current.Types)
+    for i := len(ordered) - 1 ; i >= 0 ; i-- {
+        if _, found := findType(desired.Types, ordered[i].Name) ; !found {
+            result = append(result, dropMissing(desired, "type", ordered[i].Name, "drop_type_" + current.Name + "_" + ordered[i].Name, "DROP TYPE " + current.Name + "." + ordered[i].Name + ";")...)
+        }
+    }
+
+    return result, nil
+}
+
+//
+//  dropMissing
+//      The DROP of something a declared keyspace leaves out, when it sets drop_missing
+//      Otherwise nothing, and a warning naming what is left in place
+//
+func dropMissing(desired db.KeyspaceDescriptor, kind, name, action, query string) migrate.MigrationCollection {
+    if (desired.DropMissing) {
+        return migrate.MigrationCollection{ StatementMigration(action, query) }
+    }
+
+    fmt.Fprintf(os.Stderr, "WARNING: %s [%s.%s] is not declared, set \"drop_missing\" on the keyspace to drop it\n", kind, desired.Name, name)
+    return nil
+}
+
+
+func findTable(tables []db.TableDescriptor, name string) (db.TableDescriptor, bool) {
+    for _, table := range tables {
+        if (table.Name == name) { return table, true }
+    }
+    return db.TableDescriptor{}, false
+}
+
+func findType(types []db.TypeDescriptor, name string) (db.TypeDescriptor, bool) {
+    for _, described := range types {
+        if (described.Name == name) { return described, true }
+    }
+    return db.TypeDescriptor{}, false
+}
+
+func findView(views []db.ViewDescriptor, name string) (db.ViewDescriptor, bool) {
+    for _, view := range views {
+        if (view.Name == name) { return view, true }
+    }
+    return db.ViewDescriptor{}, false
+}
+
+func hasIndexNamed(indexes []db.IndexDescriptor, name string) bool {
+    for _, other := range indexes {
+        if (other.Name == name) { return true }
+    }
+    return false
+}
+
+func hasIndex(indexes []db.IndexDescriptor, index db.IndexDescriptor) bool {
+    for _, other := range indexes {
+        if (other == index) { return true }
+    }
+    return false
+}
+
+func findFunction(functions []db.FunctionDescriptor, function db.FunctionDescriptor) (db.FunctionDescriptor, bool) {
+    var signature = functionSignature(function.Name, argumentTypes(function))
+    for _, other := range functions {
+        if (functionSignature(other.Name, argumentTypes(other)) == signature) { return other, true }
+    }
+    return db.FunctionDescriptor{}, false
+}
+
+func findAggregate(aggregates []db.AggregateDescriptor, aggregate db.AggregateDescriptor) (db.AggregateDescriptor, bool) {
+    var signature = functionSignature(aggregate.Name, aggregate.ArgumentTypes)
+    for _, other := range aggregates {
+        if (functionSignature(other.Name, other.ArgumentTypes) == signature) { return other, true }
+    }
+    return db.AggregateDescriptor{}, false
+}
+
+//
+//  functionSignature
+//      The name of a function or aggregate with its argument types, e.g. plus(INT, INT)
+//
+func functionSignature(name string, types []string) string {
+    return name + "(" + strings.Join(types, ", ") + ")"
+}
+
+func argumentTypes(function db.FunctionDescriptor) []string {
+    var types []string
+    for _, argument := range function.Arguments {
+        types = append(types, argument.Type)
+    }
+    return types
+}
\ No newline at end of file
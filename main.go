@@ -3,69 +3,177 @@ package main
 import (
     "os"
     "fmt"
-    "time"
+    "context"
 
+    "github.com/jessevdk/go-flags"
     "github.com/tux21b/gocql"
 
+    "github.com/zmarcantel/cmm/cql"
     "github.com/zmarcantel/cmm/db"
+    "github.com/zmarcantel/cmm/migrate"
 )
 
 var Hosts           []string
-var Migrations      MigrationCollection
-var SettleTime      time.Duration
-var Session         *gocql.Session
+var Session         cql.Session
 var Verbosity       int
 var Consistency     gocql.Consistency
 
+// runs and records the migrations, configured from the cli
+var Migrator        *migrate.Migrator
+var Settings        = migrate.DefaultOptions()
+
+const (
+    QUIET   = migrate.QUIET;
+    SOFT    = migrate.SOFT;
+    MEDIUM  = migrate.MEDIUM;
+    LOUD    = migrate.LOUD;
+    ALL     = migrate.ALL;
+)
+
+//
+// Exit codes
+//
 const (
-    QUIET   = 0;
-    SOFT    = 1;
-    MEDIUM  = 2;
-    LOUD    = 3;
-    ALL     = 4;
+    EXIT_APPLIED    = 0;    // migrations were applied, or the command succeeded
+    EXIT_FAILED     = 1;    // anything went wrong, the error is printed
+    EXIT_DRIFT      = 2;    // --verify found applied migrations that changed or disappeared, or --diff found differences
+    EXIT_NOTHING    = 3;    // there were no migrations to apply, revert or baseline
 )
 
 func main() {
+    os.Exit(run())
+}
+
+//
+//  run
+//      Everything main does, returning the exit code
+//      Errors bubble up to here and are only reported here
+//
+func run() int {
     // handle all cli arguments
-    HandleArguments()
+    if err := HandleArguments() ; err != nil {
+        if flagErr, ok := err.(*flags.Error) ; ok {
+            // go-flags already printed the usage or the error
+            if (flagErr.Type == flags.ErrHelp) { return EXIT_APPLIED }
+            return EXIT_FAILED
+        }
+        return fail(err)
+    }
+
+    // a diff connects to the clusters it compares, if any, by itself
+    if (len(Opts.Diff) > 0) {
+        return handleDiff()
+    }
 
     // build cassandra hosts from the cli/default
     BuildHosts(Opts.Hosts)
 
     // create a cluster of Cassandra connections
-    // var cluster *gocql.ClusterConfig
-    _, Session = connectCluster()
+    var err error
+    if _, Session, err = connectCluster() ; err != nil {
+        return fail(err)
+    }
     defer Session.Close()
     db.Init(Session)
 
+    Migrator = migrate.New(Session, Settings)
+    Migrator.Consistency = Consistency
+
     // handle arguments that do not result in running migrations
-    handlePseudocommands()
+    if code, handled := handlePseudocommands() ; handled {
+        return code
+    }
 
     // load migration files and sort them
-    GetMigrationFiles(Opts.Migrations)
-    fmt.Printf("Loaded %d migrations\n", len(Migrations))
+    if err = loadMigrations() ; err != nil {
+        return fail(err)
+    }
+    fmt.Printf("Loaded %d migrations\n", len(Migrator.Migrations))
 
     // idempotently create migrations keyspace/table
-    CreateMigrationTable(Session)
+    if err = Migrator.Init() ; err != nil {
+        return fail(err)
+    }
+
+    // make sure no other run touches the schema while we do
+    var lock, lockErr = Migrator.AcquireLock()
+    if (lockErr != nil) {
+        return fail(lockErr)
+    }
+
+    var count = 1
+    if (len(Opts.Baseline) > 0) {
+        // record migrations as applied without running them
+        count, err = Migrator.Baseline(Opts.Baseline, Opts.Force)
+    } else if (Opts.Repair != "none") {
+        // clear a failed marker rather than apply anything
+        err = Migrator.Repair(Opts.Repair)
+    } else if (Opts.Rollback != "none") {
+        // revert migrations rather than apply them
+        count, err = Migrator.Down(context.Background(), Opts.Rollback)
+    } else {
+        // run the migrations, moving down first when a target is given
+        count, err = Migrator.To(context.Background(), Opts.Target)
+    }
+
+    // losing the lock part way means another run may have changed the schema too
+    if releaseErr := lock.Release() ; releaseErr != nil && err == nil {
+        err = releaseErr
+    }
 
-    // run the migrations
-    DoMigrations(Migrations, SettleTime)
+    if (err != nil) {
+        return fail(err)
+    }
+    if (count == 0) {
+        return EXIT_NOTHING
+    }
+    return EXIT_APPLIED
 }
 
-func connectCluster() (*gocql.ClusterConfig, *gocql.Session) {
+//
+//  fail
+//      Report an error, with a hint of the flag that gets past it
+//
+func fail(err error) int {
+    fmt.Printf("ERROR: %s\n", err)
+
+    switch err.(type) {
+        case migrate.ErrIncomplete:
+            if (err.(migrate.ErrIncomplete).Changed) {
+                fmt.Print("Undo what it applied by hand, then use --repair to run it from the start\n")
+            } else {
+                fmt.Print("Use --resume to continue from the first unapplied statement, or --repair after fixing it by hand\n")
+            }
+        case migrate.ErrOutOfOrder:
+            fmt.Print("Use --order warn or --order allow to run them anyway\n")
+        case migrate.ErrLockHeld:
+            fmt.Print("If that run is gone, wait for the lock to expire or remove it with --unlock\n")
+    }
+
+    fmt.Println()
+    return EXIT_FAILED
+}
+
+func connectCluster() (*gocql.ClusterConfig, cql.Session, error) {
+    return connectHosts(Hosts)
+}
+
+//
+//  connectHosts
+//      Connect to the cluster of the given hosts, with the protocol of the cli
+//
+func connectHosts(hosts []string) (*gocql.ClusterConfig, cql.Session, error) {
     var protoVersion = 2
     if (Opts.Protocol > 0) { protoVersion = Opts.Protocol }
 
-    var cluster = gocql.NewCluster(Hosts...)
+    var cluster = gocql.NewCluster(hosts...)
     cluster.Consistency = gocql.Quorum
     cluster.ProtoVersion = protoVersion
 
-    var session, err = cluster.CreateSession()
-
+    var session, err = cql.Connect(cluster)
     if (err != nil) {
-        fmt.Printf("ERROR: could not create session for cluster\n%s\n\n", err)
-        os.Exit(1)
+        return cluster, nil, fmt.Errorf("could not create session for cluster: %s", err)
     }
 
-    return cluster, session
+    return cluster, session, nil
 }
\ No newline at end of file
@@ -0,0 +1,144 @@
+package migrate
+
+import (
+    "fmt"
+    "time"
+    "regexp"
+    "strings"
+)
+
+//-------------------------------------------------------
+// Errors
+//-------------------------------------------------------
+
+//
+//  ErrMigrationFailed
+//      A migration could not be parsed, or one of its statements returned an error
+//      Statement is 1-based, 0 when no statement was run
+//
+type ErrMigrationFailed struct {
+    Name            string
+    Statement       int
+    Cause           error
+}
+
+func (self ErrMigrationFailed) Error() string {
+    if (self.Statement > 0) {
+        return fmt.Sprintf("migration [%s] failed at statement %d: %s", self.Name, self.Statement, self.Cause)
+    }
+    return fmt.Sprintf("migration [%s] failed: %s", self.Name, self.Cause)
+}
+
+//
+//  ErrIncomplete
+//      A previous run stopped part way through the migration
+//      It has to be resumed, or repaired after fixing it by hand, before anything else runs
+//      Changed is set when the applied statements were edited since, it can then only be repaired
+//
+type ErrIncomplete struct {
+    Name            string
+    Progress        Progress
+    Statements      int
+    Changed         bool
+}
+
+func (self ErrIncomplete) Error() string {
+    var message = fmt.Sprintf("[%s] is %s, %d of %d statements were applied", self.Name, self.Progress.Status, self.Progress.Applied, self.Statements)
+    if (self.Progress.Status == STATUS_FAILED) {
+        message += fmt.Sprintf("\n\tStatement %d failed: %s", self.Progress.Statement, self.Progress.Error)
+    }
+    if (self.Changed) {
+        message += "\n\tThe statements it applied changed since, resuming could start at the wrong statement"
+    }
+    return message
+}
+
+//
+//  ErrOutOfOrder
+//      Pending migrations sort before the latest applied one and the order policy is fail
+//
+type ErrOutOfOrder struct {
+    Latest          string
+    Pending         []string
+}
+
+func (self ErrOutOfOrder) Error() string {
+    return fmt.Sprintf("%d pending migrations sort before the latest applied one [%s]\n\t%s", len(self.Pending), self.Latest, strings.Join(self.Pending, "\n\t"))
+}
+
+//
+//  ErrLockHeld
+//      Another run holds the migration lock and did not release it in time
+//      or took it over while this run held it, Owner is empty when it expired without being taken
+//
+type ErrLockHeld struct {
+    Owner           string
+    Acquired        time.Time
+}
+
+func (self ErrLockHeld) Error() string {
+    if (len(self.Owner) == 0) {
+        return "migration lock expired and is no longer held"
+    }
+    return fmt.Sprintf("migration lock held by %s since %s", self.Owner, self.Acquired)
+}
+
+//
+//  ErrConfig
+//      An option (flag, config key, or Options field) has an unusable value
+//
+type ErrConfig struct {
+    Option          string
+    Reason          string
+}
+
+func (self ErrConfig) Error() string {
+    return fmt.Sprintf("invalid %s: %s", self.Option, self.Reason)
+}
+
+//
+//  ErrNotFound
+//      A migration, keyspace or table that was asked for does not exist
+//
+type ErrNotFound struct {
+    Kind            string
+    Name            string
+}
+
+func (self ErrNotFound) Error() string {
+    return fmt.Sprintf("%s [%s] does not exist", self.Kind, self.Name)
+}
+
+
+//
+//  Validate
+//      Check the options before anything is created with them
+//
+func (self Options) Validate() error {
+    var identifier = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+    if (!identifier.MatchString(self.Keyspace)) {
+        return ErrConfig{ "keyspace", "[" + self.Keyspace + "] is not a valid keyspace name" }
+    }
+    if (!identifier.MatchString(self.Table)) {
+        return ErrConfig{ "table", "[" + self.Table + "] is not a valid table name" }
+    }
+    if (len(self.Replication["class"]) == 0) {
+        return ErrConfig{ "replication", "must include a class" }
+    }
+    if (self.Order != ORDER_FAIL && self.Order != ORDER_WARN && self.Order != ORDER_ALLOW) {
+        return ErrConfig{ "order", "unknown policy [" + self.Order + "], expected fail, warn or allow" }
+    }
+
+    // the lock row is written with a TTL in whole seconds and refreshed every third of it
+    if (self.LockTTL < time.Second) {
+        return ErrConfig{ "lock.ttl", fmt.Sprintf("%s is under a second, the lock would never expire", self.LockTTL) }
+    }
+    if (self.LockWait < 0) {
+        return ErrConfig{ "lock.wait", fmt.Sprintf("%s is negative", self.LockWait) }
+    }
+    if (self.SchemaWait < 0) {
+        return ErrConfig{ "schema.wait", fmt.Sprintf("%s is negative", self.SchemaWait) }
+    }
+
+    return nil
+}
\ No newline at end of file
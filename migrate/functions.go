@@ -0,0 +1,119 @@
+package migrate
+
+import (
+    "fmt"
+    "sort"
+    "sync"
+    "context"
+    "runtime"
+
+    "github.com/tux21b/gocql"
+
+    "github.com/zmarcantel/cmm/cql"
+)
+
+//-------------------------------------------------------
+// Go Migrations
+//-------------------------------------------------------
+
+//
+//  MigrationFunc
+//      A migration written in Go, for changes CQL cannot express
+//      such as backfilling a new column from existing rows
+//      The context is the one given to Up or To, long backfills should stop once it is done
+//      It may be run again after failing, so it should be safe to repeat
+//
+type MigrationFunc func(ctx context.Context, session cql.Session, run *Run) error
+
+//
+//  Run
+//      What a Go migration runs with besides its context and the session
+//
+type Run struct {
+    Migration       Migration
+    Consistency     gocql.Consistency
+
+    migrator        *Migrator
+}
+
+//
+//  Printf
+//      Report progress through the logger of the run
+//
+func (self *Run) Printf(format string, args ...interface{}) {
+    self.migrator.log(SOFT, "\t" + format, args...)
+}
+
+
+var registered = make(map[string]Migration)
+var registeredLock sync.Mutex
+
+//
+//  Register
+//      Add a Go migration, ordered by name with the .cql files every Migrator loads
+//      The name takes the same timestamp prefix, e.g. 2014-05-01T00-00-00Z_backfill_emails
+//      Meant to be called from init(), registering a name twice panics
+//
+func Register(name string, up MigrationFunc) {
+    registeredLock.Lock()
+    defer registeredLock.Unlock()
+
+    if (up == nil) {
+        panic("migrate: Register of a nil migration " + name)
+    }
+    if _, exists := registered[name] ; exists {
+        panic("migrate: Register called twice for migration " + name)
+    }
+
+    // where it was registered stands in for the file path
+    var _, file, line, _ = runtime.Caller(1)
+    registered[name] = Migration{
+        Name:           name,
+        Path:           fmt.Sprintf("%s:%d", file, line),
+        Func:           up,
+    }
+}
+
+//
+//  Registered
+//      Every registered Go migration, sorted by name
+//
+func Registered() MigrationCollection {
+    registeredLock.Lock()
+    defer registeredLock.Unlock()
+
+    var migrations = make(MigrationCollection, 0, len(registered))
+    for _, mig := range registered {
+        migrations = append(migrations, mig)
+    }
+
+    sort.Sort(migrations)
+    return migrations
+}
+
+
+//
+//  execFunc
+//      Run a Go migration, which counts as a single statement
+//      The function may have changed the schema, so agreement is awaited after it
+//
+func (self *Migrator) execFunc(ctx context.Context, mig Migration) (int, error) {
+    if err := self.checkLock() ; err != nil {
+        return 0, err
+    }
+    if err := ctx.Err() ; err != nil {
+        return 0, err
+    }
+    self.MarkProgress(mig, STATUS_PARTIAL, 0, 0, "")
+
+    var run = &Run{ Migration: mig, Consistency: self.Consistency, migrator: self }
+    if err := mig.Func(ctx, self.Session, run) ; err != nil {
+        return 0, fmt.Errorf("%s:\n%w", mig.Path, err)
+    }
+
+    if err := self.WaitForSchemaAgreement() ; err != nil {
+        return 0, err
+    }
+
+    return 1, nil
+}
\ No newline at end of file
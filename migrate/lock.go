@@ -0,0 +1,236 @@
+package migrate
+
+import (
+    "os"
+    "fmt"
+    "sync"
+    "time"
+)
+
+// the single row in the lock table every run competes for
+const LOCK_NAME = "migrations"
+
+//-------------------------------------------------------
+// Lock Type
+//-------------------------------------------------------
+
+type MigrationLock struct {
+    Owner       string
+    Acquired    time.Time
+    TTL         time.Duration
+
+    migrator    *Migrator
+    stop        chan bool
+    lost        error           // set once the lock was taken over or expired, the run stops at the next statement
+    lock        sync.Mutex
+
+    release     sync.Once
+    released    error           // what Release returned, returned again by later calls
+}
+
+
+//
+//  AcquireLock
+//    Take the cluster-wide migration lock using a lightweight transaction
+//    Polls until the lock is free or the lock wait expires
+//    The lock is refreshed in the background until released
+//    If it is lost meanwhile, migrations stop before their next statement
+//
+func (self *Migrator) AcquireLock() (*MigrationLock, error) {
+    if err := self.Options.Validate() ; err != nil {
+        return nil, err
+    }
+
+    var lock = &MigrationLock{
+        Owner:      lockOwner(),
+        TTL:        self.Options.LockTTL,
+        migrator:   self,
+        stop:       make(chan bool),
+    }
+
+    var deadline = time.Now().Add(self.Options.LockWait)
+    for {
+        lock.Acquired = time.Now()
+
+        var existing = make(map[string]interface{})
+        var applied, err = self.Session.Query(
+            `INSERT INTO ` + self.LockTable() + ` (name, owner, acquired) VALUES (?, ?, ?) IF NOT EXISTS USING TTL ?`,
+            LOCK_NAME, lock.Owner, lock.Acquired, int(lock.TTL / time.Second)).MapScanCAS(existing)
+
+        if (err != nil) {
+            return nil, fmt.Errorf("could not take migration lock: %s", err)
+        }
+
+        if (applied) {
+            self.log(SOFT, "Acquired migration lock as %s\n", lock.Owner)
+            self.lock = lock
+            go lock.refresh()
+            return lock, nil
+        }
+
+        if (time.Now().After(deadline)) {
+            return nil, heldBy(existing)
+        }
+
+        self.log(SOFT, "Waiting for migration lock held by %v\n", existing["owner"])
+        time.Sleep(time.Second)
+    }
+}
+
+
+//
+//  refresh
+//    Extend the TTL of the lock while migrations are running
+//    Runs until the lock is released, or until it is lost to another run
+//    or has gone unrefreshed for a whole TTL
+//
+func (self *MigrationLock) refresh() {
+    var migrator = self.migrator
+    var ticker = time.NewTicker(self.TTL / 3)
+    defer ticker.Stop()
+
+    var refreshed = time.Now()
+    for {
+        select {
+            case <-self.stop:
+                return
+
+            case <-ticker.C:
+                var existing = make(map[string]interface{})
+                var applied, err = migrator.Session.Query(
+                    `UPDATE ` + migrator.LockTable() + ` USING TTL ? SET owner = ?, acquired = ? WHERE name = ? IF owner = ?`,
+                    int(self.TTL / time.Second), self.Owner, self.Acquired, LOCK_NAME, self.Owner).MapScanCAS(existing)
+
+                if (err != nil) {
+                    migrator.log(QUIET, "WARNING: could not refresh migration lock\n%s\n", err)
+                }
+
+                if (err != nil && time.Since(refreshed) >= self.TTL) {
+                    // the row has expired by now, whether or not another run took it
+                    self.lose(ErrLockHeld{})
+                    return
+                } else if (err != nil) {
+                    continue
+                } else if (!applied) {
+                    self.lose(heldBy(existing))
+                    return
+                } else {
+                    refreshed = time.Now()
+                    migrator.log(LOUD, "\tRefreshed migration lock\n")
+                }
+        }
+    }
+}
+
+//
+//  lose
+//    Remember why the lock is no longer ours, so the run stops before its next statement
+//
+func (self *MigrationLock) lose(err error) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    self.migrator.log(QUIET, "WARNING: %s, stopping before the next statement\n", err)
+    self.lost = err
+}
+
+//
+//  Lost
+//    Why the lock is no longer held, an ErrLockHeld, nil while it is
+//
+func (self *MigrationLock) Lost() error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    return self.lost
+}
+
+
+//
+//  Release
+//    Stop refreshing and remove the lock if we still own it
+//    Returns ErrLockHeld when another run holds it by now, the run was not protected to the end
+//    Only the first call releases, later ones return what it did
+//
+func (self *MigrationLock) Release() error {
+    self.release.Do(func() {
+        self.released = self.remove()
+    })
+    return self.released
+}
+
+func (self *MigrationLock) remove() error {
+    close(self.stop)
+    if (self.migrator.lock == self) {
+        self.migrator.lock = nil
+    }
+
+    var existing = make(map[string]interface{})
+    var applied, err = self.migrator.Session.Query(
+        `DELETE FROM ` + self.migrator.LockTable() + ` WHERE name = ? IF owner = ?`,
+        LOCK_NAME, self.Owner).MapScanCAS(existing)
+
+    if (err != nil) {
+        return fmt.Errorf("could not release migration lock: %s", err)
+    }
+    if (!applied) {
+        return heldBy(existing)
+    }
+
+    self.migrator.log(SOFT, "Released migration lock\n")
+    return nil
+}
+
+
+//
+//  checkLock
+//    The reason to stop when the lock this migrator holds was lost
+//
+func (self *Migrator) checkLock() error {
+    if (self.lock == nil) {
+        return nil
+    }
+
+    return self.lock.Lost()
+}
+
+//
+//  heldBy
+//    The lock row a failed lightweight transaction returned as ErrLockHeld
+//    A lock that expired meanwhile has no row, and so no owner
+//
+func heldBy(existing map[string]interface{}) error {
+    var owner, _ = existing["owner"].(string)
+    var since, _ = existing["acquired"].(time.Time)
+    return ErrLockHeld{ owner, since }
+}
+
+
+//
+//  ForceUnlock
+//    Remove the lock regardless of who holds it
+//    Only meant for locks left behind by a run that died
+//
+func (self *Migrator) ForceUnlock() error {
+    var err = self.Session.Query(`DELETE FROM ` + self.LockTable() + ` WHERE name = ?`, LOCK_NAME).Exec()
+    if (err != nil) {
+        return fmt.Errorf("could not remove migration lock: %s", err)
+    }
+
+    self.log(QUIET, "Removed migration lock\n")
+    return nil
+}
+
+
+//
+//  lockOwner
+//    Identify this run as hostname:pid
+//
+func lockOwner() string {
+    var hostname, err = os.Hostname()
+    if (err != nil) {
+        hostname = "unknown"
+    }
+
+    return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
\ No newline at end of file
@@ -0,0 +1,763 @@
+//
+//  Package migrate
+//      Runs timestamp-prefixed CQL migrations against a Cassandra cluster
+//      and records which of them have been applied
+//
+//      var session, _ = cql.Connect(cluster)
+//      var migrator = migrate.New(session, migrate.DefaultOptions())
+//      if err := migrator.Load("./migrations") ; err != nil { ... }
+//      if err := migrator.Init() ; err != nil { ... }
+//      if _, err := migrator.Up(context.Background(), "") ; err != nil { ... }
+//
+package migrate
+
+import (
+    "os"
+    "log"
+    "fmt"
+    "context"
+    "sort"
+    "time"
+    "errors"
+    "strings"
+    "strconv"
+    "io/ioutil"
+    "path/filepath"
+
+    "github.com/tux21b/gocql"
+
+    "github.com/zmarcantel/cmm/cql"
+)
+
+// recorded with every applied migration
+const VERSION = "0.2.0"
+
+const (
+    QUIET   = 0;
+    SOFT    = 1;
+    MEDIUM  = 2;
+    LOUD    = 3;
+    ALL     = 4;
+)
+
+//
+// Policies for pending migrations that sort before the latest applied one
+//
+
+const (
+    ORDER_FAIL      = "fail";
+    ORDER_WARN      = "warn";
+    ORDER_ALLOW     = "allow";
+)
+
+
+//-------------------------------------------------------
+// Migrator Type
+//-------------------------------------------------------
+
+//
+//  Logger
+//      Where progress is reported, satisfied by *log.Logger
+//
+type Logger interface {
+    Printf(format string, v ...interface{})
+}
+
+//
+//  Options
+//      Everything that changes how migrations are run and recorded
+//
+type Options struct {
+    Keyspace        string              // where migrations are recorded, separate per app sharing a cluster
+    Table           string
+    Replication     map[string]string   // used when the keyspace is created
+
+    Delay           time.Duration       // wait after each migration that does not set its own delay
+    SchemaWait      time.Duration       // how long nodes get to agree on the schema after DDL
+    LockWait        time.Duration       // how long to wait for another run to release the lock
+    LockTTL         time.Duration       // how long the lock survives without being refreshed
+
+    Resume          bool                // continue failed or partial migrations
+    Order           string              // ORDER_FAIL, ORDER_WARN or ORDER_ALLOW
+    Verbosity       int
+}
+
+//
+//  DefaultOptions
+//      The options the command line uses when no flags are given
+//
+func DefaultOptions() Options {
+    return Options{
+        Keyspace:       "migrations",
+        Table:          "completed",
+        Replication:    map[string]string{ "class": "SimpleStrategy", "replication_factor": "3" },
+        SchemaWait:     30 * time.Second,
+        LockWait:       60 * time.Second,
+        LockTTL:        60 * time.Second,
+        Order:          ORDER_FAIL,
+    }
+}
+
+type Migrator struct {
+    Session         cql.Session
+    Consistency     gocql.Consistency
+    Logger          Logger
+    Options         Options
+
+    Migrations      MigrationCollection
+
+    lock            *MigrationLock      // held while running, if AcquireLock was called
+}
+
+//
+//  New
+//      Create a migrator using the given session, from cql.Connect or cql.Wrap for a gocql session
+//      Queries run at quorum and progress is logged to stdout until changed
+//
+func New(session cql.Session, options Options) *Migrator {
+    return &Migrator{
+        Session:        session,
+        Consistency:    gocql.Quorum,
+        Logger:         log.New(os.Stdout, "", 0),
+        Options:        options,
+    }
+}
+
+//
+//  log
+//      Report progress when the verbosity is at least the given level
+//
+func (self *Migrator) log(level int, format string, args ...interface{}) {
+    if (self.Logger != nil && self.Options.Verbosity >= level) {
+        self.Logger.Printf(format, args...)
+    }
+}
+
+
+//
+//  Load
+//      Recursively walk the directory looking for .cql files
+//      Builds a migration for each one, replacing anything loaded before
+//      Registered Go migrations are sorted in with them
+//
+func (self *Migrator) Load(dir string) error {
+    self.log(SOFT, "Loading migration files from: %s\n", dir)
+
+    // start from a clean collection so repeated loads do not duplicate
+    var migrations MigrationCollection
+
+    // sibling *.down.cql files keyed by the name of the migration they revert
+    var downs = make(map[string]string)
+
+    var topErr = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        // if there was an error, bubble to top
+        if (err != nil) { return err }
+
+        // if the file does not have the extension .cql
+        // or it is a hidden file (or swap file for many editors)
+        // just skip this file
+        if (filepath.Ext(path) != ".cql" || info.Name()[:1] == ".") { return nil }
+
+        // attempt to read the contents of the migration file
+        if contents, fileErr := ioutil.ReadFile(path) ; fileErr != nil {
+            return fmt.Errorf("could not read migration file [%s]: %s", path, fileErr)
+        } else if (strings.HasSuffix(info.Name(), ".down.cql")) {
+            self.log(LOUD, "\tDown File: %s\n", info.Name())
+
+            // hold on to it until every up migration is loaded
+            downs[strings.TrimSuffix(info.Name(), ".down.cql") + ".cql"] = string(contents)
+        } else {
+            self.log(LOUD, "\tFile: %s\n", info.Name())
+
+            // we got everything we need, so let's create a migration
+            var up, down = SplitDirections(string(contents))
+            migrations = append(migrations, Migration{
+                Name:           info.Name(),
+                Path:           path,
+                Query:          up,
+                Down:           down,
+            })
+        }
+
+        return nil
+    })
+    if (os.IsNotExist(topErr)) {
+        return ErrNotFound{ "migrations directory", dir }
+    } else if (topErr != nil) {
+        return topErr
+    }
+
+    // pair the down files with their migrations
+    for i, mig := range migrations {
+        if down, exists := downs[mig.Name] ; exists {
+            if (len(mig.Down) > 0) {
+                return ErrMigrationFailed{ mig.Name, 0, errors.New("has both a '-- +down' section and a .down.cql file") }
+            }
+            migrations[i].Down = strings.TrimSpace(down)
+            delete(downs, mig.Name)
+        }
+    }
+    for name := range downs {
+        self.log(QUIET, "WARNING: no migration found for down file of [%s]\n", name)
+    }
+
+    // Go migrations are ordered along with the files
+    var files = make(map[string]bool)
+    for _, mig := range migrations {
+        files[mig.Name] = true
+    }
+    for _, mig := range Registered() {
+        if (files[mig.Name]) {
+            return ErrMigrationFailed{ mig.Name, 0, errors.New("is both a registered Go migration and a file") }
+        }
+        self.log(LOUD, "\tGo: %s\n", mig.Name)
+        migrations = append(migrations, mig)
+    }
+
+    self.log(SOFT, "Sorting migrations\n")
+    sort.Sort(migrations)
+
+    self.Migrations = migrations
+    return nil
+}
+
+
+//
+//  Status
+//      Split the loaded migrations into those applied and those still pending
+//
+func (self *Migrator) Status() (complete MigrationCollection, pending MigrationCollection, err error) {
+    for _, mig := range self.Migrations {
+        var isComplete, err = self.IsComplete(mig)
+        if (err != nil) {
+            return nil, nil, fmt.Errorf("could not check completion status of [%s]: %s", mig.Name, err)
+        }
+
+        if (isComplete) {
+            complete = append(complete, mig)
+        } else {
+            pending = append(pending, mig)
+        }
+    }
+
+    return complete, pending, nil
+}
+
+//
+//  Pending
+//      The loaded migrations that have not been applied
+//
+func (self *Migrator) Pending() (MigrationCollection, error) {
+    var _, pending, err = self.Status()
+    return pending, err
+}
+
+
+//
+//  Up
+//      Apply every pending migration up to and including the target
+//      An empty target applies everything loaded
+//      Cancelling the context stops before the next statement, leaving the migration partial
+//      Returns how many migrations were applied
+//
+func (self *Migrator) Up(ctx context.Context, target string) (int, error) {
+    var last, err = self.TargetIndex(target)
+    if (err != nil) {
+        return 0, err
+    }
+
+    // refuse (or warn about) migrations merged behind newer ones
+    var migrations = self.Migrations[:last + 1]
+    if err = self.CheckOrder(migrations) ; err != nil {
+        return 0, err
+    }
+
+    var applied = 0
+    for _, mig := range migrations {
+        var isComplete, err = self.IsComplete(mig)
+        if (err != nil) {
+            return applied, fmt.Errorf("could not check completion status of [%s]: %s", mig.Name, err)
+        } else if (isComplete) {
+            continue
+        }
+
+        // logic as far as completion and marking are done by Exec
+        if err = self.Exec(ctx, mig) ; err != nil {
+            return applied, err
+        }
+        applied++
+
+        if err = self.wait(ctx, mig) ; err != nil {
+            return applied, err
+        }
+    }
+
+    return applied, nil
+}
+
+
+//
+//  Down
+//      Revert applied migrations
+//      Target is either a count of the most recent migrations to revert,
+//      or the name of a migration after which everything is reverted
+//      Returns how many migrations were reverted
+//
+func (self *Migrator) Down(ctx context.Context, target string) (int, error) {
+    var complete, _, err = self.Status()
+    if (err != nil) {
+        return 0, err
+    }
+
+    var reverting MigrationCollection
+    reverting, err = RollbackTargets(self.Migrations, complete, target)
+    if (err != nil) {
+        return 0, err
+    }
+
+    if (len(reverting) == 0) {
+        self.log(QUIET, "Nothing to roll back\n")
+        return 0, nil
+    }
+    self.log(QUIET, "Rolling back %d migrations\n", len(reverting))
+
+    // make sure every migration can be reverted before touching anything
+    for _, mig := range reverting {
+        if (len(strings.TrimSpace(mig.Down)) == 0) {
+            return 0, ErrMigrationFailed{ mig.Name, 0, errors.New("no down section, nothing was reverted") }
+        }
+    }
+
+    // revert in reverse collection order, stopping at the first failure
+    var reverted = 0
+    for i := len(reverting) - 1; i >= 0; i-- {
+        if err = self.Revert(ctx, reverting[i]) ; err != nil {
+            return reverted, err
+        }
+        reverted++
+
+        if err = self.wait(ctx, reverting[i]) ; err != nil {
+            return reverted, err
+        }
+    }
+
+    return reverted, nil
+}
+
+
+//
+//  To
+//      Move the schema to the target
+//      Applied migrations after it are reverted first, then pending ones up to it are applied
+//      An empty target only applies, like Up
+//      Returns how many migrations were reverted and applied
+//
+func (self *Migrator) To(ctx context.Context, target string) (int, error) {
+    var last, err = self.TargetIndex(target)
+    if (err != nil) {
+        return 0, err
+    }
+
+    var reverted = 0
+    if (len(target) > 0) {
+        if reverted, err = self.Down(ctx, self.Migrations[last].Name) ; err != nil {
+            return reverted, err
+        }
+    }
+
+    var applied, upErr = self.Up(ctx, target)
+    return reverted + applied, upErr
+}
+
+
+//
+//  Exec
+//      Executes the query(ies) described in the migration
+//      Upon completion, will mark it as complete
+//
+func (self *Migrator) Exec(ctx context.Context, mig Migration) error {
+    self.log(SOFT, "\n\nMigration: %s\n", mig.Name)
+
+    // if the migration has already been issued, notify of skip
+    if complete, err := self.IsComplete(mig) ; err != nil {
+        return fmt.Errorf("could not fetch status of migration [%s]: %s", mig.Name, err)
+    } else if (complete == true) {
+        self.log(SOFT, "\tSkipping [%s]\n", mig.Name)
+        return nil
+    }
+
+    // a Go migration counts as a single statement
+    var statements []Statement
+    var total = 1
+    if (mig.Func == nil) {
+        var splitErr error
+        if statements, splitErr = mig.Statements() ; splitErr != nil {
+            return ErrMigrationFailed{ mig.Name, 0, fmt.Errorf("%s: %s", mig.Path, splitErr) }
+        }
+        total = len(statements)
+    }
+
+    // a previous run may have stopped part way through this migration
+    var skip = 0
+    if progress, found, err := self.GetProgress(mig) ; err != nil {
+        return fmt.Errorf("could not fetch progress of migration [%s]: %s", mig.Name, err)
+    } else if (found && !self.Options.Resume) {
+        return ErrIncomplete{ mig.Name, progress, total, false }
+    } else if (found) {
+        // the applied count only means something while the statements it counts are unchanged
+        // rows recorded before checksums were kept have none to compare
+        var changed = len(progress.Checksum) > 0 && progress.Checksum != mig.AppliedChecksum(progress.Applied)
+        if (changed || progress.Applied > total) {
+            return ErrIncomplete{ mig.Name, progress, total, true }
+        }
+
+        skip = progress.Applied
+        self.log(SOFT, "\tResuming at statement %d\n", skip + 1)
+    }
+
+    // run every statement of the up section, recording each one as it succeeds
+    var started = time.Now()
+    var applied int
+    var err error
+    if (mig.Func != nil) {
+        applied, err = self.execFunc(ctx, mig)
+    } else {
+        applied, err = self.execStatements(ctx, statements[skip:], mig.Path, func(count int) {
+            self.MarkProgress(mig, STATUS_PARTIAL, skip + count, 0, "")
+        })
+    }
+    if _, lost := err.(ErrLockHeld) ; lost || (err != nil && errors.Is(err, ctx.Err())) {
+        // stopped between statements, the migration is left partial as if the run had died
+        return err
+    } else if (err != nil) {
+        self.MarkProgress(mig, STATUS_FAILED, skip + applied, skip + applied + 1, err.Error())
+        return ErrMigrationFailed{ mig.Name, skip + applied + 1, err }
+    }
+
+    // mark the migration complete
+    if err = self.MarkComplete(mig, time.Since(started), total) ; err != nil {
+        return err
+    }
+
+    return self.ClearProgress(mig)
+}
+
+
+//
+//  Revert
+//      Executes the down section of the migration
+//      Upon completion, will remove it from the completion table
+//
+func (self *Migrator) Revert(ctx context.Context, mig Migration) error {
+    self.log(SOFT, "\n\nReverting: %s\n", mig.Name)
+
+    if (len(strings.TrimSpace(mig.Down)) == 0) {
+        return ErrMigrationFailed{ mig.Name, 0, errors.New("no down section") }
+    }
+
+    var statements, splitErr = SplitStatements(mig.Down)
+    if (splitErr != nil) {
+        return ErrMigrationFailed{ mig.Name, 0, fmt.Errorf("%s (down section): %s", mig.Path, splitErr) }
+    }
+
+    // run every statement of the down section
+    if applied, err := self.execStatements(ctx, statements, mig.Path + " (down section)", nil) ; err != nil {
+        if _, lost := err.(ErrLockHeld) ; lost || errors.Is(err, ctx.Err()) {
+            return err
+        }
+        return ErrMigrationFailed{ mig.Name, applied + 1, err }
+    }
+
+    // forget the migration was ever run
+    return self.MarkIncomplete(mig)
+}
+
+
+//
+//  execStatements
+//      Run statements sequentially, stopping at the first failure
+//      Returns how many statements succeeded, applied is called after each one
+//      Where is how failures describe the block, e.g. the file path
+//      A cancelled context is returned as is, before the next statement
+//
+func (self *Migrator) execStatements(ctx context.Context, statements []Statement, where string, applied func(count int)) (int, error) {
+    self.log(LOUD, "\tSplit into %d queries\n", len(statements))
+
+    // allow for multiple queries to be in the same file
+    // split them up and run sequentially
+    for i, statement := range statements {
+        // another run may own the schema by now, or the caller gave up
+        if err := self.checkLock() ; err != nil {
+            return i, err
+        }
+        if err := ctx.Err() ; err != nil {
+            return i, err
+        }
+
+        self.log(MEDIUM, "\tPart: %d (line %d)\n", i, statement.Line)
+
+        var err = self.Session.Query(statement.Query).Consistency(self.Consistency).Exec()
+
+        // schema changes must reach every node before the next statement relies on them
+        if (err == nil && IsSchemaChange(statement.Query)) {
+            err = self.WaitForSchemaAgreement()
+        }
+
+        if err != nil {
+            return i, fmt.Errorf("%s:%d:%d:\n\tQuery: '%s'\n%s", where, statement.Line, statement.Column, statement.Query, err)
+        }
+
+        if (applied != nil) { applied(i + 1) }
+    }
+
+    return len(statements), nil
+}
+
+
+//
+//  wait
+//      Sleep for the delay of the migration, or the default delay
+//      Returns the error of the context if it is cancelled meanwhile
+//
+func (self *Migrator) wait(ctx context.Context, mig Migration) error {
+    var delay, err = mig.GetDelay(self.Options.Delay)
+    if (err != nil) {
+        return err
+    }
+
+    if (delay > 0) {
+        self.log(SOFT, "\tWaiting %s\n", delay)
+    }
+
+    var timer = time.NewTimer(delay)
+    defer timer.Stop()
+
+    select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-timer.C:
+            return nil
+    }
+}
+
+
+//
+//  OutOfOrder
+//      Find pending migrations that sort before the latest applied one
+//      These usually come from a branch merged after newer migrations already ran
+//
+func (self *Migrator) OutOfOrder(migrations MigrationCollection) (pending MigrationCollection, latest string, err error) {
+    var remaining MigrationCollection
+
+    for _, mig := range migrations {
+        var isComplete, err = self.IsComplete(mig)
+        if (err != nil) {
+            return nil, "", err
+        }
+
+        if (!isComplete) {
+            remaining = append(remaining, mig)
+        } else if (mig.Name > latest) {
+            latest = mig.Name
+        }
+    }
+
+    for _, mig := range remaining {
+        // ISO-8601 prefix allows simple alphabetic comparison
+        if (mig.Name < latest) {
+            pending = append(pending, mig)
+        }
+    }
+
+    return pending, latest, nil
+}
+
+
+//
+//  CheckOrder
+//      Apply the out-of-order policy before running migrations
+//      fail returns ErrOutOfOrder, warn reports and carries on, allow carries on silently
+//
+func (self *Migrator) CheckOrder(migrations MigrationCollection) error {
+    var pending, latest, err = self.OutOfOrder(migrations)
+    if (err != nil) {
+        return fmt.Errorf("could not check migration order: %s", err)
+    }
+
+    if (len(pending) == 0 || self.Options.Order == ORDER_ALLOW) {
+        if (len(pending) > 0) {
+            self.log(SOFT, "Running %d migrations out of order\n", len(pending))
+        }
+        return nil
+    }
+
+    var names []string
+    for _, mig := range pending {
+        names = append(names, mig.Name)
+    }
+
+    var outOfOrder = ErrOutOfOrder{ latest, names }
+    if (self.Options.Order == ORDER_FAIL) {
+        return outOfOrder
+    }
+
+    self.log(QUIET, "WARNING: %s\n", outOfOrder)
+    return nil
+}
+
+
+//
+//  Repair
+//      Clear the failed or partial marker of a migration
+//      Meant for after the failure has been fixed by hand, the migration runs from the start next time
+//
+func (self *Migrator) Repair(name string) error {
+    for _, mig := range self.Migrations {
+        if (mig.Name != name) { continue }
+
+        var progress, found, err = self.GetProgress(mig)
+        if (err != nil) {
+            return fmt.Errorf("could not fetch progress of [%s]: %s", name, err)
+        }
+        if (!found) {
+            self.log(QUIET, "[%s] has no failed or partial run to repair\n", name)
+            return nil
+        }
+
+        if err = self.ClearProgress(mig) ; err != nil {
+            return err
+        }
+        self.log(QUIET, "Cleared %s marker of [%s] (%d statements had been applied)\n", progress.Status, name, progress.Applied)
+        return nil
+    }
+
+    return ErrNotFound{ "migration", name }
+}
+
+
+//
+//  Baseline
+//      Mark every migration up to and including the target as complete without running it
+//      Without a target, that is every migration loaded, as for Up
+//      Meant for clusters whose schema already exists when cmm is adopted
+//      Refuses when migrations were already recorded, unless forced
+//      Returns how many migrations were marked
+//
+func (self *Migrator) Baseline(target string, force bool) (int, error) {
+    var last, err = self.TargetIndex(target)
+    if (err != nil) {
+        return 0, err
+    }
+    if (last < 0) {
+        return 0, ErrConfig{ "baseline", "no migrations are loaded" }
+    }
+
+    var existing string
+    err = self.Session.Query(`SELECT name FROM ` + self.CompletedTable() + ` LIMIT 1`).Consistency(self.Consistency).Scan(&existing)
+    if (err != nil && err != gocql.ErrNotFound) {
+        return 0, fmt.Errorf("could not read completed migrations: %s", err)
+    }
+    if (len(existing) > 0 && !force) {
+        return 0, fmt.Errorf("%s already has entries, force the baseline to mark migrations anyway", self.CompletedTable())
+    }
+
+    var marked = 0
+    for _, mig := range self.Migrations[:last + 1] {
+        var isComplete, err = self.IsComplete(mig)
+        if (err != nil) {
+            return marked, fmt.Errorf("could not check completion status of [%s]: %s", mig.Name, err)
+        }
+        if (isComplete) { continue }
+
+        var statements, splitErr = mig.Statements()
+        if (splitErr != nil) {
+            return marked, ErrMigrationFailed{ mig.Name, 0, fmt.Errorf("%s: %s", mig.Path, splitErr) }
+        }
+
+        if err = self.MarkComplete(mig, 0, len(statements)) ; err != nil {
+            return marked, err
+        }
+        marked++
+    }
+
+    self.log(QUIET, "Baselined %d migrations up to %s\n", marked, self.Migrations[last].Name)
+    return marked, nil
+}
+
+
+//
+//  TargetIndex
+//      Index of the last migration to apply given a target
+//      Without a target, that is the last migration loaded
+//
+func (self *Migrator) TargetIndex(target string) (int, error) {
+    if (len(target) == 0) {
+        return len(self.Migrations) - 1, nil
+    }
+
+    return ResolveTarget(self.Migrations, target)
+}
+
+
+//
+//  ResolveTarget
+//      Find the migration a target refers to, by filename or a unique prefix of it (e.g. the timestamp)
+//      Returns the index of the migration in the collection
+//
+func ResolveTarget(migrations MigrationCollection, target string) (int, error) {
+    var found = -1
+    for i, mig := range migrations {
+        if (mig.Name == target || mig.Name == target + ".cql") {
+            return i, nil
+        }
+
+        if (strings.HasPrefix(mig.Name, target)) {
+            if (found >= 0) {
+                return -1, fmt.Errorf("target [%s] matches both [%s] and [%s]", target, migrations[found].Name, mig.Name)
+            }
+            found = i
+        }
+    }
+
+    if (found < 0) {
+        return -1, ErrNotFound{ "migration", target }
+    }
+
+    return found, nil
+}
+
+
+//
+//  RollbackTargets
+//      Select the completed migrations that a rollback target refers to
+//      Returned in collection order, the caller reverts them backwards
+//
+func RollbackTargets(migrations, complete MigrationCollection, target string) (MigrationCollection, error) {
+    // a count of the most recent migrations
+    if count, err := strconv.Atoi(target) ; err == nil {
+        if (count < 0) {
+            return nil, ErrConfig{ "rollback", "cannot roll back a negative number of migrations" }
+        }
+        if (count > len(complete)) {
+            count = len(complete)
+        }
+        return complete[len(complete) - count:], nil
+    }
+
+    // everything applied after the named migration, named as Up and Down name their target
+    var index, err = ResolveTarget(migrations, target)
+    if (err != nil) {
+        return nil, err
+    }
+    var name = migrations[index].Name
+
+    var result MigrationCollection
+    for _, mig := range complete {
+        // ISO-8601 prefix allows simple alphabetic comparison
+        if (mig.Name > name) {
+            result = append(result, mig)
+        }
+    }
+
+    return result, nil
+}
\ No newline at end of file
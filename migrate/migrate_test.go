@@ -0,0 +1,648 @@
+package migrate
+
+import (
+    "os"
+    "context"
+    "errors"
+    "time"
+    "strings"
+    "strconv"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+
+    "github.com/zmarcantel/cmm/cql"
+    "github.com/zmarcantel/cmm/cql/cqltest"
+)
+
+func TestResolveTarget(t *testing.T) {
+    var migrations = MigrationCollection{
+        Migration{ Name: "2014-03-01T05-44-32.070Z_add_main_keyspace.cql" },
+        Migration{ Name: "2014-03-02T05-44-32.070Z_create_user_table.cql" },
+        Migration{ Name: "2014-03-02T06-13-03.495Z_create_item_table.cql" },
+    }
+
+    var cases = map[string]int{
+        "2014-03-02T05-44-32.070Z_create_user_table.cql":   1,
+        "2014-03-02T05-44-32.070Z_create_user_table":       1,
+        "2014-03-01":                                       0,
+        "2014-03-02T06":                                    2,
+    }
+    for target, expected := range cases {
+        if index, err := ResolveTarget(migrations, target) ; index != expected || err != nil {
+            t.Error(
+                "For", "ResolveTarget " + target,
+                "expected", expected,
+                "got", index, err,
+            )
+        }
+    }
+
+    // ambiguous and unknown targets are errors
+    for _, target := range []string{ "2014-03-02", "2015" } {
+        if _, err := ResolveTarget(migrations, target) ; err == nil {
+            t.Error(
+                "For", "ResolveTarget " + target,
+                "expected", "error",
+                "got", nil,
+            )
+        }
+    }
+
+    if _, err := ResolveTarget(migrations, "2015") ; err != (ErrNotFound{ "migration", "2015" }) {
+        t.Error(
+            "For", "ResolveTarget 2015",
+            "expected", ErrNotFound{ "migration", "2015" },
+            "got", err,
+        )
+    }
+}
+
+
+func TestValidate(t *testing.T) {
+    if err := DefaultOptions().Validate() ; err != nil {
+        t.Error(
+            "For", "DefaultOptions().Validate()",
+            "expected", nil,
+            "got", err,
+        )
+    }
+
+    var cases = map[string]func(*Options){
+        "keyspace":     func(options *Options) { options.Keyspace = "bad-name" },
+        "table":        func(options *Options) { options.Table = "1table" },
+        "replication":  func(options *Options) { options.Replication = map[string]string{} },
+        "order":        func(options *Options) { options.Order = "sometimes" },
+        "lock.ttl":     func(options *Options) { options.LockTTL = 500 * time.Millisecond },
+        "lock.wait":    func(options *Options) { options.LockWait = -time.Second },
+        "schema.wait":  func(options *Options) { options.SchemaWait = -time.Second },
+    }
+    for option, breakIt := range cases {
+        var options = DefaultOptions()
+        breakIt(&options)
+
+        if configErr, ok := options.Validate().(ErrConfig) ; !ok || configErr.Option != option {
+            t.Error(
+                "For", "Validate with invalid " + option,
+                "expected", "ErrConfig for " + option,
+                "got", options.Validate(),
+            )
+        }
+    }
+}
+
+
+func TestLockOptions(t *testing.T) {
+    // the zero value has no lock TTL to write or refresh with
+    var migrator = New(cqltest.NewFake(), Options{})
+    migrator.Logger = nil
+
+    if lock, err := migrator.AcquireLock() ; err == nil {
+        lock.Release()
+        t.Error(
+            "For", "AcquireLock with Options{}",
+            "expected", "ErrConfig",
+            "got", nil,
+        )
+    } else if _, ok := err.(ErrConfig) ; !ok {
+        t.Error(
+            "For", "AcquireLock with Options{}",
+            "expected", "ErrConfig",
+            "got", err,
+        )
+    }
+}
+
+
+func TestSplitDirections(t *testing.T) {
+    var up, down = SplitDirections("-- +up\nCREATE TABLE foo.bar (id UUID PRIMARY KEY);\n\n-- +down\nDROP TABLE foo.bar;\n")
+
+    if (strings.TrimSpace(up) != "-- +up\nCREATE TABLE foo.bar (id UUID PRIMARY KEY);") {
+        t.Error(
+            "For", "SplitDirections up",
+            "expected", "-- +up\nCREATE TABLE foo.bar (id UUID PRIMARY KEY);",
+            "got", up,
+        )
+    }
+
+    if (down != "DROP TABLE foo.bar;") {
+        t.Error(
+            "For", "SplitDirections down",
+            "expected", "DROP TABLE foo.bar;",
+            "got", down,
+        )
+    }
+
+    if _, down = SplitDirections("-- delay: 500\nCREATE TABLE foo.bar (id UUID PRIMARY KEY);") ; down != "" {
+        t.Error(
+            "For", "SplitDirections without down",
+            "expected", "",
+            "got", down,
+        )
+    }
+}
+
+
+func TestSplitStatements(t *testing.T) {
+    var block = `-- leading comment; not a statement
+INSERT INTO foo.bar (id, note) VALUES (1, 'semi; colon ''quoted''');
+/* block; comment */ UPDATE foo.bar SET note = 'a' WHERE id = 1;
+
+BEGIN BATCH
+    INSERT INTO foo.bar (id) VALUES (2);
+    INSERT INTO foo.bar (id) VALUES (3);
+APPLY BATCH;
+CREATE FUNCTION foo.f (x int) RETURNS NULL ON NULL INPUT RETURNS int LANGUAGE java AS $$ return x; $$;
+  DROP TABLE "odd;name" // trailing comment;
+`
+
+    var statements, err = SplitStatements(block)
+    if (err != nil) {
+        t.Error(
+            "For", "SplitStatements error",
+            "expected", nil,
+            "got", err,
+        )
+        return
+    }
+
+    var expected = []Statement{
+        Statement{ Query: "INSERT INTO foo.bar (id, note) VALUES (1, 'semi; colon ''quoted''')", Line: 2, Column: 1 },
+        Statement{ Query: "UPDATE foo.bar SET note = 'a' WHERE id = 1", Line: 3, Column: 22 },
+        Statement{ Query: "BEGIN BATCH\n    INSERT INTO foo.bar (id) VALUES (2);\n    INSERT INTO foo.bar (id) VALUES (3);\nAPPLY BATCH", Line: 5, Column: 1 },
+        Statement{ Query: "CREATE FUNCTION foo.f (x int) RETURNS NULL ON NULL INPUT RETURNS int LANGUAGE java AS $$ return x; $$", Line: 9, Column: 1 },
+        Statement{ Query: "DROP TABLE \"odd;name\" // trailing comment;", Line: 10, Column: 3 },
+    }
+
+    if (len(statements) != len(expected)) {
+        t.Error(
+            "For", "len(statements)",
+            "expected", len(expected),
+            "got", len(statements),
+        )
+        return
+    }
+
+    for i, statement := range statements {
+        if (statement != expected[i]) {
+            t.Error(
+                "For", "statement", i,
+                "\nexpected", expected[i],
+                "\n     got", statement,
+            )
+        }
+    }
+
+    // empty statements are never sent
+    var empty = map[string][]string{
+        "CREATE TABLE a (x int);;":                 []string{ "CREATE TABLE a (x int)" },
+        ";CREATE TABLE a (x int);":                 []string{ "CREATE TABLE a (x int)" },
+        "CREATE TABLE a (x int);\n  ;\n":           []string{ "CREATE TABLE a (x int)" },
+        "-- only a comment\n;":                     []string{},
+        "/* a comment */;\nDROP TABLE a;":          []string{ "DROP TABLE a" },
+    }
+    for block, queries := range empty {
+        var statements, err = SplitStatements(block)
+        var got = []string{}
+        for _, statement := range statements {
+            got = append(got, statement.Query)
+        }
+        if (err != nil || strings.Join(got, "|") != strings.Join(queries, "|") || len(got) != len(queries)) {
+            t.Error(
+                "For", "SplitStatements " + strconv.Quote(block),
+                "expected", queries,
+                "got", got, err,
+            )
+        }
+    }
+
+    if _, err = SplitStatements("INSERT INTO foo.bar (note) VALUES ('open);") ; err == nil {
+        t.Error(
+            "For", "SplitStatements unterminated string",
+            "expected", "error",
+            "got", nil,
+        )
+    }
+}
+
+
+func TestIsSchemaChange(t *testing.T) {
+    var cases = map[string]bool{
+        "CREATE TABLE foo.bar (id UUID PRIMARY KEY)":                   true,
+        "-- add items\n\nalter table foo.bar ADD items SET<UUID>":       true,
+        "DROP KEYSPACE foo":                                            true,
+        "INSERT INTO foo.bar (id) VALUES (now())":                      false,
+        "UPDATE foo.bar SET created = 'CREATE TABLE' WHERE id = now()":  false,
+    }
+
+    for query, expected := range cases {
+        if (IsSchemaChange(query) != expected) {
+            t.Error(
+                "For", query,
+                "expected", expected,
+                "got", !expected,
+            )
+        }
+    }
+}
+
+
+func TestUpAgainstFake(t *testing.T) {
+    var fake = cqltest.NewFake()
+    var migrator = New(fake, DefaultOptions())
+    migrator.Logger = nil
+    migrator.Migrations = MigrationCollection{
+        Migration{ Name: "2014-03-01_keyspace.cql", Query: "CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 };" },
+        Migration{ Name: "2014-03-02_users.cql", Query: "CREATE TABLE app.users (id UUID PRIMARY KEY);\nALTER TABLE app.users ADD name TEXT;" },
+    }
+
+    if err := migrator.Init() ; err != nil {
+        t.Fatal(
+            "For", "Init",
+            "expected", nil,
+            "got", err,
+        )
+    }
+
+    // the second statement of the users migration fails
+    fake.FailOn("ADD name", errors.New("timed out"))
+    var applied, err = migrator.Up(context.Background(), "")
+    if failed, ok := err.(ErrMigrationFailed) ; !ok || failed.Name != "2014-03-02_users.cql" || failed.Statement != 2 || applied != 1 {
+        t.Error(
+            "For", "Up with a failing statement",
+            "expected", "1 applied, 2014-03-02_users.cql failing at statement 2",
+            "got", applied, err,
+        )
+    }
+
+    if progress, found, _ := migrator.GetProgress(migrator.Migrations[1]) ; !found || progress.Status != STATUS_FAILED || progress.Applied != 1 {
+        t.Error(
+            "For", "GetProgress after failure",
+            "expected", "failed, 1 applied",
+            "got", progress,
+        )
+    }
+
+    // the next run refuses to touch it without --resume
+    fake.FailOn("ADD name", nil)
+    if _, err = migrator.Up(context.Background(), "") ; err == nil {
+        t.Error(
+            "For", "Up after failure",
+            "expected", "ErrIncomplete",
+            "got", nil,
+        )
+    } else if _, ok := err.(ErrIncomplete) ; !ok {
+        t.Error(
+            "For", "Up after failure",
+            "expected", "ErrIncomplete",
+            "got", err,
+        )
+    }
+
+    migrator.Options.Resume = true
+    if applied, err = migrator.Up(context.Background(), "") ; applied != 1 || err != nil {
+        t.Error(
+            "For", "Up with Resume",
+            "expected", 1,
+            "got", applied, err,
+        )
+    }
+
+    // resuming only ran the statement that failed
+    var creates = 0
+    for _, statement := range fake.Executed() {
+        if (strings.Contains(statement, "CREATE TABLE app.users")) { creates++ }
+    }
+    if (creates != 1) {
+        t.Error(
+            "For", "CREATE TABLE app.users runs",
+            "expected", 1,
+            "got", creates,
+        )
+    }
+}
+
+
+func TestBaselineAll(t *testing.T) {
+    var fake = cqltest.NewFake()
+    var migrator = New(fake, DefaultOptions())
+    migrator.Logger = nil
+    migrator.Init()
+
+    if _, err := migrator.Baseline("", false) ; err != (ErrConfig{ "baseline", "no migrations are loaded" }) {
+        t.Error(
+            "For", "Baseline without migrations",
+            "expected", ErrConfig{ "baseline", "no migrations are loaded" },
+            "got", err,
+        )
+    }
+
+    // without a target, every migration loaded is marked
+    migrator.Migrations = MigrationCollection{
+        Migration{ Name: "2014-03-01_keyspace.cql", Query: "CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 };" },
+        Migration{ Name: "2014-03-02_users.cql", Query: "CREATE TABLE app.users (id INT PRIMARY KEY);" },
+    }
+    if marked, err := migrator.Baseline("", false) ; marked != 2 || err != nil {
+        t.Error(
+            "For", "Baseline(\"\")",
+            "expected", 2,
+            "got", marked, err,
+        )
+    }
+    for _, mig := range migrator.Migrations {
+        if complete, err := migrator.IsComplete(mig) ; !complete || err != nil {
+            t.Error(
+                "For", "Baselined: " + mig.Name,
+                "expected", true,
+                "got", complete, err,
+            )
+        }
+    }
+}
+
+
+func TestLockLost(t *testing.T) {
+    var fake = cqltest.NewFake()
+    var migrator = New(fake, DefaultOptions())
+    migrator.Logger = nil
+    migrator.Options.LockWait = 0
+    migrator.Options.LockTTL = time.Second
+    migrator.Migrations = MigrationCollection{
+        Migration{ Name: "2014-03-01_keyspace.cql", Query: "CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 };" },
+    }
+    migrator.Init()
+
+    var lock, err = migrator.AcquireLock()
+    if (err != nil) {
+        t.Fatal(
+            "For", "AcquireLock",
+            "expected", nil,
+            "got", err,
+        )
+    }
+
+    // another run takes the lock over before the next refresh
+    fake.Query(`UPDATE ` + migrator.LockTable() + ` SET owner = 'other:1' WHERE name = ?`, LOCK_NAME).Exec()
+    time.Sleep(500 * time.Millisecond)
+
+    if held, ok := lock.Lost().(ErrLockHeld) ; !ok || held.Owner != "other:1" {
+        t.Error(
+            "For", "Lost after the lock was taken over",
+            "expected", "ErrLockHeld by other:1",
+            "got", lock.Lost(),
+        )
+    }
+
+    if _, err = migrator.Up(context.Background(), "") ; err == nil {
+        t.Error(
+            "For", "Up without the lock",
+            "expected", "ErrLockHeld",
+            "got", nil,
+        )
+    }
+    for _, statement := range fake.Executed() {
+        if (strings.Contains(statement, "CREATE KEYSPACE app")) {
+            t.Error(
+                "For", "Up without the lock",
+                "expected", "no statements run",
+                "got", statement,
+            )
+        }
+    }
+
+    if held, ok := lock.Release().(ErrLockHeld) ; !ok || held.Owner != "other:1" {
+        t.Error(
+            "For", "Release of a lock taken over",
+            "expected", "ErrLockHeld by other:1",
+            "got", held,
+        )
+    }
+
+    // a deferred Release after an explicit one does not panic, and reports the same
+    if held, ok := lock.Release().(ErrLockHeld) ; !ok || held.Owner != "other:1" {
+        t.Error(
+            "For", "Release called twice",
+            "expected", "ErrLockHeld by other:1",
+            "got", held,
+        )
+    }
+}
+
+
+func TestSchemaAgreement(t *testing.T) {
+    var fake = cqltest.NewFake()
+    var migrator = New(fake, DefaultOptions())
+    migrator.Logger = nil
+    migrator.Options.SchemaWait = 300 * time.Millisecond
+
+    fake.Peers["10.0.0.2"] = fake.SchemaVersion()
+    fake.Peers["10.0.0.3"] = "00000000-0000-1000-8000-0000000000ff"
+
+    if err := migrator.WaitForSchemaAgreement() ; err == nil || !strings.Contains(err.Error(), "node 10.0.0.3 is on schema 00000000-0000-1000-8000-0000000000ff") {
+        t.Error(
+            "For", "WaitForSchemaAgreement with a disagreeing peer",
+            "expected", "node 10.0.0.3 reported",
+            "got", err,
+        )
+    }
+
+    // a down node keeps the version it had
+    fake.Down["10.0.0.3"] = true
+    if err := migrator.WaitForSchemaAgreement() ; err != nil {
+        t.Error(
+            "For", "WaitForSchemaAgreement with the disagreeing peer down",
+            "expected", nil,
+            "got", err,
+        )
+    }
+}
+
+
+func TestResumeEdited(t *testing.T) {
+    var fake = cqltest.NewFake()
+    var migrator = New(fake, DefaultOptions())
+    migrator.Logger = nil
+    migrator.Options.Resume = true
+    migrator.Migrations = MigrationCollection{
+        Migration{ Name: "2014-03-01_users.cql", Query:
+            "CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 };\n" +
+            "CREATE TABLE app.users (id UUID PRIMARY KEY);\n" +
+            "ALTER TABLE app.users ADD name TEXT;" },
+    }
+    migrator.Init()
+
+    fake.FailOn("ADD name", errors.New("timed out"))
+    migrator.Up(context.Background(), "")
+    fake.FailOn("ADD name", nil)
+
+    // fixing the failing statement still resumes
+    migrator.Migrations[0].Query = strings.Replace(migrator.Migrations[0].Query, "name TEXT", "name VARCHAR", 1)
+
+    // but not once the applied statements change, or are fewer than were applied
+    var edits = map[string]string{
+        "edited":   strings.Replace(migrator.Migrations[0].Query, "id UUID", "id TIMEUUID", 1),
+        "shorter":  "CREATE TABLE app.users (id UUID PRIMARY KEY);",
+    }
+    for edit, query := range edits {
+        var mig = migrator.Migrations[0]
+        mig.Query = query
+
+        if incomplete, ok := migrator.Exec(context.Background(), mig).(ErrIncomplete) ; !ok || !incomplete.Changed {
+            t.Error(
+                "For", "Exec with resume, " + edit,
+                "expected", "ErrIncomplete of a changed migration",
+                "got", migrator.Exec(context.Background(), mig),
+            )
+        }
+    }
+
+    if err := migrator.Exec(context.Background(), migrator.Migrations[0]) ; err != nil {
+        t.Error(
+            "For", "Exec with resume, failing statement fixed",
+            "expected", nil,
+            "got", err,
+        )
+    }
+}
+
+
+func TestUpCancelled(t *testing.T) {
+    var ctx, cancel = context.WithCancel(context.Background())
+    defer cancel()
+
+    var fake = cqltest.NewFake()
+    var migrator = New(fake, DefaultOptions())
+    migrator.Logger = nil
+    migrator.Migrations = MigrationCollection{
+        Migration{ Name: "2014-03-01_gives_up", Func: func(ctx context.Context, session cql.Session, run *Run) error {
+            cancel()
+            return nil
+        } },
+        Migration{ Name: "2014-03-02_keyspace.cql", Query: "CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 };" },
+    }
+    migrator.Init()
+
+    if applied, err := migrator.Up(ctx, "") ; applied != 1 || err != context.Canceled {
+        t.Error(
+            "For", "Up cancelled by the first migration",
+            "expected", "1 applied, context.Canceled",
+            "got", applied, err,
+        )
+    }
+
+    for _, statement := range fake.Executed() {
+        if (strings.Contains(statement, "CREATE KEYSPACE app")) {
+            t.Error(
+                "For", "Up after cancelling",
+                "expected", "no more statements run",
+                "got", statement,
+            )
+        }
+    }
+
+    // a Go migration that notices the cancel itself stops the run the same way, and is left partial
+    ctx, cancel = context.WithCancel(context.Background())
+    defer cancel()
+
+    fake = cqltest.NewFake()
+    migrator = New(fake, DefaultOptions())
+    migrator.Logger = nil
+    migrator.Migrations = MigrationCollection{
+        Migration{ Name: "2014-03-01_interrupted", Path: "migrate_test.go:1", Func: func(ctx context.Context, session cql.Session, run *Run) error {
+            cancel()
+            return ctx.Err()
+        } },
+        Migration{ Name: "2014-03-02_keyspace.cql", Query: "CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 };" },
+    }
+    migrator.Init()
+
+    if applied, err := migrator.Up(ctx, "") ; applied != 0 || !errors.Is(err, context.Canceled) {
+        t.Error(
+            "For", "Up cancelled within a Go migration",
+            "expected", "0 applied, context.Canceled",
+            "got", applied, err,
+        )
+    }
+    if progress, found, _ := migrator.GetProgress(migrator.Migrations[0]) ; !found || progress.Status != STATUS_PARTIAL {
+        t.Error(
+            "For", "progress of the Go migration cancelled",
+            "expected", STATUS_PARTIAL,
+            "got", progress, found,
+        )
+    }
+}
+
+
+func TestGoMigrations(t *testing.T) {
+    var dir, _ = ioutil.TempDir("", "cmm")
+    defer os.RemoveAll(dir)
+
+    ioutil.WriteFile(filepath.Join(dir, "2014-03-01T00-00-00.000Z_keyspace.cql"), []byte(
+        "CREATE KEYSPACE app WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 };"), 0644)
+    ioutil.WriteFile(filepath.Join(dir, "2014-03-02T00-00-00.000Z_users.cql"), []byte(
+        "CREATE TABLE app.users (id INT PRIMARY KEY, email TEXT, domain TEXT);\n" +
+        "INSERT INTO app.users (id, email) VALUES (1, 'ann@example.com');\n" +
+        "INSERT INTO app.users (id, email) VALUES (2, 'bob@example.org');"), 0644)
+
+    // fill in the new column from the existing rows
+    Register("2014-03-03T00-00-00.000Z_backfill_domains", func(ctx context.Context, session cql.Session, run *Run) error {
+        var id int
+        var email string
+        var domains = make(map[int]string)
+
+        var iter = session.Query(`SELECT id, email FROM app.users`).Consistency(run.Consistency).Iter()
+        for iter.Scan(&id, &email) {
+            domains[id] = email[strings.Index(email, "@") + 1:]
+        }
+        if err := iter.Close() ; err != nil {
+            return err
+        }
+
+        for id, domain := range domains {
+            if err := session.Query(`UPDATE app.users SET domain = ? WHERE id = ?`, domain, id).Exec() ; err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+
+    var fake = cqltest.NewFake()
+    var migrator = New(fake, DefaultOptions())
+    migrator.Logger = nil
+
+    if err := migrator.Load(dir) ; err != nil || len(migrator.Migrations) != 3 || migrator.Migrations[2].Func == nil {
+        t.Fatal(
+            "For", "Load with a registered Go migration",
+            "expected", "3 migrations, the Go one last",
+            "got", migrator.Migrations, err,
+        )
+    }
+    migrator.Init()
+
+    if applied, err := migrator.Up(context.Background(), "") ; applied != 3 || err != nil {
+        t.Error(
+            "For", "Up with a Go migration",
+            "expected", 3,
+            "got", applied, err,
+        )
+    }
+
+    var domain string
+    fake.Query(`SELECT domain FROM app.users WHERE id = ?`, 2).Scan(&domain)
+    if (domain != "example.org") {
+        t.Error(
+            "For", "domain backfilled by the Go migration",
+            "expected", "example.org",
+            "got", domain,
+        )
+    }
+
+    var history, _ = migrator.History()
+    if (len(history) != 3 || history[2].Name != "2014-03-03T00-00-00.000Z_backfill_domains" || history[2].Statements != 1) {
+        t.Error(
+            "For", "History of the Go migration",
+            "expected", "recorded last, as 1 statement",
+            "got", history,
+        )
+    }
+}
\ No newline at end of file
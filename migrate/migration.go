@@ -0,0 +1,166 @@
+package migrate
+
+import (
+    "fmt"
+    "time"
+    "regexp"
+    "strings"
+    "encoding/hex"
+    "crypto/sha256"
+)
+
+//-------------------------------------------------------
+// Migration Type
+//-------------------------------------------------------
+
+type Migration struct {
+    Name        string
+    Path        string
+    Query       string
+    Down        string
+    Func        MigrationFunc   `json:"-"`    // set for Go migrations, which have no query
+}
+
+
+//
+//  Statements
+//    The individual CQL statements of the up section, in execution order
+//
+func (self Migration) Statements() ([]Statement, error) {
+    return SplitStatements(self.Query)
+}
+
+
+//
+//  Checksum
+//      Hex encoded SHA-256 of the up section
+//      Recorded on completion so later edits of the file can be detected
+//      Go migrations have none
+//
+func (self Migration) Checksum() string {
+    if (self.Func != nil) { return "" }
+
+    var sum = sha256.Sum256([]byte(self.Query))
+    return hex.EncodeToString(sum[:])
+}
+
+//
+//  AppliedChecksum
+//      Hex encoded SHA-256 of the first count statements of the up section
+//      Recorded with the progress of a run, so a resume is refused when the statements it applied were edited
+//      while the failing statement may still be fixed
+//      Empty for Go migrations, and when the file no longer has that many statements
+//
+func (self Migration) AppliedChecksum(count int) string {
+    if (self.Func != nil) { return "" }
+
+    var statements, err = self.Statements()
+    if (err != nil || count > len(statements)) {
+        return ""
+    }
+
+    var sum = sha256.New()
+    for _, statement := range statements[:count] {
+        sum.Write([]byte(statement.Query + "\x00"))
+    }
+    return hex.EncodeToString(sum.Sum(nil))
+}
+
+//
+//  GetDelay
+//      Parse the comments to see if a delay has been set
+//      If not, the fallback is used
+//
+//      comment form: '-- delay: 500' with or without spaces
+//
+func (self Migration) GetDelay(fallback time.Duration) (time.Duration, error) {
+    // matches format `-- delay: ###` with spaces irrelevant and # being a count in ms
+    var delayRegex = regexp.MustCompile(`--\s?delay:\s?[0-9]+`)
+    var migrationDelay = delayRegex.Find([]byte(self.Query))
+
+    if (len(migrationDelay) == 0) {
+        return fallback, nil
+    }
+
+    var delayString = string(migrationDelay)
+    var msString = delayString[ (strings.LastIndex(delayString, ":") + 1) : ] + "ms"
+
+    var result, err = time.ParseDuration(strings.TrimSpace(msString))
+    if (err != nil) {
+        return fallback, ErrMigrationFailed{ self.Name, 0, fmt.Errorf("could not parse delay: %s", err) }
+    }
+
+    return result, nil
+}
+
+
+//
+//  String -- returns query as string representation
+//
+func (self Migration) String() string {
+    return self.Query
+}
+
+
+
+//
+// Progress of a migration that did not finish
+//
+
+const (
+    STATUS_PARTIAL  = "partial";     // statements are being applied, or the run died
+    STATUS_FAILED   = "failed";      // a statement returned an error
+)
+
+type Progress struct {
+    Status      string
+    Applied     int         // statements applied successfully
+    Statement   int         // 1-based index of the failing statement
+    Error       string
+    Date        time.Time
+    Checksum    string      // AppliedChecksum of the applied statements
+}
+
+
+
+//
+// Sorter
+//
+
+type MigrationCollection []Migration
+
+// Len is part of sort.Interface.
+func (self MigrationCollection) Len() int {
+    return len(self)
+}
+
+// Swap is part of sort.Interface.
+func (self MigrationCollection) Swap(i, j int) {
+    self[i], self[j] = self[j], self[i]
+}
+
+// Less is part of sort.Interface.
+func (self MigrationCollection) Less(i, j int) bool {
+    // ISO-8601 prefix allows simple alphabetic sort
+    return self[i].Name < self[j].Name
+}
+
+
+//
+//  SplitDirections
+//    Split the contents of a migration file into its up and down sections
+//    Everything after a '-- +down' comment line reverts the migration
+//    An optional '-- +up' comment may mark the start of the up section
+//    The up section is left untouched so statement positions match the file
+//
+func SplitDirections(contents string) (up string, down string) {
+    var downRegex = regexp.MustCompile(`(?m)^[ \t]*--\s?\+down[ \t]*$`)
+
+    up = contents
+    if loc := downRegex.FindStringIndex(contents) ; loc != nil {
+        up = contents[:loc[0]]
+        down = strings.TrimSpace(contents[loc[1]:])
+    }
+
+    return up, down
+}
\ No newline at end of file
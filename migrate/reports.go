@@ -0,0 +1,240 @@
+package migrate
+
+import (
+    "fmt"
+    "sort"
+    "time"
+)
+
+//-------------------------------------------------------
+// Plan
+//-------------------------------------------------------
+
+//
+//  PlannedMigration
+//      A migration as it would be executed, or reverted
+//      Delay is the resolved wait after the migration, in milliseconds
+//
+type PlannedMigration struct {
+    Name            string
+    Path            string
+    Statements      []Statement
+    Delay           int64
+    Go              bool        `json:",omitempty"`    // runs a registered Go function instead of statements
+}
+
+//
+//  MigrationPlan
+//      Pending migrations up to the target, in execution order
+//      With a target, applied migrations after it are reverted first (in reverse order)
+//      and pending migrations after it are left alone
+//
+type MigrationPlan struct {
+    Target          string              `json:",omitempty"`
+    Reverting       []PlannedMigration  `json:",omitempty"`
+    Pending         []PlannedMigration
+    OutOfOrder      []string            `json:",omitempty"`
+    AfterTarget     []string            `json:",omitempty"`
+}
+
+
+//
+//  Plan
+//      Build the list of migrations that would run to reach the target, without running them
+//      Nothing is executed and nothing is marked complete
+//
+func (self *Migrator) Plan(target string) (MigrationPlan, error) {
+    var plan = MigrationPlan{ Pending: make([]PlannedMigration, 0) }
+
+    var last, err = self.TargetIndex(target)
+    if (err != nil) {
+        return plan, err
+    }
+    if (len(target) > 0) { plan.Target = self.Migrations[last].Name }
+
+    var latest string
+    for i, mig := range self.Migrations {
+        var isComplete, err = self.IsComplete(mig)
+        if (err != nil) {
+            return plan, fmt.Errorf("could not check completion status of [%s]: %s", mig.Name, err)
+        }
+
+        var planned PlannedMigration
+        if (isComplete && i > last) {
+            // reverted last to first, so prepend
+            if planned, err = self.planMigration(mig, mig.Down) ; err != nil { return plan, err }
+            plan.Reverting = append([]PlannedMigration{ planned }, plan.Reverting...)
+        } else if (!isComplete && i > last) {
+            plan.AfterTarget = append(plan.AfterTarget, mig.Name)
+        } else if (!isComplete) {
+            if planned, err = self.planMigration(mig, mig.Query) ; err != nil { return plan, err }
+            plan.Pending = append(plan.Pending, planned)
+        } else if (mig.Name > latest) {
+            latest = mig.Name
+        }
+    }
+
+    // pending migrations that sort before the latest one staying applied
+    for _, mig := range plan.Pending {
+        if (mig.Name < latest) {
+            plan.OutOfOrder = append(plan.OutOfOrder, mig.Name)
+        }
+    }
+
+    return plan, nil
+}
+
+//
+//  planMigration
+//      Describe running the given block (up or down section) of a migration
+//
+func (self *Migrator) planMigration(mig Migration, block string) (PlannedMigration, error) {
+    var statements, err = SplitStatements(block)
+    if (err != nil) {
+        return PlannedMigration{}, ErrMigrationFailed{ mig.Name, 0, fmt.Errorf("%s: %s", mig.Path, err) }
+    }
+
+    var delay time.Duration
+    if delay, err = mig.GetDelay(self.Options.Delay) ; err != nil {
+        return PlannedMigration{}, err
+    }
+
+    return PlannedMigration{
+        Name:           mig.Name,
+        Path:           mig.Path,
+        Statements:     statements,
+        Delay:          int64(delay / time.Millisecond),
+        Go:             mig.Func != nil,
+    }, nil
+}
+
+
+//-------------------------------------------------------
+// Drift
+//-------------------------------------------------------
+
+//
+//  Drift
+//      Differences between the loaded migrations and those recorded as applied
+//
+type Drift struct {
+    Modified        []string    // applied, but the file no longer matches the recorded checksum
+    Missing         []string    // applied, but no longer on disk
+    Unknown         []string    // on disk, but not recorded in the completion table
+    Unverified      []string    // applied before checksums were recorded
+}
+
+//
+//  Found
+//      Drift is only found when applied migrations changed or disappeared
+//      An applied migration with no file on disk is Missing, and drift
+//      Unknown migrations have a file but no record, they are simply pending and not drift
+//
+func (self Drift) Found() bool {
+    return len(self.Modified) > 0 || len(self.Missing) > 0
+}
+
+
+//
+//  Verify
+//      Compare the loaded migrations against the checksums recorded when they were applied
+//
+func (self *Migrator) Verify() (Drift, error) {
+    var drift Drift
+    var name, checksum string
+    var recorded = make(map[string]string)
+
+    var iter = self.Session.Query(`SELECT name, checksum FROM ` + self.CompletedTable()).Consistency(self.Consistency).Iter()
+    for iter.Scan(&name, &checksum) {
+        recorded[name] = checksum
+    }
+    if err := iter.Close(); err != nil {
+        return drift, fmt.Errorf("could not read completed migrations: %s", err)
+    }
+
+    var onDisk = make(map[string]bool)
+    for _, mig := range self.Migrations {
+        onDisk[mig.Name] = true
+
+        if known, exists := recorded[mig.Name] ; !exists {
+            drift.Unknown = append(drift.Unknown, mig.Name)
+        } else if (mig.Func != nil) {
+            // Go code has no checksum to compare
+        } else if (len(known) == 0) {
+            drift.Unverified = append(drift.Unverified, mig.Name)
+        } else if (known != mig.Checksum()) {
+            drift.Modified = append(drift.Modified, mig.Name)
+        }
+    }
+
+    for name := range recorded {
+        if (!onDisk[name]) {
+            drift.Missing = append(drift.Missing, name)
+        }
+    }
+    sort.Strings(drift.Missing)
+
+    return drift, nil
+}
+
+
+//-------------------------------------------------------
+// History
+//-------------------------------------------------------
+
+//
+//  HistoryEntry
+//      A single applied migration as recorded in the completion table
+//      Duration is in milliseconds, entries applied by older versions lack the audit fields
+//
+type HistoryEntry struct {
+    Name            string
+    Date            time.Time
+    Duration        int64
+    AppliedBy       string
+    Host            string
+    Version         string
+    Statements      int
+    Checksum        string
+}
+
+type History []HistoryEntry
+
+// Len is part of sort.Interface.
+func (self History) Len() int {
+    return len(self)
+}
+
+// Swap is part of sort.Interface.
+func (self History) Swap(i, j int) {
+    self[i], self[j] = self[j], self[i]
+}
+
+// Less is part of sort.Interface.
+func (self History) Less(i, j int) bool {
+    // applied order, falling back to name for migrations applied within the same millisecond
+    if (self[i].Date.Equal(self[j].Date)) { return self[i].Name < self[j].Name }
+    return self[i].Date.Before(self[j].Date)
+}
+
+
+//
+//  History
+//      Read the completion table in the order migrations were applied
+//
+func (self *Migrator) History() (History, error) {
+    var entry HistoryEntry
+    var history = make(History, 0)
+
+    var iter = self.Session.Query(`SELECT name, date, duration, applied_by, host, version, statements, checksum FROM ` + self.CompletedTable()).Consistency(self.Consistency).Iter()
+    for iter.Scan(&entry.Name, &entry.Date, &entry.Duration, &entry.AppliedBy, &entry.Host, &entry.Version, &entry.Statements, &entry.Checksum) {
+        history = append(history, entry)
+        entry = HistoryEntry{}
+    }
+    if err := iter.Close(); err != nil {
+        return history, fmt.Errorf("could not read migration history: %s", err)
+    }
+
+    sort.Sort(history)
+    return history, nil
+}
\ No newline at end of file
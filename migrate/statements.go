@@ -0,0 +1,232 @@
+package migrate
+
+import (
+    "fmt"
+    "strings"
+)
+
+//-------------------------------------------------------
+// Statement Type
+//-------------------------------------------------------
+
+//
+//  Statement
+//    A single CQL statement and where it starts in its block
+//    Line and Column are 1-based
+//
+type Statement struct {
+    Query       string
+    Line        int
+    Column      int
+}
+
+//
+//  String -- returns the query as string representation
+//
+func (self Statement) String() string {
+    return self.Query
+}
+
+
+//
+//  SplitStatements
+//    Split a block of CQL into its statements
+//    Semicolons only end a statement outside of string literals, quoted identifiers,
+//    comments, $$-quoted bodies, and BEGIN BATCH ... APPLY BATCH blocks
+//    Comments before a statement are dropped, blocks of only comments yield nothing
+//
+func SplitStatements(block string) ([]Statement, error) {
+    var lex = &lexer{ input: block, line: 1, column: 1 }
+    var result []Statement
+
+    // state of the statement currently being read
+    var start = -1
+    var startLine, startColumn int
+    var first, previous string
+    var inBatch bool
+
+    for !lex.done() {
+        var c = lex.peek(0)
+
+        // whitespace and comments never start a statement
+        if (c == ' ' || c == '\t' || c == '\r' || c == '\n') {
+            lex.next()
+            continue
+        }
+        if (lex.startsWith("--") || lex.startsWith("//")) {
+            lex.skipPast("\n")
+            continue
+        }
+        if (lex.startsWith("/*")) {
+            var line, column = lex.line, lex.column
+            if (!lex.skipPast("*/")) {
+                return nil, fmt.Errorf("unterminated comment starting at line %d, column %d", line, column)
+            }
+            continue
+        }
+
+        // anything else belongs to a statement
+        if (start < 0) {
+            start, startLine, startColumn = lex.pos, lex.line, lex.column
+            first, previous, inBatch = "", "", false
+        }
+
+        switch {
+            case c == '\'' || c == '"':
+                var line, column = lex.line, lex.column
+                if (!lex.skipQuoted(c)) {
+                    return nil, fmt.Errorf("unterminated string starting at line %d, column %d", line, column)
+                }
+
+            case lex.startsWith("$$"):
+                var line, column = lex.line, lex.column
+                lex.next()
+                lex.next()
+                if (!lex.skipPast("$$")) {
+                    return nil, fmt.Errorf("unterminated $$ body starting at line %d, column %d", line, column)
+                }
+
+            case c == ';':
+                // statements inside a batch are terminated, the batch is not
+                if (inBatch) {
+                    lex.next()
+                    continue
+                }
+
+                // a stray or doubled semicolon ends nothing
+                if query := strings.TrimSpace(block[start:lex.pos]) ; len(query) > 0 {
+                    result = append(result, Statement{
+                        Query:      query,
+                        Line:       startLine,
+                        Column:     startColumn,
+                    })
+                }
+                start = -1
+                lex.next()
+
+            case isWordChar(c):
+                var word = strings.ToUpper(lex.word())
+                if (len(first) == 0) {
+                    first = word
+                    inBatch = first == "BEGIN"
+                }
+                if (previous == "APPLY" && word == "BATCH") {
+                    inBatch = false
+                }
+                previous = word
+
+            default:
+                lex.next()
+        }
+    }
+
+    if (inBatch) {
+        return nil, fmt.Errorf("BEGIN BATCH at line %d, column %d is missing APPLY BATCH", startLine, startColumn)
+    }
+
+    // the last statement does not need a trailing semicolon
+    if (start >= 0 && len(strings.TrimSpace(block[start:])) > 0) {
+        result = append(result, Statement{
+            Query:      strings.TrimSpace(block[start:]),
+            Line:       startLine,
+            Column:     startColumn,
+        })
+    }
+
+    return result, nil
+}
+
+
+//-------------------------------------------------------
+// Lexer
+//-------------------------------------------------------
+
+type lexer struct {
+    input       string
+    pos         int
+    line        int
+    column      int
+}
+
+func (self *lexer) done() bool {
+    return self.pos >= len(self.input)
+}
+
+func (self *lexer) peek(offset int) byte {
+    if (self.pos + offset >= len(self.input)) { return 0 }
+    return self.input[self.pos + offset]
+}
+
+func (self *lexer) startsWith(prefix string) bool {
+    return strings.HasPrefix(self.input[self.pos:], prefix)
+}
+
+//
+//  next
+//    Consume one byte, keeping track of line and column
+//
+func (self *lexer) next() byte {
+    var c = self.input[self.pos]
+    self.pos++
+
+    if (c == '\n') {
+        self.line++
+        self.column = 1
+    } else {
+        self.column++
+    }
+
+    return c
+}
+
+//
+//  skipPast
+//    Consume everything up to and including the terminator
+//    Returns false if the input ends first
+//
+func (self *lexer) skipPast(terminator string) bool {
+    for !self.done() {
+        if (self.startsWith(terminator)) {
+            for i := 0; i < len(terminator); i++ { self.next() }
+            return true
+        }
+        self.next()
+    }
+
+    return false
+}
+
+//
+//  skipQuoted
+//    Consume a quoted literal, a doubled quote is an escaped quote
+//    Returns false if the input ends first
+//
+func (self *lexer) skipQuoted(quote byte) bool {
+    self.next()
+
+    for !self.done() {
+        if (self.next() == quote) {
+            if (self.peek(0) != quote) { return true }
+            self.next()
+        }
+    }
+
+    return false
+}
+
+//
+//  word
+//    Consume and return an unquoted identifier or keyword
+//
+func (self *lexer) word() string {
+    var start = self.pos
+    for !self.done() && isWordChar(self.peek(0)) {
+        self.next()
+    }
+
+    return self.input[start:self.pos]
+}
+
+func isWordChar(c byte) bool {
+    return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_'
+}
\ No newline at end of file
@@ -0,0 +1,397 @@
+package migrate
+
+import (
+    "os"
+    "fmt"
+    "sort"
+    "time"
+    "regexp"
+    "strings"
+    "os/user"
+
+    "github.com/tux21b/gocql"
+    "github.com/zmarcantel/cmm/cql"
+)
+
+// columns added to the completion table since it only held (name, date)
+var COMPLETED_COLUMNS = []string{
+    "checksum TEXT",
+    "duration BIGINT",
+    "applied_by TEXT",
+    "host TEXT",
+    "version TEXT",
+    "statements INT",
+}
+
+// columns added to the progress table since it was created
+var PROGRESS_COLUMNS = []string{
+    "checksum TEXT",
+}
+
+//
+//  CompletedTable, ProgressTable, LockTable
+//    Fully qualified names of the bookkeeping tables
+//    Progress and lock tables are named after the completion table so separate histories never share them
+//
+func (self *Migrator) CompletedTable() string {
+    return self.Options.Keyspace + "." + self.Options.Table
+}
+
+func (self *Migrator) ProgressTable() string {
+    return self.CompletedTable() + "_progress"
+}
+
+func (self *Migrator) LockTable() string {
+    return self.CompletedTable() + "_lock"
+}
+
+
+//
+//  ReplicationLiteral
+//    Render a replication map as a CQL map literal
+//    Keys are sorted so the output is stable
+//
+func ReplicationLiteral(replication map[string]string) string {
+    var keys []string
+    for key := range replication {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+
+    var pairs []string
+    for _, key := range keys {
+        pairs = append(pairs, fmt.Sprintf("'%s' : '%s'", key, strings.Replace(replication[key], "'", "''", -1)))
+    }
+
+    return "{ " + strings.Join(pairs, ", ") + " }"
+}
+
+
+//
+//  Init
+//    Idempotently creates the keyspace and tables used to monitor the status of migrations
+//    The completion table contains the name and completion date of every applied migration
+//    Also creates the tables holding the cluster-wide migration lock
+//    and the progress of migrations that did not finish
+//    Invalid options are reported as ErrConfig before anything is created
+//
+func (self *Migrator) Init() error {
+    if err := self.Options.Validate() ; err != nil {
+        return err
+    }
+
+    self.log(MEDIUM, "Creating migration keypace\n")
+
+    // creation errors for things that already exist are ignored
+    // gocql is expanding error codes
+    var keyErr = self.Session.Query(`
+        CREATE KEYSPACE ` + self.Options.Keyspace + `
+        WITH REPLICATION = ` + ReplicationLiteral(self.Options.Replication) + `
+    `).Exec()
+    if keyErr != nil && strings.Index(keyErr.Error(), "Cannot add existing") < 0 {
+        return fmt.Errorf("could not place %s keyspace: %s", self.Options.Keyspace, keyErr)
+    }
+
+    // wait for that to settle
+    if err := self.WaitForSchemaAgreement() ; err != nil {
+        return fmt.Errorf("could not place %s keyspace: %s", self.Options.Keyspace, err)
+    }
+
+    self.log(MEDIUM, "Creating migration table\n")
+
+    var tables = map[string]string{
+        self.CompletedTable(): `(
+            name        TEXT PRIMARY KEY,
+            date        TIMESTAMP,
+            checksum    TEXT,
+            duration    BIGINT,
+            applied_by  TEXT,
+            host        TEXT,
+            version     TEXT,
+            statements  INT
+        )`,
+        self.LockTable(): `(
+            name      TEXT PRIMARY KEY,
+            owner     TEXT,
+            acquired  TIMESTAMP
+        )`,
+        self.ProgressTable(): `(
+            name      TEXT PRIMARY KEY,
+            status    TEXT,
+            applied   INT,
+            statement INT,
+            error     TEXT,
+            date      TIMESTAMP,
+            checksum  TEXT
+        )`,
+    }
+    for table, columns := range tables {
+        var tableErr = self.Session.Query(`CREATE TABLE ` + table + ` ` + columns).Exec()
+        if tableErr != nil && strings.Index(tableErr.Error(), "Cannot add already existing") < 0 {
+            return fmt.Errorf("could not place %s table: %s", table, tableErr)
+        }
+    }
+
+    // tables created by older versions only have some of the columns
+    // adding the rest keeps every existing row
+    var added = map[string][]string{
+        self.CompletedTable(): COMPLETED_COLUMNS,
+        self.ProgressTable(): PROGRESS_COLUMNS,
+    }
+    for table, columns := range added {
+        for _, column := range columns {
+            var columnErr = self.Session.Query(`ALTER TABLE ` + table + ` ADD ` + column).Exec()
+            if columnErr != nil && strings.Index(columnErr.Error(), "conflicts with an existing column") < 0 {
+                return fmt.Errorf("could not add [%s] to %s table: %s", column, table, columnErr)
+            }
+        }
+    }
+
+    // wait for that to settle
+    if err := self.WaitForSchemaAgreement() ; err != nil {
+        return fmt.Errorf("could not place migrations tables: %s", err)
+    }
+
+    return nil
+}
+
+
+//
+//  IsComplete
+//    Queries the completion table to detect if a migration has been run or not
+//    This is done by testing for existence only
+//
+func (self *Migrator) IsComplete(mig Migration) (bool, error) {
+    var name string
+    var date time.Time
+
+    self.log(LOUD, "\tChecking if complete\n")
+
+    // try to select the migration from the completed table
+    // existence indicates completion
+    var err = self.Session.Query(
+        `SELECT name, date FROM ` + self.CompletedTable() + ` WHERE name = ?`,
+        mig.Name).Consistency(self.Consistency).Scan(&name, &date)
+
+    // not found is a passable error -- the scan is a better indicator
+    if err != nil && err != gocql.ErrNotFound {
+        return false, err
+    }
+
+    // if the name is a non-null value (gocql coerces null->"")
+    // return it is in fact done
+    if len(name) > 0 {
+        self.log(LOUD, "\tWas completed\n")
+        return true, nil
+    }
+
+    // otherwise, it needs to be run
+    self.log(LOUD, "\tNeeds to be run\n")
+    return false, nil
+}
+
+
+//
+//  MarkComplete
+//    Mark the given migration as complete
+//    This consists of inserting it into the completion table (pure existence test)
+//    Who ran it, from where, and how long it took are kept for auditing
+//
+func (self *Migrator) MarkComplete(mig Migration, duration time.Duration, statements int) error {
+    self.log(MEDIUM, "\tMarking complete\n")
+
+    var hostname, _ = os.Hostname()
+
+    // insert the filename (migration name), the date run, and the audit details into the completion table
+    var err = self.Session.Query(
+        `INSERT INTO ` + self.CompletedTable() + ` (name, date, checksum, duration, applied_by, host, version, statements) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+        mig.Name, time.Now(), mig.Checksum(), int64(duration / time.Millisecond),
+        currentUser(), hostname, VERSION, statements).Exec()
+
+    if err != nil {
+        return fmt.Errorf("could not mark migration [%s] complete: %s", mig.Name, err)
+    }
+
+    self.log(SOFT, "Completed: %s\n", mig.Name)
+    return nil
+}
+
+//
+//  MarkIncomplete
+//    Remove the given migration from the completion table
+//    The migration will be considered pending on the next run
+//
+func (self *Migrator) MarkIncomplete(mig Migration) error {
+    self.log(MEDIUM, "\tMarking incomplete\n")
+
+    var err = self.Session.Query(
+        `DELETE FROM ` + self.CompletedTable() + ` WHERE name = ?`,
+        mig.Name).Exec()
+
+    if err != nil {
+        return fmt.Errorf("could not mark migration [%s] incomplete: %s", mig.Name, err)
+    }
+
+    self.log(SOFT, "Reverted: %s\n", mig.Name)
+    return nil
+}
+
+//
+//  GetProgress
+//      Fetch the progress recorded by a run that did not finish the migration
+//      Found is false when no run stopped part way through
+//
+func (self *Migrator) GetProgress(mig Migration) (progress Progress, found bool, err error) {
+    err = self.Session.Query(
+        `SELECT status, applied, statement, error, date, checksum FROM ` + self.ProgressTable() + ` WHERE name = ?`,
+        mig.Name).Consistency(self.Consistency).Scan(&progress.Status, &progress.Applied, &progress.Statement, &progress.Error, &progress.Date, &progress.Checksum)
+
+    if (err != nil) {
+        if (err == gocql.ErrNotFound) { return progress, false, nil }
+        return progress, false, err
+    }
+
+    return progress, len(progress.Status) > 0, nil
+}
+
+//
+//  MarkProgress
+//      Record how many statements have been applied
+//      A failed migration also records the failing statement (1-based) and its error
+//      The checksum of the applied statements is kept so a resume never skips statements that were edited
+//
+func (self *Migrator) MarkProgress(mig Migration, status string, applied, statement int, cause string) error {
+    var err = self.Session.Query(
+        `INSERT INTO ` + self.ProgressTable() + ` (name, status, applied, statement, error, date, checksum) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+        mig.Name, status, applied, statement, cause, time.Now(), mig.AppliedChecksum(applied)).Exec()
+
+    if err != nil {
+        self.log(QUIET, "WARNING: could not record progress of migration [%s]\n%s\n", mig.Name, err)
+    }
+
+    return err
+}
+
+//
+//  ClearProgress
+//      Forget any partial or failed run of the migration
+//
+func (self *Migrator) ClearProgress(mig Migration) error {
+    var err = self.Session.Query(`DELETE FROM ` + self.ProgressTable() + ` WHERE name = ?`, mig.Name).Exec()
+    if err != nil {
+        return fmt.Errorf("could not clear progress of migration [%s]: %s", mig.Name, err)
+    }
+
+    return nil
+}
+
+
+//
+//  currentUser
+//    The OS user running the migrations, falling back to $USER
+//
+func currentUser() string {
+    if current, err := user.Current() ; err == nil {
+        return current.Username
+    }
+
+    return os.Getenv("USER")
+}
+
+
+//
+//  IsSchemaChange
+//    Detect CREATE, ALTER and DROP statements
+//    Leading comment lines are skipped
+//
+func IsSchemaChange(query string) bool {
+    var ddlRegex = regexp.MustCompile(`(?i)^(\s*(--|//)[^\n]*\n)*\s*(CREATE|ALTER|DROP)\s`)
+    return ddlRegex.MatchString(query)
+}
+
+
+//
+//  WaitForSchemaAgreement
+//    Poll the schema version of every live node until they all agree
+//    Nodes disagreeing with the majority are reported if the wait is exceeded
+//
+func (self *Migrator) WaitForSchemaAgreement() error {
+    var deadline = time.Now().Add(self.Options.SchemaWait)
+
+    for {
+        var versions, err = self.schemaVersions()
+        if (err != nil) {
+            return err
+        }
+
+        // find the version most nodes are on
+        var counts = make(map[string]int)
+        var expected string
+        for _, version := range versions {
+            counts[version]++
+            if (counts[version] > counts[expected]) { expected = version }
+        }
+
+        if (len(counts) <= 1) {
+            self.log(LOUD, "\tSchema agreed on %s\n", expected)
+            return nil
+        }
+
+        if (time.Now().After(deadline)) {
+            var disagreeing []string
+            for address, version := range versions {
+                if (version != expected) {
+                    disagreeing = append(disagreeing, fmt.Sprintf("node %s is on schema %s, expected %s", address, version, expected))
+                }
+            }
+            sort.Strings(disagreeing)
+            return fmt.Errorf("nodes did not agree on the schema within %s\n\t%s", self.Options.SchemaWait, strings.Join(disagreeing, "\n\t"))
+        }
+
+        self.log(MEDIUM, "\tWaiting for schema agreement (%d versions)\n", len(counts))
+        time.Sleep(200 * time.Millisecond)
+    }
+}
+
+
+//
+//  schemaVersions
+//      Get the schema version each node reports, keyed by node address
+//      Peers that have not reported a version yet are left out, as are those the session knows are down
+//      Both tables are read from the same coordinator when the session can pin one, or the answers could leave a node out
+//
+func (self *Migrator) schemaVersions() (map[string]string, error) {
+    var address string
+    var version string
+    var versions = make(map[string]string)
+
+    var session = self.Session
+    if pinned, canPin := session.(cql.Pinned) ; canPin {
+        session = pinned.Pin()
+    }
+
+    // the coordinator reports its own version in system.local
+    var err = session.Query(`SELECT broadcast_address, schema_version FROM system.local WHERE key = 'local';`).Scan(&address, &version)
+    if (err != nil) {
+        return nil, err
+    }
+    if (len(address) == 0) { address = "local" }
+    versions[address] = version
+
+    // and what it knows of every other node in system.peers
+    var states, _ = self.Session.(cql.HostStates)
+    var iter = session.Query(`SELECT peer, schema_version FROM system.peers;`).Iter()
+    for iter.Scan(&address, &version) {
+        if (len(version) == 0) { continue }
+        if (states != nil && states.IsDown(address)) {
+            self.log(LOUD, "\tSkipping schema version of down node %s\n", address)
+            continue
+        }
+        versions[address] = version
+    }
+    if err = iter.Close(); err != nil {
+        return nil, err
+    }
+
+    return versions, nil
+}
\ No newline at end of file
@@ -1,377 +1,478 @@
 package main
 
 import (
-    "os"
     "fmt"
+    "sort"
     "time"
-    "regexp"
     "strings"
     "io/ioutil"
     "path/filepath"
 
-    "github.com/tux21b/gocql"
-
     "github.com/zmarcantel/cmm/db"
+    "github.com/zmarcantel/cmm/migrate"
 )
 
 //-------------------------------------------------------
-// Migration Type
+// Generated Migrations
 //-------------------------------------------------------
 
-type Migration struct {
-    Name        string
-    Path        string
-    Query       string
-}
+// RFC3339Nano keeping its trailing zeros, so names sort in the order they were made
+const MIGRATION_TIME = "2006-01-02T15:04:05.000000000Z07:00"
+
+// time of the last generated migration
+var lastMigration time.Time
 
 //
-//  Exec
-//    Executes the query(ies) described in the migration
-//    Upon completion, will mark itself as complete
+//  migrationTime
+//      The UTC time a generated migration is named after
+//      Always later than the previous one, a keyspace has to be created before its tables
 //
-func (self Migration) Exec() error {
-    if (Verbosity != QUIET) {
-        fmt.Printf("\n\nMigration: %s\n", self.Name)
-    }
-
-    // if the migration has already been issued, notify of skip
-    // catch error, and completed == true
-    if complete, err := self.IsComplete() ; err != nil {
-        fmt.Printf("ERROR: could not fetch status of migration\n%s\n\n", err)
-        return err
-    } else if (complete == true) {
-        if (Verbosity != QUIET) {
-            fmt.Printf("\tSkipping [%s]\n", self.Name)
-        }
-        return nil
+func migrationTime() time.Time {
+    var now = time.Now().UTC()
+    if (!now.After(lastMigration)) {
+        now = lastMigration.Add(time.Nanosecond)
     }
+    lastMigration = now
+    return now
+}
 
-    // first, split the query into CQL "lines"
-    var queries = strings.Split(self.Query, ";")
-    if (Verbosity >= LOUD) {
-        fmt.Printf("\tSplit into %d queries\n", len(queries))
+//
+//  PrintMigrations
+//      Print the name and query of every generated migration
+//
+func PrintMigrations(migrations migrate.MigrationCollection) {
+    //  format the migrations slice
+    for _, mig := range migrations {
+        fmt.Printf("Name: %s\nQuery:\n%s\n\n", mig.Name, mig.Query)
     }
+}
 
-    // allow for multiple queries to be in the same file
-    // split them up and run sequentially
-    for i, q := range queries {
-        var query = strings.TrimSpace(q)
-        if (len(query) == 0) { continue } // if empty line
-
-        if (Verbosity >= MEDIUM) {
-            fmt.Printf("\tPart: %d\n", i)
-        }
-
-        var err = Session.Query(query).Consistency(Consistency).Exec()
-        if err != nil {
-            fmt.Printf("Error applying [%s]:\n\tQuery: '%s'\n%s\n", self.Name, query, err)
-            os.Exit(1)
+//
+//  SaveMigrations
+//      Write every generated migration to a file in the given directory
+//      Stops at the first migration that cannot be written
+//
+func SaveMigrations(migrations migrate.MigrationCollection, path string) error {
+    for _, mig := range migrations {
+        var err = ioutil.WriteFile(filepath.Join(path, mig.Name), []byte(mig.Query), 0777)
+        if (err != nil) {
+            return fmt.Errorf("could not save migration to directory [%s]: %s", path, err)
         }
     }
 
-    // mark the migration complete
-    self.MarkComplete()
-
     return nil
 }
 
 
 //
-//  IsComplete
-//    Queries the migrations table to detect if a migration has been run or not
-//    This is done by testing for existence only
+//  CreationMigration
+//    Create a migration for adding a field
 //
-func (self Migration) IsComplete() (bool, error) {
-    var name string
-    var date time.Time
-
-    if (Verbosity >= LOUD) {
-        fmt.Println("\tChecking if complete")
-    }
-
-    // try to select the migration from the completed table
-    // existence indicates completion
-    var err = Session.Query(
-        `SELECT * FROM migrations.completed WHERE name = ?`,
-        self.Name).Consistency(Consistency).Scan(&name, &date)
+func CreationMigration(table db.TableDescriptor, colName string, colType string) migrate.Migration {
+    var result = "ALTER TABLE " + table.Keyspace + "." + table.Name + " ADD " + colName + " " + colType + ";"
 
-    // not found is a passable error -- the scan is a better indicator
-    // handle errors here
-    if err != nil && err.Error() != "not found" {
-        fmt.Printf("Error checking status of migration [%s]:\n%s\n", self.Name, err)
-        return false, err
+    var currDate = migrationTime()
+    return migrate.Migration{
+        Name:     currDate.Format(MIGRATION_TIME) + "_add_" + colName + "_to_" + table.Name + ".cql",
+        Query:    result,
     }
+}
 
-    // if the name is a non-null value (gocql coerces null->"")
-    // return it is in fact done
-    if len(name) > 0 {
-        if (Verbosity >= LOUD) {
-            fmt.Println("\tWas completed")
-        }
 
-        return true, nil
-    }
+//
+//  RemovalMigration
+//    Cretes a migration for removing a field
+//
+func RemovalMigration(table db.TableDescriptor, colName string) migrate.Migration {
+    var result = "ALTER TABLE " + table.Keyspace + "." + table.Name + " DROP " + colName + ";"
 
-    if (Verbosity >= LOUD) {
-        fmt.Println("\tNeeds to be run")
+    var currDate = migrationTime()
+    return migrate.Migration{
+        Name:     currDate.Format(MIGRATION_TIME) + "_remove_" + colName + "_from_" + table.Name + ".cql",
+        Query:    result,
     }
-
-    // otherwise, it needs to be run
-    return false, nil
 }
 
 
 //
-//  MarkComplete
-//    Mark the given migratiton as complete
-//    This consists of inserting it into the migrations table (pure existence test)
+//  ChangeTypeMigration
+//    Creates a migration for changing a column's type
 //
-func (self Migration) MarkComplete() error {
-    if (Verbosity >= MEDIUM) {
-        fmt.Println("\tMarking complete")
-    }
+func ChangeTypeMigration(table db.TableDescriptor, colName, newType string) migrate.Migration {
+    var result = "ALTER TABLE " + table.Keyspace + "." + table.Name + " ALTER " + colName + " TYPE " + newType + ";"
 
-    // insert the filename (migration name) and the date run into the completion table
-    var err = Session.Query(
-        `INSERT INTO migrations.completed (name, date) VALUES (?, ?)`,
-        self.Name, time.Now()).Exec()
+    var currDate = migrationTime()
+    var typeString = strings.Replace(newType, "<", "_of_", -1)
+    typeString = strings.Replace(typeString, ">", "_", -1)
+    typeString = strings.Replace(typeString, " ", "_", -1)
+    typeString = strings.Replace(typeString, ",", "_to_", -1)
 
-    if err != nil {
-        fmt.Printf("Error marking migration [%s] complete:\n%s\n", self.Name, err)
-        return err
-    }
 
-    if (Verbosity >= SOFT) {
-        fmt.Printf("Completed: %s\n", self.Name)
-    }
+    typeString = strings.TrimSuffix(typeString, "_")
+    typeString = strings.ToLower(typeString)
 
-    return nil
+    return migrate.Migration{
+        Name:     currDate.Format(MIGRATION_TIME) + "_change_" + table.Keyspace + "_" + table.Name + "_" + colName + "_to_" + typeString + ".cql",
+        Query:    result,
+    }
 }
 
+
 //
-//  GetDelay
-//      Parse the comments to see if a delay has been set
-//      If not, the SettleTime resolved from the cli is used
-//
-//      comment form: '-- delay: 500' with or without spaces
+//  OptionMigration
+//    Creates a migration for setting a table option
 //
-func (self Migration) GetDelay() time.Duration {
-    var result = SettleTime
+func OptionMigration(table db.TableDescriptor, option string, value interface{}) migrate.Migration {
+    var result = "ALTER TABLE " + table.Keyspace + "." + table.Name + " WITH " + option + " = " + db.OptionCQL(value) + ";"
 
-    // matches format `-- delay: ###` with spaces irrelevant and # being a count in ms
-    var delayRegex = regexp.MustCompile(`--\s?delay:\s?[0-9]+`)
-    var migrationDelay = delayRegex.Find([]byte(self.Query))
+    var currDate = migrationTime()
+    return migrate.Migration{
+        Name:     currDate.Format(MIGRATION_TIME) + "_set_" + option + "_of_" + table.Keyspace + "_" + table.Name + ".cql",
+        Query:    result,
+    }
+}
 
-    if (len(migrationDelay) > 0) {
-        var delayString = string(migrationDelay)
-        var msString = delayString[ (strings.LastIndex(delayString, ":") + 1) : ] + "ms"
 
-        var err error
-        result, err = time.ParseDuration(strings.TrimSpace(msString))
-        if (err != nil) {
-            fmt.Printf("ERROR: could not parse migration-level delay\n%s\n\n", err)
-            os.Exit(1)
-        }
+//
+//  CreateTableMigration
+//      Creates a migrations that will create a table from a target schema
+//
+func CreateTableMigration(keyspace, table string, target map[string]interface{}) (migrate.MigrationCollection, error) {
+    var desired, err = TargetTable(keyspace, table, target)
+    if (err != nil) {
+        return nil, err
     }
 
-    return result
+    var currDate = migrationTime()
+    return migrate.MigrationCollection{
+        migrate.Migration{
+            Name:       currDate.Format(MIGRATION_TIME) + "_create_table_" + keyspace + "_" + table + ".cql",
+            Query:      desired.CQL(),
+        },
+    }, nil
 }
 
 
 //
-//  String -- returns query as string representation
+//  DropTableMigration
+//      Creates a migration for dropping a table
 //
-func (self Migration) String() string {
-    return self.Query
+func DropTableMigration(table db.TableDescriptor) migrate.Migration {
+    var currDate = migrationTime()
+    return migrate.Migration{
+        Name:     currDate.Format(MIGRATION_TIME) + "_drop_table_" + table.Keyspace + "_" + table.Name + ".cql",
+        Query:    "DROP TABLE " + table.Keyspace + "." + table.Name + ";",
+    }
 }
 
 
-
 //
-// Sorter
+//  CreateKeyspaceMigration
+//      Creates the migrations that will create a keyspace from a target schema, followed by those creating its tables
 //
-
-type MigrationCollection []Migration
-
-// Len is part of sort.Interface.
-func (self MigrationCollection) Len() int {
-    return len(self)
-}
-
-// Swap is part of sort.Interface.
-func (self MigrationCollection) Swap(i, j int) {
-    if (Verbosity > LOUD) {
-        fmt.Printf("\tSwap:\n\t%s\n\t%s\n\n", self[i].Name, self[j].Name)
+func CreateKeyspaceMigration(keyspace string, target map[string]interface{}) (migrate.MigrationCollection, error) {
+    var desired, tables, _, err = TargetKeyspace(keyspace, target)
+    if (err != nil) {
+        return nil, err
     }
 
-    self[i], self[j] = self[j], self[i]
-}
+    var currDate = migrationTime()
+    var result = migrate.MigrationCollection{
+        migrate.Migration{
+            Name:       currDate.Format(MIGRATION_TIME) + "_create_keyspace_" + keyspace + ".cql",
+            Query:      desired.CQL(),
+        },
+    }
 
-// Less is part of sort.Interface.
-func (self MigrationCollection) Less(i, j int) bool {
-    if (Verbosity > LOUD) {
-        fmt.Printf("\tCompare:\n\t%s\n\t%s\n\n", self[i].Name, self[j].Name)
+    for _, name := range sortedKeys(tables) {
+        var migs, err = CreateTableMigration(keyspace, name, tables[name])
+        if (err != nil) {
+            return nil, err
+        }
+        result = append(result, migs...)
     }
 
-    // ISO-8601 prefix allows simple alphabetic sort
-    return self[i].Name < self[j].Name
+    return result, nil
 }
 
-func (self MigrationCollection) Print() {
-    //  format the migrations slice
-    for _, mig := range self {
-        fmt.Printf("Name: %s\nQuery:\n%s\n\n", mig.Name, mig.Query)
-    }
-}
 
-func (self MigrationCollection) Save(path string) {
-    for _, mig := range self {
-        var err = ioutil.WriteFile(filepath.Join(path, mig.Name), []byte(mig.Query), 0777)
-        if (err != nil) {
-            fmt.Printf("ERROR: could not save migration to directory [%s]\n%s\n\n", Opts.Output, err)
-        }
+//
+//  AlterKeyspaceMigration
+//      Creates a migration for changing the replication and/or durable writes of a keyspace
+//
+func AlterKeyspaceMigration(desired db.KeyspaceDescriptor, replication, durable bool) migrate.Migration {
+    var options []string
+    if (replication) { options = append(options, "replication = " + desired.Replication()) }
+    if (durable) { options = append(options, fmt.Sprintf("durable_writes = %t", desired.DurableWrites)) }
+
+    var currDate = migrationTime()
+    return migrate.Migration{
+        Name:     currDate.Format(MIGRATION_TIME) + "_alter_keyspace_" + desired.Name + ".cql",
+        Query:    "ALTER KEYSPACE " + desired.Name + " WITH " + strings.Join(options, " AND ") + ";",
     }
 }
 
 
-//-------------------------------------------------------
-// General Functions
-//-------------------------------------------------------
-
 //
-//  CreateMigrationsTable
-//    Creates the table we will use to monitor the status of migrations
-//    This table contains a set of (name, date) tuples of the name and completion date
+//  StatementMigration
+//      Creates a migration running a single statement, named after what it does, e.g. create_type_main_address
 //
-func CreateMigrationTable(session *gocql.Session) {
-    if (Verbosity > SOFT) {
-        fmt.Println("Creating migration keypace")
+func StatementMigration(action, query string) migrate.Migration {
+    var currDate = migrationTime()
+    return migrate.Migration{
+        Name:     currDate.Format(MIGRATION_TIME) + "_" + action + ".cql",
+        Query:    query,
     }
+}
 
-    // errors are ignored here
-    // gocql is expanding error codes
-    // these are idempotent anyway
 
-    var keyErr = session.Query(`
-        CREATE KEYSPACE migrations
-        WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 3 }
-    `).Exec()
-    if keyErr != nil && strings.Index(keyErr.Error(), "Cannot add existing") < 0 {
-        fmt.Printf("Error placing migrations keyspace: %s\n", keyErr)
+//
+//  TargetKeyspace
+//      Read the backfill JSON of a keyspace into a descriptor, and the backfill JSON of each of its tables
+//      "replication" is the CQL map, class included, and "durable_writes" defaults to true
+//      "tables" maps the name of each table to its JSON as TargetTable reads it
+//      "drop_missing" asks for the existing tables "tables" leaves out to be dropped, false by default
+//
+func TargetKeyspace(keyspace string, target map[string]interface{}) (desired db.KeyspaceDescriptor, tables map[string]map[string]interface{}, dropMissing bool, err error) {
+    desired = db.KeyspaceDescriptor{ Name: keyspace, Options: make(map[string]interface{}), DurableWrites: true }
+    var invalid = func(format string, args ...interface{}) error {
+        return migrate.ErrConfig{ Option: "backfill", Reason: fmt.Sprintf(format, args...) }
     }
 
-    // wait for that to settle
-    time.Sleep(2000 * time.Millisecond)
-
-    if (Verbosity > SOFT) {
-        fmt.Println("Creating migration table")
+    for name, value := range target {
+        switch (strings.ToLower(name)) {
+            case "replication":
+                var replication, isObject = value.(map[string]interface{})
+                if (!isObject) {
+                    return desired, nil, false, invalid("\"replication\" must be an object, got %v", value)
+                }
+                for key, option := range replication {
+                    if (key == "class") {
+                        desired.Class = fmt.Sprint(option)
+                    } else {
+                        desired.Options[key] = fmt.Sprint(option)
+                    }
+                }
+
+            case "durable_writes":
+                var durable, isBool = value.(bool)
+                if (!isBool) {
+                    return desired, nil, false, invalid("\"durable_writes\" must be true or false, got %v", value)
+                }
+                desired.DurableWrites = durable
+
+            case "drop_missing":
+                var drop, isBool = value.(bool)
+                if (!isBool) {
+                    return desired, nil, false, invalid("\"drop_missing\" must be true or false, got %v", value)
+                }
+                dropMissing = drop
+
+            case "tables":
+                var described, isObject = value.(map[string]interface{})
+                if (!isObject) {
+                    return desired, nil, false, invalid("\"tables\" must be an object of table name to schema, got %v", value)
+                }
+
+                tables = make(map[string]map[string]interface{})
+                for table, schema := range described {
+                    var columns, isObject = schema.(map[string]interface{})
+                    if (!isObject) {
+                        return desired, nil, false, invalid("the schema of table [%s] must be an object, got %v", table, schema)
+                    }
+                    delete(columns, "_")
+                    tables[table] = columns
+                }
+
+            default:
+                return desired, nil, false, invalid("unknown entry [%s] in the schema of keyspace [%s], expected replication, durable_writes, tables or drop_missing", name, keyspace)
+        }
     }
 
-    var tableErr = session.Query(`
-    CREATE TABLE migrations.completed (
-        name      TEXT PRIMARY KEY,
-        date      TIMESTAMP
-    )`).Exec()
-    if tableErr != nil && strings.Index(tableErr.Error(), "Cannot add already existing") < 0 {
-        fmt.Printf("Error placing migrations.completed table: %s\n", tableErr)
+    if (len(desired.Class) == 0) {
+        return desired, nil, false, invalid("keyspace [%s] needs a replication class", keyspace)
     }
+    return desired, tables, dropMissing, nil
+}
 
-    // wait for that to settle
-    time.Sleep(2000 * time.Millisecond)
+func sortedKeys(tables map[string]map[string]interface{}) []string {
+    var names []string
+    for name := range tables {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
 }
 
 
 //
-//  DoMigrations
-//    Once a set of migrations has been loaded/sorted, we need to run them
-//    This function iterates over the sorted slice calling .Exec(session) on all migrations
-//    Logic as far as completion and marking are done by the migration's .Exec(session)
+//  TargetTable
+//      Read the backfill JSON of a table into a descriptor
+//      Columns map to their type, with a PRIMARY KEY or STATIC suffix
+//      A composite key is instead given by the "PRIMARY KEY" entry, e.g. "((a, b), c)"
+//      and the order of its clustering columns by "CLUSTERING ORDER BY", e.g. "(c DESC)"
+//      Table options are an object under "WITH", e.g. { "gc_grace_seconds": 3600 }
 //
-func DoMigrations(migrations []Migration, delay time.Duration) {
-    // iterate over the migrations we loaded
-    for _, m := range migrations {
-        m.Exec()
-
-        // delay
-        var delay = m.GetDelay()
-        if (delay > 0 && Verbosity >= SOFT) {
-            fmt.Printf("\tWaiting %s\n", delay)
+func TargetTable(keyspace, table string, target map[string]interface{}) (db.TableDescriptor, error) {
+    var desired = db.TableDescriptor{ Name: table, Keyspace: keyspace }
+    var invalid = func(format string, args ...interface{}) error {
+        return migrate.ErrConfig{ Option: "backfill", Reason: fmt.Sprintf(format, args...) }
+    }
+
+    var key, order string
+    var partition, clustering []string
+    var names []string
+    for name, value := range target {
+        if (strings.ToUpper(name) == "WITH") {
+            var options, isObject = value.(map[string]interface{})
+            if (!isObject) {
+                return desired, invalid("the \"WITH\" entry must be an object of table options, got %v", value)
+            }
+
+            desired.Options = make(map[string]interface{})
+            for option, setting := range options {
+                var typed, err = db.TableOption(strings.ToLower(option), setting)
+                if (err != nil) {
+                    return desired, invalid("%s", err)
+                }
+                desired.Options[strings.ToLower(option)] = typed
+            }
+            continue
+        }
+
+        var definition, isString = value.(string)
+        if (!isString) {
+            return desired, invalid("the definition of [%s] must be a string, got %v", name, value)
+        }
+
+        switch (strings.ToUpper(name)) {
+            case "PRIMARY KEY":
+                key = definition
+            case "CLUSTERING ORDER BY":
+                order = definition
+            default:
+                names = append(names, name)
         }
-        time.Sleep(delay)
     }
-}
+    sort.Strings(names)
+
+    for _, name := range names {
+        var column = db.ColumnDescriptor{ Name: name, Type: strings.TrimSpace(target[name].(string)), Kind: "regular" }
+
+        var upper = strings.ToUpper(column.Type)
+        if (strings.HasSuffix(upper, " PRIMARY KEY")) {
+            column.Type = strings.TrimSpace(column.Type[:len(column.Type) - len(" PRIMARY KEY")])
+            partition = append(partition, name)
+        } else if (strings.HasSuffix(upper, " STATIC")) {
+            column.Type = strings.TrimSpace(column.Type[:len(column.Type) - len(" STATIC")])
+            column.Kind = "static"
+        }
 
+        desired.Columns = append(desired.Columns, column)
+    }
 
-//
-//  CreationMigration
-//    Create a migration for adding a field
-//
-func CreationMigration(table db.TableDescriptor, colName string, colType string) Migration {
-    var result = "ALTER TABLE " + table.Keyspace + "." + table.Name + " ADD " + colName + " " + colType + ";"
+    if (len(key) > 0) {
+        if (len(partition) > 0) {
+            return desired, invalid("[%s] is marked PRIMARY KEY as well as given a \"PRIMARY KEY\" entry", partition[0])
+        }
 
-    var currDate = time.Now().UTC()
-    return Migration{
-        Name:     currDate.Format(time.RFC3339Nano) + "_add_" + colName + "_to_" + table.Name + ".cql",
-        Query:    result,
+        var err error
+        if partition, clustering, err = parsePrimaryKey(key) ; err != nil {
+            return desired, invalid("%s", err)
+        }
+    }
+    if (len(partition) != 1 && len(key) == 0) {
+        return desired, invalid("table [%s.%s] needs exactly one PRIMARY KEY", keyspace, table)
     }
-}
 
+    var orders = make(map[string]string)
+    if (len(order) > 0) {
+        for _, part := range strings.Split(strings.Trim(strings.TrimSpace(order), "()"), ",") {
+            var fields = strings.Fields(part)
+            if (len(fields) != 2 || (strings.ToUpper(fields[1]) != "ASC" && strings.ToUpper(fields[1]) != "DESC")) {
+                return desired, invalid("could not read CLUSTERING ORDER BY [%s], expected (column ASC|DESC, ...)", order)
+            }
+            if (indexOf(clustering, fields[0]) < 0) {
+                return desired, invalid("only clustering columns can be in CLUSTERING ORDER BY, [%s] is not one", fields[0])
+            }
+            orders[fields[0]] = strings.ToUpper(fields[1])
+        }
+    }
 
-//
-//  RemovalMigration
-//    Cretes a migration for removing a field
-//
-func RemovalMigration(table db.TableDescriptor, colName string) Migration {
-    var result = "ALTER TABLE " + table.Keyspace + "." + table.Name + " DROP " + colName + ";"
+    var markKey = func(name, kind string, position int) error {
+        for i := range desired.Columns {
+            var column = &desired.Columns[i]
+            if (column.Name != name) { continue }
+
+            column.Kind = kind
+            column.Position = position
+            column.Primary = kind == "partition_key"
+            if (kind == "clustering_key") {
+                column.Order = orders[name]
+                if (len(column.Order) == 0) { column.Order = "ASC" }
+            }
+            return nil
+        }
+        return invalid("PRIMARY KEY column [%s] is not defined", name)
+    }
 
-    var currDate = time.Now().UTC()
-    return Migration{
-        Name:     currDate.Format(time.RFC3339Nano) + "_remove_" + colName + "_from_" + table.Name + ".cql",
-        Query:    result,
+    for position, name := range partition {
+        if err := markKey(name, "partition_key", position) ; err != nil {
+            return desired, err
+        }
+    }
+    for position, name := range clustering {
+        if err := markKey(name, "clustering_key", position) ; err != nil {
+            return desired, err
+        }
     }
-}
 
+    return desired, nil
+}
 
 //
-//  ChangeTypeMigration
-//    Creates a migration for changing a column's type
+//  parsePrimaryKey
+//      Split "((a, b), c, d)" into its partition and clustering columns
+//      Without inner parentheses the first column alone is the partition key
 //
-func ChangeTypeMigration(table db.TableDescriptor, colName, newType string) Migration {
-    var result = "ALTER TABLE " + table.Keyspace + "." + table.Name + " ALTER " + colName + " TYPE " + newType + ";"
-
-    var currDate = time.Now().UTC()
-    var typeString = strings.Replace(newType, "<", "_of_", -1)
-    typeString = strings.Replace(typeString, ">", "_", -1)
-    typeString = strings.Replace(typeString, " ", "_", -1)
-    typeString = strings.Replace(typeString, ",", "_to_", -1)
-
+func parsePrimaryKey(key string) (partition []string, clustering []string, err error) {
+    var inner = strings.TrimSpace(key)
+    if (!strings.HasPrefix(inner, "(") || !strings.HasSuffix(inner, ")")) {
+        return nil, nil, fmt.Errorf("could not read PRIMARY KEY [%s], expected ((partition, ...), clustering, ...)", key)
+    }
+    inner = strings.TrimSpace(inner[1:len(inner) - 1])
+
+    var split = func(names string) []string {
+        var result []string
+        for _, name := range strings.Split(names, ",") {
+            if name = strings.TrimSpace(name) ; len(name) > 0 {
+                result = append(result, name)
+            }
+        }
+        return result
+    }
 
-    typeString = strings.TrimSuffix(typeString, "_")
-    typeString = strings.ToLower(typeString)
+    if (strings.HasPrefix(inner, "(")) {
+        var end = strings.Index(inner, ")")
+        if (end < 0) {
+            return nil, nil, fmt.Errorf("could not read PRIMARY KEY [%s], unbalanced parentheses", key)
+        }
+        partition = split(inner[1:end])
+        clustering = split(inner[end + 1:])
+    } else if names := split(inner) ; len(names) > 0 {
+        partition = names[:1]
+        clustering = names[1:]
+    }
 
-    return Migration{
-        Name:     currDate.Format(time.RFC3339Nano) + "_change_" + table.Keyspace + "_" + table.Name + "_" + colName + "_to_" + typeString + ".cql",
-        Query:    result,
+    if (len(partition) == 0) {
+        return nil, nil, fmt.Errorf("PRIMARY KEY [%s] has no partition key", key)
     }
+    return partition, clustering, nil
 }
 
-
-//
-//  CreateTableMigration
-//      Creates a migrations that will create a table from a target schema
-//
-func CreateTableMigration(keyspace, table string, target map[string]interface{}) []Migration {
-    var result = "CREATE TABLE " + keyspace + "." + table + " (\n"
-    for key, value := range target {
-        result += fmt.Sprintf("\t%10s\t%-20s\n", key, value.(string))
-    }
-    result += "\n);"
-
-    var currDate = time.Now()
-    return []Migration{
-        Migration{
-            Name:       currDate.Format(time.RFC3339Nano) + "_create_table_" + keyspace + "_" + table + ".cql",
-            Query:      result,
-        },
+func indexOf(list []string, target string) int {
+    for i, value := range list {
+        if (value == target) { return i }
     }
+    return -1
 }
\ No newline at end of file